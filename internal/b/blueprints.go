@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KnownBlueprints lists static blueprints
@@ -33,6 +34,7 @@ var KnownBlueprints = map[string]*Blueprint{
 	BlueprintPerfManyMessages.Name:            &BlueprintPerfManyMessages,
 	BlueprintPerfManyRooms.Name:               &BlueprintPerfManyRooms,
 	BlueprintPerfE2EERoom.Name:                &BlueprintPerfE2EERoom,
+	BlueprintPerfLargeRoom.Name:               &BlueprintPerfLargeRoom,
 }
 
 // Blueprint represents an entire deployment to make.
@@ -66,8 +68,20 @@ type User struct {
 	// amount of one-time keys. This requires the DeviceId to be set as
 	// well.
 	OneTimeKeys uint
+	// Upload device keys for this user even if OneTimeKeys is 0. This
+	// requires the DeviceId to be set as well.
+	DeviceKeys bool
 }
 
+// HasE2EE returns true if keys are uploaded for this user when the blueprint is run.
+func (u User) HasE2EE() bool {
+	return u.DeviceKeys || u.OneTimeKeys > 0
+}
+
+// OlmPickleKey is the key which encrypts the pickled Olm accounts of E2EE blueprint users, so that tests can
+// restore them. The accounts are only for testing, so it is not secret.
+const OlmPickleKey = "complement"
+
 type AccountData struct {
 	Type  string
 	Value map[string]interface{}
@@ -82,12 +96,31 @@ type Room struct {
 }
 
 type ApplicationService struct {
-	ID              string
+	ID string
+	// The tokens the homeserver and application service use to authenticate to each other. Random tokens are
+	// generated if these are empty.
 	HSToken         string
 	ASToken         string
 	URL             string
 	SenderLocalpart string
 	RateLimited     bool
+	// The namespaces the application service is interested in. If nil, it is interested in all users,
+	// non-exclusively.
+	Namespaces *ApplicationServiceNamespaces
+}
+
+// ApplicationServiceNamespaces are the users, room aliases and room IDs an application service is interested in.
+type ApplicationServiceNamespaces struct {
+	Users   []ApplicationServiceNamespace
+	Aliases []ApplicationServiceNamespace
+	Rooms   []ApplicationServiceNamespace
+}
+
+// ApplicationServiceNamespace is a regular expression matching IDs in a namespace, e.g "@bridge_.*:hs1".
+type ApplicationServiceNamespace struct {
+	Regex string
+	// If true, only the application service may create users or aliases in the namespace.
+	Exclusive bool
 }
 
 type Event struct {
@@ -113,6 +146,14 @@ type Event struct {
 
 	// If this is a redaction, the event that it redacts
 	Redacts string
+
+	// The origin_server_ts of the event, e.g to create events with skewed timestamps.
+	// If it is left at the zero value, MustCreateEvent will use the current time.
+	OriginServerTS time.Time
+
+	// The depth of the event if we want to override or falsify it.
+	// If it is left at 0, MustCreateEvent will use one more than the depth of the room.
+	Depth int64
 }
 
 func MustValidate(bp Blueprint) Blueprint {
@@ -136,6 +177,9 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			if strings.Contains(u.Localpart, ":") {
 				return bp, fmt.Errorf("HS %s user localpart '%s' must not contain a domain", hs.Name, u.Localpart)
 			}
+			if u.HasE2EE() && u.DeviceID == nil {
+				return bp, fmt.Errorf("HS %s user '%s' must have a DeviceID to upload keys", hs.Name, u.Localpart)
+			}
 			// strip the @
 			hs.Users[i].Localpart = hs.Users[i].Localpart[1:]
 		}
@@ -198,22 +242,28 @@ func normaliseUser(u string, hsName string) (string, error) {
 }
 
 func normalizeApplicationService(as ApplicationService) (ApplicationService, error) {
-	hsToken := make([]byte, 32)
-	_, err := rand.Read(hsToken)
-	if err != nil {
-		return as, err
+	var err error
+	if as.HSToken == "" {
+		as.HSToken, err = randomToken()
+		if err != nil {
+			return as, err
+		}
 	}
-
-	asToken := make([]byte, 32)
-	_, err = rand.Read(asToken)
-	if err != nil {
-		return as, err
+	if as.ASToken == "" {
+		as.ASToken, err = randomToken()
+		if err != nil {
+			return as, err
+		}
 	}
+	return as, nil
+}
 
-	as.HSToken = hex.EncodeToString(hsToken)
-	as.ASToken = hex.EncodeToString(asToken)
-
-	return as, err
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
 }
 
 // Ptr returns a pointer to `in`, because Go doesn't allow you to inline this.
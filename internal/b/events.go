@@ -0,0 +1,316 @@
+package b
+
+import "time"
+
+// Typed builders for common events. Each returns an Event with the type, state key and content filled in, so
+// field names are checked at compile time instead of being typed into map[string]interface{} literals. Set
+// Sender on the result when using it in a blueprint or with federation.Server.
+
+// Membership values for MembershipEvent.
+const (
+	MembershipJoin   = "join"
+	MembershipInvite = "invite"
+	MembershipLeave  = "leave"
+	MembershipBan    = "ban"
+	MembershipKnock  = "knock"
+)
+
+// Join rules for JoinRulesEvent.
+const (
+	JoinRulePublic          = "public"
+	JoinRuleInvite          = "invite"
+	JoinRuleKnock           = "knock"
+	JoinRuleRestricted      = "restricted"
+	JoinRuleKnockRestricted = "knock_restricted"
+)
+
+// Membership is the content of an m.room.member event. Empty fields are omitted.
+type Membership struct {
+	Membership  string
+	DisplayName string
+	AvatarURL   string
+	Reason      string
+	// The user whose power level authorised a join to a restricted room.
+	JoinAuthorisedViaUsersServer string
+}
+
+// MembershipEvent returns an m.room.member event for `userID`.
+func MembershipEvent(userID string, m Membership) Event {
+	content := map[string]interface{}{
+		"membership": m.Membership,
+	}
+	setIfNotEmpty(content, "displayname", m.DisplayName)
+	setIfNotEmpty(content, "avatar_url", m.AvatarURL)
+	setIfNotEmpty(content, "reason", m.Reason)
+	setIfNotEmpty(content, "join_authorised_via_users_server", m.JoinAuthorisedViaUsersServer)
+	return Event{
+		Type:     "m.room.member",
+		StateKey: &userID,
+		Content:  content,
+	}
+}
+
+// PowerLevels is the content of an m.room.power_levels event. Nil fields are omitted, so the server defaults
+// apply. Use Int to set them.
+type PowerLevels struct {
+	Ban           *int
+	Invite        *int
+	Kick          *int
+	Redact        *int
+	StateDefault  *int
+	EventsDefault *int
+	UsersDefault  *int
+	Events        map[string]int
+	Users         map[string]int
+	Notifications map[string]int
+}
+
+// Int returns a pointer to `i`, for setting optional fields such as those of PowerLevels.
+func Int(i int) *int {
+	return &i
+}
+
+// PowerLevelsEvent returns an m.room.power_levels event.
+func PowerLevelsEvent(pl PowerLevels) Event {
+	content := map[string]interface{}{}
+	for key, level := range map[string]*int{
+		"ban":            pl.Ban,
+		"invite":         pl.Invite,
+		"kick":           pl.Kick,
+		"redact":         pl.Redact,
+		"state_default":  pl.StateDefault,
+		"events_default": pl.EventsDefault,
+		"users_default":  pl.UsersDefault,
+	} {
+		if level != nil {
+			content[key] = *level
+		}
+	}
+	if pl.Events != nil {
+		content["events"] = pl.Events
+	}
+	if pl.Users != nil {
+		content["users"] = pl.Users
+	}
+	if pl.Notifications != nil {
+		content["notifications"] = pl.Notifications
+	}
+	return stateEvent("m.room.power_levels", content)
+}
+
+// JoinRuleAllow is a condition under which users may join a restricted room.
+type JoinRuleAllow struct {
+	// Defaults to "m.room_membership".
+	Type   string
+	RoomID string
+}
+
+// JoinRulesEvent returns an m.room.join_rules event. `allow` is only used by the restricted join rules.
+func JoinRulesEvent(joinRule string, allow ...JoinRuleAllow) Event {
+	content := map[string]interface{}{
+		"join_rule": joinRule,
+	}
+	if len(allow) > 0 {
+		allowContent := make([]map[string]interface{}, len(allow))
+		for i, a := range allow {
+			if a.Type == "" {
+				a.Type = "m.room_membership"
+			}
+			allowContent[i] = map[string]interface{}{
+				"type":    a.Type,
+				"room_id": a.RoomID,
+			}
+		}
+		content["allow"] = allowContent
+	}
+	return stateEvent("m.room.join_rules", content)
+}
+
+// EncryptionEvent returns an m.room.encryption event enabling Megolm encryption.
+func EncryptionEvent() Event {
+	return stateEvent("m.room.encryption", map[string]interface{}{
+		"algorithm": "m.megolm.v1.aes-sha2",
+	})
+}
+
+// RedactionEvent returns an m.room.redaction event redacting `eventID`. The event ID is set both at the top
+// level, for room versions up to 10, and in the content, for room version 11 onwards.
+func RedactionEvent(eventID, reason string) Event {
+	content := map[string]interface{}{
+		"redacts": eventID,
+	}
+	setIfNotEmpty(content, "reason", reason)
+	return Event{
+		Type:    "m.room.redaction",
+		Redacts: eventID,
+		Content: content,
+	}
+}
+
+// Mentions is the m.mentions property of a message, listing who it intentionally mentions.
+type Mentions struct {
+	UserIDs []string
+	Room    bool
+}
+
+// TextMessageEvent returns an m.room.message event with the text `body`. If `mentions` is nil, the message has
+// no m.mentions property, as with clients which predate intentional mentions.
+func TextMessageEvent(body string, mentions *Mentions) Event {
+	content := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    body,
+	}
+	if mentions != nil {
+		mentionsContent := map[string]interface{}{}
+		if len(mentions.UserIDs) > 0 {
+			mentionsContent["user_ids"] = mentions.UserIDs
+		}
+		if mentions.Room {
+			mentionsContent["room"] = true
+		}
+		content["m.mentions"] = mentionsContent
+	}
+	return Event{
+		Type:    "m.room.message",
+		Content: content,
+	}
+}
+
+// Unstable event types and content keys for location sharing (MSC3488) and live location beacons (MSC3672).
+const (
+	BeaconInfoEventType = "org.matrix.msc3672.beacon_info"
+	BeaconEventType     = "org.matrix.msc3672.beacon"
+	LocationKey         = "org.matrix.msc3488.location"
+	LocationAssetKey    = "org.matrix.msc3488.asset"
+	LocationTSKey       = "org.matrix.msc3488.ts"
+)
+
+// Location is a geolocation, as shared in location events and beacons.
+type Location struct {
+	// A geo URI (RFC 5870), e.g "geo:51.5008,0.1247;u=35".
+	URI         string
+	Description string
+	// When the location was taken. Defaults to now.
+	Timestamp time.Time
+}
+
+func (l Location) content() map[string]interface{} {
+	location := map[string]interface{}{
+		"uri": l.URI,
+	}
+	setIfNotEmpty(location, "description", l.Description)
+	return location
+}
+
+func (l Location) timestamp() int64 {
+	if l.Timestamp.IsZero() {
+		l.Timestamp = time.Now()
+	}
+	return l.Timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+// LocationMessageEvent returns a static location message sharing the sender's own location (MSC3488), with the
+// fallback m.location fields for clients without extensible events support.
+func LocationMessageEvent(body string, l Location) Event {
+	return Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype":                 "m.location",
+			"body":                    body,
+			"geo_uri":                 l.URI,
+			"org.matrix.msc1767.text": body,
+			LocationKey:               l.content(),
+			LocationAssetKey:          map[string]interface{}{"type": "m.self"},
+			LocationTSKey:             l.timestamp(),
+		},
+	}
+}
+
+// BeaconInfoEvent returns the beacon_info state event with which `userID` starts or, if `live` is false, stops
+// sharing their live location (MSC3672). The beacon stops being live after `timeout` even if it is not stopped.
+func BeaconInfoEvent(userID, description string, live bool, timeout time.Duration) Event {
+	content := map[string]interface{}{
+		"live":           live,
+		"timeout":        timeout.Milliseconds(),
+		LocationAssetKey: map[string]interface{}{"type": "m.self"},
+		LocationTSKey:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	setIfNotEmpty(content, "description", description)
+	return Event{
+		Type:     BeaconInfoEventType,
+		StateKey: &userID,
+		Content:  content,
+	}
+}
+
+// BeaconEvent returns a location update for the live beacon started by the beacon_info event `beaconInfoEventID`.
+func BeaconEvent(beaconInfoEventID string, l Location) Event {
+	return Event{
+		Type: BeaconEventType,
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.reference",
+				"event_id": beaconInfoEventID,
+			},
+			LocationKey:   l.content(),
+			LocationTSKey: l.timestamp(),
+		},
+	}
+}
+
+// ServerACLEvent returns an m.room.server_acl event. Server names in `allow` and `deny` may be globs. Note that
+// an empty `allow` denies every server, including the one sending the event.
+func ServerACLEvent(allow, deny []string, allowIPLiterals bool) Event {
+	if allow == nil {
+		allow = []string{}
+	}
+	if deny == nil {
+		deny = []string{}
+	}
+	return stateEvent("m.room.server_acl", map[string]interface{}{
+		"allow":             allow,
+		"deny":              deny,
+		"allow_ip_literals": allowIPLiterals,
+	})
+}
+
+// Policy rule event types, for PolicyRuleEvent.
+const (
+	PolicyRuleUser   = "m.policy.rule.user"
+	PolicyRuleRoom   = "m.policy.rule.room"
+	PolicyRuleServer = "m.policy.rule.server"
+)
+
+// PolicyRecommendationBan is the only recommendation in the spec: entities matching the rule should be banned.
+const PolicyRecommendationBan = "m.ban"
+
+// PolicyRuleEvent returns a policy rule (MSC2313) recommending a ban of the entities matching `entity`, which may
+// be a glob. `ruleType` is one of the PolicyRule constants. The state key is derived from the entity, so sending
+// another rule for the same entity replaces it.
+func PolicyRuleEvent(ruleType, entity, reason string) Event {
+	stateKey := "rule:" + entity
+	return Event{
+		Type:     ruleType,
+		StateKey: &stateKey,
+		Content: map[string]interface{}{
+			"entity":         entity,
+			"recommendation": PolicyRecommendationBan,
+			"reason":         reason,
+		},
+	}
+}
+
+func stateEvent(eventType string, content map[string]interface{}) Event {
+	emptyStateKey := ""
+	return Event{
+		Type:     eventType,
+		StateKey: &emptyStateKey,
+		Content:  content,
+	}
+}
+
+func setIfNotEmpty(content map[string]interface{}, key, value string) {
+	if value != "" {
+		content[key] = value
+	}
+}
@@ -0,0 +1,87 @@
+package b
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// LargeRoomOpts configures the room made by BlueprintLargeRoom.
+type LargeRoomOpts struct {
+	// The number of users joined to the room, including the creator @alice.
+	Users int
+	// The number of messages sent into the room, by the users in turn.
+	Messages int
+}
+
+// LargeRoomOptsFromEnv returns the room size from COMPLEMENT_LARGE_ROOM_USERS and COMPLEMENT_LARGE_ROOM_MESSAGES,
+// defaulting to 100 users and 1000 messages.
+func LargeRoomOptsFromEnv() LargeRoomOpts {
+	return LargeRoomOpts{
+		Users:    envIntWithDefault("COMPLEMENT_LARGE_ROOM_USERS", 100),
+		Messages: envIntWithDefault("COMPLEMENT_LARGE_ROOM_MESSAGES", 1000),
+	}
+}
+
+// BlueprintPerfLargeRoom is BlueprintLargeRoom sized by the environment, see LargeRoomOptsFromEnv.
+var BlueprintPerfLargeRoom = BlueprintLargeRoom(LargeRoomOptsFromEnv())
+
+// BlueprintLargeRoom returns a blueprint for a homeserver with one public room of the given size, created by
+// @alice and joined by @user_0, @user_1 and so on. The room has the alias #large_room:hs1. The name includes the
+// size, so each size is built once and then deployed from its cached image.
+func BlueprintLargeRoom(opts LargeRoomOpts) Blueprint {
+	if opts.Users < 1 {
+		opts.Users = 1
+	}
+	users := []User{
+		{
+			Localpart:   "@alice",
+			DisplayName: "Alice",
+		},
+	}
+	senders := []string{"@alice"}
+	var events []Event
+	for i := 0; i < opts.Users-1; i++ {
+		localpart := fmt.Sprintf("@user_%d", i)
+		users = append(users, User{
+			Localpart:   localpart,
+			DisplayName: fmt.Sprintf("User %d", i),
+		})
+		senders = append(senders, localpart)
+		events = append(events, Event{
+			Type:     "m.room.member",
+			StateKey: Ptr(localpart + ":hs1"),
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+			Sender: localpart,
+		})
+	}
+	return MustValidate(Blueprint{
+		Name: fmt.Sprintf("perf_large_room_%du_%dm", opts.Users, opts.Messages),
+		Homeservers: []Homeserver{
+			{
+				Name:  "hs1",
+				Users: users,
+				Rooms: []Room{
+					{
+						CreateRoom: map[string]interface{}{
+							"preset":          "public_chat",
+							"room_alias_name": "large_room",
+						},
+						Creator: "@alice",
+						Events:  append(events, manyMessages(senders, opts.Messages)...),
+					},
+				},
+			},
+		},
+	})
+}
+
+func envIntWithDefault(key string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return i
+}
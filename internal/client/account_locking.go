@@ -0,0 +1,118 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Expected responses for requests by locked (MSC3939) and suspended (MSC3823) accounts.
+var (
+	// The account is locked. Clients should treat this as a soft logout, and keep the session until it is unlocked.
+	AccountLocked = match.HTTPResponse{
+		StatusCode: 401,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("errcode", "M_USER_LOCKED"),
+			match.JSONKeyEqual("soft_logout", true),
+		},
+	}
+	// The account is suspended, so the action is not allowed. Servers may still use the unstable errcode.
+	AccountSuspended = match.HTTPResponse{
+		StatusCode: 403,
+		JSON: []match.JSON{
+			match.AnyOf(
+				match.JSONKeyEqual("errcode", "M_USER_SUSPENDED"),
+				match.JSONKeyEqual("errcode", "ORG.MATRIX.MSC3823.USER_ACCOUNT_SUSPENDED"),
+			),
+		},
+	}
+)
+
+// accountRestrictionRequest is a request made to check how the homeserver treats a locked or suspended account.
+type accountRestrictionRequest struct {
+	name string
+	do   func() *http.Response
+}
+
+// MustBeLocked asserts that every request by this client, reading or writing, fails with M_USER_LOCKED and
+// soft_logout, as the account has been locked. `roomID` is a room the user has joined. Logging out must still
+// work, which can be checked with MustLogoutWhileRestricted once the other assertions are done.
+func (c *CSAPI) MustBeLocked(t *testing.T, roomID string) {
+	t.Helper()
+	for _, req := range append(c.accountReadRequests(t, roomID), c.accountWriteRequests(t, roomID)...) {
+		t.Logf("MustBeLocked: %s", req.name)
+		must.MatchResponse(t, req.do(), AccountLocked)
+	}
+}
+
+// MustBeSuspended asserts that this client, whose account has been suspended, can still read from the homeserver,
+// including /sync, but cannot send events into `roomID`, a room the user has joined, nor change their profile or
+// create rooms.
+func (c *CSAPI) MustBeSuspended(t *testing.T, roomID string) {
+	t.Helper()
+	for _, req := range c.accountReadRequests(t, roomID) {
+		t.Logf("MustBeSuspended: %s", req.name)
+		res := req.do()
+		if res.StatusCode != 200 {
+			t.Fatalf("MustBeSuspended: %s returned HTTP %d, want 200: %s", req.name, res.StatusCode, string(ParseJSON(t, res)))
+		}
+		res.Body.Close()
+	}
+	for _, req := range c.accountWriteRequests(t, roomID) {
+		t.Logf("MustBeSuspended: %s", req.name)
+		must.MatchResponse(t, req.do(), AccountSuspended)
+	}
+}
+
+// MustLogoutWhileRestricted asserts that this client can log out despite its account being locked or suspended,
+// and that the access token is then invalid.
+func (c *CSAPI) MustLogoutWhileRestricted(t *testing.T) {
+	t.Helper()
+	res := c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "logout"}, WithJSONBody(t, map[string]interface{}{}))
+	if res.StatusCode != 200 {
+		t.Fatalf("MustLogoutWhileRestricted: logout returned HTTP %d: %s", res.StatusCode, string(ParseJSON(t, res)))
+	}
+	res.Body.Close()
+	c.MustWhoamiFailUnknownToken(t, false)
+}
+
+// accountReadRequests are requests which only read, so are allowed for suspended accounts.
+func (c *CSAPI) accountReadRequests(t *testing.T, roomID string) []accountRestrictionRequest {
+	return []accountRestrictionRequest{
+		{"whoami", func() *http.Response { return c.DoWhoami(t) }},
+		{"sync", func() *http.Response {
+			return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(map[string][]string{
+				"timeout": {"0"},
+			}))
+		}},
+		{"messages", func() *http.Response {
+			return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, WithQueries(map[string][]string{
+				"dir": {"b"},
+			}))
+		}},
+	}
+}
+
+// accountWriteRequests are requests which affect other users, so are forbidden for suspended accounts.
+func (c *CSAPI) accountWriteRequests(t *testing.T, roomID string) []accountRestrictionRequest {
+	return []accountRestrictionRequest{
+		{"send message", func() *http.Response {
+			c.txnID++
+			return c.DoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.message", strconv.Itoa(c.txnID)}, WithJSONBody(t, map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "restricted account",
+			}))
+		}},
+		{"set displayname", func() *http.Response {
+			return c.DoFunc(t, "PUT", []string{"_matrix", "client", "v3", "profile", c.UserID, "displayname"}, WithJSONBody(t, map[string]interface{}{
+				"displayname": "restricted account",
+			}))
+		}},
+		{"create room", func() *http.Response {
+			return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "createRoom"}, WithJSONBody(t, map[string]interface{}{}))
+		}},
+	}
+}
@@ -0,0 +1,231 @@
+// Package admin contains typed helpers for the Synapse Admin API.
+//
+// Wrap a client for a server admin, e.g one created with Deployment.RegisterUser(t, "hs1", "admin", "pass", true):
+//
+//	adm := admin.NewClient(deployment.RegisterUser(t, "hs1", "admin", "adminpassword", true))
+//	adm.DeactivateUser(t, alice.UserID, false)
+//
+// These endpoints are Synapse-specific, so tests which use them should be skipped on other homeservers.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Client makes Synapse Admin API requests as a server admin.
+type Client struct {
+	*client.CSAPI
+}
+
+// NewClient wraps `c`, which must be logged in as a server admin.
+func NewClient(c *client.CSAPI) *Client {
+	return &Client{CSAPI: c}
+}
+
+// User is a user as returned by the admin user APIs.
+type User struct {
+	Name         string `json:"name"`
+	DisplayName  string `json:"displayname"`
+	AvatarURL    string `json:"avatar_url"`
+	Admin        bool   `json:"admin"`
+	Deactivated  bool   `json:"deactivated"`
+	ShadowBanned bool   `json:"shadow_banned"`
+	Locked       bool   `json:"locked"`
+	IsGuest      bool   `json:"is_guest"`
+	UserType     string `json:"user_type"`
+	CreationTS   int64  `json:"creation_ts"`
+}
+
+// ListUsersReq filters the users returned by ListUsers. The empty struct lists all local, non-guest,
+// non-deactivated users.
+type ListUsersReq struct {
+	// Only return users whose user ID or display name contains this.
+	Name          string
+	Guests        bool
+	Deactivated   bool
+	ExcludeAdmins bool
+}
+
+// ListUsers returns all users matching the request, following `next_token` until every page has been fetched.
+// Fails the test on error.
+func (a *Client) ListUsers(t *testing.T, req ListUsersReq) []User {
+	t.Helper()
+	query := url.Values{
+		"guests":      []string{strconv.FormatBool(req.Guests)},
+		"deactivated": []string{strconv.FormatBool(req.Deactivated)},
+	}
+	if req.Name != "" {
+		query.Set("name", req.Name)
+	}
+	if req.ExcludeAdmins {
+		query.Set("admins", "false")
+	}
+	var users []User
+	for {
+		res := a.MustDoFunc(t, "GET", []string{"_synapse", "admin", "v2", "users"}, client.WithQueries(query))
+		body := client.ParseJSON(t, res)
+		var page struct {
+			Users     []User      `json:"users"`
+			NextToken interface{} `json:"next_token"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("ListUsers: failed to unmarshal response: %s - %s", err, string(body))
+		}
+		users = append(users, page.Users...)
+		// Synapse returns next_token as a string, older versions as an integer
+		if page.NextToken == nil {
+			return users
+		}
+		query.Set("from", fmt.Sprint(page.NextToken))
+	}
+}
+
+// GetUser returns the account details of `userID`. Fails the test on error.
+func (a *Client) GetUser(t *testing.T, userID string) User {
+	t.Helper()
+	res := a.MustDoFunc(t, "GET", []string{"_synapse", "admin", "v2", "users", userID})
+	body := client.ParseJSON(t, res)
+	user := User{Name: userID}
+	if err := json.Unmarshal(body, &user); err != nil {
+		t.Fatalf("GetUser: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return user
+}
+
+// DeactivateUser deactivates `userID`, also erasing their messages if `erase` is true. Fails the test on error.
+func (a *Client) DeactivateUser(t *testing.T, userID string, erase bool) {
+	t.Helper()
+	a.MustDoFunc(t, "POST", []string{"_synapse", "admin", "v1", "deactivate", userID}, client.WithJSONBody(t, map[string]interface{}{
+		"erase": erase,
+	}))
+}
+
+// SetShadowBanned shadow-bans `userID`, or lifts the shadow-ban if `banned` is false. Shadow-banned users get
+// successful responses, but their events are not sent to other users. Fails the test on error.
+func (a *Client) SetShadowBanned(t *testing.T, userID string, banned bool) {
+	t.Helper()
+	method := "POST"
+	if !banned {
+		method = "DELETE"
+	}
+	a.MustDoFunc(t, method, []string{"_synapse", "admin", "v1", "users", userID, "shadow_ban"})
+}
+
+// SetLocked locks `userID`'s account, or unlocks it if `locked` is false. Locked users are soft logged out, and
+// every request except logging out fails with M_USER_LOCKED until the account is unlocked (MSC3939). Fails the
+// test on error.
+func (a *Client) SetLocked(t *testing.T, userID string, locked bool) {
+	t.Helper()
+	a.MustDoFunc(t, "PUT", []string{"_synapse", "admin", "v2", "users", userID}, client.WithJSONBody(t, map[string]interface{}{
+		"locked": locked,
+	}))
+}
+
+// SetSuspended suspends `userID`'s account, or lifts the suspension if `suspended` is false. Suspended users can
+// still read, but most actions which affect other users fail (MSC3823). Fails the test on error.
+func (a *Client) SetSuspended(t *testing.T, userID string, suspended bool) {
+	t.Helper()
+	a.MustDoFunc(t, "PUT", []string{"_synapse", "admin", "v1", "suspend", userID}, client.WithJSONBody(t, map[string]interface{}{
+		"suspend": suspended,
+	}))
+}
+
+// PurgeRoomReq configures PurgeRoom. The empty struct removes all local users from the room and purges it
+// from the database.
+type PurgeRoomReq struct {
+	// If set, local users are moved to a new room created by this user, which contains `Message`.
+	NewRoomUserID string
+	Message       string
+	// Prevent the room from being joined again.
+	Block bool
+	// Keep the room in the database, only removing local users.
+	NoPurge bool
+}
+
+// PurgeRoom removes all local users from `roomID` and purges it, waiting until the purge has finished. Fails the
+// test on error, or if the purge does not finish within SyncUntilTimeout.
+func (a *Client) PurgeRoom(t *testing.T, roomID string, req PurgeRoomReq) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"block": req.Block,
+		"purge": !req.NoPurge,
+	}
+	if req.NewRoomUserID != "" {
+		reqBody["new_room_user_id"] = req.NewRoomUserID
+	}
+	if req.Message != "" {
+		reqBody["message"] = req.Message
+	}
+	res := a.MustDoFunc(t, "DELETE", []string{"_synapse", "admin", "v2", "rooms", roomID}, client.WithJSONBody(t, reqBody))
+	deleteID := client.GetJSONFieldStr(t, client.ParseJSON(t, res), "delete_id")
+	a.pollUntil(t, "PurgeRoom", func() bool {
+		res := a.MustDoFunc(t, "GET", []string{"_synapse", "admin", "v2", "rooms", "delete_status", deleteID})
+		body := gjson.ParseBytes(client.ParseJSON(t, res))
+		switch status := body.Get("status").Str; status {
+		case "complete":
+			return true
+		case "failed":
+			t.Fatalf("PurgeRoom(%s): failed: %s", roomID, body.Get("error").Str)
+		default:
+			t.Logf("PurgeRoom(%s): status is %s", roomID, status)
+		}
+		return false
+	})
+}
+
+// Names of background jobs which can be started with StartBackgroundJob.
+const (
+	BackgroundJobPopulateRoomStats   = "populate_stats_process_rooms"
+	BackgroundJobRegenerateDirectory = "regenerate_directory"
+)
+
+// SetBackgroundUpdatesEnabled pauses or resumes background database updates. Fails the test on error.
+func (a *Client) SetBackgroundUpdatesEnabled(t *testing.T, enabled bool) {
+	t.Helper()
+	a.MustDoFunc(t, "POST", []string{"_synapse", "admin", "v1", "background_updates", "enabled"}, client.WithJSONBody(t, map[string]interface{}{
+		"enabled": enabled,
+	}))
+}
+
+// StartBackgroundJob schedules a background job, e.g BackgroundJobRegenerateDirectory. Fails the test on error.
+func (a *Client) StartBackgroundJob(t *testing.T, jobName string) {
+	t.Helper()
+	a.MustDoFunc(t, "POST", []string{"_synapse", "admin", "v1", "background_updates", "start_job"}, client.WithJSONBody(t, map[string]interface{}{
+		"job_name": jobName,
+	}))
+}
+
+// WaitForBackgroundUpdates waits until no background updates are running. Fails the test on error, or if
+// updates are still running after SyncUntilTimeout.
+func (a *Client) WaitForBackgroundUpdates(t *testing.T) {
+	t.Helper()
+	a.pollUntil(t, "WaitForBackgroundUpdates", func() bool {
+		res := a.MustDoFunc(t, "GET", []string{"_synapse", "admin", "v1", "background_updates", "status"})
+		body := gjson.ParseBytes(client.ParseJSON(t, res))
+		if !body.Get("enabled").Bool() {
+			t.Fatalf("WaitForBackgroundUpdates: background updates are disabled")
+		}
+		return len(body.Get("current_updates").Map()) == 0
+	})
+}
+
+// pollUntil calls `done` every 100ms until it returns true, failing the test after SyncUntilTimeout.
+func (a *Client) pollUntil(t *testing.T, funcName string, done func() bool) {
+	t.Helper()
+	start := time.Now()
+	for !done() {
+		if time.Since(start) > a.SyncUntilTimeout {
+			t.Fatalf("%s: timed out after %v", funcName, time.Since(start))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// ServerNoticeTag is the room tag Synapse puts on server notice rooms.
+const ServerNoticeTag = "m.server_notice"
+
+// SendServerNotice sends a server notice with the given message content to `userID`. If `txnID` is non-empty the
+// request is idempotent for that transaction ID. Fails the test on error. Returns the event ID of the notice.
+func (a *Client) SendServerNotice(t *testing.T, userID string, content map[string]interface{}, txnID string) string {
+	t.Helper()
+	paths := []string{"_synapse", "admin", "v1", "send_server_notice"}
+	method := "POST"
+	if txnID != "" {
+		paths = append(paths, txnID)
+		method = "PUT"
+	}
+	res := a.MustDoFunc(t, method, paths, client.WithJSONBody(t, map[string]interface{}{
+		"user_id": userID,
+		"content": content,
+	}))
+	return client.GetJSONFieldStr(t, client.ParseJSON(t, res), "event_id")
+}
+
+// MustSyncUntilServerNoticeInvite syncs until `c` is invited to a room by the server notices user `senderUserID`.
+// Returns the room ID of the server notice room.
+func MustSyncUntilServerNoticeInvite(t *testing.T, c *client.CSAPI, since, senderUserID string) string {
+	t.Helper()
+	var roomID string
+	c.MustSyncUntil(t, client.SyncReq{Since: since}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		topLevelSyncJSON.Get("rooms.invite").ForEach(func(key, room gjson.Result) bool {
+			for _, ev := range room.Get("invite_state.events").Array() {
+				if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == clientUserID && ev.Get("sender").Str == senderUserID {
+					roomID = key.Str
+					return false
+				}
+			}
+			return true
+		})
+		if roomID == "" {
+			return fmt.Errorf("MustSyncUntilServerNoticeInvite: no invite from %s", senderUserID)
+		}
+		return nil
+	})
+	return roomID
+}
+
+// Check that `roomID` is tagged as a server notice room and its timeline has the notice `eventID`, whose content
+// passes all of the checks, e.g match.JSONKeyEqual("body", "hello"). The client must have joined the room.
+func SyncServerNoticeHas(roomID, eventID string, checks ...match.JSON) client.SyncCheckOpt {
+	tagged := client.SyncRoomTagHas(roomID, ServerNoticeTag, nil)
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if err := tagged(clientUserID, topLevelSyncJSON); err != nil {
+			return fmt.Errorf("SyncServerNoticeHas(%s): %s", roomID, err)
+		}
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + client.GjsonEscape(roomID) + ".timeline.events").Array() {
+			if ev.Get("event_id").Str != eventID {
+				continue
+			}
+			for _, check := range checks {
+				if err := check([]byte(ev.Get("content").Raw)); err != nil {
+					return fmt.Errorf("SyncServerNoticeHas(%s): notice %s: %s", roomID, eventID, err)
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("SyncServerNoticeHas(%s): notice %s not in timeline", roomID, eventID)
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// Expected responses for alias requests which the homeserver should reject.
+var (
+	// The user lacks permission to create, delete or list the alias(es).
+	AliasForbidden = match.HTTPResponse{
+		StatusCode: 403,
+		JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_FORBIDDEN")},
+	}
+	// The alias does not exist.
+	AliasNotFound = match.HTTPResponse{
+		StatusCode: 404,
+		JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_NOT_FOUND")},
+	}
+	// The alias already points at a room.
+	AliasInUse = match.HTTPResponse{
+		StatusCode: 409,
+	}
+	// The m.room.canonical_alias event references an alias which does not point at the room.
+	AliasBadCanonical = match.HTTPResponse{
+		StatusCode: 400,
+		JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_BAD_ALIAS")},
+	}
+)
+
+// CreateAlias makes `alias` point at `roomID`. Fails the test on error.
+func (c *CSAPI) CreateAlias(t *testing.T, alias, roomID string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", alias}, WithJSONBody(t, map[string]interface{}{
+		"room_id": roomID,
+	}))
+}
+
+// DoCreateAlias is the same as CreateAlias but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoCreateAlias(t *testing.T, alias, roomID string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", alias}, WithJSONBody(t, map[string]interface{}{
+		"room_id": roomID,
+	}))
+}
+
+// ResolveAlias returns the room ID `alias` points at and the servers which know about the room. Fails the test
+// on error.
+func (c *CSAPI) ResolveAlias(t *testing.T, alias string) (roomID string, servers []string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", alias})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "room_id"), GetJSONFieldStringArray(t, body, "servers")
+}
+
+// DoResolveAlias is the same as ResolveAlias but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoResolveAlias(t *testing.T, alias string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", alias})
+}
+
+// DeleteAlias removes `alias`. Fails the test on error.
+func (c *CSAPI) DeleteAlias(t *testing.T, alias string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "v3", "directory", "room", alias})
+}
+
+// DoDeleteAlias is the same as DeleteAlias but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoDeleteAlias(t *testing.T, alias string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "DELETE", []string{"_matrix", "client", "v3", "directory", "room", alias})
+}
+
+// GetRoomAliases returns the local aliases which point at `roomID`. Fails the test on error.
+func (c *CSAPI) GetRoomAliases(t *testing.T, roomID string) []string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "aliases"})
+	return GetJSONFieldStringArray(t, ParseJSON(t, res), "aliases")
+}
+
+// DoGetRoomAliases is the same as GetRoomAliases but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoGetRoomAliases(t *testing.T, roomID string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "aliases"})
+}
+
+// DoSetCanonicalAlias sends an m.room.canonical_alias event with the given alias and alternative aliases.
+// Either may be empty. Returns the response, as homeservers reject aliases which do not point at the room.
+func (c *CSAPI) DoSetCanonicalAlias(t *testing.T, roomID, alias string, altAliases []string) *http.Response {
+	t.Helper()
+	content := map[string]interface{}{}
+	if alias != "" {
+		content["alias"] = alias
+	}
+	if altAliases != nil {
+		content["alt_aliases"] = altAliases
+	}
+	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.canonical_alias"}, WithJSONBody(t, content))
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// MustHaveCapabilities fails the test unless the server's /capabilities response passes all of the checks.
+func (c *CSAPI) MustHaveCapabilities(t *testing.T, checks ...match.JSON) {
+	t.Helper()
+	body := c.GetCapabilities(t)
+	for _, check := range checks {
+		if err := check(body); err != nil {
+			t.Fatalf("MustHaveCapabilities: %s - body: %s", err, string(body))
+		}
+	}
+}
+
+// CapabilityPresent checks that the capability with the given name, e.g "m.change_password" or an unstable
+// MSC name, is advertised.
+func CapabilityPresent(name string) match.JSON {
+	return func(body []byte) error {
+		if !gjson.GetBytes(body, capabilityPath(name)).Exists() {
+			return fmt.Errorf("CapabilityPresent: %s is missing", name)
+		}
+		return nil
+	}
+}
+
+// CapabilityEnabled checks that the capability with the given name is advertised with `enabled` set as given,
+// e.g CapabilityEnabled("m.change_password", true).
+func CapabilityEnabled(name string, enabled bool) match.JSON {
+	return func(body []byte) error {
+		got := gjson.GetBytes(body, capabilityPath(name)+".enabled")
+		if !got.Exists() {
+			return fmt.Errorf("CapabilityEnabled: %s.enabled is missing", name)
+		}
+		if got.Bool() != enabled {
+			return fmt.Errorf("CapabilityEnabled: %s.enabled is %v, want %v", name, got.Bool(), enabled)
+		}
+		return nil
+	}
+}
+
+// CapabilityDefaultRoomVersion checks that m.room_versions advertises `version` as the default.
+func CapabilityDefaultRoomVersion(version string) match.JSON {
+	return func(body []byte) error {
+		got := gjson.GetBytes(body, capabilityPath("m.room_versions")+".default").Str
+		if got != version {
+			return fmt.Errorf("CapabilityDefaultRoomVersion: default is %q, want %q", got, version)
+		}
+		return nil
+	}
+}
+
+// CapabilityRoomVersionAvailable checks that m.room_versions advertises `version` with the given stability,
+// "stable" or "unstable". An empty `stability` matches either.
+func CapabilityRoomVersionAvailable(version, stability string) match.JSON {
+	return func(body []byte) error {
+		got := gjson.GetBytes(body, capabilityPath("m.room_versions")+".available."+GjsonEscape(version))
+		if !got.Exists() {
+			return fmt.Errorf("CapabilityRoomVersionAvailable: %s is not available", version)
+		}
+		if stability != "" && got.Str != stability {
+			return fmt.Errorf("CapabilityRoomVersionAvailable: %s is %q, want %q", version, got.Str, stability)
+		}
+		return nil
+	}
+}
+
+func capabilityPath(name string) string {
+	return "capabilities." + GjsonEscape(name)
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trafficCaptures holds the capture for each test, so every client in a test writes to the same file.
+var (
+	trafficCapturesMu sync.Mutex
+	trafficCaptures   = make(map[*testing.T]*trafficCapture)
+)
+
+// WithTrafficCapture wraps the client's transport so every request and response made during the test is
+// recorded. If the test fails, the traffic is written to `dir` as a HAR file named after the test, which can be
+// opened in browser dev tools or HAR viewers. Clients in the same test share one file.
+func WithTrafficCapture(t *testing.T, cli *http.Client, dir string) *http.Client {
+	t.Helper()
+	trafficCapturesMu.Lock()
+	capture, ok := trafficCaptures[t]
+	if !ok {
+		capture = &trafficCapture{}
+		trafficCaptures[t] = capture
+		t.Cleanup(func() {
+			trafficCapturesMu.Lock()
+			delete(trafficCaptures, t)
+			trafficCapturesMu.Unlock()
+			if !t.Failed() {
+				return
+			}
+			path, err := capture.writeHAR(dir, t.Name())
+			if err != nil {
+				t.Logf("WithTrafficCapture: failed to write HAR file: %s", err)
+				return
+			}
+			t.Logf("WithTrafficCapture: wrote HTTP traffic to %s", path)
+		})
+	}
+	trafficCapturesMu.Unlock()
+	transport := cli.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	cli.Transport = &capturingRoundTripper{capture: capture, wrap: transport}
+	return cli
+}
+
+// maxCapturedBodySize is the most of each request and response body which is kept, so that long-running syncs
+// and large media do not use unbounded memory.
+const maxCapturedBodySize = 64 * 1024
+
+type trafficCapture struct {
+	mu      sync.Mutex
+	entries []*capturedEntry
+}
+
+// capturedEntry is a HAR entry whose bodies are filled in when the HAR file is written, as they are captured
+// while the caller reads them.
+type capturedEntry struct {
+	harEntry
+	reqBody *capturedBody
+	resBody *capturedBody
+}
+
+type capturingRoundTripper struct {
+	capture *trafficCapture
+	wrap    http.RoundTripper
+}
+
+func (rt *capturingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := &capturedEntry{}
+	if req.Body != nil && req.Body != http.NoBody {
+		// tee the body as the transport sends it, so streamed uploads are not buffered
+		entry.reqBody = newCapturedBody(req.Header.Get("Content-Type"))
+		req = req.Clone(req.Context())
+		req.Body = &teeReadCloser{Reader: io.TeeReader(req.Body, entry.reqBody), Closer: req.Body}
+	}
+	start := time.Now()
+	res, err := rt.wrap.RoundTrip(req)
+	entry.harEntry = harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            float64(time.Since(start).Microseconds()) / 1000,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+	if err != nil {
+		entry.Response.StatusText = err.Error()
+	} else {
+		entry.Response.Status = res.StatusCode
+		entry.Response.StatusText = http.StatusText(res.StatusCode)
+		entry.Response.HTTPVersion = res.Proto
+		entry.Response.Headers = harHeaders(res.Header)
+		entry.Response.Content.MimeType = res.Header.Get("Content-Type")
+		// tee the body as the caller reads it, so streamed responses like /sync are not buffered
+		entry.resBody = newCapturedBody(res.Header.Get("Content-Type"))
+		res.Body = &teeReadCloser{Reader: io.TeeReader(res.Body, entry.resBody), Closer: res.Body}
+	}
+	entry.Timings.Wait = entry.Time
+	rt.capture.mu.Lock()
+	rt.capture.entries = append(rt.capture.entries, entry)
+	rt.capture.mu.Unlock()
+	return res, err
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// capturedBody keeps up to maxCapturedBodySize bytes of a body as it is read, and counts the rest. The contents
+// of binary bodies, such as media, are not kept at all.
+type capturedBody struct {
+	mu       sync.Mutex
+	mimeType string
+	binary   bool
+	buf      bytes.Buffer
+	size     int
+}
+
+func newCapturedBody(contentType string) *capturedBody {
+	return &capturedBody{
+		mimeType: contentType,
+		binary:   isBinaryContentType(contentType),
+	}
+}
+
+func (b *capturedBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += len(p)
+	if room := maxCapturedBodySize - b.buf.Len(); !b.binary && room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// text returns the body to put in the HAR file, noting when it was truncated or left out, and the number of
+// bytes which were read.
+func (b *capturedBody) text() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.binary {
+		return fmt.Sprintf("(%d bytes of %s not captured)", b.size, b.mimeType), b.size
+	}
+	if b.size > b.buf.Len() {
+		return fmt.Sprintf("%s\n(truncated: captured %d of %d bytes)", b.buf.String(), b.buf.Len(), b.size), b.size
+	}
+	return b.buf.String(), b.size
+}
+
+// isBinaryContentType returns true unless the content type is JSON, text, a form or XML. Bodies without a
+// content type are assumed to be text.
+func isBinaryContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/x-www-form-urlencoded",
+		mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+xml"):
+		return false
+	}
+	return true
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func (c *trafficCapture) writeHAR(dir, testName string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	var har struct {
+		Log struct {
+			Version string `json:"version"`
+			Creator struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"creator"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	har.Log.Version = "1.2"
+	har.Log.Creator.Name = "complement"
+	har.Log.Entries = make([]harEntry, len(c.entries))
+	for i, entry := range c.entries {
+		if entry.reqBody != nil {
+			text, size := entry.reqBody.text()
+			entry.Request.BodySize = size
+			entry.Request.PostData = &harPostData{MimeType: entry.reqBody.mimeType, Text: text}
+		}
+		if entry.resBody != nil {
+			text, size := entry.resBody.text()
+			entry.Response.BodySize = size
+			entry.Response.Content.Size = size
+			entry.Response.Content.Text = text
+		}
+		har.Log.Entries[i] = entry.harEntry
+	}
+	b, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, unsafeFilenameChars.ReplaceAllString(testName, "_")+".har")
+	return path, ioutil.WriteFile(path, b, 0644)
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// The subset of HAR 1.2 which is needed to view requests and responses.
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
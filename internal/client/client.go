@@ -10,8 +10,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
@@ -61,6 +63,9 @@ type SyncReq struct {
 	// filter using the filter API is recommended for clients that reuse the same filter multiple
 	// times, for example in long poll requests.
 	Filter string
+	// The ID of a filter created with CreateFilter. Unlike Filter, this is never treated as inline JSON, so
+	// tests can be explicit about using a stored filter. Must not be set alongside Filter.
+	FilterID string
 	// Controls whether to include the full state for all rooms the user is a member of.
 	// If this is set to true, then all state events will be returned, even if since is non-empty.
 	// The timeline will still be limited by the since parameter. In this case, the timeout parameter
@@ -80,6 +85,11 @@ type SyncReq struct {
 	// with empty fields.
 	// By default, this is 1000 for Complement testing.
 	TimeoutMillis string // string for easier conversion to query params
+	// If set, the response is decoded incrementally and OnEvent is called for each event in the rooms,
+	// to_device, presence and account_data sections, instead of buffering the whole response. These events
+	// are omitted from the response returned by MustSync, so sync checks will not see them. Use this for
+	// load tests with very large initial syncs.
+	OnEvent func(ev SyncStreamEvent)
 }
 
 type CSAPI struct {
@@ -92,8 +102,18 @@ type CSAPI struct {
 	SyncUntilTimeout time.Duration
 	// True to enable verbose logging
 	Debug bool
+	// The refresh token, if the client logged in or registered with refresh tokens enabled. When set,
+	// requests which fail with a soft logout are retried once after refreshing the access token.
+	RefreshToken string
+	// True to stop DoFunc refreshing the access token automatically, e.g to assert on soft logouts.
+	DisableAutoRefresh bool
+
+	// How to handle 429 M_LIMIT_EXCEEDED responses. The zero value returns them to the caller.
+	RateLimit RateLimitPolicy
 
 	txnID int
+	// set if the client logged in via LoginWithOIDC
+	oidc *oidcSession
 }
 
 // UploadContent uploads the provided content with an optional file name. Fails the test on error. Returns the MXC URI.
@@ -176,9 +196,9 @@ func (c *CSAPI) SetGlobalAccountData(t *testing.T, eventType string, content map
 	return c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", eventType}, WithJSONBody(t, content))
 }
 
-// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
+// SendEventUnsynced sends `e` into the room without waiting for it to come down /sync.
 // Returns the event ID of the sent event.
-func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
+func (c *CSAPI) SendEventUnsynced(t *testing.T, roomID string, e b.Event) string {
 	t.Helper()
 	c.txnID++
 	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
@@ -187,7 +207,14 @@ func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
 	}
 	res := c.MustDo(t, "PUT", paths, e.Content)
 	body := ParseJSON(t, res)
-	eventID := GetJSONFieldStr(t, body, "event_id")
+	return GetJSONFieldStr(t, body, "event_id")
+}
+
+// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
+// Returns the event ID of the sent event.
+func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
+	t.Helper()
+	eventID := c.SendEventUnsynced(t, roomID, e)
 	t.Logf("SendEventSynced waiting for event ID %s", eventID)
 	c.MustSyncUntil(t, SyncReq{}, SyncTimelineHas(roomID, func(r gjson.Result) bool {
 		return r.Get("event_id").Str == eventID
@@ -195,12 +222,54 @@ func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
 	return eventID
 }
 
+// GetStateEvent returns the content of the state event with the given type and state key, else fails the test.
+func (c *CSAPI) GetStateEvent(t *testing.T, roomID, eventType, stateKey string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", eventType, stateKey})
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// GetRoomState returns all current state events in the room, else fails the test.
+func (c *CSAPI) GetRoomState(t *testing.T, roomID string) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	return gjson.ParseBytes(ParseJSON(t, res)).Array()
+}
+
+// GetEvent returns the event from /rooms/{roomID}/event/{eventID}, else fails the test.
+func (c *CSAPI) GetEvent(t *testing.T, roomID, eventID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
 // Perform a single /sync request with the given request options. To sync until something happens,
 // see `MustSyncUntil`.
 //
 // Fails the test if the /sync request does not return 200 OK.
 // Returns the top-level parsed /sync response JSON as well as the next_batch token from the response.
 func (c *CSAPI) MustSync(t *testing.T, syncReq SyncReq) (gjson.Result, string) {
+	t.Helper()
+	query := syncReq.queryParams(t)
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
+	var body []byte
+	if syncReq.OnEvent != nil {
+		defer res.Body.Close()
+		var err error
+		body, err = decodeSyncStreaming(res.Body, syncReq.OnEvent)
+		if err != nil {
+			t.Fatalf("MustSync: failed to decode response: %s", err)
+		}
+	} else {
+		body = ParseJSON(t, res)
+	}
+	result := gjson.ParseBytes(body)
+	nextBatch := GetJSONFieldStr(t, body, "next_batch")
+	return result, nextBatch
+}
+
+// queryParams returns the /sync query parameters for the request.
+func (syncReq SyncReq) queryParams(t *testing.T) url.Values {
 	t.Helper()
 	query := url.Values{
 		"timeout": []string{"1000"},
@@ -212,20 +281,22 @@ func (c *CSAPI) MustSync(t *testing.T, syncReq SyncReq) (gjson.Result, string) {
 	if syncReq.Since != "" {
 		query["since"] = []string{syncReq.Since}
 	}
+	if syncReq.Filter != "" && syncReq.FilterID != "" {
+		t.Fatalf("MustSync: SyncReq.Filter and SyncReq.FilterID are mutually exclusive")
+	}
 	if syncReq.Filter != "" {
 		query["filter"] = []string{syncReq.Filter}
 	}
+	if syncReq.FilterID != "" {
+		query["filter"] = []string{syncReq.FilterID}
+	}
 	if syncReq.FullState {
 		query["full_state"] = []string{"true"}
 	}
 	if syncReq.SetPresence != "" {
 		query["set_presence"] = []string{syncReq.SetPresence}
 	}
-	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
-	body := ParseJSON(t, res)
-	result := gjson.ParseBytes(body)
-	nextBatch := GetJSONFieldStr(t, body, "next_batch")
-	return result, nextBatch
+	return query
 }
 
 // MustSyncUntil blocks and continually calls /sync (advancing the since token) until all the
@@ -376,7 +447,7 @@ func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bo
 	return userID, accessToken, deviceID
 }
 
-// GetCapbabilities queries the server's capabilities
+// GetCapabilities queries the server's capabilities. See MustHaveCapabilities to assert on them.
 func (c *CSAPI) GetCapabilities(t *testing.T) []byte {
 	t.Helper()
 	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "capabilities"})
@@ -419,10 +490,86 @@ func (c *CSAPI) MustDo(t *testing.T, method string, paths []string, jsonBody int
 func WithRawBody(body []byte) RequestOpt {
 	return func(req *http.Request) {
 		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-		// we need to manually set this because we don't set the body
+		// we need to manually set these because we don't set the body
 		// in http.NewRequest due to using functional options, and only in NewRequest
-		// does the stdlib set this for us.
+		// does the stdlib set this for us. GetBody lets DoFunc replay the body on retries.
 		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+}
+
+// WithBodyReader sets the HTTP request body to the contents of `body` and the Content-Type to `contentType`.
+// The length is only set for *bytes.Buffer, *bytes.Reader and *strings.Reader, otherwise the body is chunked.
+// The body is streamed rather than buffered, so it cannot be replayed: the request is not retried after a token
+// refresh or rate limit, and cannot be used with WithRetryUntil.
+func WithBodyReader(contentType string, body io.Reader) RequestOpt {
+	return func(req *http.Request) {
+		req.Body = ioutil.NopCloser(body)
+		req.GetBody = nil
+		switch b := body.(type) {
+		case *bytes.Buffer:
+			req.ContentLength = int64(b.Len())
+		case *bytes.Reader:
+			req.ContentLength = int64(b.Len())
+		case *strings.Reader:
+			req.ContentLength = int64(b.Len())
+		default:
+			req.ContentLength = -1
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+}
+
+// MultipartFile is a file part of a multipart/form-data body. See WithMultipartBody.
+type MultipartFile struct {
+	FieldName   string
+	FileName    string
+	ContentType string
+	Content     []byte
+}
+
+// WithMultipartBody sets the HTTP request body to a multipart/form-data body containing the form fields and
+// then the files, and sets the Content-Type including the boundary.
+func WithMultipartBody(t *testing.T, fields map[string]string, files ...MultipartFile) RequestOpt {
+	return func(req *http.Request) {
+		t.Helper()
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		for name, value := range fields {
+			if err := w.WriteField(name, value); err != nil {
+				t.Fatalf("CSAPI.Do failed to write multipart field: %s", err)
+			}
+		}
+		for _, file := range files {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, file.FieldName, file.FileName))
+			if file.ContentType != "" {
+				header.Set("Content-Type", file.ContentType)
+			}
+			part, err := w.CreatePart(header)
+			if err != nil {
+				t.Fatalf("CSAPI.Do failed to create multipart file: %s", err)
+			}
+			if _, err = part.Write(file.Content); err != nil {
+				t.Fatalf("CSAPI.Do failed to write multipart file: %s", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("CSAPI.Do failed to close multipart body: %s", err)
+		}
+		WithBodyReader(w.FormDataContentType(), &buf)(req)
+	}
+}
+
+// WithHeaders sets the given HTTP request headers, replacing any existing values. Setting Authorization
+// overrides CSAPI.AccessToken.
+func WithHeaders(headers map[string]string) RequestOpt {
+	return func(req *http.Request) {
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
 	}
 }
 
@@ -454,6 +601,13 @@ func WithQueries(q url.Values) RequestOpt {
 	}
 }
 
+// WithoutAccessToken removes the access token from the request, to test endpoints which require authentication.
+func WithoutAccessToken() RequestOpt {
+	return func(req *http.Request) {
+		req.Header.Del("Authorization")
+	}
+}
+
 // WithRetryUntil will retry the request until the provided function returns true. Times out after
 // `timeout`, which will then fail the test.
 func WithRetryUntil(timeout time.Duration, untilFn func(res *http.Response) bool) RequestOpt {
@@ -528,7 +682,15 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 			t.Logf("Request body: <binary:%s>", contentType)
 		}
 	}
+	// retried requests replay their body with GetBody, which is unset for bodies streamed by WithBodyReader
+	replayable := req.Body == nil || req.GetBody != nil
+	if retryUntil.timeout > 0 && !replayable {
+		t.Fatalf("CSAPI.DoFunc: %v %v cannot use WithRetryUntil as its body is streamed and cannot be replayed", method, req.URL)
+	}
+	// the access token is refreshed at most once per request
+	canRefresh := c.autoRefreshEnabled(req)
 	now := time.Now()
+	var rateLimitedFor time.Duration
 	for {
 		// Perform the HTTP request
 		res, err := c.Client.Do(req)
@@ -544,6 +706,23 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 			}
 			t.Logf("%s", string(dump))
 		}
+		if canRefresh && replayable && c.shouldRefresh(t, res) {
+			canRefresh = false
+			t.Logf("CSAPI.DoFunc: %v %v returned a soft logout, refreshing the access token and retrying", method, req.URL)
+			res.Body.Close()
+			c.MustRefresh(t)
+			req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+			mustRewindBody(t, req)
+			continue
+		}
+		if retryAfter, limited := c.RateLimit.shouldRetry(t, res, rateLimitedFor); limited && replayable {
+			rateLimitedFor += retryAfter
+			t.Logf("CSAPI.DoFunc: %v %v was rate limited, retrying after %v", method, req.URL, retryAfter)
+			res.Body.Close()
+			time.Sleep(retryAfter)
+			mustRewindBody(t, req)
+			continue
+		}
 		if retryUntil == nil || retryUntil.timeout == 0 {
 			return res // don't retry
 		}
@@ -569,7 +748,21 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 		t.Logf("CSAPI.DoFunc RetryUntil: %v %v response condition not yet met, retrying", method, req.URL)
 		// small sleep to avoid tight-looping
 		time.Sleep(100 * time.Millisecond)
+		mustRewindBody(t, req)
+	}
+}
+
+// mustRewindBody resets the body of a request which DoFunc is about to send again.
+func mustRewindBody(t *testing.T, req *http.Request) {
+	t.Helper()
+	if req.GetBody == nil {
+		return
 	}
+	body, err := req.GetBody()
+	if err != nil {
+		t.Fatalf("CSAPI.DoFunc failed to replay request body: %s", err)
+	}
+	req.Body = body
 }
 
 // NewLoggedClient returns an http.Client which logs requests/responses
@@ -655,6 +848,19 @@ func ParseJSON(t *testing.T, res *http.Response) []byte {
 	return body
 }
 
+// isUnrecognisedEndpoint returns true if the response indicates the server does not implement the endpoint, i.e
+// a 404 or 405 with no errcode or M_UNRECOGNIZED. The response body is left intact.
+func isUnrecognisedEndpoint(res *http.Response) bool {
+	if res.StatusCode != 404 && res.StatusCode != 405 {
+		return false
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	errcode := gjson.GetBytes(body, "errcode").Str
+	return errcode == "" || errcode == "M_UNRECOGNIZED"
+}
+
 // GjsonEscape escapes . and * from the input so it can be used with gjson.Get
 func GjsonEscape(in string) string {
 	in = strings.ReplaceAll(in, ".", `\.`)
@@ -675,6 +881,19 @@ func SyncTimelineHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt
 	}
 }
 
+// Check that the ephemeral section for `roomID` has an event which passes the check function.
+func SyncEphemeralHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(
+			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".ephemeral.events", check,
+		)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncEphemeralHas(%s): %s", roomID, err)
+	}
+}
+
 // Check that the timeline for `roomID` has an event which matches the event ID.
 func SyncTimelineHasEventID(roomID string, eventID string) SyncCheckOpt {
 	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
@@ -749,6 +968,80 @@ func SyncLeftFrom(userID, roomID string) SyncCheckOpt {
 	}
 }
 
+// Checks that `userID` knocks on `roomID`.
+//
+// Like SyncInvitedTo, this inspects the 'knock' block if the client is the user knocking, else the join timeline.
+func SyncKnockedOn(userID, roomID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		isKnock := func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == userID && ev.Get("content.membership").Str == "knock"
+		}
+		if clientUserID == userID {
+			// active
+			err := loopArray(topLevelSyncJSON, "rooms.knock."+GjsonEscape(roomID)+".knock_state.events", isKnock)
+			if err != nil {
+				return fmt.Errorf("SyncKnockedOn(%s): %s", roomID, err)
+			}
+			return nil
+		}
+		// passive
+		return SyncTimelineHas(roomID, isKnock)(clientUserID, topLevelSyncJSON)
+	}
+}
+
+// Check that `roomID` has a state event with the given type and state key which passes the check function,
+// either in the state block or as a state event in the timeline. `check` may be nil to only check existence.
+func SyncStateHas(roomID, eventType, stateKey string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		for _, key := range []string{"state.events", "timeline.events"} {
+			for _, ev := range room.Get(key).Array() {
+				if ev.Get("type").Str != eventType || !ev.Get("state_key").Exists() || ev.Get("state_key").Str != stateKey {
+					continue
+				}
+				if check == nil || check(ev) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("SyncStateHas(%s): no matching %s state event with state key %q", roomID, eventType, stateKey)
+	}
+}
+
+// Check that the unread notification count for `roomID` is as given, ignoring the highlight count. See
+// SyncUnreadNotificationCountsAre to check both.
+func SyncNotificationCountIs(roomID string, notificationCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		counts, err := unreadNotificationCounts(topLevelSyncJSON, roomID)
+		if err != nil {
+			return fmt.Errorf("SyncNotificationCountIs(%s): %w", roomID, err)
+		}
+		if got := counts.Get("notification_count").Int(); got != notificationCount {
+			return fmt.Errorf("SyncNotificationCountIs(%s): got %d, want %d", roomID, got, notificationCount)
+		}
+		return nil
+	}
+}
+
+// Check that the MSC2654 unread count for `roomID`, i.e the number of unread messages regardless of push rules,
+// is as given. Accepts the stable or unstable field name.
+func SyncUnreadCountIs(roomID string, unreadCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		got := room.Get("unread_count")
+		if !got.Exists() {
+			got = room.Get(GjsonEscape("org.matrix.msc2654.unread_count"))
+		}
+		if !got.Exists() {
+			return fmt.Errorf("SyncUnreadCountIs(%s): no unread_count for room", roomID)
+		}
+		if got.Int() != unreadCount {
+			return fmt.Errorf("SyncUnreadCountIs(%s): got %d, want %d", roomID, got.Int(), unreadCount)
+		}
+		return nil
+	}
+}
+
 // Calls the `check` function for each global account data event, and returns with success if the
 // `check` function returns true for at least one event.
 func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
@@ -757,6 +1050,53 @@ func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
 	}
 }
 
+// Calls the `check` function for each account data event for `roomID`, and returns with success if the
+// `check` function returns true for at least one event.
+func SyncRoomAccountDataHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		return loopArray(topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".account_data.events", check)
+	}
+}
+
+// SyncAll checks that a single /sync response passes all of the checks. Passing checks to MustSyncUntil
+// separately lets each one pass on a different response; use this when they must hold at the same time.
+func SyncAll(checks ...SyncCheckOpt) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, check := range checks {
+			if err := check(clientUserID, topLevelSyncJSON); err != nil {
+				return fmt.Errorf("SyncAll: %s", err)
+			}
+		}
+		return nil
+	}
+}
+
+// SyncAny checks that a /sync response passes at least one of the checks.
+func SyncAny(checks ...SyncCheckOpt) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		errs := make([]string, 0, len(checks))
+		for _, check := range checks {
+			err := check(clientUserID, topLevelSyncJSON)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("SyncAny: no check passed: [%s]", strings.Join(errs, "; "))
+	}
+}
+
+// SyncNot checks that a /sync response fails the check. As MustSyncUntil returns once every check passes, this
+// is most useful inside SyncAll, e.g to wait for a join without a particular event in the same response.
+func SyncNot(check SyncCheckOpt) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if check(clientUserID, topLevelSyncJSON) == nil {
+			return fmt.Errorf("SyncNot: check unexpectedly passed")
+		}
+		return nil
+	}
+}
+
 func loopArray(object gjson.Result, key string, check func(gjson.Result) bool) error {
 	array := object.Get(key)
 	if !array.Exists() {
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// EventContext is the response to /context.
+type EventContext struct {
+	Start        string
+	End          string
+	EventsBefore []gjson.Result // newest first
+	Event        gjson.Result
+	EventsAfter  []gjson.Result // oldest first
+	State        []gjson.Result
+}
+
+// EventContextCheck is a check over the response to /context.
+type EventContextCheck func(ec EventContext) error
+
+// GetEventContext returns up to `limit` events around `eventID`, and the state at the start of the window.
+// `filter` is a RoomEventFilter and may be nil. Set `lazy_load_members` in the filter to only get the members
+// who sent events in the window. Fails the test on error.
+func (c *CSAPI) GetEventContext(t *testing.T, roomID, eventID string, limit int, filter map[string]interface{}) EventContext {
+	t.Helper()
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if filter != nil {
+		filterJSON, err := json.Marshal(filter)
+		if err != nil {
+			t.Fatalf("GetEventContext: failed to marshal filter: %s", err)
+		}
+		query.Set("filter", string(filterJSON))
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "context", eventID}, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	return EventContext{
+		Start:        body.Get("start").Str,
+		End:          body.Get("end").Str,
+		EventsBefore: body.Get("events_before").Array(),
+		Event:        body.Get("event"),
+		EventsAfter:  body.Get("events_after").Array(),
+		State:        body.Get("state").Array(),
+	}
+}
+
+// MustMatch fails the test unless the context passes all of the checks.
+func (ec EventContext) MustMatch(t *testing.T, checks ...EventContextCheck) {
+	t.Helper()
+	for _, check := range checks {
+		if err := check(ec); err != nil {
+			t.Fatalf("EventContext.MustMatch: %s", err)
+		}
+	}
+}
+
+// ContextEventsBeforeAre checks that `events_before` has exactly these event IDs, newest first.
+func ContextEventsBeforeAre(eventIDs ...string) EventContextCheck {
+	return func(ec EventContext) error {
+		if err := eventIDsEqual(ec.EventsBefore, eventIDs); err != nil {
+			return fmt.Errorf("ContextEventsBeforeAre: %s", err)
+		}
+		return nil
+	}
+}
+
+// ContextEventsAfterAre checks that `events_after` has exactly these event IDs, oldest first.
+func ContextEventsAfterAre(eventIDs ...string) EventContextCheck {
+	return func(ec EventContext) error {
+		if err := eventIDsEqual(ec.EventsAfter, eventIDs); err != nil {
+			return fmt.Errorf("ContextEventsAfterAre: %s", err)
+		}
+		return nil
+	}
+}
+
+// ContextStateHasMembers checks that `state` has an m.room.member event for each of the users.
+func ContextStateHasMembers(userIDs ...string) EventContextCheck {
+	return func(ec EventContext) error {
+		members := contextStateMembers(ec)
+		for _, userID := range userIDs {
+			if !members[userID] {
+				return fmt.Errorf("ContextStateHasMembers: no m.room.member event for %s", userID)
+			}
+		}
+		return nil
+	}
+}
+
+// ContextStateMissingMembers checks that `state` has no m.room.member event for any of the users, e.g to check
+// lazy-loading omitted members who did not send events in the window.
+func ContextStateMissingMembers(userIDs ...string) EventContextCheck {
+	return func(ec EventContext) error {
+		members := contextStateMembers(ec)
+		for _, userID := range userIDs {
+			if members[userID] {
+				return fmt.Errorf("ContextStateMissingMembers: unexpected m.room.member event for %s", userID)
+			}
+		}
+		return nil
+	}
+}
+
+func contextStateMembers(ec EventContext) map[string]bool {
+	members := make(map[string]bool)
+	for _, ev := range ec.State {
+		if ev.Get("type").Str == "m.room.member" {
+			members[ev.Get("state_key").Str] = true
+		}
+	}
+	return members
+}
+
+func eventIDsEqual(events []gjson.Result, wantEventIDs []string) error {
+	gotEventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		gotEventIDs = append(gotEventIDs, ev.Get("event_id").Str)
+	}
+	if len(gotEventIDs) != len(wantEventIDs) {
+		return fmt.Errorf("got %v, want %v", gotEventIDs, wantEventIDs)
+	}
+	for i := range gotEventIDs {
+		if gotEventIDs[i] != wantEventIDs[i] {
+			return fmt.Errorf("got %v, want %v", gotEventIDs, wantEventIDs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// CrossSigningKey is a cross-signing public key in the format used by /keys/device_signing/upload and /keys/query.
+type CrossSigningKey struct {
+	UserID     string                       `json:"user_id"`
+	Usage      []string                     `json:"usage"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// CrossSigningKeyPair is a cross-signing key along with its private key.
+type CrossSigningKeyPair struct {
+	Key   CrossSigningKey
+	KeyID string // e.g "ed25519:<public key>"
+	Priv  ed25519.PrivateKey
+}
+
+// CrossSigningKeys is a full set of cross-signing keys for a user.
+type CrossSigningKeys struct {
+	Master      *CrossSigningKeyPair
+	SelfSigning *CrossSigningKeyPair
+	UserSigning *CrossSigningKeyPair
+}
+
+// MustGenerateCrossSigningKeys generates master, self-signing and user-signing keys for this user. The
+// self-signing and user-signing keys are signed by the master key. The keys are not uploaded: see
+// MustUploadCrossSigningKeys.
+func (c *CSAPI) MustGenerateCrossSigningKeys(t *testing.T) *CrossSigningKeys {
+	t.Helper()
+	keys := &CrossSigningKeys{
+		Master:      mustGenerateCrossSigningKey(t, c.UserID, "master"),
+		SelfSigning: mustGenerateCrossSigningKey(t, c.UserID, "self_signing"),
+		UserSigning: mustGenerateCrossSigningKey(t, c.UserID, "user_signing"),
+	}
+	var signed CrossSigningKey
+	if err := json.Unmarshal(keys.Master.MustSignJSON(t, keys.SelfSigning.Key), &signed); err != nil {
+		t.Fatalf("MustGenerateCrossSigningKeys: failed to unmarshal signed key: %s", err)
+	}
+	keys.SelfSigning.Key = signed
+	signed = CrossSigningKey{}
+	if err := json.Unmarshal(keys.Master.MustSignJSON(t, keys.UserSigning.Key), &signed); err != nil {
+		t.Fatalf("MustGenerateCrossSigningKeys: failed to unmarshal signed key: %s", err)
+	}
+	keys.UserSigning.Key = signed
+	return keys
+}
+
+func mustGenerateCrossSigningKey(t *testing.T, userID, usage string) *CrossSigningKeyPair {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("MustGenerateCrossSigningKeys: failed to generate ed25519 key: %s", err)
+	}
+	pubB64 := base64.RawStdEncoding.EncodeToString(pub)
+	keyID := "ed25519:" + pubB64
+	return &CrossSigningKeyPair{
+		Key: CrossSigningKey{
+			UserID: userID,
+			Usage:  []string{usage},
+			Keys:   map[string]string{keyID: pubB64},
+		},
+		KeyID: keyID,
+		Priv:  priv,
+	}
+}
+
+// PublicKey returns the unpadded base64 public key.
+func (kp *CrossSigningKeyPair) PublicKey() string {
+	return kp.Key.Keys[kp.KeyID]
+}
+
+// MustSignJSON signs `obj` with this key, ignoring any `unsigned` section. Existing signatures are kept.
+// Returns the signed JSON.
+func (kp *CrossSigningKeyPair) MustSignJSON(t *testing.T, obj interface{}) []byte {
+	t.Helper()
+	toSign, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("CrossSigningKeyPair.MustSignJSON: failed to marshal JSON: %s", err)
+	}
+	signed, err := gomatrixserverlib.SignJSON(kp.Key.UserID, gomatrixserverlib.KeyID(kp.KeyID), kp.Priv, toSign)
+	if err != nil {
+		t.Fatalf("CrossSigningKeyPair.MustSignJSON: failed to sign JSON: %s", err)
+	}
+	return signed
+}
+
+// MustUploadCrossSigningKeys uploads the cross-signing keys via /keys/device_signing/upload. If the server
+// requires user-interactive auth, `password` is used to complete it.
+func (c *CSAPI) MustUploadCrossSigningKeys(t *testing.T, keys *CrossSigningKeys, password string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"master_key":       keys.Master.Key,
+		"self_signing_key": keys.SelfSigning.Key,
+		"user_signing_key": keys.UserSigning.Key,
+	}
+	c.MustDoWithPasswordUIA(t, "POST", []string{"_matrix", "client", "v3", "keys", "device_signing", "upload"}, reqBody, password)
+}
+
+// MustQueryKeys calls /keys/query for all devices of the given users and returns the response.
+func (c *CSAPI) MustQueryKeys(t *testing.T, userIDs ...string) gjson.Result {
+	t.Helper()
+	deviceKeys := make(map[string][]string)
+	for _, userID := range userIDs {
+		deviceKeys[userID] = []string{}
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys": deviceKeys,
+	}))
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// MustSignDevice signs the device keys of one of this user's devices with the self-signing key and uploads
+// the signature.
+func (c *CSAPI) MustSignDevice(t *testing.T, keys *CrossSigningKeys, deviceID string) {
+	t.Helper()
+	deviceKeys := c.MustQueryKeys(t, c.UserID).Get("device_keys." + GjsonEscape(c.UserID) + "." + GjsonEscape(deviceID))
+	if !deviceKeys.Exists() {
+		t.Fatalf("MustSignDevice: no device keys for device %s", deviceID)
+	}
+	c.mustUploadSignature(t, c.UserID, deviceID, keys.SelfSigning, deviceKeys)
+}
+
+// MustSignUser signs the master key of `userID` with the user-signing key and uploads the signature.
+func (c *CSAPI) MustSignUser(t *testing.T, keys *CrossSigningKeys, userID string) {
+	t.Helper()
+	masterKey := c.MustQueryKeys(t, userID).Get("master_keys." + GjsonEscape(userID))
+	if !masterKey.Exists() {
+		t.Fatalf("MustSignUser: no master key for %s", userID)
+	}
+	var masterKeyID string
+	masterKey.Get("keys").ForEach(func(k, _ gjson.Result) bool {
+		masterKeyID = k.Str
+		return false
+	})
+	// the key ID is "ed25519:<public key>", and signatures are uploaded against the public key
+	c.mustUploadSignature(t, userID, masterKeyID[len("ed25519:"):], keys.UserSigning, masterKey)
+}
+
+func (c *CSAPI) mustUploadSignature(t *testing.T, userID, keyID string, signer *CrossSigningKeyPair, obj gjson.Result) {
+	t.Helper()
+	var toSign map[string]interface{}
+	if err := json.Unmarshal([]byte(obj.Raw), &toSign); err != nil {
+		t.Fatalf("mustUploadSignature: failed to unmarshal key: %s", err)
+	}
+	delete(toSign, "unsigned")
+	signed := signer.MustSignJSON(t, toSign)
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "signatures", "upload"}, WithJSONBody(t, map[string]interface{}{
+		userID: map[string]json.RawMessage{
+			keyID: signed,
+		},
+	}))
+	body := ParseJSON(t, res)
+	if failures := gjson.GetBytes(body, "failures"); len(failures.Map()) > 0 {
+		t.Fatalf("mustUploadSignature: signature upload failed: %s", failures.Raw)
+	}
+}
+
+// MustSeeDeviceSignature fails the test unless /keys/query shows that the given device of `userID` is signed
+// by `signerUserID` with `signerKeyID`.
+func (c *CSAPI) MustSeeDeviceSignature(t *testing.T, userID, deviceID, signerUserID, signerKeyID string) {
+	t.Helper()
+	res := c.MustQueryKeys(t, userID)
+	path := "device_keys." + GjsonEscape(userID) + "." + GjsonEscape(deviceID) + ".signatures." + GjsonEscape(signerUserID) + "." + GjsonEscape(signerKeyID)
+	if !res.Get(path).Exists() {
+		t.Fatalf("MustSeeDeviceSignature: device %s of %s is not signed by %s %s: %s", deviceID, userID, signerUserID, signerKeyID, res.Raw)
+	}
+}
+
+// MustSeeMasterKeySignature fails the test unless /keys/query shows that the master key of `userID` is signed
+// by `signerUserID` with `signerKeyID`.
+func (c *CSAPI) MustSeeMasterKeySignature(t *testing.T, userID, signerUserID, signerKeyID string) {
+	t.Helper()
+	res := c.MustQueryKeys(t, userID)
+	path := "master_keys." + GjsonEscape(userID) + ".signatures." + GjsonEscape(signerUserID) + "." + GjsonEscape(signerKeyID)
+	if !res.Get(path).Exists() {
+		t.Fatalf("MustSeeMasterKeySignature: master key of %s is not signed by %s %s: %s", userID, signerUserID, signerKeyID, res.Raw)
+	}
+}
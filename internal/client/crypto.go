@@ -0,0 +1,404 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	OlmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	MegolmAlgorithm = "m.megolm.v1.aes-sha2"
+)
+
+// Crypto is a minimal end-to-end encryption implementation for a CSAPI client. It owns an Olm account for the
+// client's device, and remembers the Olm and Megolm sessions it has made so tests can send and receive encrypted
+// events. It is not safe for concurrent use, and nothing is verified beyond what is needed to decrypt.
+type Crypto struct {
+	client  *CSAPI
+	account *olm.Account
+	// Olm sessions keyed off the other device's curve25519 key, most recently created last.
+	olmSessions map[id.Curve25519][]*olm.Session
+	// Outbound Megolm sessions keyed off room ID.
+	outboundGroupSessions map[string]*olm.OutboundGroupSession
+	// Inbound Megolm sessions keyed off session ID.
+	inboundGroupSessions map[id.SessionID]*olm.InboundGroupSession
+	// The identity keys of other devices, keyed off user ID then device ID.
+	deviceKeys map[string]map[string]deviceIdentity
+}
+
+type deviceIdentity struct {
+	curve25519 id.Curve25519
+	ed25519    id.Ed25519
+}
+
+// NewCrypto creates a new Olm account for the device of `c`. Call MustUploadKeys to publish its keys.
+func NewCrypto(c *CSAPI) *Crypto {
+	return &Crypto{
+		client:                c,
+		account:               olm.NewAccount(),
+		olmSessions:           make(map[id.Curve25519][]*olm.Session),
+		outboundGroupSessions: make(map[string]*olm.OutboundGroupSession),
+		inboundGroupSessions:  make(map[id.SessionID]*olm.InboundGroupSession),
+		deviceKeys:            make(map[string]map[string]deviceIdentity),
+	}
+}
+
+// MustRestoreCrypto restores the Olm account of the device of `c` from `pickle`, e.g one created when a
+// blueprint was run, so that a test can use a device whose keys are already uploaded. The account was pickled
+// with `pickleKey`. Sessions are not restored.
+func MustRestoreCrypto(t *testing.T, c *CSAPI, pickle, pickleKey string) *Crypto {
+	t.Helper()
+	account, err := olm.AccountFromPickled([]byte(pickle), []byte(pickleKey))
+	if err != nil {
+		t.Fatalf("MustRestoreCrypto: failed to unpickle Olm account for %s: %s", c.UserID, err)
+	}
+	cr := NewCrypto(c)
+	cr.account = account
+	return cr
+}
+
+// IdentityKeys returns the ed25519 and curve25519 keys of this device.
+func (cr *Crypto) IdentityKeys() (id.Ed25519, id.Curve25519) {
+	return cr.account.IdentityKeys()
+}
+
+// DeviceKeys returns the signed device keys of this device, as uploaded to /keys/upload.
+func (cr *Crypto) DeviceKeys(t *testing.T) map[string]interface{} {
+	t.Helper()
+	ed25519Key, curveKey := cr.account.IdentityKeys()
+	deviceKeys := map[string]interface{}{
+		"user_id":    cr.client.UserID,
+		"device_id":  cr.client.DeviceID,
+		"algorithms": []string{OlmAlgorithm, MegolmAlgorithm},
+		"keys": map[string]string{
+			"ed25519:" + cr.client.DeviceID:    ed25519Key.String(),
+			"curve25519:" + cr.client.DeviceID: curveKey.String(),
+		},
+	}
+	deviceKeys["signatures"] = cr.mustSign(t, deviceKeys)
+	return deviceKeys
+}
+
+// MustUploadKeys uploads the device keys of this device along with `otkCount` new signed one-time keys.
+func (cr *Crypto) MustUploadKeys(t *testing.T, otkCount uint) {
+	t.Helper()
+	cr.client.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys":   cr.DeviceKeys(t),
+		"one_time_keys": cr.mustGenerateOneTimeKeys(t, otkCount),
+	}))
+	cr.account.MarkKeysAsPublished()
+}
+
+// mustGenerateOneTimeKeys generates `otkCount` new one-time keys, returning them signed in the form uploaded to
+// /keys/upload. The caller must mark them as published once uploaded.
+func (cr *Crypto) mustGenerateOneTimeKeys(t *testing.T, otkCount uint) map[string]interface{} {
+	t.Helper()
+	cr.account.GenOneTimeKeys(otkCount)
+	oneTimeKeys := make(map[string]interface{})
+	for keyID, key := range cr.account.OneTimeKeys() {
+		keyMap := map[string]interface{}{
+			"key": key.String(),
+		}
+		keyMap["signatures"] = cr.mustSign(t, keyMap)
+		oneTimeKeys["signed_curve25519:"+keyID] = keyMap
+	}
+	return oneTimeKeys
+}
+
+func (cr *Crypto) mustSign(t *testing.T, obj interface{}) map[string]map[string]string {
+	t.Helper()
+	signature, err := cr.account.SignJSON(obj)
+	if err != nil {
+		t.Fatalf("Crypto: failed to sign JSON: %s", err)
+	}
+	return map[string]map[string]string{
+		cr.client.UserID: {
+			"ed25519:" + cr.client.DeviceID: signature,
+		},
+	}
+}
+
+// mustQueryDevice returns the identity keys of the given device, querying /keys/query if they are not yet known.
+func (cr *Crypto) mustQueryDevice(t *testing.T, userID, deviceID string) deviceIdentity {
+	t.Helper()
+	if identity, ok := cr.deviceKeys[userID][deviceID]; ok {
+		return identity
+	}
+	res := cr.client.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys": map[string][]string{
+			userID: {deviceID},
+		},
+	}))
+	body := ParseJSON(t, res)
+	keys := gjson.GetBytes(body, "device_keys."+GjsonEscape(userID)+"."+GjsonEscape(deviceID)+".keys")
+	identity := deviceIdentity{
+		curve25519: id.Curve25519(keys.Get(GjsonEscape("curve25519:" + deviceID)).Str),
+		ed25519:    id.Ed25519(keys.Get(GjsonEscape("ed25519:" + deviceID)).Str),
+	}
+	if identity.curve25519 == "" || identity.ed25519 == "" {
+		t.Fatalf("Crypto: /keys/query returned no identity keys for %s %s: %s", userID, deviceID, string(body))
+	}
+	if cr.deviceKeys[userID] == nil {
+		cr.deviceKeys[userID] = make(map[string]deviceIdentity)
+	}
+	cr.deviceKeys[userID][deviceID] = identity
+	return identity
+}
+
+// MustEstablishOlmSession claims a one-time key for the given device and creates an outbound Olm session with it,
+// replacing any existing session. Sessions are created automatically when needed, so this is only required when
+// testing /keys/claim or when a fresh session is wanted.
+func (cr *Crypto) MustEstablishOlmSession(t *testing.T, userID, deviceID string) {
+	t.Helper()
+	identity := cr.mustQueryDevice(t, userID, deviceID)
+	res := cr.client.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "keys", "claim"}, WithJSONBody(t, map[string]interface{}{
+		"one_time_keys": map[string]map[string]string{
+			userID: {
+				deviceID: "signed_curve25519",
+			},
+		},
+	}))
+	body := ParseJSON(t, res)
+	var otk string
+	gjson.GetBytes(body, "one_time_keys."+GjsonEscape(userID)+"."+GjsonEscape(deviceID)).ForEach(func(_, v gjson.Result) bool {
+		otk = v.Get("key").Str
+		return false
+	})
+	if otk == "" {
+		t.Fatalf("Crypto.MustEstablishOlmSession: /keys/claim returned no one-time key for %s %s: %s", userID, deviceID, string(body))
+	}
+	session, err := cr.account.NewOutboundSession(identity.curve25519, id.Curve25519(otk))
+	if err != nil {
+		t.Fatalf("Crypto.MustEstablishOlmSession: failed to create outbound session: %s", err)
+	}
+	cr.olmSessions[identity.curve25519] = append(cr.olmSessions[identity.curve25519], session)
+}
+
+// MustEncryptOlm returns the content of an m.room.encrypted to-device event which contains the given event for the
+// given device. An Olm session is established first if there is not already one.
+func (cr *Crypto) MustEncryptOlm(t *testing.T, userID, deviceID, evType string, content map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	identity := cr.mustQueryDevice(t, userID, deviceID)
+	if len(cr.olmSessions[identity.curve25519]) == 0 {
+		cr.MustEstablishOlmSession(t, userID, deviceID)
+	}
+	sessions := cr.olmSessions[identity.curve25519]
+	session := sessions[len(sessions)-1]
+	ourEd25519, ourCurve25519 := cr.account.IdentityKeys()
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":           evType,
+		"content":        content,
+		"sender":         cr.client.UserID,
+		"sender_device":  cr.client.DeviceID,
+		"recipient":      userID,
+		"recipient_keys": map[string]string{"ed25519": identity.ed25519.String()},
+		"keys":           map[string]string{"ed25519": ourEd25519.String()},
+	})
+	if err != nil {
+		t.Fatalf("Crypto.MustEncryptOlm: failed to marshal plaintext: %s", err)
+	}
+	msgType, ciphertext := session.Encrypt(plaintext)
+	return map[string]interface{}{
+		"algorithm":  OlmAlgorithm,
+		"sender_key": ourCurve25519.String(),
+		"ciphertext": map[string]interface{}{
+			identity.curve25519.String(): map[string]interface{}{
+				"type": msgType,
+				"body": string(ciphertext),
+			},
+		},
+	}
+}
+
+// MustSendEncryptedToDevice Olm-encrypts the given event and sends it to the given device.
+func (cr *Crypto) MustSendEncryptedToDevice(t *testing.T, userID, deviceID, evType string, content map[string]interface{}) {
+	t.Helper()
+	encrypted := cr.MustEncryptOlm(t, userID, deviceID, evType, content)
+	cr.client.txnID++
+	cr.client.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "sendToDevice", "m.room.encrypted", strconv.Itoa(cr.client.txnID)}, WithJSONBody(t, map[string]interface{}{
+		"messages": map[string]interface{}{
+			userID: map[string]interface{}{
+				deviceID: encrypted,
+			},
+		},
+	}))
+}
+
+// MustDecryptOlm decrypts an m.room.encrypted to-device event sent to this device, creating an inbound Olm session
+// if it is a pre-key message. If the decrypted event is an m.room_key, the Megolm session is stored so room events
+// can be decrypted with MustDecryptEvent. Returns the decrypted event.
+func (cr *Crypto) MustDecryptOlm(t *testing.T, ev gjson.Result) gjson.Result {
+	t.Helper()
+	if alg := ev.Get("content.algorithm").Str; alg != OlmAlgorithm {
+		t.Fatalf("Crypto.MustDecryptOlm: unsupported algorithm %q", alg)
+	}
+	_, ourCurve25519 := cr.account.IdentityKeys()
+	senderKey := id.Curve25519(ev.Get("content.sender_key").Str)
+	ciphertext := ev.Get("content.ciphertext." + GjsonEscape(ourCurve25519.String()))
+	if !ciphertext.Exists() {
+		t.Fatalf("Crypto.MustDecryptOlm: event has no ciphertext for this device: %s", ev.Raw)
+	}
+	msgType := id.OlmMsgType(ciphertext.Get("type").Int())
+	body := ciphertext.Get("body").Str
+
+	var plaintext []byte
+	for _, session := range cr.olmSessions[senderKey] {
+		if msgType == id.OlmMsgTypePreKey {
+			if matches, err := session.MatchesInboundSessionFrom(senderKey.String(), body); err != nil || !matches {
+				continue
+			}
+		}
+		if decrypted, err := session.Decrypt(body, msgType); err == nil {
+			plaintext = decrypted
+			break
+		}
+	}
+	if plaintext == nil {
+		if msgType != id.OlmMsgTypePreKey {
+			t.Fatalf("Crypto.MustDecryptOlm: no Olm session with %s can decrypt the message", senderKey)
+		}
+		session, err := cr.account.NewInboundSessionFrom(senderKey, body)
+		if err != nil {
+			t.Fatalf("Crypto.MustDecryptOlm: failed to create inbound session: %s", err)
+		}
+		if err = cr.account.RemoveOneTimeKeys(session); err != nil {
+			t.Fatalf("Crypto.MustDecryptOlm: failed to remove used one-time key: %s", err)
+		}
+		plaintext, err = session.Decrypt(body, msgType)
+		if err != nil {
+			t.Fatalf("Crypto.MustDecryptOlm: failed to decrypt pre-key message: %s", err)
+		}
+		cr.olmSessions[senderKey] = append(cr.olmSessions[senderKey], session)
+	}
+
+	decrypted := gjson.ParseBytes(plaintext)
+	if decrypted.Get("type").Str == "m.room_key" && decrypted.Get("content.algorithm").Str == MegolmAlgorithm {
+		session, err := olm.NewInboundGroupSession([]byte(decrypted.Get("content.session_key").Str))
+		if err != nil {
+			t.Fatalf("Crypto.MustDecryptOlm: failed to create inbound group session from m.room_key: %s", err)
+		}
+		cr.inboundGroupSessions[session.ID()] = session
+	}
+	return decrypted
+}
+
+// MustDecryptToDeviceEvents decrypts every m.room.encrypted event in the to_device section of the /sync response,
+// in order. Returns the decrypted events.
+func (cr *Crypto) MustDecryptToDeviceEvents(t *testing.T, topLevelSyncJSON gjson.Result) []gjson.Result {
+	t.Helper()
+	var decrypted []gjson.Result
+	for _, ev := range topLevelSyncJSON.Get("to_device.events").Array() {
+		if ev.Get("type").Str == "m.room.encrypted" {
+			decrypted = append(decrypted, cr.MustDecryptOlm(t, ev))
+		}
+	}
+	return decrypted
+}
+
+// MustShareRoomKey sends the key for this device's current Megolm session in `roomID` to each of the given
+// devices, keyed off user ID. A new Megolm session is created if there is not already one for the room.
+func (cr *Crypto) MustShareRoomKey(t *testing.T, roomID string, devices map[string][]string) {
+	t.Helper()
+	session := cr.outboundGroupSession(roomID)
+	for userID, deviceIDs := range devices {
+		for _, deviceID := range deviceIDs {
+			cr.MustSendEncryptedToDevice(t, userID, deviceID, "m.room_key", map[string]interface{}{
+				"algorithm":   MegolmAlgorithm,
+				"room_id":     roomID,
+				"session_id":  session.ID().String(),
+				"session_key": session.Key(),
+			})
+		}
+	}
+}
+
+// RotateRoomKey discards the outbound Megolm session for `roomID`, so the next encrypted event uses a new session.
+func (cr *Crypto) RotateRoomKey(roomID string) {
+	delete(cr.outboundGroupSessions, roomID)
+}
+
+// outboundGroupSession returns the outbound Megolm session for the room, creating one if needed. Our own inbound
+// copy is stored too, so we can decrypt our own events.
+func (cr *Crypto) outboundGroupSession(roomID string) *olm.OutboundGroupSession {
+	session, ok := cr.outboundGroupSessions[roomID]
+	if ok {
+		return session
+	}
+	session = olm.NewOutboundGroupSession()
+	cr.outboundGroupSessions[roomID] = session
+	if inbound, err := olm.NewInboundGroupSession([]byte(session.Key())); err == nil {
+		cr.inboundGroupSessions[inbound.ID()] = inbound
+	}
+	return session
+}
+
+// MustEncryptEvent returns the content of an m.room.encrypted event which contains the given event, encrypted
+// with the current Megolm session for the room. Use MustShareRoomKey to let other devices decrypt it.
+func (cr *Crypto) MustEncryptEvent(t *testing.T, roomID, evType string, content map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	session := cr.outboundGroupSession(roomID)
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":    evType,
+		"content": content,
+		"room_id": roomID,
+	})
+	if err != nil {
+		t.Fatalf("Crypto.MustEncryptEvent: failed to marshal plaintext: %s", err)
+	}
+	_, ourCurve25519 := cr.account.IdentityKeys()
+	return map[string]interface{}{
+		"algorithm":  MegolmAlgorithm,
+		"sender_key": ourCurve25519.String(),
+		"device_id":  cr.client.DeviceID,
+		"session_id": session.ID().String(),
+		"ciphertext": string(session.Encrypt(plaintext)),
+	}
+}
+
+// MustSendEncryptedEvent Megolm-encrypts the given event and sends it into the room. Returns the event ID.
+func (cr *Crypto) MustSendEncryptedEvent(t *testing.T, roomID, evType string, content map[string]interface{}) string {
+	t.Helper()
+	encrypted := cr.MustEncryptEvent(t, roomID, evType, content)
+	cr.client.txnID++
+	res := cr.client.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.encrypted", strconv.Itoa(cr.client.txnID)}, WithJSONBody(t, encrypted))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "event_id")
+}
+
+// MustDecryptEvent decrypts an m.room.encrypted room event using a Megolm session received via m.room_key.
+// Returns the decrypted event, which has `type`, `content` and `room_id` keys.
+func (cr *Crypto) MustDecryptEvent(t *testing.T, ev gjson.Result) gjson.Result {
+	t.Helper()
+	decrypted, err := cr.DecryptEvent(ev)
+	if err != nil {
+		t.Fatalf("Crypto.MustDecryptEvent: %s", err)
+	}
+	return decrypted
+}
+
+// DecryptEvent is like MustDecryptEvent but returns an error rather than failing the test, e.g for use in
+// SyncCheckOpts where the room key may not have arrived yet.
+func (cr *Crypto) DecryptEvent(ev gjson.Result) (gjson.Result, error) {
+	if alg := ev.Get("content.algorithm").Str; alg != MegolmAlgorithm {
+		return gjson.Result{}, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	sessionID := id.SessionID(ev.Get("content.session_id").Str)
+	session, ok := cr.inboundGroupSessions[sessionID]
+	if !ok {
+		return gjson.Result{}, fmt.Errorf("unknown Megolm session %s", sessionID)
+	}
+	plaintext, _, err := session.Decrypt([]byte(ev.Get("content.ciphertext").Str))
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to decrypt event %s: %s", ev.Get("event_id").Str, err)
+	}
+	decrypted := gjson.ParseBytes(plaintext)
+	if roomID := ev.Get("room_id").Str; roomID != "" && decrypted.Get("room_id").Str != roomID {
+		return gjson.Result{}, fmt.Errorf("decrypted event is for room %s, not %s", decrypted.Get("room_id").Str, roomID)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// DeactivateAccount deactivates the account this client is logged in as, completing user-interactive auth with
+// `password`. If `erase` is true, the homeserver is asked to forget the user's messages (GDPR erasure). The
+// client's access token is invalidated by this call. Fails the test on error.
+func (c *CSAPI) DeactivateAccount(t *testing.T, password string, erase bool) {
+	t.Helper()
+	c.MustDoWithPasswordUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "deactivate"}, map[string]interface{}{
+		"erase": erase,
+	}, password)
+}
+
+// DoPasswordLogin attempts to log in as `userID` with `password` and returns the response. The client's own
+// credentials are neither used nor modified.
+func (c *CSAPI) DoPasswordLogin(t *testing.T, userID, password string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": userID,
+		},
+		"password": password,
+	}), WithoutAccessToken())
+}
+
+// MustFailLogin asserts that logging in as `userID` with `password` is rejected, as it should be once the
+// account has been deactivated.
+func (c *CSAPI) MustFailLogin(t *testing.T, userID, password string) {
+	t.Helper()
+	res := c.DoPasswordLogin(t, userID, password)
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 403,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+		},
+	})
+}
+
+// MustSyncUntilUserLeftRooms syncs until `userID` is seen to have left each of `roomIDs`, as happens when the
+// account is deactivated. The client must be joined to the rooms.
+func (c *CSAPI) MustSyncUntilUserLeftRooms(t *testing.T, since, userID string, roomIDs ...string) string {
+	t.Helper()
+	checks := make([]SyncCheckOpt, len(roomIDs))
+	for i, roomID := range roomIDs {
+		checks[i] = SyncLeftFrom(userID, roomID)
+	}
+	return c.MustSyncUntil(t, SyncReq{Since: since}, checks...)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// DehydratedDeviceAlgorithm is the device_data algorithm used by UploadDehydratedDevice when none is given.
+const DehydratedDeviceAlgorithm = "org.matrix.msc3814.v1.olm"
+
+// dehydratedDevicePath returns the path to the MSC3814 dehydrated device endpoint, with `extra` appended.
+func dehydratedDevicePath(extra ...string) []string {
+	return append([]string{"_matrix", "client", "unstable", "org.matrix.msc3814.v1", "dehydrated_device"}, extra...)
+}
+
+// UploadDehydratedDevice creates a dehydrated device for this user (MSC3814) with the given device ID, uploading
+// its identity keys and `otkCount` one-time keys so other devices can send it to-device messages while the user
+// has no devices online. `deviceData` is stored opaquely by the server, and defaults to an object with just the
+// algorithm. Real clients store the pickled account there, encrypted; tests instead keep the returned Crypto to
+// rehydrate with. Fails the test on error.
+func (c *CSAPI) UploadDehydratedDevice(t *testing.T, deviceID string, deviceData map[string]interface{}, otkCount uint) *Crypto {
+	t.Helper()
+	if deviceData == nil {
+		deviceData = map[string]interface{}{
+			"algorithm": DehydratedDeviceAlgorithm,
+		}
+	}
+	// the dehydrated device shares the user's access token, but signs its keys with its own device ID. It gets a
+	// fresh client rather than a copy of this one, so the two never share transaction IDs or other state.
+	device := &CSAPI{
+		UserID:      c.UserID,
+		AccessToken: c.AccessToken,
+		DeviceID:    deviceID,
+		BaseURL:     c.BaseURL,
+		Client:      c.Client,
+	}
+	cr := NewCrypto(device)
+	res := c.MustDoFunc(t, "PUT", dehydratedDevicePath(), WithJSONBody(t, map[string]interface{}{
+		"device_id":                   deviceID,
+		"device_data":                 deviceData,
+		"initial_device_display_name": "Dehydrated device",
+		"device_keys":                 cr.DeviceKeys(t),
+		"one_time_keys":               cr.mustGenerateOneTimeKeys(t, otkCount),
+	}))
+	cr.account.MarkKeysAsPublished()
+	if got := GetJSONFieldStr(t, ParseJSON(t, res), "device_id"); got != deviceID {
+		t.Fatalf("UploadDehydratedDevice: server returned device ID %s, want %s", got, deviceID)
+	}
+	return cr
+}
+
+// GetDehydratedDevice returns the ID and device_data of this user's dehydrated device, or false if there is none.
+// Fails the test on any other error.
+func (c *CSAPI) GetDehydratedDevice(t *testing.T) (deviceID string, deviceData gjson.Result, ok bool) {
+	t.Helper()
+	res := c.DoFunc(t, "GET", dehydratedDevicePath())
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return "", gjson.Result{}, false
+	}
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("GetDehydratedDevice: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return GetJSONFieldStr(t, body, "device_id"), gjson.GetBytes(body, "device_data"), true
+}
+
+// DeleteDehydratedDevice deletes this user's dehydrated device. Fails the test on error.
+func (c *CSAPI) DeleteDehydratedDevice(t *testing.T) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", dehydratedDevicePath())
+}
+
+// GetDehydratedDeviceEvents returns a page of the to-device events queued for the dehydrated device, starting
+// from `nextBatch` which is empty for the first page. Returns the events and the token for the next page. Fails
+// the test on error.
+func (c *CSAPI) GetDehydratedDeviceEvents(t *testing.T, deviceID, nextBatch string) ([]gjson.Result, string) {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if nextBatch != "" {
+		reqBody["next_batch"] = nextBatch
+	}
+	res := c.MustDoFunc(t, "POST", dehydratedDevicePath(deviceID, "events"), WithJSONBody(t, reqBody))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	return body.Get("events").Array(), body.Get("next_batch").Str
+}
+
+// MustRehydrateDevice fetches every to-device event queued for the dehydrated device of `cr`, as returned by
+// UploadDehydratedDevice, and decrypts the encrypted ones. Each check must match at least one decrypted event,
+// to assert that messages sent while the user was offline are redelivered. Returns the decrypted events.
+func (c *CSAPI) MustRehydrateDevice(t *testing.T, cr *Crypto, checks ...func(gjson.Result) bool) []gjson.Result {
+	t.Helper()
+	deviceID := cr.client.DeviceID
+	var decrypted []gjson.Result
+	nextBatch := ""
+	for {
+		events, next := c.GetDehydratedDeviceEvents(t, deviceID, nextBatch)
+		if len(events) == 0 {
+			break
+		}
+		for _, ev := range events {
+			if ev.Get("type").Str == "m.room.encrypted" {
+				decrypted = append(decrypted, cr.MustDecryptOlm(t, ev))
+			}
+		}
+		if next == "" || next == nextBatch {
+			break
+		}
+		nextBatch = next
+	}
+	for i, check := range checks {
+		matched := false
+		for _, ev := range decrypted {
+			if check(ev) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			t.Fatalf("MustRehydrateDevice(%s): check %d matched none of the %d decrypted events", deviceID, i, len(decrypted))
+		}
+	}
+	return decrypted
+}
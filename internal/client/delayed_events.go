@@ -0,0 +1,103 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Actions for UpdateDelayedEvent.
+const (
+	DelayedEventRestart = "restart"
+	DelayedEventCancel  = "cancel"
+	DelayedEventSend    = "send"
+)
+
+// DelayedEvent is a delayed event which has been scheduled but not yet sent.
+type DelayedEvent struct {
+	DelayID string
+	// When the event was scheduled. The homeserver should not send it before ScheduledAt + Delay.
+	ScheduledAt time.Time
+	Delay       time.Duration
+}
+
+// ScheduleDelayedEvent schedules `e` to be sent into the room after `delay` (MSC4140), unless it is cancelled or
+// restarted first. State events are supported by setting StateKey. Fails the test on error.
+func (c *CSAPI) ScheduleDelayedEvent(t *testing.T, roomID string, e b.Event, delay time.Duration) DelayedEvent {
+	t.Helper()
+	scheduledAt := time.Now()
+	res := c.DoScheduleDelayedEvent(t, roomID, e, delay)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("ScheduleDelayedEvent: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return DelayedEvent{
+		DelayID:     GetJSONFieldStr(t, body, "delay_id"),
+		ScheduledAt: scheduledAt,
+		Delay:       delay,
+	}
+}
+
+// DoScheduleDelayedEvent is the same as ScheduleDelayedEvent but returns the response, for testing requests
+// which should fail, e.g a delay above the server's maximum.
+func (c *CSAPI) DoScheduleDelayedEvent(t *testing.T, roomID string, e b.Event, delay time.Duration) *http.Response {
+	t.Helper()
+	c.txnID++
+	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
+	if e.StateKey != nil {
+		paths = []string{"_matrix", "client", "v3", "rooms", roomID, "state", e.Type, *e.StateKey}
+	}
+	return c.DoFunc(t, "PUT", paths, WithJSONBody(t, e.Content), WithQueries(map[string][]string{
+		"org.matrix.msc4140.delay": {strconv.FormatInt(delay.Milliseconds(), 10)},
+	}))
+}
+
+// UpdateDelayedEvent restarts, cancels or immediately sends a delayed event. `action` is one of the DelayedEvent
+// action constants. Restarting resets the ScheduledAt time of `de`. Fails the test on error.
+func (c *CSAPI) UpdateDelayedEvent(t *testing.T, de *DelayedEvent, action string) {
+	t.Helper()
+	now := time.Now()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc4140", "delayed_events", de.DelayID}, WithJSONBody(t, map[string]interface{}{
+		"action": action,
+	}))
+	if action == DelayedEventRestart {
+		de.ScheduledAt = now
+	}
+}
+
+// GetDelayedEvents returns this user's delayed events which have not been sent yet. Fails the test on error.
+func (c *CSAPI) GetDelayedEvents(t *testing.T) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc4140", "delayed_events"})
+	return gjson.ParseBytes(ParseJSON(t, res)).Get("delayed_events").Array()
+}
+
+// MustSyncUntilDelayedEventSent syncs until an event passing `check` arrives in the room's timeline, and asserts
+// that it was not sent before the delay of `de` had passed, so should not be used after DelayedEventSend. The
+// sync timeout is extended by the delay. Returns the event.
+func (c *CSAPI) MustSyncUntilDelayedEventSent(t *testing.T, since, roomID string, de DelayedEvent, check func(gjson.Result) bool) gjson.Result {
+	t.Helper()
+	var sent gjson.Result
+	waiter := *c
+	waiter.SyncUntilTimeout = c.SyncUntilTimeout + time.Until(de.ScheduledAt.Add(de.Delay))
+	waiter.MustSyncUntil(t, SyncReq{Since: since}, SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		if !check(ev) {
+			return false
+		}
+		sent = ev
+		return true
+	}))
+	// allow for clock skew between the test runner and the homeserver container
+	const skew = 100 * time.Millisecond
+	earliest := de.ScheduledAt.Add(de.Delay).Add(-skew)
+	sentAt := time.Unix(0, sent.Get("origin_server_ts").Int()*int64(time.Millisecond))
+	if sentAt.Before(earliest) {
+		t.Fatalf("MustSyncUntilDelayedEventSent: event %s was sent at %v, before its delay of %v had passed at %v", sent.Get("event_id").Str, sentAt, de.Delay, earliest)
+	}
+	return sent
+}
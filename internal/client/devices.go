@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Device is a device as returned by /devices.
+type Device struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenIP  string `json:"last_seen_ip"`
+	LastSeenTS  int64  `json:"last_seen_ts"`
+}
+
+// ListDevices returns all devices of this user. Fails the test on error.
+func (c *CSAPI) ListDevices(t *testing.T) []Device {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "devices"})
+	body := ParseJSON(t, res)
+	var devices struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := json.Unmarshal(body, &devices); err != nil {
+		t.Fatalf("ListDevices: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return devices.Devices
+}
+
+// GetDevice returns a device of this user. Fails the test on error.
+func (c *CSAPI) GetDevice(t *testing.T, deviceID string) Device {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "devices", deviceID})
+	body := ParseJSON(t, res)
+	var device Device
+	if err := json.Unmarshal(body, &device); err != nil {
+		t.Fatalf("GetDevice: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return device
+}
+
+// RenameDevice sets the display name of a device of this user. Fails the test on error.
+func (c *CSAPI) RenameDevice(t *testing.T, deviceID, displayName string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "devices", deviceID}, WithJSONBody(t, map[string]interface{}{
+		"display_name": displayName,
+	}))
+}
+
+// DeleteDevices deletes the given devices of this user via /delete_devices, completing user-interactive auth
+// with `password`. Fails the test on error.
+func (c *CSAPI) DeleteDevices(t *testing.T, password string, deviceIDs ...string) {
+	t.Helper()
+	c.MustDoWithPasswordUIA(t, "POST", []string{"_matrix", "client", "v3", "delete_devices"}, map[string]interface{}{
+		"devices": deviceIDs,
+	}, password)
+}
+
+// DeleteDevice deletes a single device of this user, completing user-interactive auth with `password`.
+// Fails the test on error.
+func (c *CSAPI) DeleteDevice(t *testing.T, password, deviceID string) {
+	t.Helper()
+	c.MustDoWithPasswordUIA(t, "DELETE", []string{"_matrix", "client", "v3", "devices", deviceID}, map[string]interface{}{}, password)
+}
+
+// LoginNewDevice logs in as this client's user with `password`, creating a new device, and returns a new client
+// for it. `deviceID` may be empty to let the homeserver generate one. The new client shares this client's HTTP
+// client and settings but has its own access token, so the two devices can be used independently. Fails the test
+// on error.
+func (c *CSAPI) LoginNewDevice(t *testing.T, password, deviceID string) *CSAPI {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": c.UserID,
+		},
+		"password": password,
+	}
+	if deviceID != "" {
+		reqBody["device_id"] = deviceID
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, reqBody), WithoutAccessToken())
+	body := ParseJSON(t, res)
+	device := &CSAPI{
+		UserID:           GetJSONFieldStr(t, body, "user_id"),
+		AccessToken:      GetJSONFieldStr(t, body, "access_token"),
+		DeviceID:         GetJSONFieldStr(t, body, "device_id"),
+		BaseURL:          c.BaseURL,
+		Client:           c.Client,
+		SyncUntilTimeout: c.SyncUntilTimeout,
+		Debug:            c.Debug,
+		RateLimit:        c.RateLimit,
+	}
+	if device.DeviceID == c.DeviceID {
+		t.Fatalf("LoginNewDevice: login returned the existing device %s", c.DeviceID)
+	}
+	return device
+}
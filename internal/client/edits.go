@@ -0,0 +1,88 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// EditContent returns the content of an m.room.message which replaces the text of `eventID` with `newText`,
+// including the fallback body for clients which do not support edits. This can also be used to build edits
+// sent over federation.
+func EditContent(eventID, newText string) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "* " + newText,
+		"m.new_content": map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    newText,
+		},
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		},
+	}
+}
+
+// SendEdit replaces the text of `eventID` with `newText`. Returns the event ID of the edit.
+func (c *CSAPI) SendEdit(t *testing.T, roomID, eventID, newText string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type:    "m.room.message",
+		Content: EditContent(eventID, newText),
+	})
+}
+
+// MustHaveLatestEdit asserts that /event returns `eventID` with `editEventID` as the bundled m.replace
+// aggregation, and that the edit replaces the text with `newText`. If the server only bundles the edit's event
+// ID, as servers implementing MSC3925 do, the edit is fetched to check its content.
+func (c *CSAPI) MustHaveLatestEdit(t *testing.T, roomID, eventID, editEventID, newText string) {
+	t.Helper()
+	replace := c.GetEvent(t, roomID, eventID).Get(`unsigned.m\.relations.m\.replace`)
+	if err := checkLatestEdit(replace, editEventID); err != nil {
+		t.Fatalf("MustHaveLatestEdit(%s): %s", eventID, err)
+	}
+	edit := replace
+	if !edit.Get("content").Exists() {
+		edit = c.GetEvent(t, roomID, editEventID)
+	}
+	if got := edit.Get(`content.m\.new_content.body`).Str; got != newText {
+		t.Fatalf("MustHaveLatestEdit(%s): edit %s has new body %q, want %q", eventID, editEventID, got, newText)
+	}
+}
+
+// Check that the timeline for `roomID` has `eventID` with `editEventID` as the bundled m.replace aggregation.
+func SyncLatestEditIs(roomID, eventID, editEventID string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var lastErr error
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("event_id").Str != eventID {
+				return false
+			}
+			lastErr = checkLatestEdit(ev.Get(`unsigned.m\.relations.m\.replace`), editEventID)
+			return lastErr == nil
+		})(clientUserID, topLevelSyncJSON)
+		if lastErr != nil {
+			return fmt.Errorf("SyncLatestEditIs(%s): %s", eventID, lastErr)
+		}
+		if err != nil {
+			return fmt.Errorf("SyncLatestEditIs(%s): %s", eventID, err)
+		}
+		return nil
+	}
+}
+
+// checkLatestEdit checks an m.replace aggregation, which is either the full edit event or, in older servers, an
+// object with its event ID.
+func checkLatestEdit(replace gjson.Result, editEventID string) error {
+	if !replace.Exists() {
+		return fmt.Errorf("no m.replace aggregation")
+	}
+	if got := replace.Get("event_id").Str; got != editEventID {
+		return fmt.Errorf("latest edit is %s, want %s", got, editEventID)
+	}
+	return nil
+}
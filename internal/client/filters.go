@@ -0,0 +1,34 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// CreateFilter uploads a filter for this user. Fails the test on error. Returns the filter ID, which can be
+// used as SyncReq.FilterID.
+func (c *CSAPI) CreateFilter(t *testing.T, filter map[string]interface{}) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "user", c.UserID, "filter"}, WithJSONBody(t, filter))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "filter_id")
+}
+
+// GetFilter returns the filter with the given ID, as stored by the server. Fails the test on error.
+func (c *CSAPI) GetFilter(t *testing.T, filterID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "filter", filterID})
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// InlineFilter encodes `filter` as JSON for use as SyncReq.Filter, so a test can compare the same filter
+// sent inline with one created via CreateFilter.
+func InlineFilter(t *testing.T, filter map[string]interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatalf("InlineFilter: failed to marshal filter: %s", err)
+	}
+	return string(b)
+}
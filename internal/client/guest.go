@@ -0,0 +1,80 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// GuestAccessForbidden is the expected response when a guest calls an endpoint which guests may not use.
+var GuestAccessForbidden = match.HTTPResponse{
+	StatusCode: 403,
+	JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_GUEST_ACCESS_FORBIDDEN")},
+}
+
+// RegisterGuest registers a new guest account and returns its user ID, access token and device ID. Skips the test
+// if the homeserver does not allow guest registration.
+func (c *CSAPI) RegisterGuest(t *testing.T) (userID, accessToken, deviceID string) {
+	t.Helper()
+	res := c.DoRegisterGuest(t)
+	if res.StatusCode == 403 {
+		t.Skipf("RegisterGuest: homeserver does not allow guest registration")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("RegisterGuest: returned HTTP %d", res.StatusCode)
+	}
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id"), GetJSONFieldStr(t, body, "access_token"), GetJSONFieldStr(t, body, "device_id")
+}
+
+// DoRegisterGuest is the same as RegisterGuest but returns the response, for testing guest registration itself.
+func (c *CSAPI) DoRegisterGuest(t *testing.T) *http.Response {
+	t.Helper()
+	return c.DoFunc(
+		t, "POST", []string{"_matrix", "client", "v3", "register"},
+		WithQueries(map[string][]string{"kind": {"guest"}}), WithJSONBody(t, map[string]interface{}{}), WithoutAccessToken(),
+	)
+}
+
+// UpgradeGuest upgrades the guest account this client is logged in as to a full account with the given
+// password, keeping its user ID. `localpart` may be empty to let the homeserver keep the guest's localpart. The
+// client's access token and device ID are replaced with those of the full account. Fails the test on error.
+func (c *CSAPI) UpgradeGuest(t *testing.T, localpart, password string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"auth": map[string]string{
+			"type": "m.login.dummy",
+		},
+		"guest_access_token": c.AccessToken,
+		"password":           password,
+	}
+	if localpart != "" {
+		reqBody["username"] = localpart
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "register"}, WithJSONBody(t, reqBody), WithoutAccessToken())
+	body := ParseJSON(t, res)
+	if userID := GetJSONFieldStr(t, body, "user_id"); userID != c.UserID {
+		t.Fatalf("UpgradeGuest: upgraded account has user ID %s, want %s", userID, c.UserID)
+	}
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	c.DeviceID = GetJSONFieldStr(t, body, "device_id")
+}
+
+// SetGuestAccess sets whether guests may join `roomID`, waiting until the change comes down /sync.
+func (c *CSAPI) SetGuestAccess(t *testing.T, roomID string, allowed bool) {
+	t.Helper()
+	guestAccess := "forbidden"
+	if allowed {
+		guestAccess = "can_join"
+	}
+	stateKey := ""
+	c.SendEventSynced(t, roomID, b.Event{
+		Type:     "m.room.guest_access",
+		StateKey: &stateKey,
+		Content: map[string]interface{}{
+			"guest_access": guestAccess,
+		},
+	})
+}
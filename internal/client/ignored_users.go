@@ -0,0 +1,71 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// IgnoreUsers replaces this user's m.ignored_user_list with `userIDs`. Pass no user IDs to unignore everyone.
+// Fails the test on error.
+func (c *CSAPI) IgnoreUsers(t *testing.T, userIDs ...string) {
+	t.Helper()
+	ignored := make(map[string]interface{}, len(userIDs))
+	for _, userID := range userIDs {
+		ignored[userID] = map[string]interface{}{}
+	}
+	c.SetGlobalAccountData(t, "m.ignored_user_list", map[string]interface{}{
+		"ignored_users": ignored,
+	})
+}
+
+// Check that the ignored user list is exactly `userIDs`, in any order.
+func SyncIgnoredUsersAre(userIDs ...string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var got []string
+		err := SyncGlobalAccountDataHas(func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.ignored_user_list" {
+				return false
+			}
+			got = nil
+			ev.Get("content.ignored_users").ForEach(func(k, _ gjson.Result) bool {
+				got = append(got, k.Str)
+				return true
+			})
+			return sameStringSet(got, userIDs)
+		})(clientUserID, topLevelSyncJSON)
+		if err != nil {
+			return fmt.Errorf("SyncIgnoredUsersAre: got %v, want %v: %s", got, userIDs, err)
+		}
+		return nil
+	}
+}
+
+// MustNotSeeEventsFrom syncs from `since` until `sentinelEventID` appears in the timeline of `roomID`, and fails
+// the test if any response along the way contains timeline events in `roomID`, or invites to any room, from
+// `userIDs`. Send the sentinel from a user who is not ignored after the events which should be hidden.
+// Returns the since token of the response with the sentinel.
+func (c *CSAPI) MustNotSeeEventsFrom(t *testing.T, since, roomID, sentinelEventID string, userIDs ...string) string {
+	t.Helper()
+	forbidden := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		forbidden[userID] = true
+	}
+	return c.MustSyncUntil(t, SyncReq{Since: since}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.events").Array() {
+			if forbidden[ev.Get("sender").Str] {
+				t.Errorf("MustNotSeeEventsFrom: saw event %s from %s in %s", ev.Get("event_id").Str, ev.Get("sender").Str, roomID)
+			}
+		}
+		topLevelSyncJSON.Get("rooms.invite").ForEach(func(invitedRoomID, room gjson.Result) bool {
+			for _, ev := range room.Get("invite_state.events").Array() {
+				if ev.Get("type").Str == "m.room.member" && ev.Get("state_key").Str == clientUserID && forbidden[ev.Get("sender").Str] {
+					t.Errorf("MustNotSeeEventsFrom: saw invite to %s from %s", invitedRoomID.Str, ev.Get("sender").Str)
+				}
+			}
+			return true
+		})
+		return SyncTimelineHasEventID(roomID, sentinelEventID)(clientUserID, topLevelSyncJSON)
+	})
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// JWTSecret is the HMAC secret homeservers which support JWT login are expected to be configured with.
+const JWTSecret = "complement"
+
+// Algorithms for signing JWTs with MintJWT. JWTAlgNone produces an unsigned token, which homeservers must reject.
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgHS384 = "HS384"
+	JWTAlgHS512 = "HS512"
+	JWTAlgNone  = "none"
+)
+
+// The login types used for JWT login, in order of preference.
+var jwtLoginTypes = []string{"m.login.jwt", "org.matrix.login.jwt"}
+
+// MintJWT returns a JWT with the given claims, signed with `secret` using `alg`, which is one of the JWTAlg
+// constants. Fails the test if the algorithm is not supported.
+func MintJWT(t *testing.T, alg, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	var newHash func() hash.Hash
+	switch alg {
+	case JWTAlgHS256:
+		newHash = sha256.New
+	case JWTAlgHS384:
+		newHash = sha512.New384
+	case JWTAlgHS512:
+		newHash = sha512.New
+	case JWTAlgNone:
+	default:
+		t.Fatalf("MintJWT: unsupported algorithm %s", alg)
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatalf("MintJWT: failed to marshal header: %s", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("MintJWT: failed to marshal claims: %s", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if newHash == nil {
+		return signingInput + "."
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// JWTForUser returns a token for `localpart` signed with JWTSecret, valid for an hour. `extraClaims` are added to
+// the default `sub`, `iat` and `exp` claims, and can override them.
+func JWTForUser(t *testing.T, localpart string, extraClaims map[string]interface{}) string {
+	t.Helper()
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": localpart,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+	return MintJWT(t, JWTAlgHS256, JWTSecret, claims)
+}
+
+// LoginJWT logs in with a JWT. The client's user ID, access token and device ID are replaced with those from the
+// response. Skips the test if the homeserver does not support JWT login, and fails it on any other error.
+func (c *CSAPI) LoginJWT(t *testing.T, token string) {
+	t.Helper()
+	res := c.DoLoginJWT(t, token)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("LoginJWT: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	c.UserID = GetJSONFieldStr(t, body, "user_id")
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	c.DeviceID = GetJSONFieldStr(t, body, "device_id")
+}
+
+// DoLoginJWT is the same as LoginJWT but returns the response, for testing tokens which should be rejected. Skips
+// the test if the homeserver does not support JWT login.
+func (c *CSAPI) DoLoginJWT(t *testing.T, token string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, map[string]interface{}{
+		"type":  c.jwtLoginType(t),
+		"token": token,
+	}), WithoutAccessToken())
+}
+
+// jwtLoginType returns the JWT login type advertised by the homeserver, skipping the test if there is none.
+func (c *CSAPI) jwtLoginType(t *testing.T) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "login"}, WithoutAccessToken())
+	body := ParseJSON(t, res)
+	flows := map[string]bool{}
+	for _, flow := range gjson.GetBytes(body, "flows").Array() {
+		flows[flow.Get("type").Str] = true
+	}
+	for _, loginType := range jwtLoginTypes {
+		if flows[loginType] {
+			return loginType
+		}
+	}
+	t.Skipf("LoginJWT: homeserver does not support JWT login")
+	return ""
+}
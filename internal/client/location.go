@@ -0,0 +1,103 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// SendLocation shares a static location in the room (MSC3488). Fails the test on error. Returns the event ID.
+func (c *CSAPI) SendLocation(t *testing.T, roomID, body string, l b.Location) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.LocationMessageEvent(body, l))
+}
+
+// StartBeacon starts sharing this user's live location in the room (MSC3672), for up to `timeout`. Fails the test
+// on error. Returns the event ID of the beacon_info event, which location updates reference.
+func (c *CSAPI) StartBeacon(t *testing.T, roomID, description string, timeout time.Duration) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.BeaconInfoEvent(c.UserID, description, true, timeout))
+}
+
+// StopBeacon stops sharing this user's live location in the room. Fails the test on error.
+func (c *CSAPI) StopBeacon(t *testing.T, roomID string) {
+	t.Helper()
+	c.SendEventUnsynced(t, roomID, b.BeaconInfoEvent(c.UserID, "", false, 0))
+}
+
+// SendBeaconLocation sends a location update for the live beacon `beaconInfoEventID`. Fails the test on error.
+// Returns the event ID.
+func (c *CSAPI) SendBeaconLocation(t *testing.T, roomID, beaconInfoEventID string, l b.Location) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.BeaconEvent(beaconInfoEventID, l))
+}
+
+// MustHaveLatestBeaconLocation fails the test unless the most recent location update for the beacon, as returned
+// by /relations, is at `geoURI`.
+func (c *CSAPI) MustHaveLatestBeaconLocation(t *testing.T, roomID, beaconInfoEventID, geoURI string) {
+	t.Helper()
+	resp := c.GetRelations(t, roomID, beaconInfoEventID, RelationsReq{
+		RelType:   "m.reference",
+		EventType: b.BeaconEventType,
+		Limit:     1,
+	})
+	if len(resp.Chunk) == 0 {
+		t.Fatalf("MustHaveLatestBeaconLocation(%s): beacon has no location updates", beaconInfoEventID)
+	}
+	if err := LocationURIIs(geoURI)([]byte(resp.Chunk[0].Raw)); err != nil {
+		t.Fatalf("MustHaveLatestBeaconLocation(%s): %s", beaconInfoEventID, err)
+	}
+}
+
+// LocationURIIs checks that a location message or beacon event is at `geoURI`.
+func LocationURIIs(geoURI string) match.JSON {
+	return match.JSONKeyEqual("content."+GjsonEscape(b.LocationKey)+".uri", geoURI)
+}
+
+// LocationIsSelf checks that a location message or beacon_info event shares the sender's own location, rather
+// than a pinned location.
+func LocationIsSelf() match.JSON {
+	return match.JSONKeyEqual("content."+GjsonEscape(b.LocationAssetKey)+".type", "m.self")
+}
+
+// SyncBeaconLiveIs checks that the beacon_info state event of `userID` comes down /sync in the room with the
+// given liveness.
+func SyncBeaconLiveIs(roomID, userID string, live bool) SyncCheckOpt {
+	return SyncStateHas(roomID, b.BeaconInfoEventType, userID, func(ev gjson.Result) bool {
+		return ev.Get("content.live").Bool() == live
+	})
+}
+
+// SyncBeaconLocationIs checks that a location update at `geoURI` for the beacon `beaconInfoEventID` comes down
+// /sync in the room.
+func SyncBeaconLocationIs(roomID, beaconInfoEventID, geoURI string) SyncCheckOpt {
+	return SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+		if ev.Get("type").Str != b.BeaconEventType || ev.Get(`content.m\.relates_to.event_id`).Str != beaconInfoEventID {
+			return false
+		}
+		return LocationURIIs(geoURI)([]byte(ev.Raw)) == nil
+	})
+}
+
+// IsBeaconLive returns true if the content of a beacon_info event is live and had not timed out at `now`. Beacons
+// time out `timeout` milliseconds after their timestamp.
+func IsBeaconLive(beaconInfo gjson.Result, now time.Time) bool {
+	if !beaconInfo.Get("live").Bool() {
+		return false
+	}
+	startedAt := beaconInfo.Get(GjsonEscape(b.LocationTSKey)).Int()
+	return now.UnixNano()/int64(time.Millisecond) < startedAt+beaconInfo.Get("timeout").Int()
+}
+
+// MustHaveLiveBeacon fails the test unless `userID` is sharing their live location in the room.
+func (c *CSAPI) MustHaveLiveBeacon(t *testing.T, roomID, userID string) {
+	t.Helper()
+	beaconInfo := c.GetStateEvent(t, roomID, b.BeaconInfoEventType, userID)
+	if !IsBeaconLive(beaconInfo, time.Now()) {
+		t.Fatalf("MustHaveLiveBeacon(%s): beacon of %s is not live: %s", roomID, userID, beaconInfo.Raw)
+	}
+}
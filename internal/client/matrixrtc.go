@@ -0,0 +1,175 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// CallMemberEventType is the state event type of MatrixRTC call memberships (MSC3401, MSC4143).
+const CallMemberEventType = "org.matrix.msc3401.call.member"
+
+// CallMembership is the content of a session-based call member event, describing one device taking part in a call.
+type CallMembership struct {
+	// Defaults to "m.call".
+	Application string
+	// Empty for the room's main call.
+	CallID string
+	// Defaults to "m.room".
+	Scope string
+	// How long the membership is valid for after the event is sent. Defaults to 4 hours, as in Element Call.
+	Expires time.Duration
+	// The LiveKit service URL of the focus the device prefers.
+	LiveKitServiceURL string
+}
+
+// defaultCallMembershipExpiry is the expiry Element Call uses for call memberships.
+const defaultCallMembershipExpiry = 4 * time.Hour
+
+// CallMemberStateKey returns the state key of the call member event for a device. Keys start with an underscore
+// so that the auth rules, which only let users set state keys matching their own user ID, do not apply; rooms
+// must therefore let members send call member events.
+func CallMemberStateKey(userID, deviceID string) string {
+	return "_" + userID + "_" + deviceID
+}
+
+// CallMemberEvent returns the call member event joining the device to a call.
+func CallMemberEvent(userID, deviceID string, m CallMembership) b.Event {
+	if m.Application == "" {
+		m.Application = "m.call"
+	}
+	if m.Scope == "" {
+		m.Scope = "m.room"
+	}
+	if m.Expires == 0 {
+		m.Expires = defaultCallMembershipExpiry
+	}
+	content := map[string]interface{}{
+		"application": m.Application,
+		"call_id":     m.CallID,
+		"scope":       m.Scope,
+		"device_id":   deviceID,
+		"expires":     m.Expires.Milliseconds(),
+		"focus_active": map[string]interface{}{
+			"type":            "livekit",
+			"focus_selection": "oldest_membership",
+		},
+		"foci_preferred": []map[string]interface{}{},
+	}
+	if m.LiveKitServiceURL != "" {
+		content["foci_preferred"] = []map[string]interface{}{{
+			"type":                "livekit",
+			"livekit_service_url": m.LiveKitServiceURL,
+		}}
+	}
+	stateKey := CallMemberStateKey(userID, deviceID)
+	return b.Event{
+		Type:     CallMemberEventType,
+		StateKey: &stateKey,
+		Content:  content,
+	}
+}
+
+// JoinCall sends a call member event for this device. Fails the test on error. Returns the event ID.
+func (c *CSAPI) JoinCall(t *testing.T, roomID string, m CallMembership) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, CallMemberEvent(c.UserID, c.DeviceID, m))
+}
+
+// LeaveCall removes this device from the call by replacing its call member event with empty content. Fails the
+// test on error. Returns the event ID.
+func (c *CSAPI) LeaveCall(t *testing.T, roomID string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, callLeaveEvent(c.UserID, c.DeviceID))
+}
+
+// ScheduleCallLeave schedules the call member event of this device to be emptied after `delay` (MSC4140), as
+// clients do so that they drop out of calls when they go away without leaving. Keep the membership alive with
+// UpdateDelayedEvent and DelayedEventRestart. Fails the test on error.
+func (c *CSAPI) ScheduleCallLeave(t *testing.T, roomID string, delay time.Duration) DelayedEvent {
+	t.Helper()
+	return c.ScheduleDelayedEvent(t, roomID, callLeaveEvent(c.UserID, c.DeviceID), delay)
+}
+
+func callLeaveEvent(userID, deviceID string) b.Event {
+	stateKey := CallMemberStateKey(userID, deviceID)
+	return b.Event{
+		Type:     CallMemberEventType,
+		StateKey: &stateKey,
+		Content:  map[string]interface{}{},
+	}
+}
+
+// GetCallMembers returns the call member events in the room's current state which have not left or expired.
+// Fails the test on error.
+func (c *CSAPI) GetCallMembers(t *testing.T, roomID string) []gjson.Result {
+	t.Helper()
+	var members []gjson.Result
+	for _, ev := range c.GetRoomState(t, roomID) {
+		if ev.Get("type").Str == CallMemberEventType && IsActiveCallMembership(ev, time.Now()) {
+			members = append(members, ev)
+		}
+	}
+	return members
+}
+
+// MustBeInCall fails the test unless the device has an active call membership in the room.
+func (c *CSAPI) MustBeInCall(t *testing.T, roomID, userID, deviceID string) {
+	t.Helper()
+	stateKey := CallMemberStateKey(userID, deviceID)
+	for _, ev := range c.GetCallMembers(t, roomID) {
+		if ev.Get("state_key").Str == stateKey {
+			return
+		}
+	}
+	t.Fatalf("MustBeInCall(%s): %s device %s has no active call membership", roomID, userID, deviceID)
+}
+
+// IsActiveCallMembership returns true if the call member event has not been emptied and had not expired at `now`.
+// Memberships expire `expires` milliseconds after the event's origin_server_ts.
+func IsActiveCallMembership(ev gjson.Result, now time.Time) bool {
+	if !ev.Get("content.application").Exists() {
+		return false
+	}
+	expiresAt := ev.Get("origin_server_ts").Int() + ev.Get("content.expires").Int()
+	return now.UnixNano()/int64(time.Millisecond) < expiresAt
+}
+
+// SyncCallMembershipLeft checks that the call member event of the device is emptied, e.g by a delayed event from
+// ScheduleCallLeave.
+func SyncCallMembershipLeft(roomID, userID, deviceID string) SyncCheckOpt {
+	return SyncStateHas(roomID, CallMemberEventType, CallMemberStateKey(userID, deviceID), func(ev gjson.Result) bool {
+		return !ev.Get("content.application").Exists()
+	})
+}
+
+// TurnServer is the response of /voip/turnServer.
+type TurnServer struct {
+	Username string
+	Password string
+	URIs     []string
+	TTL      time.Duration
+}
+
+// GetTurnServer returns the TURN server credentials the homeserver gives clients for calls, or false if it has no
+// TURN server configured. Fails the test on error.
+func (c *CSAPI) GetTurnServer(t *testing.T) (TurnServer, bool) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "voip", "turnServer"})
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	if !body.Get("uris").Exists() {
+		return TurnServer{}, false
+	}
+	turn := TurnServer{
+		Username: body.Get("username").Str,
+		Password: body.Get("password").Str,
+		TTL:      time.Duration(body.Get("ttl").Int()) * time.Second,
+	}
+	for _, uri := range body.Get("uris").Array() {
+		turn.URIs = append(turn.URIs, uri.Str)
+	}
+	return turn, true
+}
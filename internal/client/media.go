@@ -0,0 +1,108 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// AuthenticatedMediaPath returns the path to an authenticated media endpoint (MSC3916),
+// e.g AuthenticatedMediaPath("download", origin, mediaID).
+func AuthenticatedMediaPath(endpoint ...string) []string {
+	return append([]string{"_matrix", "client", "v1", "media"}, endpoint...)
+}
+
+// UnauthenticatedMediaPath returns the path to a deprecated unauthenticated media endpoint,
+// e.g UnauthenticatedMediaPath("download", origin, mediaID).
+func UnauthenticatedMediaPath(endpoint ...string) []string {
+	return append([]string{"_matrix", "media", "v3"}, endpoint...)
+}
+
+// DoMediaFunc performs a request to the given media endpoint, e.g []string{"download", origin, mediaID}. If
+// `authenticated` is true the authenticated endpoint is used with this client's access token. Otherwise the
+// deprecated unauthenticated endpoint is used without an access token. This is useful to assert how the server
+// enforces authentication and the freeze of unauthenticated media.
+func (c *CSAPI) DoMediaFunc(t *testing.T, authenticated bool, method string, endpoint []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	if authenticated {
+		return c.DoFunc(t, method, AuthenticatedMediaPath(endpoint...), opts...)
+	}
+	return c.DoFunc(t, method, UnauthenticatedMediaPath(endpoint...), append([]RequestOpt{WithoutAccessToken()}, opts...)...)
+}
+
+// doMediaFuncWithFallback performs an authenticated media request, retrying against the unauthenticated endpoint
+// if the server does not support authenticated media.
+func (c *CSAPI) doMediaFuncWithFallback(t *testing.T, method string, endpoint []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	res := c.DoMediaFunc(t, true, method, endpoint, opts...)
+	if !isUnrecognisedEndpoint(res) {
+		return res
+	}
+	res.Body.Close()
+	t.Logf("%s does not support authenticated media, falling back to %v", c.BaseURL, UnauthenticatedMediaPath(endpoint...))
+	return c.DoFunc(t, method, UnauthenticatedMediaPath(endpoint...), opts...)
+}
+
+// DownloadContentAuthenticated is like DownloadContent but uses the authenticated media endpoint, falling back to
+// the unauthenticated endpoint if the server does not support it. Fails the test on error.
+func (c *CSAPI) DownloadContentAuthenticated(t *testing.T, mxcUri string) ([]byte, string) {
+	t.Helper()
+	origin, mediaId := SplitMxc(mxcUri)
+	res := c.doMediaFuncWithFallback(t, "GET", []string{"download", origin, mediaId})
+	return mustReadMedia(t, "DownloadContentAuthenticated", res)
+}
+
+// ThumbnailContentAuthenticated requests a thumbnail of the media using the authenticated media endpoint, falling
+// back to the unauthenticated endpoint if the server does not support it. `method` is "crop" or "scale". Returns
+// the raw bytes and the Content-Type. Fails the test on error.
+func (c *CSAPI) ThumbnailContentAuthenticated(t *testing.T, mxcUri string, width, height int, method string) ([]byte, string) {
+	t.Helper()
+	origin, mediaId := SplitMxc(mxcUri)
+	query := url.Values{
+		"width":  []string{strconv.Itoa(width)},
+		"height": []string{strconv.Itoa(height)},
+		"method": []string{method},
+	}
+	res := c.doMediaFuncWithFallback(t, "GET", []string{"thumbnail", origin, mediaId}, WithQueries(query))
+	return mustReadMedia(t, "ThumbnailContentAuthenticated", res)
+}
+
+// GetMediaConfig returns the media config, e.g the `m.upload.size` limit, using the authenticated media endpoint
+// with a fallback to the unauthenticated endpoint. Fails the test on error.
+func (c *CSAPI) GetMediaConfig(t *testing.T) gjson.Result {
+	t.Helper()
+	res := c.doMediaFuncWithFallback(t, "GET", []string{"config"})
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("GetMediaConfig: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// GetURLPreview requests a preview of `previewURL` using the authenticated media endpoint, falling back to the
+// unauthenticated endpoint if the server does not support it. Returns the response so tests can assert on
+// blocked URLs as well as successful previews.
+func (c *CSAPI) GetURLPreview(t *testing.T, previewURL string) *http.Response {
+	t.Helper()
+	query := url.Values{
+		"url": []string{previewURL},
+	}
+	return c.doMediaFuncWithFallback(t, "GET", []string{"preview_url"}, WithQueries(query))
+}
+
+func mustReadMedia(t *testing.T, funcName string, res *http.Response) ([]byte, string) {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s: failed to read response body: %s", funcName, err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("%s: returned HTTP %d: %s", funcName, res.StatusCode, string(body))
+	}
+	return body, res.Header.Get("Content-Type")
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// MediaDigest is the size and SHA-256 hash of some media, which tests can compare instead of holding large
+// files in memory.
+type MediaDigest struct {
+	Size   int64
+	SHA256 string
+}
+
+// mediaDigester accumulates a MediaDigest from everything written to it.
+type mediaDigester struct {
+	size int64
+	hash hash.Hash
+}
+
+func newMediaDigester() *mediaDigester {
+	return &mediaDigester{hash: sha256.New()}
+}
+
+func (d *mediaDigester) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+func (d *mediaDigester) digest() MediaDigest {
+	return MediaDigest{
+		Size:   d.size,
+		SHA256: hex.EncodeToString(d.hash.Sum(nil)),
+	}
+}
+
+// RandomMedia returns a reader of `size` pseudo-random bytes generated from `seed`, so large media can be
+// uploaded without being held in memory. The same seed and size always produce the same bytes.
+func RandomMedia(seed, size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), size)
+}
+
+// UploadContentStream uploads `size` bytes read from `r`, streaming them to the server rather than buffering them.
+// Returns the MXC URI and the digest of what was sent. Fails the test on error.
+func (c *CSAPI) UploadContentStream(t *testing.T, r io.Reader, size int64, fileName, contentType string) (string, MediaDigest) {
+	t.Helper()
+	query := url.Values{}
+	if fileName != "" {
+		query.Set("filename", fileName)
+	}
+	digester := newMediaDigester()
+	res := c.MustDoFunc(
+		t, "POST", []string{"_matrix", "media", "v3", "upload"},
+		WithBodyReader(contentType, io.TeeReader(r, digester)), WithQueries(query),
+		func(req *http.Request) {
+			req.ContentLength = size
+		},
+	)
+	body := ParseJSON(t, res)
+	if digester.size != size {
+		t.Fatalf("UploadContentStream: read %d bytes from the reader, want %d", digester.size, size)
+	}
+	return GetJSONFieldStr(t, body, "content_uri"), digester.digest()
+}
+
+// DownloadContentDigest downloads media, streaming it into a digest rather than memory, using the authenticated
+// media endpoint with a fallback to the unauthenticated endpoint. Returns the digest and the Content-Type. Fails
+// the test on error.
+func (c *CSAPI) DownloadContentDigest(t *testing.T, mxcUri string) (MediaDigest, string) {
+	t.Helper()
+	origin, mediaId := SplitMxc(mxcUri)
+	res := c.doMediaFuncWithFallback(t, "GET", []string{"download", origin, mediaId})
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		t.Fatalf("DownloadContentDigest: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	digester := newMediaDigester()
+	if _, err := io.Copy(digester, res.Body); err != nil {
+		t.Fatalf("DownloadContentDigest: failed to read response body after %d bytes: %s", digester.size, err)
+	}
+	return digester.digest(), res.Header.Get("Content-Type")
+}
+
+// MustDownloadContentMatch downloads media and asserts it has the size and hash in `want`.
+func (c *CSAPI) MustDownloadContentMatch(t *testing.T, mxcUri string, want MediaDigest) {
+	t.Helper()
+	got, _ := c.DownloadContentDigest(t, mxcUri)
+	if got != want {
+		t.Fatalf("MustDownloadContentMatch(%s): got %d bytes with sha256 %s, want %d bytes with sha256 %s", mxcUri, got.Size, got.SHA256, want.Size, want.SHA256)
+	}
+}
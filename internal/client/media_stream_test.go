@@ -0,0 +1,60 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingReader counts how many bytes have been read from it so far.
+type countingReader struct {
+	r    io.Reader
+	read int64 // accessed atomically
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+// Tests that UploadContentStream sends the body as it is read, rather than reading it all into memory first,
+// even when DoFunc could retry the request after a token refresh or rate limit.
+func TestUploadContentStreamDoesNotBufferBody(t *testing.T) {
+	// far larger than the socket buffers, so the whole body cannot have been read when the request arrives
+	const size = 32 * 1024 * 1024
+	body := &countingReader{r: RandomMedia(1, size)}
+	var readOnArrival, received int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		readOnArrival = atomic.LoadInt64(&body.read)
+		received, _ = io.Copy(ioutil.Discard, req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"content_uri":"mxc://hs1/streamed"}`))
+	}))
+	defer srv.Close()
+
+	c := &CSAPI{
+		UserID:       "@alice:hs1",
+		AccessToken:  "access_token",
+		RefreshToken: "refresh_token",
+		BaseURL:      srv.URL,
+		Client:       srv.Client(),
+		RateLimit: RateLimitPolicy{
+			MaxWait: time.Second,
+		},
+	}
+	mxcURI, digest := c.UploadContentStream(t, body, size, "", "application/octet-stream")
+	if mxcURI != "mxc://hs1/streamed" {
+		t.Errorf("got content URI %s, want mxc://hs1/streamed", mxcURI)
+	}
+	if received != size || digest.Size != size {
+		t.Errorf("server received %d bytes and digest has %d, want %d", received, digest.Size, size)
+	}
+	if readOnArrival >= size {
+		t.Errorf("whole body of %d bytes was read before the request reached the server, so it was buffered", size)
+	}
+}
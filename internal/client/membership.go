@@ -0,0 +1,108 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// KnockRoom knocks on the room ID or alias given, else fails the test. Returns the room ID.
+func (c *CSAPI) KnockRoom(t *testing.T, roomIDOrAlias string, serverNames []string, reason string) string {
+	t.Helper()
+	res := c.DoKnockRoom(t, roomIDOrAlias, serverNames, reason)
+	mustSucceed(t, "KnockRoom", res)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "room_id")
+}
+
+// DoKnockRoom is the same as KnockRoom but returns the response, for testing knocks which should fail.
+func (c *CSAPI) DoKnockRoom(t *testing.T, roomIDOrAlias string, serverNames []string, reason string) *http.Response {
+	t.Helper()
+	query := make(url.Values, len(serverNames))
+	for _, serverName := range serverNames {
+		query.Add("server_name", serverName)
+		// MSC4156 renamed server_name to via
+		query.Add("via", serverName)
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "knock", roomIDOrAlias}, WithQueries(query), withReason(t, nil, reason))
+}
+
+// ForgetRoom forgets the room ID, which the user must have left, else fails the test.
+func (c *CSAPI) ForgetRoom(t *testing.T, roomID string) {
+	t.Helper()
+	mustSucceed(t, "ForgetRoom", c.DoForgetRoom(t, roomID))
+}
+
+// DoForgetRoom is the same as ForgetRoom but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoForgetRoom(t *testing.T, roomID string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "forget"}, WithJSONBody(t, map[string]interface{}{}))
+}
+
+// KickUser kicks `userID` from the room ID, else fails the test.
+func (c *CSAPI) KickUser(t *testing.T, roomID, userID, reason string) {
+	t.Helper()
+	mustSucceed(t, "KickUser", c.DoKickUser(t, roomID, userID, reason))
+}
+
+// DoKickUser is the same as KickUser but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoKickUser(t *testing.T, roomID, userID, reason string) *http.Response {
+	t.Helper()
+	return c.doMembershipChange(t, roomID, "kick", userID, reason)
+}
+
+// BanUser bans `userID` from the room ID, else fails the test.
+func (c *CSAPI) BanUser(t *testing.T, roomID, userID, reason string) {
+	t.Helper()
+	mustSucceed(t, "BanUser", c.DoBanUser(t, roomID, userID, reason))
+}
+
+// DoBanUser is the same as BanUser but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoBanUser(t *testing.T, roomID, userID, reason string) *http.Response {
+	t.Helper()
+	return c.doMembershipChange(t, roomID, "ban", userID, reason)
+}
+
+// UnbanUser unbans `userID` from the room ID, else fails the test.
+func (c *CSAPI) UnbanUser(t *testing.T, roomID, userID, reason string) {
+	t.Helper()
+	mustSucceed(t, "UnbanUser", c.DoUnbanUser(t, roomID, userID, reason))
+}
+
+// DoUnbanUser is the same as UnbanUser but returns the response, for testing requests which should fail.
+func (c *CSAPI) DoUnbanUser(t *testing.T, roomID, userID, reason string) *http.Response {
+	t.Helper()
+	return c.doMembershipChange(t, roomID, "unban", userID, reason)
+}
+
+func (c *CSAPI) doMembershipChange(t *testing.T, roomID, action, userID, reason string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, action}, withReason(t, map[string]interface{}{
+		"user_id": userID,
+	}, reason))
+}
+
+// withReason returns a JSON body option for `reqBody`, adding `reason` if it is non-empty.
+func withReason(t *testing.T, reqBody map[string]interface{}, reason string) RequestOpt {
+	if reqBody == nil {
+		reqBody = map[string]interface{}{}
+	}
+	if reason != "" {
+		reqBody["reason"] = reason
+	}
+	return WithJSONBody(t, reqBody)
+}
+
+// mustSucceed fails the test, showing the errcode and error, if the response is not 2xx.
+func mustSucceed(t *testing.T, funcName string, res *http.Response) {
+	t.Helper()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	t.Fatalf("%s: returned HTTP %d %s: %s - body: %s",
+		funcName, res.StatusCode, gjson.GetBytes(body, "errcode").Str, gjson.GetBytes(body, "error").Str, string(body))
+}
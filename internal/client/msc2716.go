@@ -0,0 +1,153 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// MSC2716 event types and content fields.
+const (
+	MSC2716InsertionEventType          = "org.matrix.msc2716.insertion"
+	MSC2716BatchEventType              = "org.matrix.msc2716.batch"
+	MSC2716MarkerEventType             = "org.matrix.msc2716.marker"
+	MSC2716HistoricalContentField      = "org.matrix.msc2716.historical"
+	MSC2716NextBatchIDContentField     = "org.matrix.msc2716.next_batch_id"
+	MSC2716MarkerInsertionContentField = "org.matrix.msc2716.marker.insertion"
+)
+
+// BatchSendReq is an MSC2716 /batch_send request. The client must be an application service.
+type BatchSendReq struct {
+	// The event to insert the batch after.
+	PrevEventID string
+	// The next_batch_id from an earlier batch, to connect this batch before it. Empty for the first batch.
+	BatchID string
+	// State such as m.room.member events for the senders of the historical events.
+	StateEventsAtStart []map[string]interface{}
+	// The historical events, oldest first. Each needs `sender` and `origin_server_ts`.
+	Events []map[string]interface{}
+}
+
+// BatchSendResp is the response to /batch_send.
+type BatchSendResp struct {
+	StateEventIDs        []string `json:"state_event_ids"`
+	EventIDs             []string `json:"event_ids"`
+	InsertionEventID     string   `json:"insertion_event_id"`
+	BatchEventID         string   `json:"batch_event_id"`
+	BaseInsertionEventID string   `json:"base_insertion_event_id"`
+	NextBatchID          string   `json:"next_batch_id"`
+}
+
+// BatchSend imports a batch of historical events into the room. Fails the test on error.
+func (c *CSAPI) BatchSend(t *testing.T, roomID string, req BatchSendReq) BatchSendResp {
+	t.Helper()
+	res := c.DoBatchSend(t, roomID, req)
+	mustSucceed(t, "BatchSend", res)
+	body := ParseJSON(t, res)
+	var resp BatchSendResp
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("BatchSend: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return resp
+}
+
+// DoBatchSend is the same as BatchSend but returns the response, for testing batches which should fail.
+func (c *CSAPI) DoBatchSend(t *testing.T, roomID string, req BatchSendReq) *http.Response {
+	t.Helper()
+	query := url.Values{
+		"prev_event_id": []string{req.PrevEventID},
+	}
+	if req.BatchID != "" {
+		query.Set("batch_id", req.BatchID)
+	}
+	stateEvents := req.StateEventsAtStart
+	if stateEvents == nil {
+		stateEvents = []map[string]interface{}{}
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"},
+		WithQueries(query), WithJSONBody(t, map[string]interface{}{
+			"events":                req.Events,
+			"state_events_at_start": stateEvents,
+		}),
+	)
+}
+
+// SendMarkerEvent sends a marker event pointing at `insertionEventID`, so other homeservers in the room know
+// to backfill the history imported there. Each marker has a unique state key so all of them stay in the current
+// state. Returns the event ID.
+func (c *CSAPI) SendMarkerEvent(t *testing.T, roomID, insertionEventID string) string {
+	t.Helper()
+	c.txnID++
+	stateKey := fmt.Sprintf("marker_%d_%s", c.txnID, insertionEventID)
+	res := c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "state", MSC2716MarkerEventType, stateKey},
+		WithJSONBody(t, map[string]interface{}{
+			MSC2716MarkerInsertionContentField: insertionEventID,
+		}),
+	)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "event_id")
+}
+
+// MustSeeEventsInTopologicalOrder paginates backwards through /messages from the latest event until all of
+// `eventIDs` have been seen, and fails the test unless they appear in the given order, oldest first. Other
+// events may appear in between. To check historical events were inserted at the right point, pass the
+// event they were inserted after followed by the event IDs from BatchSendResp.
+func (c *CSAPI) MustSeeEventsInTopologicalOrder(t *testing.T, roomID string, eventIDs []string) {
+	t.Helper()
+	want := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		if want[eventID] {
+			t.Fatalf("MustSeeEventsInTopologicalOrder: %s appears more than once in %v", eventID, eventIDs)
+		}
+		want[eventID] = true
+	}
+	// newest first, as returned by /messages?dir=b
+	var seen []string
+	query := url.Values{
+		"dir":   []string{"b"},
+		"limit": []string{"100"},
+	}
+	for len(seen) < len(eventIDs) {
+		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, WithQueries(query))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		chunk := body.Get("chunk").Array()
+		for _, ev := range chunk {
+			if eventID := ev.Get("event_id").Str; want[eventID] {
+				seen = append(seen, eventID)
+				delete(want, eventID)
+			}
+		}
+		end := body.Get("end").Str
+		if len(chunk) == 0 || end == "" {
+			break
+		}
+		query.Set("from", end)
+	}
+	if len(want) > 0 || len(seen) != len(eventIDs) {
+		t.Fatalf("MustSeeEventsInTopologicalOrder: did not see %v in /messages of %s, saw %v", setKeys(want), roomID, reversedStrings(seen))
+	}
+	for i, eventID := range eventIDs {
+		if got := seen[len(seen)-1-i]; got != eventID {
+			t.Fatalf("MustSeeEventsInTopologicalOrder: got order %v (oldest first), want %v", reversedStrings(seen), eventIDs)
+		}
+	}
+}
+
+func setKeys(m map[string]bool) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func reversedStrings(in []string) []string {
+	out := make([]string, len(in))
+	for i := range in {
+		out[len(in)-1-i] = in[i]
+	}
+	return out
+}
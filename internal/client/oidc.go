@@ -0,0 +1,239 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	oidcDefaultClientURI   = "https://complement.invalid/"
+	oidcDefaultRedirectURI = "https://complement.invalid/callback"
+	oidcScopeAPI           = "urn:matrix:org.matrix.msc2967.client:api:*"
+	oidcScopeDevicePrefix  = "urn:matrix:org.matrix.msc2967.client:device:"
+)
+
+// OIDCConfig configures LoginWithOIDC.
+type OIDCConfig struct {
+	// The issuer of the auth service. If empty, it is discovered from the homeserver's auth_issuer endpoint.
+	Issuer string
+	// The OAuth2 client ID. If empty, a client is registered via dynamic client registration.
+	ClientID string
+	// The redirect URI to use. Defaults to a URI which does not resolve, as the redirect is never followed.
+	RedirectURI string
+	// The device ID to request. If empty, a random device ID is generated.
+	DeviceID string
+	// Authorize is called with the authorization URL and must complete login at the auth service, e.g by
+	// submitting its login form, then return the URL the auth service redirected to which contains the
+	// authorization code. If nil, redirects are followed with GET requests, which works with auth services
+	// that authorize immediately, such as mocks.
+	Authorize func(t *testing.T, authorizationURL string) (redirectURL string)
+}
+
+// oidcSession is the state needed to refresh tokens obtained via LoginWithOIDC.
+type oidcSession struct {
+	tokenEndpoint string
+	clientID      string
+}
+
+// LoginWithOIDC logs in to a homeserver which delegates auth to an OAuth2 auth service (MSC3861), by completing
+// an authorization code flow with PKCE. The access token, refresh token, user ID and device ID are stored on the
+// client, and later refreshes go to the auth service. Fails the test on error.
+func (c *CSAPI) LoginWithOIDC(t *testing.T, cfg OIDCConfig) {
+	t.Helper()
+	if cfg.Issuer == "" {
+		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc2965", "auth_issuer"}, WithoutAccessToken())
+		cfg.Issuer = GetJSONFieldStr(t, ParseJSON(t, res), "issuer")
+	}
+	if cfg.RedirectURI == "" {
+		cfg.RedirectURI = oidcDefaultRedirectURI
+	}
+	if cfg.DeviceID == "" {
+		cfg.DeviceID = strings.ToUpper(randomString(t, 8))
+	}
+	discovery := c.mustDoOIDCRequest(t, "GET", strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if cfg.ClientID == "" {
+		cfg.ClientID = c.mustRegisterOIDCClient(t, discovery.Get("registration_endpoint").Str, cfg.RedirectURI)
+	}
+
+	verifier := randomString(t, 32)
+	challenge := sha256.Sum256([]byte(verifier))
+	state := randomString(t, 16)
+	authURL, err := url.Parse(discovery.Get("authorization_endpoint").Str)
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: invalid authorization_endpoint: %s", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.ClientID)
+	query.Set("redirect_uri", cfg.RedirectURI)
+	query.Set("scope", strings.Join([]string{"openid", oidcScopeAPI, oidcScopeDevicePrefix + cfg.DeviceID}, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	authorize := cfg.Authorize
+	if authorize == nil {
+		authorize = c.followOIDCRedirects(cfg.RedirectURI)
+	}
+	redirectURL, err := url.Parse(authorize(t, authURL.String()))
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: invalid redirect URL: %s", err)
+	}
+	if got := redirectURL.Query().Get("state"); got != state {
+		t.Fatalf("LoginWithOIDC: redirect has state %q, want %q", got, state)
+	}
+	code := redirectURL.Query().Get("code")
+	if code == "" {
+		t.Fatalf("LoginWithOIDC: redirect has no code: %s", redirectURL)
+	}
+
+	c.oidc = &oidcSession{
+		tokenEndpoint: discovery.Get("token_endpoint").Str,
+		clientID:      cfg.ClientID,
+	}
+	tokens := c.mustDoOIDCRequest(t, "POST", c.oidc.tokenEndpoint, url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{cfg.RedirectURI},
+		"client_id":     []string{cfg.ClientID},
+		"code_verifier": []string{verifier},
+	})
+	c.AccessToken = tokens.Get("access_token").Str
+	c.RefreshToken = tokens.Get("refresh_token").Str
+	if c.AccessToken == "" {
+		t.Fatalf("LoginWithOIDC: token endpoint returned no access token: %s", tokens.Raw)
+	}
+	whoami := c.Whoami(t)
+	c.UserID = whoami.UserID
+	c.DeviceID = cfg.DeviceID
+	if whoami.DeviceID != "" {
+		c.DeviceID = whoami.DeviceID
+	}
+}
+
+// mustRefreshOIDC refreshes the access token at the auth service's token endpoint.
+func (c *CSAPI) mustRefreshOIDC(t *testing.T) {
+	t.Helper()
+	tokens := c.mustDoOIDCRequest(t, "POST", c.oidc.tokenEndpoint, url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{c.RefreshToken},
+		"client_id":     []string{c.oidc.clientID},
+	})
+	c.AccessToken = tokens.Get("access_token").Str
+	if c.AccessToken == "" {
+		t.Fatalf("MustRefresh: token endpoint returned no access token: %s", tokens.Raw)
+	}
+	if refreshToken := tokens.Get("refresh_token").Str; refreshToken != "" {
+		c.RefreshToken = refreshToken
+	}
+}
+
+// mustRegisterOIDCClient registers a public client via dynamic client registration. Returns the client ID.
+func (c *CSAPI) mustRegisterOIDCClient(t *testing.T, registrationEndpoint, redirectURI string) string {
+	t.Helper()
+	if registrationEndpoint == "" {
+		t.Fatalf("LoginWithOIDC: auth service does not support dynamic client registration, set OIDCConfig.ClientID")
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"client_name":                "Complement",
+		"client_uri":                 oidcDefaultClientURI,
+		"redirect_uris":              []string{redirectURI},
+		"application_type":           "web",
+		"grant_types":                []string{"authorization_code", "refresh_token"},
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": "none",
+	})
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: failed to marshal client registration: %s", err)
+	}
+	req, err := http.NewRequest("POST", registrationEndpoint, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("LoginWithOIDC: failed to create client registration request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	clientID := c.mustSendOIDCRequest(t, req).Get("client_id").Str
+	if clientID == "" {
+		t.Fatalf("LoginWithOIDC: client registration returned no client_id")
+	}
+	return clientID
+}
+
+// mustDoOIDCRequest makes a request to the auth service, sending `form` as a form-encoded body if it is non-nil.
+func (c *CSAPI) mustDoOIDCRequest(t *testing.T, method, reqURL string, form url.Values) gjson.Result {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if form != nil {
+		req, err = http.NewRequest(method, reqURL, strings.NewReader(form.Encode()))
+	} else {
+		req, err = http.NewRequest(method, reqURL, nil)
+	}
+	if err != nil {
+		t.Fatalf("CSAPI.mustDoOIDCRequest failed to create request: %s", err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return c.mustSendOIDCRequest(t, req)
+}
+
+func (c *CSAPI) mustSendOIDCRequest(t *testing.T, req *http.Request) gjson.Result {
+	t.Helper()
+	res, err := c.Client.Do(req)
+	if err != nil {
+		t.Fatalf("CSAPI.mustDoOIDCRequest %s %s returned error: %s", req.Method, req.URL, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("CSAPI.mustDoOIDCRequest %s %s failed to read response body: %s", req.Method, req.URL, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		t.Fatalf("CSAPI.mustDoOIDCRequest %s %s returned HTTP %d: %s", req.Method, req.URL, res.StatusCode, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
+
+// followOIDCRedirects returns an Authorize function which follows redirects until one points at `redirectURI`.
+func (c *CSAPI) followOIDCRedirects(redirectURI string) func(t *testing.T, authorizationURL string) string {
+	return func(t *testing.T, authorizationURL string) string {
+		t.Helper()
+		var redirectURL string
+		cli := *c.Client
+		cli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURI) {
+				redirectURL = req.URL.String()
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}
+		res, err := cli.Get(authorizationURL)
+		if err != nil {
+			t.Fatalf("LoginWithOIDC: authorization request failed: %s", err)
+		}
+		res.Body.Close()
+		if redirectURL == "" {
+			t.Fatalf("LoginWithOIDC: auth service did not redirect to %s, returned HTTP %d. Set OIDCConfig.Authorize to log in interactively.", redirectURI, res.StatusCode)
+		}
+		return redirectURL
+	}
+}
+
+func randomString(t *testing.T, n int) string {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("randomString: failed to generate random bytes: %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
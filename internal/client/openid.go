@@ -0,0 +1,30 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// OpenIDToken is the response to /user/{userId}/openid/request_token, which a third party such as an
+// integration manager can validate via the homeserver's /_matrix/federation/v1/openid/userinfo endpoint.
+type OpenIDToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+// GetOpenIDToken requests an OpenID token for this user. Fails the test on error.
+func (c *CSAPI) GetOpenIDToken(t *testing.T) OpenIDToken {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "user", c.UserID, "openid", "request_token"}, WithJSONBody(t, map[string]interface{}{}))
+	body := ParseJSON(t, res)
+	var token OpenIDToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		t.Fatalf("GetOpenIDToken: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	if token.AccessToken == "" {
+		t.Fatalf("GetOpenIDToken: response has no access_token: %s", string(body))
+	}
+	return token
+}
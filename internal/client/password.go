@@ -0,0 +1,62 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// ChangePassword changes the password of the account this client is logged in as, completing
+// user-interactive auth with `oldPassword`. If `logoutDevices` is true, the homeserver logs out every other
+// device of the account. Fails the test on error.
+func (c *CSAPI) ChangePassword(t *testing.T, oldPassword, newPassword string, logoutDevices bool) {
+	t.Helper()
+	c.MustDoWithPasswordUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "password"}, map[string]interface{}{
+		"new_password":   newPassword,
+		"logout_devices": logoutDevices,
+	}, oldPassword)
+}
+
+// EmailLinkFetcher returns the validation link from the latest email sent to `email`, e.g by reading it from a
+// mail-capture server the homeserver is configured to send through. It should wait for the email to arrive.
+type EmailLinkFetcher func(t *testing.T, email string) (link string)
+
+// ResetPasswordViaEmail resets the password of the account with the 3PID `email`, as a user who has forgotten
+// their password would: a validation email is requested, the link from it (obtained with `fetchLink`) is
+// followed, then the new password is set using the validated session. The client does not need to be logged
+// in. Fails the test on error.
+func (c *CSAPI) ResetPasswordViaEmail(t *testing.T, email, newPassword string, logoutDevices bool, fetchLink EmailLinkFetcher) {
+	t.Helper()
+	clientSecret := randomString(t, 16)
+	sid := c.RequestEmailToken(t, ThreePIDPurposePassword, email, clientSecret, 1)
+	c.followEmailLink(t, fetchLink(t, email))
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "account", "password"}, WithJSONBody(t, map[string]interface{}{
+		"new_password":   newPassword,
+		"logout_devices": logoutDevices,
+		"auth": map[string]interface{}{
+			"type": "m.login.email.identity",
+			"threepid_creds": map[string]interface{}{
+				"sid":           sid,
+				"client_secret": clientSecret,
+			},
+		},
+	}), WithoutAccessToken())
+}
+
+// followEmailLink opens a validation link from an email, as the user would in their browser.
+func (c *CSAPI) followEmailLink(t *testing.T, link string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		t.Fatalf("CSAPI.followEmailLink failed to create request for %s: %s", link, err)
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		t.Fatalf("CSAPI.followEmailLink GET %s returned error: %s", link, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("CSAPI.followEmailLink GET %s returned HTTP %d: %s", link, res.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// BlockedByPolicy is the expected response when a homeserver which enforces policy lists refuses a request, e.g a
+// join by a user or into a room matching a ban rule.
+var BlockedByPolicy = match.HTTPResponse{
+	StatusCode: 403,
+	JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_FORBIDDEN")},
+}
+
+// CreatePolicyRoom creates a public room to publish policy rules (MSC2313) in, i.e a ban list. `createRoomBody` is
+// merged into the /createRoom request body and may be nil. Fails the test on error. Returns the room ID.
+func (c *CSAPI) CreatePolicyRoom(t *testing.T, name string, createRoomBody map[string]interface{}) string {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"preset": "public_chat",
+		"name":   name,
+	}
+	for k, v := range createRoomBody {
+		reqBody[k] = v
+	}
+	return c.CreateRoom(t, reqBody)
+}
+
+// AddPolicyRule publishes a rule banning entities which match `entity` in the policy room. `ruleType` is one of
+// b.PolicyRuleUser, b.PolicyRuleRoom or b.PolicyRuleServer, and `entity` may be a glob, e.g "*.evil.example".
+// Fails the test on error. Returns the event ID.
+func (c *CSAPI) AddPolicyRule(t *testing.T, policyRoomID, ruleType, entity, reason string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, policyRoomID, b.PolicyRuleEvent(ruleType, entity, reason))
+}
+
+// RemovePolicyRule removes the rule for `entity` from the policy room by replacing it with empty content. Fails
+// the test on error. Returns the event ID.
+func (c *CSAPI) RemovePolicyRule(t *testing.T, policyRoomID, ruleType, entity string) string {
+	t.Helper()
+	rule := b.PolicyRuleEvent(ruleType, entity, "")
+	rule.Content = map[string]interface{}{}
+	return c.SendEventUnsynced(t, policyRoomID, rule)
+}
+
+// GetPolicyRules returns the current rules of type `ruleType` in the policy room as state events, skipping
+// removed rules. Fails the test on error.
+func (c *CSAPI) GetPolicyRules(t *testing.T, policyRoomID, ruleType string) []gjson.Result {
+	t.Helper()
+	var rules []gjson.Result
+	for _, ev := range c.GetRoomState(t, policyRoomID) {
+		if ev.Get("type").Str == ruleType && ev.Get("content.entity").Exists() {
+			rules = append(rules, ev)
+		}
+	}
+	return rules
+}
+
+// MustHavePolicyRule fails the test unless the policy room has a rule of type `ruleType` for exactly `entity` with
+// the given recommendation, e.g b.PolicyRecommendationBan.
+func (c *CSAPI) MustHavePolicyRule(t *testing.T, policyRoomID, ruleType, entity, recommendation string) {
+	t.Helper()
+	for _, rule := range c.GetPolicyRules(t, policyRoomID, ruleType) {
+		if rule.Get("content.entity").Str == entity && rule.Get("content.recommendation").Str == recommendation {
+			return
+		}
+	}
+	t.Fatalf("MustHavePolicyRule(%s): no %s rule for %s with recommendation %s", policyRoomID, ruleType, entity, recommendation)
+}
+
+// MustBeBlockedByPolicy asserts that the homeserver refused `res` because of a policy rule, i.e that it enforces
+// the policy list. Returns the response body.
+func MustBeBlockedByPolicy(t *testing.T, res *http.Response) []byte {
+	t.Helper()
+	return must.MatchResponse(t, res, BlockedByPolicy)
+}
+
+// PolicyRuleMatches returns true if the rule, a policy rule state event, applies to `entity`: a user ID, room ID or
+// server name depending on the rule type. Entities are globs where * matches any characters and ? matches one.
+func PolicyRuleMatches(rule gjson.Result, entity string) bool {
+	glob := rule.Get("content.entity").Str
+	if glob == "" {
+		return false
+	}
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("^" + pattern + "$").MatchString(entity)
+}
+
+// SyncPolicyRuleIs checks that the rule of type `ruleType` for `entity` comes down /sync in the policy room with
+// the given recommendation. An empty `recommendation` checks that the rule was removed.
+func SyncPolicyRuleIs(policyRoomID, ruleType, entity, recommendation string) SyncCheckOpt {
+	return SyncStateHas(policyRoomID, ruleType, "rule:"+entity, func(ev gjson.Result) bool {
+		if recommendation == "" {
+			return !ev.Get("content.entity").Exists()
+		}
+		return ev.Get("content.entity").Str == entity && ev.Get("content.recommendation").Str == recommendation
+	})
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// Presence is a user's presence as returned by /presence/{userId}/status.
+type Presence struct {
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool   `json:"currently_active,omitempty"`
+}
+
+// SetPresence sets this user's presence to `presence` ("online", "unavailable" or "offline") with an optional
+// status message. Fails the test on error.
+func (c *CSAPI) SetPresence(t *testing.T, presence, statusMsg string) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"presence": presence,
+	}
+	if statusMsg != "" {
+		reqBody["status_msg"] = statusMsg
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "presence", c.UserID, "status"}, WithJSONBody(t, reqBody))
+}
+
+// GetPresence returns the presence of `userID`. Fails the test on error.
+func (c *CSAPI) GetPresence(t *testing.T, userID string) Presence {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "presence", userID, "status"})
+	body := ParseJSON(t, res)
+	return Presence{
+		Presence:        gjson.GetBytes(body, "presence").Str,
+		StatusMsg:       gjson.GetBytes(body, "status_msg").Str,
+		LastActiveAgo:   gjson.GetBytes(body, "last_active_ago").Int(),
+		CurrentlyActive: gjson.GetBytes(body, "currently_active").Bool(),
+	}
+}
+
+// Check that the presence section has an m.presence event for `userID` with the presence `state`, e.g "online".
+// If `state` is empty, any presence event for the user passes.
+func SyncPresenceHas(userID, state string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(topLevelSyncJSON, "presence.events", func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.presence" && ev.Get("sender").Str == userID &&
+				(state == "" || ev.Get("content.presence").Str == state)
+		})
+		if err != nil {
+			return fmt.Errorf("SyncPresenceHas(%s, %s): %s", userID, state, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// Profile is a user's global profile as returned by /profile/{userId}.
+type Profile struct {
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// SetDisplayName sets the display name of this user. Fails the test on error.
+func (c *CSAPI) SetDisplayName(t *testing.T, displayName string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "profile", c.UserID, "displayname"}, WithJSONBody(t, map[string]interface{}{
+		"displayname": displayName,
+	}))
+}
+
+// SetAvatarURL sets the avatar of this user to the given mxc:// URI. Fails the test on error.
+func (c *CSAPI) SetAvatarURL(t *testing.T, avatarURL string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "profile", c.UserID, "avatar_url"}, WithJSONBody(t, map[string]interface{}{
+		"avatar_url": avatarURL,
+	}))
+}
+
+// GetProfile returns the global profile of `userID`, which may be on a remote server. Fails the test on error.
+func (c *CSAPI) GetProfile(t *testing.T, userID string) Profile {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "profile", userID})
+	body := ParseJSON(t, res)
+	var profile Profile
+	if err := json.Unmarshal(body, &profile); err != nil {
+		t.Fatalf("GetProfile: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return profile
+}
+
+// MustSyncUntilProfileInRooms syncs until the client sees an m.room.member event for `userID` with the given
+// profile in every room in `roomIDs`. Use this after SetDisplayName or SetAvatarURL to check the update was
+// propagated to the user's joined rooms. Returns the next batch token.
+func (c *CSAPI) MustSyncUntilProfileInRooms(t *testing.T, since, userID string, profile Profile, roomIDs ...string) string {
+	t.Helper()
+	checks := make([]SyncCheckOpt, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		checks = append(checks, SyncMemberProfileIs(roomID, userID, profile))
+	}
+	return c.MustSyncUntil(t, SyncReq{Since: since}, checks...)
+}
+
+// Check that the timeline or state for `roomID` has a join event for `userID` with the given profile.
+func SyncMemberProfileIs(roomID, userID string, profile Profile) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		for _, key := range []string{"timeline.events", "state.events"} {
+			for _, ev := range room.Get(key).Array() {
+				if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != userID {
+					continue
+				}
+				content := ev.Get("content")
+				if content.Get("membership").Str == "join" &&
+					content.Get("displayname").Str == profile.DisplayName &&
+					content.Get("avatar_url").Str == profile.AvatarURL {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("SyncMemberProfileIs(%s,%s): no join event with displayname %q avatar_url %q", roomID, userID, profile.DisplayName, profile.AvatarURL)
+	}
+}
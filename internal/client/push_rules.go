@@ -0,0 +1,181 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// Push rule kinds, in the order they are evaluated.
+const (
+	PushRuleKindOverride  = "override"
+	PushRuleKindContent   = "content"
+	PushRuleKindRoom      = "room"
+	PushRuleKindSender    = "sender"
+	PushRuleKindUnderride = "underride"
+)
+
+// PushCondition is a condition of a push rule.
+type PushCondition struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Is      string `json:"is,omitempty"`
+	// For event_property_is and event_property_contains
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PushRule is a push rule as returned by /pushrules, or as created by SetPushRule. Actions are e.g "notify" or
+// map[string]interface{}{"set_tweak": "highlight"}.
+type PushRule struct {
+	RuleID     string          `json:"rule_id,omitempty"`
+	Default    bool            `json:"default,omitempty"`
+	Enabled    bool            `json:"enabled,omitempty"`
+	Actions    []interface{}   `json:"actions"`
+	Conditions []PushCondition `json:"conditions,omitempty"`
+	Pattern    string          `json:"pattern,omitempty"`
+}
+
+// SetPushRule creates or replaces a global push rule. Only the actions, conditions and pattern of `rule` are
+// sent. `before` and `after` are rule IDs which position the rule, and may be empty. Fails the test on error.
+func (c *CSAPI) SetPushRule(t *testing.T, kind, ruleID string, rule PushRule, before, after string) {
+	t.Helper()
+	query := url.Values{}
+	if before != "" {
+		query.Set("before", before)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	reqBody := map[string]interface{}{
+		"actions": rule.Actions,
+	}
+	if rule.Conditions != nil {
+		reqBody["conditions"] = rule.Conditions
+	}
+	if rule.Pattern != "" {
+		reqBody["pattern"] = rule.Pattern
+	}
+	c.MustDoFunc(t, "PUT", pushRulePath(kind, ruleID), WithJSONBody(t, reqBody), WithQueries(query))
+}
+
+// GetPushRule returns a global push rule. Fails the test on error.
+func (c *CSAPI) GetPushRule(t *testing.T, kind, ruleID string) PushRule {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", pushRulePath(kind, ruleID))
+	body := ParseJSON(t, res)
+	var rule PushRule
+	if err := json.Unmarshal(body, &rule); err != nil {
+		t.Fatalf("GetPushRule: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return rule
+}
+
+// GetPushRules returns all of this user's push rules, i.e the `global` ruleset. Fails the test on error.
+func (c *CSAPI) GetPushRules(t *testing.T) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "pushrules", ""})
+	return gjson.ParseBytes(ParseJSON(t, res)).Get("global")
+}
+
+// DeletePushRule deletes a global push rule. Fails the test on error.
+func (c *CSAPI) DeletePushRule(t *testing.T, kind, ruleID string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", pushRulePath(kind, ruleID))
+}
+
+// SetPushRuleEnabled enables or disables a global push rule. Fails the test on error.
+func (c *CSAPI) SetPushRuleEnabled(t *testing.T, kind, ruleID string, enabled bool) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", append(pushRulePath(kind, ruleID), "enabled"), WithJSONBody(t, map[string]interface{}{
+		"enabled": enabled,
+	}))
+}
+
+// GetPushRuleActions returns the actions of a global push rule. Fails the test on error.
+func (c *CSAPI) GetPushRuleActions(t *testing.T, kind, ruleID string) []interface{} {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", append(pushRulePath(kind, ruleID), "actions"))
+	body := ParseJSON(t, res)
+	var actions struct {
+		Actions []interface{} `json:"actions"`
+	}
+	if err := json.Unmarshal(body, &actions); err != nil {
+		t.Fatalf("GetPushRuleActions: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return actions.Actions
+}
+
+// SetPushRuleActions replaces the actions of a global push rule. Fails the test on error.
+func (c *CSAPI) SetPushRuleActions(t *testing.T, kind, ruleID string, actions []interface{}) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", append(pushRulePath(kind, ruleID), "actions"), WithJSONBody(t, map[string]interface{}{
+		"actions": actions,
+	}))
+}
+
+func pushRulePath(kind, ruleID string) []string {
+	return []string{"_matrix", "client", "v3", "pushrules", "global", kind, ruleID}
+}
+
+// GetNotifications returns one page of /notifications and the `next_token`, which is empty on the last page.
+// `only` may be "highlight" to only return highlights. Fails the test on error.
+func (c *CSAPI) GetNotifications(t *testing.T, from string, limit int, only string) (notifications []gjson.Result, nextToken string) {
+	t.Helper()
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if only != "" {
+		query.Set("only", only)
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "notifications"}, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	return body.Get("notifications").Array(), body.Get("next_token").Str
+}
+
+// NotificationIsHighlight returns true if the notification's actions set the highlight tweak.
+func NotificationIsHighlight(notification gjson.Result) bool {
+	for _, action := range notification.Get("actions").Array() {
+		if action.Get("set_tweak").Str == "highlight" {
+			value := action.Get("value")
+			return !value.Exists() || value.Bool()
+		}
+	}
+	return false
+}
+
+// unreadNotificationCounts returns the unread_notifications object for `roomID` in a sync response.
+func unreadNotificationCounts(topLevelSyncJSON gjson.Result, roomID string) (gjson.Result, error) {
+	counts := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".unread_notifications")
+	if !counts.Exists() {
+		return counts, fmt.Errorf("no unread_notifications for room")
+	}
+	return counts, nil
+}
+
+// Check that the unread notification counts for `roomID` are as given.
+func SyncUnreadNotificationCountsAre(roomID string, notificationCount, highlightCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		counts, err := unreadNotificationCounts(topLevelSyncJSON, roomID)
+		if err != nil {
+			return fmt.Errorf("SyncUnreadNotificationCountsAre(%s): %w", roomID, err)
+		}
+		gotNotifs := counts.Get("notification_count").Int()
+		gotHighlights := counts.Get("highlight_count").Int()
+		if gotNotifs != notificationCount || gotHighlights != highlightCount {
+			return fmt.Errorf(
+				"SyncUnreadNotificationCountsAre(%s): got notification_count=%d highlight_count=%d, want %d and %d",
+				roomID, gotNotifs, gotHighlights, notificationCount, highlightCount,
+			)
+		}
+		return nil
+	}
+}
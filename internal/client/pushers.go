@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Pusher is an HTTP pusher as used by /pushers and /pushers/set.
+type Pusher struct {
+	AppID             string     `json:"app_id"`
+	AppDisplayName    string     `json:"app_display_name"`
+	DeviceDisplayName string     `json:"device_display_name"`
+	Kind              string     `json:"kind"`
+	Lang              string     `json:"lang"`
+	Pushkey           string     `json:"pushkey"`
+	ProfileTag        string     `json:"profile_tag,omitempty"`
+	Data              PusherData `json:"data"`
+}
+
+// PusherData is the `data` of a pusher. URL must point at a push gateway's /_matrix/push/v1/notify endpoint,
+// e.g web.PushGateway.URL.
+type PusherData struct {
+	URL    string `json:"url,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// SetPusher creates or updates an HTTP pusher. If `appendPusher` is true, other pushers with the same app ID
+// and pushkey are kept. `Kind` defaults to "http" and `Lang` to "en". Fails the test on error.
+func (c *CSAPI) SetPusher(t *testing.T, pusher Pusher, appendPusher bool) {
+	t.Helper()
+	if pusher.Kind == "" {
+		pusher.Kind = "http"
+	}
+	if pusher.Lang == "" {
+		pusher.Lang = "en"
+	}
+	reqBody := map[string]interface{}{}
+	marshalled, err := json.Marshal(pusher)
+	if err != nil {
+		t.Fatalf("SetPusher: failed to marshal pusher: %s", err)
+	}
+	if err = json.Unmarshal(marshalled, &reqBody); err != nil {
+		t.Fatalf("SetPusher: failed to unmarshal pusher: %s", err)
+	}
+	reqBody["append"] = appendPusher
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "pushers", "set"}, WithJSONBody(t, reqBody))
+}
+
+// DeletePusher deletes the pusher with the given app ID and pushkey. Fails the test on error.
+func (c *CSAPI) DeletePusher(t *testing.T, appID, pushkey string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "pushers", "set"}, WithJSONBody(t, map[string]interface{}{
+		"app_id":  appID,
+		"pushkey": pushkey,
+		"kind":    nil,
+	}))
+}
+
+// GetPushers returns all pushers for this user. Fails the test on error.
+func (c *CSAPI) GetPushers(t *testing.T) []Pusher {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "pushers"})
+	body := ParseJSON(t, res)
+	var pushers struct {
+		Pushers []Pusher `json:"pushers"`
+	}
+	if err := json.Unmarshal(body, &pushers); err != nil {
+		t.Fatalf("GetPushers: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return pushers.Pushers
+}
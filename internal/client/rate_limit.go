@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// RateLimitPolicy controls how DoFunc handles 429 M_LIMIT_EXCEEDED responses. The zero value returns them to
+// the caller, so tests can assert on rate limiting.
+type RateLimitPolicy struct {
+	// The total time a single request may spend waiting for rate limits. Requests are retried after the
+	// `retry_after_ms` the server asks for, or the Retry-After header, until this budget runs out. The 429 is
+	// then returned to the caller.
+	MaxWait time.Duration
+	// Fail the test on any 429 rather than retrying, e.g to check a test does not trip rate limits.
+	Strict bool
+}
+
+// defaultRetryAfter is used when a 429 response does not say how long to wait.
+const defaultRetryAfter = 500 * time.Millisecond
+
+// shouldRetry returns how long to wait before retrying if `res` is a 429 and the budget allows it. The response
+// body is left intact.
+func (p RateLimitPolicy) shouldRetry(t *testing.T, res *http.Response, waitedSoFar time.Duration) (time.Duration, bool) {
+	t.Helper()
+	if res.StatusCode != 429 || (p.MaxWait == 0 && !p.Strict) {
+		return 0, false
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if p.Strict {
+		t.Fatalf("CSAPI.DoFunc: %s %s was rate limited with RateLimitPolicy.Strict set: %s", res.Request.Method, res.Request.URL, string(body))
+	}
+	retryAfter := defaultRetryAfter
+	if ms := gjson.GetBytes(body, "retry_after_ms"); ms.Exists() {
+		retryAfter = time.Duration(ms.Int()) * time.Millisecond
+	} else if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	if waitedSoFar+retryAfter > p.MaxWait {
+		return 0, false
+	}
+	return retryAfter, true
+}
+
+// Expected responses when the homeserver rate limits a request.
+var (
+	// The request was rate limited.
+	RateLimited = match.HTTPResponse{
+		StatusCode: 429,
+		JSON:       []match.JSON{match.JSONKeyEqual("errcode", "M_LIMIT_EXCEEDED")},
+	}
+	// The request was rate limited, and the server said how long to wait.
+	RateLimitedWithRetryAfter = match.HTTPResponse{
+		StatusCode: 429,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("errcode", "M_LIMIT_EXCEEDED"),
+			match.JSONKeyTypeEqual("retry_after_ms", gjson.Number),
+		},
+	}
+)
+
+// MustBeRateLimited asserts that `res` is a 429 M_LIMIT_EXCEEDED with `retry_after_ms`, and returns how long it
+// says to wait. If `wantRetryAfterHeader` is true, the Retry-After header must also be set, to the wait rounded
+// up to whole seconds.
+func MustBeRateLimited(t *testing.T, res *http.Response, wantRetryAfterHeader bool) time.Duration {
+	t.Helper()
+	body := must.MatchResponse(t, res, RateLimitedWithRetryAfter)
+	retryAfter := time.Duration(gjson.GetBytes(body, "retry_after_ms").Int()) * time.Millisecond
+	if wantRetryAfterHeader {
+		header := res.Header.Get("Retry-After")
+		secs, err := strconv.Atoi(header)
+		if err != nil {
+			t.Fatalf("MustBeRateLimited: Retry-After header %q is not a number of seconds", header)
+		}
+		wantSecs := int((retryAfter + time.Second - 1) / time.Second)
+		if secs != wantSecs {
+			t.Fatalf("MustBeRateLimited: Retry-After header is %d seconds, want %d to match retry_after_ms %d", secs, wantSecs, retryAfter.Milliseconds())
+		}
+	}
+	return retryAfter
+}
+
+// TripRateLimit calls `fn` `attempts` times in quick succession and returns the responses which were rate limited,
+// so tests can assert on how many requests the homeserver allows. The client's RateLimitPolicy must not retry
+// rate limited requests, which is the default.
+func TripRateLimit(t *testing.T, attempts int, fn func() *http.Response) []*http.Response {
+	t.Helper()
+	var limited []*http.Response
+	for i := 0; i < attempts; i++ {
+		res := fn()
+		if res.StatusCode == 429 {
+			limited = append(limited, res)
+		} else {
+			res.Body.Close()
+		}
+	}
+	return limited
+}
+
+// MustTripRateLimit calls `fn` until it is rate limited, and returns the rate limited response. Fails the test if
+// it is not rate limited within `maxAttempts` calls.
+func MustTripRateLimit(t *testing.T, maxAttempts int, fn func() *http.Response) *http.Response {
+	t.Helper()
+	for i := 0; i < maxAttempts; i++ {
+		res := fn()
+		if res.StatusCode == 429 {
+			return res
+		}
+		res.Body.Close()
+	}
+	t.Fatalf("MustTripRateLimit: not rate limited after %d attempts", maxAttempts)
+	return nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	ReceiptTypeRead        = "m.read"
+	ReceiptTypeReadPrivate = "m.read.private"
+	// ReceiptThreadMain is the thread ID of receipts for events which are not in a thread.
+	ReceiptThreadMain = "main"
+)
+
+// SendReceipt sends a receipt of `receiptType` for the event. If `threadID` is non-empty, a threaded receipt is
+// sent: use ReceiptThreadMain for events outside of any thread. Fails the test on error.
+func (c *CSAPI) SendReceipt(t *testing.T, roomID, eventID, receiptType, threadID string) {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if threadID != "" {
+		reqBody["thread_id"] = threadID
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "receipt", receiptType, eventID}, WithJSONBody(t, reqBody))
+}
+
+// SendReadMarkers sets the fully read marker and read receipts via /read_markers. Empty event IDs are omitted
+// from the request. Fails the test on error.
+func (c *CSAPI) SendReadMarkers(t *testing.T, roomID, fullyReadEventID, readEventID, readPrivateEventID string) {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if fullyReadEventID != "" {
+		reqBody["m.fully_read"] = fullyReadEventID
+	}
+	if readEventID != "" {
+		reqBody[ReceiptTypeRead] = readEventID
+	}
+	if readPrivateEventID != "" {
+		reqBody[ReceiptTypeReadPrivate] = readPrivateEventID
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "read_markers"}, WithJSONBody(t, reqBody))
+}
+
+// Check that the ephemeral section for `roomID` has a receipt of `receiptType` from `userID` for `eventID`.
+func SyncReceiptHas(roomID, userID, eventID, receiptType string) SyncCheckOpt {
+	return SyncEphemeralHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.receipt" &&
+			ev.Get("content."+GjsonEscape(eventID)+"."+GjsonEscape(receiptType)+"."+GjsonEscape(userID)).Exists()
+	})
+}
+
+// Check that the ephemeral section for `roomID` has a receipt of `receiptType` from `userID` for `eventID` in
+// the thread `threadID`. Use ReceiptThreadMain for receipts outside of any thread.
+func SyncThreadedReceiptHas(roomID, userID, eventID, receiptType, threadID string) SyncCheckOpt {
+	return SyncEphemeralHas(roomID, func(ev gjson.Result) bool {
+		receipt := ev.Get("content." + GjsonEscape(eventID) + "." + GjsonEscape(receiptType) + "." + GjsonEscape(userID))
+		return ev.Get("type").Str == "m.receipt" && receipt.Exists() && receipt.Get("thread_id").Str == threadID
+	})
+}
+
+// Check that the room account data for `roomID` has an m.fully_read marker at `eventID`.
+func SyncFullyReadIs(roomID, eventID string) SyncCheckOpt {
+	return SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.fully_read" && ev.Get("content.event_id").Str == eventID
+	})
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// LoginWithRefreshToken logs in with a password, requesting a refresh token (MSC2918). The client's user ID,
+// access token, device ID and refresh token are replaced with those from the response. Fails the test on error.
+func (c *CSAPI) LoginWithRefreshToken(t *testing.T, localpart, password string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": localpart,
+		},
+		"password":      password,
+		"refresh_token": true,
+	}))
+	c.setTokensFromResponse(t, "LoginWithRefreshToken", ParseJSON(t, res))
+}
+
+// RegisterUserWithRefreshToken is like RegisterUser but requests a refresh token, and stores the user ID,
+// access token, device ID and refresh token on the client. Fails the test on error.
+func (c *CSAPI) RegisterUserWithRefreshToken(t *testing.T, localpart, password string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "register"}, WithJSONBody(t, map[string]interface{}{
+		"auth": map[string]string{
+			"type": "m.login.dummy",
+		},
+		"username":      localpart,
+		"password":      password,
+		"refresh_token": true,
+	}))
+	c.setTokensFromResponse(t, "RegisterUserWithRefreshToken", ParseJSON(t, res))
+}
+
+func (c *CSAPI) setTokensFromResponse(t *testing.T, funcName string, body []byte) {
+	t.Helper()
+	c.UserID = GetJSONFieldStr(t, body, "user_id")
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	c.DeviceID = GetJSONFieldStr(t, body, "device_id")
+	c.RefreshToken = gjson.GetBytes(body, "refresh_token").Str
+	if c.RefreshToken == "" {
+		t.Fatalf("%s: server did not return a refresh token: %s", funcName, string(body))
+	}
+}
+
+// DoRefresh calls /refresh with the given refresh token, without updating the client. Use this to assert on
+// refresh failures such as reusing a rotated refresh token.
+func (c *CSAPI) DoRefresh(t *testing.T, refreshToken string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "refresh"}, WithoutAccessToken(), WithJSONBody(t, map[string]interface{}{
+		"refresh_token": refreshToken,
+	}))
+}
+
+// MustRefresh exchanges the client's refresh token for a new access token, and stores the new access token
+// and the new refresh token if the server rotated it. Clients which logged in via LoginWithOIDC refresh
+// against the auth service instead of /refresh. Fails the test on error.
+func (c *CSAPI) MustRefresh(t *testing.T) {
+	t.Helper()
+	if c.RefreshToken == "" {
+		t.Fatalf("MustRefresh: client %s has no refresh token", c.UserID)
+	}
+	if c.oidc != nil {
+		c.mustRefreshOIDC(t)
+		return
+	}
+	res := c.DoRefresh(t, c.RefreshToken)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("MustRefresh: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	if refreshToken := gjson.GetBytes(body, "refresh_token").Str; refreshToken != "" {
+		c.RefreshToken = refreshToken
+	}
+}
+
+// autoRefreshEnabled returns true if DoFunc should refresh the access token when `req` gets a soft logout.
+func (c *CSAPI) autoRefreshEnabled(req *http.Request) bool {
+	return c.RefreshToken != "" && !c.DisableAutoRefresh && req.Header.Get("Authorization") != ""
+}
+
+// shouldRefresh returns true if the response is an M_UNKNOWN_TOKEN error with soft_logout set, or any
+// M_UNKNOWN_TOKEN error for clients which logged in via OIDC. The response body is left intact.
+func (c *CSAPI) shouldRefresh(t *testing.T, res *http.Response) bool {
+	t.Helper()
+	if res.StatusCode != 401 || res.Body == nil {
+		return false
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("CSAPI.DoFunc failed to read 401 response body: %s", err)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if gjson.GetBytes(body, "errcode").Str != "M_UNKNOWN_TOKEN" {
+		return false
+	}
+	return c.oidc != nil || gjson.GetBytes(body, "soft_logout").Bool()
+}
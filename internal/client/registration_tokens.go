@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// RegisterUserWithToken registers a user using an m.login.registration_token stage (MSC3231), completing any
+// m.login.dummy stage the server asks for afterwards. Fails the test if registration does not succeed.
+// Returns the user ID, access token and device ID.
+func (c *CSAPI) RegisterUserWithToken(t *testing.T, localpart, password, token string) (userID, accessToken, deviceID string) {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v3", "register"}
+	reqBody := map[string]interface{}{
+		"username": localpart,
+		"password": password,
+	}
+	res := c.DoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	// each UIA stage is completed in turn until the server stops returning 401
+	for i := 0; res.StatusCode == 401; i++ {
+		body := ParseJSON(t, res)
+		if i > 2 {
+			t.Fatalf("RegisterUserWithToken: server still requires auth after %d stages: %s", i, string(body))
+		}
+		auth := map[string]interface{}{
+			"type":    "m.login.dummy",
+			"session": gjson.GetBytes(body, "session").Str,
+		}
+		completed := false
+		for _, stage := range gjson.GetBytes(body, "completed").Array() {
+			if stage.Str == "m.login.registration_token" {
+				completed = true
+			}
+		}
+		if !completed {
+			auth["type"] = "m.login.registration_token"
+			auth["token"] = token
+		}
+		reqBody["auth"] = auth
+		res = c.DoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	}
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("RegisterUserWithToken: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	userID = gjson.GetBytes(body, "user_id").Str
+	accessToken = gjson.GetBytes(body, "access_token").Str
+	deviceID = gjson.GetBytes(body, "device_id").Str
+	return userID, accessToken, deviceID
+}
+
+// RegistrationTokenIsValid checks the token using the registration token validity endpoint. Fails the test on
+// error, e.g if the server rate limits the request.
+func (c *CSAPI) RegistrationTokenIsValid(t *testing.T, token string) bool {
+	t.Helper()
+	res := c.MustDoFunc(
+		t, "GET", []string{"_matrix", "client", "v1", "register", "m.login.registration_token", "validity"},
+		WithQueries(url.Values{"token": []string{token}}),
+	)
+	return gjson.GetBytes(ParseJSON(t, res), "valid").Bool()
+}
+
+// SynapseCreateRegistrationToken creates a registration token using the Synapse admin API. This client must be a
+// server admin. If `token` is empty Synapse generates one. `usesAllowed` and `expiryTimeMillis` are unlimited if
+// zero. Returns the token.
+func (c *CSAPI) SynapseCreateRegistrationToken(t *testing.T, token string, usesAllowed int, expiryTimeMillis int64) string {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if token != "" {
+		reqBody["token"] = token
+	}
+	if usesAllowed != 0 {
+		reqBody["uses_allowed"] = usesAllowed
+	}
+	if expiryTimeMillis != 0 {
+		reqBody["expiry_time"] = expiryTimeMillis
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_synapse", "admin", "v1", "registration_tokens", "new"}, WithJSONBody(t, reqBody))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "token")
+}
+
+// SynapseDeleteRegistrationToken deletes a registration token using the Synapse admin API. This client must be a
+// server admin.
+func (c *CSAPI) SynapseDeleteRegistrationToken(t *testing.T, token string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_synapse", "admin", "v1", "registration_tokens", token})
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// RelationsReq selects which relations GetRelations returns. Empty fields are omitted from the request.
+type RelationsReq struct {
+	// Only return relations of this type, e.g "m.annotation".
+	RelType string
+	// Only return relations with this event type. Requires RelType.
+	EventType string
+	// Also return relations of the relations, up to the server's maximum depth.
+	Recurse bool
+	// "f" or "b". Defaults to "b", newest first.
+	Dir   string
+	From  string
+	To    string
+	Limit int
+}
+
+// RelationsResp is a page of relations returned by GetRelations.
+type RelationsResp struct {
+	Chunk          []gjson.Result
+	NextBatch      string
+	PrevBatch      string
+	RecursionDepth int64
+}
+
+// SendReaction reacts to `eventID` with `key`, e.g an emoji. Returns the event ID of the reaction.
+func (c *CSAPI) SendReaction(t *testing.T, roomID, eventID, key string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": eventID,
+				"key":      key,
+			},
+		},
+	})
+}
+
+// GetRelations returns a single page of the events which relate to `eventID`. Fails the test on error.
+func (c *CSAPI) GetRelations(t *testing.T, roomID, eventID string, req RelationsReq) RelationsResp {
+	t.Helper()
+	paths, query := req.pathsAndQuery(t, roomID, eventID)
+	res := c.MustDoFunc(t, "GET", paths, WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	return RelationsResp{
+		Chunk:          body.Get("chunk").Array(),
+		NextBatch:      body.Get("next_batch").Str,
+		PrevBatch:      body.Get("prev_batch").Str,
+		RecursionDepth: body.Get("recursion_depth").Int(),
+	}
+}
+
+// GetAllRelations returns all the events which relate to `eventID`, following `next_batch` from `req.From` until
+// all events have been fetched. Fails the test on error.
+func (c *CSAPI) GetAllRelations(t *testing.T, roomID, eventID string, req RelationsReq) []gjson.Result {
+	t.Helper()
+	paths, query := req.pathsAndQuery(t, roomID, eventID)
+	return c.mustPaginate(t, paths, query)
+}
+
+func (req RelationsReq) pathsAndQuery(t *testing.T, roomID, eventID string) ([]string, url.Values) {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID}
+	if req.EventType != "" && req.RelType == "" {
+		t.Fatalf("GetRelations: RelationsReq.EventType requires RelType")
+	}
+	if req.RelType != "" {
+		paths = append(paths, req.RelType)
+	}
+	if req.EventType != "" {
+		paths = append(paths, req.EventType)
+	}
+	query := url.Values{}
+	if req.Recurse {
+		query.Set("recurse", "true")
+	}
+	if req.Dir != "" {
+		query.Set("dir", req.Dir)
+	}
+	if req.From != "" {
+		query.Set("from", req.From)
+	}
+	if req.To != "" {
+		query.Set("to", req.To)
+	}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	return paths, query
+}
+
+// MustHaveReactionCount asserts that /event returns `eventID` with an m.annotation aggregation in which `key`
+// has been used `count` times.
+func (c *CSAPI) MustHaveReactionCount(t *testing.T, roomID, eventID, key string, count int64) {
+	t.Helper()
+	if err := checkReactionCount(c.GetEvent(t, roomID, eventID), key, count); err != nil {
+		t.Fatalf("MustHaveReactionCount(%s): %s", eventID, err)
+	}
+}
+
+// Check that the timeline for `roomID` has `eventID` with an m.annotation aggregation in which `key` has been
+// used `count` times.
+func SyncReactionCountIs(roomID, eventID, key string, count int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var lastErr error
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("event_id").Str != eventID {
+				return false
+			}
+			lastErr = checkReactionCount(ev, key, count)
+			return lastErr == nil
+		})(clientUserID, topLevelSyncJSON)
+		if lastErr != nil {
+			return fmt.Errorf("SyncReactionCountIs(%s): %s", eventID, lastErr)
+		}
+		if err != nil {
+			return fmt.Errorf("SyncReactionCountIs(%s): %s", eventID, err)
+		}
+		return nil
+	}
+}
+
+// checkReactionCount checks the m.annotation aggregation bundled in the event's unsigned relations.
+func checkReactionCount(ev gjson.Result, key string, count int64) error {
+	for _, group := range ev.Get(`unsigned.m\.relations.m\.annotation.chunk`).Array() {
+		if group.Get("key").Str != key {
+			continue
+		}
+		if got := group.Get("count").Int(); got != count {
+			return fmt.Errorf("got %d reactions with key %s, want %d", got, key, count)
+		}
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+	return fmt.Errorf("no m.annotation aggregation for key %s: %s", key, ev.Get("unsigned").Raw)
+}
@@ -0,0 +1,330 @@
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The ECIES info prefix used when deriving secure channel keys for QR code login (MSC4108).
+const secureChannelInfoPrefix = "MATRIX_QR_CODE_LOGIN_ECIES_V1"
+
+// RendezvousSession is a session on the MSC4108 rendezvous endpoint, which two devices use to exchange
+// messages while one of them signs in the other by scanning a QR code.
+type RendezvousSession struct {
+	// The absolute URL of the session.
+	URL string
+	// The ETag of the latest message sent or received on the session.
+	ETag string
+
+	c *CSAPI
+}
+
+// CreateRendezvous creates a new rendezvous session containing `data`. The rendezvous endpoint does not require
+// authentication, so this can be called on a client which is not logged in. Fails the test on error.
+func (c *CSAPI) CreateRendezvous(t *testing.T, data string) *RendezvousSession {
+	t.Helper()
+	res := c.MustDoFunc(
+		t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc4108", "rendezvous"},
+		WithRawBody([]byte(data)), WithContentType("text/plain"), WithoutAccessToken(),
+	)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("CreateRendezvous: failed to read response body: %s", err)
+	}
+	// Early drafts of MSC4108 return the session URL in the Location header rather than the body.
+	sessionURL := gjson.GetBytes(body, "url").Str
+	if sessionURL == "" {
+		sessionURL = res.Header.Get("Location")
+	}
+	if sessionURL == "" {
+		t.Fatalf("CreateRendezvous: response has no session url: %s", string(body))
+	}
+	base, err := url.Parse(c.BaseURL + "/")
+	if err != nil {
+		t.Fatalf("CreateRendezvous: invalid BaseURL: %s", err)
+	}
+	ref, err := url.Parse(sessionURL)
+	if err != nil {
+		t.Fatalf("CreateRendezvous: invalid session url %s: %s", sessionURL, err)
+	}
+	return &RendezvousSession{
+		URL:  base.ResolveReference(ref).String(),
+		ETag: res.Header.Get("ETag"),
+		c:    c,
+	}
+}
+
+// JoinRendezvous returns the rendezvous session at `sessionURL`, e.g as read from a QR code, as seen by this
+// client. Call Poll to read the current message.
+func (c *CSAPI) JoinRendezvous(sessionURL string) *RendezvousSession {
+	return &RendezvousSession{
+		URL: sessionURL,
+		c:   c,
+	}
+}
+
+// DoSend replaces the message on the session with `data`, if the session has not been updated since the
+// ETag last seen, and returns the response.
+func (s *RendezvousSession) DoSend(t *testing.T, data string) *http.Response {
+	t.Helper()
+	res := s.do(t, "PUT", bytes.NewBufferString(data), "If-Match")
+	if res.StatusCode == 202 {
+		s.ETag = res.Header.Get("ETag")
+	}
+	return res
+}
+
+// Send replaces the message on the session with `data`. Fails the test if the request is rejected, including
+// if the other device has sent a message which has not been polled yet.
+func (s *RendezvousSession) Send(t *testing.T, data string) {
+	t.Helper()
+	res := s.DoSend(t, data)
+	if res.StatusCode != 202 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("RendezvousSession.Send: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+}
+
+// Poll returns the message on the session and true, or false if it has not changed since the ETag last seen.
+// Fails the test on error, including if the session has expired or been deleted.
+func (s *RendezvousSession) Poll(t *testing.T) (string, bool) {
+	t.Helper()
+	res := s.do(t, "GET", nil, "If-None-Match")
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("RendezvousSession.Poll: failed to read response body: %s", err)
+	}
+	switch res.StatusCode {
+	case 304:
+		return "", false
+	case 200:
+		etag := res.Header.Get("ETag")
+		if etag == s.ETag {
+			return "", false
+		}
+		s.ETag = etag
+		return string(body), true
+	default:
+		t.Fatalf("RendezvousSession.Poll: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return "", false
+}
+
+// MustPollUntilMessage polls the session until it has a new message, then returns it. Fails the test if there
+// is no new message within the client's SyncUntilTimeout.
+func (s *RendezvousSession) MustPollUntilMessage(t *testing.T) string {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < s.c.SyncUntilTimeout {
+		if data, ok := s.Poll(t); ok {
+			return data
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("RendezvousSession.MustPollUntilMessage: no new message after %v", s.c.SyncUntilTimeout)
+	return ""
+}
+
+// Delete deletes the session. Fails the test on error.
+func (s *RendezvousSession) Delete(t *testing.T) {
+	t.Helper()
+	res := s.do(t, "DELETE", nil, "")
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("RendezvousSession.Delete: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+}
+
+// do sends an unauthenticated request to the session URL, setting the ETag last seen in `etagHeader` if non-empty.
+func (s *RendezvousSession) do(t *testing.T, method string, body io.Reader, etagHeader string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL, body)
+	if err != nil {
+		t.Fatalf("RendezvousSession: failed to create request: %s", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	if etagHeader != "" && s.ETag != "" {
+		req.Header.Set(etagHeader, s.ETag)
+	}
+	res, err := s.c.Client.Do(req)
+	if err != nil {
+		t.Fatalf("RendezvousSession: %s %s returned error: %s", method, s.URL, err)
+	}
+	t.Cleanup(func() {
+		res.Body.Close()
+	})
+	return res
+}
+
+// SecureChannel is the end-to-end encrypted channel which two devices establish over a rendezvous session for
+// QR code login (MSC4108). Each side has an ephemeral X25519 key: the device showing the QR code includes its
+// public key in the code, and the device scanning it sends its own public key in the first message. Keys for
+// each direction are derived from the shared secret with HKDF-SHA256, and messages are encrypted with
+// ChaCha20-Poly1305 using a counter as the nonce.
+type SecureChannel struct {
+	privateKey []byte
+	publicKey  []byte
+	showsQR    bool
+	sendAEAD   cipher.AEAD
+	recvAEAD   cipher.AEAD
+	sendCount  uint64
+	recvCount  uint64
+}
+
+// NewSecureChannel generates an ephemeral key for a new secure channel. `showsQR` is true for the device which
+// shows the QR code, and false for the device which scans it.
+func NewSecureChannel(t *testing.T, showsQR bool) *SecureChannel {
+	t.Helper()
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		t.Fatalf("NewSecureChannel: failed to generate key: %s", err)
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("NewSecureChannel: failed to derive public key: %s", err)
+	}
+	return &SecureChannel{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		showsQR:    showsQR,
+	}
+}
+
+// PublicKey returns the unpadded base64 public key of this side of the channel.
+func (sc *SecureChannel) PublicKey() string {
+	return base64.RawStdEncoding.EncodeToString(sc.publicKey)
+}
+
+// Establish derives the channel keys from the other device's unpadded base64 public key. The device which
+// scans the QR code calls this with the key from the code, before sending InitiateMessage.
+func (sc *SecureChannel) Establish(t *testing.T, theirPublicKey string) {
+	t.Helper()
+	theirKey, err := base64.RawStdEncoding.DecodeString(theirPublicKey)
+	if err != nil {
+		t.Fatalf("SecureChannel.Establish: invalid public key: %s", err)
+	}
+	sc.establish(t, theirKey)
+}
+
+// InitiateMessage encrypts `content` as JSON into the first message on the channel, which also carries this
+// device's public key so the device which showed the QR code can establish the channel.
+func (sc *SecureChannel) InitiateMessage(t *testing.T, content interface{}) string {
+	t.Helper()
+	ciphertext := sc.seal(t, content)
+	return base64.RawStdEncoding.EncodeToString(append(ciphertext, sc.publicKey...))
+}
+
+// OpenInitiateMessage establishes the channel from the first message sent by the device which scanned the QR
+// code, and returns its decrypted JSON content.
+func (sc *SecureChannel) OpenInitiateMessage(t *testing.T, message string) gjson.Result {
+	t.Helper()
+	raw, err := base64.RawStdEncoding.DecodeString(message)
+	if err != nil || len(raw) < curve25519.PointSize {
+		t.Fatalf("SecureChannel.OpenInitiateMessage: malformed message: %v", err)
+	}
+	split := len(raw) - curve25519.PointSize
+	sc.establish(t, raw[split:])
+	return sc.open(t, raw[:split])
+}
+
+// Seal encrypts `content` as JSON into a message to send on the rendezvous session.
+func (sc *SecureChannel) Seal(t *testing.T, content interface{}) string {
+	t.Helper()
+	return base64.RawStdEncoding.EncodeToString(sc.seal(t, content))
+}
+
+// Open decrypts a message received on the rendezvous session and returns its JSON content.
+func (sc *SecureChannel) Open(t *testing.T, message string) gjson.Result {
+	t.Helper()
+	raw, err := base64.RawStdEncoding.DecodeString(message)
+	if err != nil {
+		t.Fatalf("SecureChannel.Open: malformed message: %s", err)
+	}
+	return sc.open(t, raw)
+}
+
+func (sc *SecureChannel) establish(t *testing.T, theirKey []byte) {
+	t.Helper()
+	shared, err := curve25519.X25519(sc.privateKey, theirKey)
+	if err != nil {
+		t.Fatalf("SecureChannel: failed to compute shared secret: %s", err)
+	}
+	// Both sides must agree on the info, so it always lists the QR code device's key first.
+	qrKey, scannerKey := sc.publicKey, theirKey
+	if !sc.showsQR {
+		qrKey, scannerKey = theirKey, sc.publicKey
+	}
+	info := secureChannelInfoPrefix + "|" + base64.RawStdEncoding.EncodeToString(qrKey) + "|" + base64.RawStdEncoding.EncodeToString(scannerKey)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, []byte(info)), keys); err != nil {
+		t.Fatalf("SecureChannel: failed to derive keys: %s", err)
+	}
+	qrToScanner, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		t.Fatalf("SecureChannel: failed to create cipher: %s", err)
+	}
+	scannerToQR, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		t.Fatalf("SecureChannel: failed to create cipher: %s", err)
+	}
+	if sc.showsQR {
+		sc.sendAEAD, sc.recvAEAD = qrToScanner, scannerToQR
+	} else {
+		sc.sendAEAD, sc.recvAEAD = scannerToQR, qrToScanner
+	}
+}
+
+func (sc *SecureChannel) seal(t *testing.T, content interface{}) []byte {
+	t.Helper()
+	if sc.sendAEAD == nil {
+		t.Fatalf("SecureChannel: channel is not established")
+	}
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("SecureChannel: failed to marshal content: %s", err)
+	}
+	ciphertext := sc.sendAEAD.Seal(nil, secureChannelNonce(sc.sendCount), plaintext, nil)
+	sc.sendCount++
+	return ciphertext
+}
+
+func (sc *SecureChannel) open(t *testing.T, ciphertext []byte) gjson.Result {
+	t.Helper()
+	if sc.recvAEAD == nil {
+		t.Fatalf("SecureChannel: channel is not established")
+	}
+	plaintext, err := sc.recvAEAD.Open(nil, secureChannelNonce(sc.recvCount), ciphertext, nil)
+	if err != nil {
+		t.Fatalf("SecureChannel: failed to decrypt message %d: %s", sc.recvCount, err)
+	}
+	sc.recvCount++
+	if !gjson.ValidBytes(plaintext) {
+		t.Fatalf("SecureChannel: decrypted message is not JSON: %s", string(plaintext))
+	}
+	return gjson.ParseBytes(plaintext)
+}
+
+func secureChannelNonce(count uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], count)
+	return nonce
+}
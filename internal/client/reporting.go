@@ -0,0 +1,80 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// ReportEvent reports an event to the homeserver administrators. `score` is only sent if non-nil, as it was
+// removed from the spec in v1.14. Fails the test on error.
+func (c *CSAPI) ReportEvent(t *testing.T, roomID, eventID, reason string, score *int) {
+	t.Helper()
+	mustReport(t, "ReportEvent", c.DoReportEvent(t, roomID, eventID, reason, score))
+}
+
+// DoReportEvent is the same as ReportEvent but returns the response, for testing reports which should fail.
+func (c *CSAPI) DoReportEvent(t *testing.T, roomID, eventID, reason string, score *int) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"reason": reason,
+	}
+	if score != nil {
+		reqBody["score"] = *score
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report", eventID}, WithJSONBody(t, reqBody))
+}
+
+// ReportRoom reports a room to the homeserver administrators. Fails the test on error.
+func (c *CSAPI) ReportRoom(t *testing.T, roomID, reason string) {
+	t.Helper()
+	mustReport(t, "ReportRoom", c.DoReportRoom(t, roomID, reason))
+}
+
+// DoReportRoom is the same as ReportRoom but returns the response, for testing reports which should fail. Uses
+// the stable endpoint, falling back to the unstable MSC4151 endpoint if the server does not support it.
+func (c *CSAPI) DoReportRoom(t *testing.T, roomID, reason string) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"reason": reason,
+	}
+	return c.doReportWithFallback(t, []string{"_matrix", "client", "v3", "rooms", roomID, "report"},
+		[]string{"_matrix", "client", "unstable", "org.matrix.msc4151", "rooms", roomID, "report"}, reqBody)
+}
+
+// ReportUser reports a user to the homeserver administrators. Fails the test on error.
+func (c *CSAPI) ReportUser(t *testing.T, userID, reason string) {
+	t.Helper()
+	mustReport(t, "ReportUser", c.DoReportUser(t, userID, reason))
+}
+
+// DoReportUser is the same as ReportUser but returns the response, for testing reports which should fail. Uses
+// the stable endpoint, falling back to the unstable MSC4260 endpoint if the server does not support it.
+func (c *CSAPI) DoReportUser(t *testing.T, userID, reason string) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"reason": reason,
+	}
+	return c.doReportWithFallback(t, []string{"_matrix", "client", "v3", "users", userID, "report"},
+		[]string{"_matrix", "client", "unstable", "org.matrix.msc4260", "users", userID, "report"}, reqBody)
+}
+
+func (c *CSAPI) doReportWithFallback(t *testing.T, paths, unstablePaths []string, reqBody map[string]interface{}) *http.Response {
+	t.Helper()
+	res := c.DoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	if !isUnrecognisedEndpoint(res) {
+		return res
+	}
+	res.Body.Close()
+	t.Logf("%s does not support %v, falling back to %v", c.BaseURL, paths, unstablePaths)
+	return c.DoFunc(t, "POST", unstablePaths, WithJSONBody(t, reqBody))
+}
+
+func mustReport(t *testing.T, funcName string, res *http.Response) {
+	t.Helper()
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("%s: returned HTTP %d: %s", funcName, res.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// SetRoomDirectoryVisibility publishes the room to the room directory if `visibility` is "public", or removes
+// it if "private". Fails the test on error.
+func (c *CSAPI) SetRoomDirectoryVisibility(t *testing.T, roomID, visibility string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "directory", "list", "room", roomID}, WithJSONBody(t, map[string]interface{}{
+		"visibility": visibility,
+	}))
+}
+
+// GetRoomDirectoryVisibility returns "public" or "private". Fails the test on error.
+func (c *CSAPI) GetRoomDirectoryVisibility(t *testing.T, roomID string) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "directory", "list", "room", roomID})
+	return GetJSONFieldStr(t, ParseJSON(t, res), "visibility")
+}
+
+// PublicRoomsReq contains the /publicRooms request options. The empty struct is valid, and returns the first
+// page of the local room directory.
+type PublicRoomsReq struct {
+	// The server to fetch the room directory of. Empty for the local server.
+	Server string
+	// A search term to filter rooms by.
+	Search string
+	// The maximum number of rooms per page. 0 uses the server default.
+	Limit int
+	// The pagination token from an earlier response.
+	Since string
+}
+
+// PublicRoomsResp is a page of the room directory.
+type PublicRoomsResp struct {
+	Chunk                  []gjson.Result
+	NextBatch              string
+	PrevBatch              string
+	TotalRoomCountEstimate int64
+}
+
+// PublicRooms returns one page of the room directory. Fails the test on error.
+func (c *CSAPI) PublicRooms(t *testing.T, req PublicRoomsReq) PublicRoomsResp {
+	t.Helper()
+	query := url.Values{}
+	if req.Server != "" {
+		query.Set("server", req.Server)
+	}
+	reqBody := map[string]interface{}{}
+	if req.Search != "" {
+		reqBody["filter"] = map[string]interface{}{
+			"generic_search_term": req.Search,
+		}
+	}
+	if req.Limit > 0 {
+		reqBody["limit"] = req.Limit
+	}
+	if req.Since != "" {
+		reqBody["since"] = req.Since
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "publicRooms"}, WithJSONBody(t, reqBody), WithQueries(query))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	return PublicRoomsResp{
+		Chunk:                  body.Get("chunk").Array(),
+		NextBatch:              body.Get("next_batch").Str,
+		PrevBatch:              body.Get("prev_batch").Str,
+		TotalRoomCountEstimate: body.Get("total_room_count_estimate").Int(),
+	}
+}
+
+// AllPublicRooms follows `next_batch` from the given request until every matching room has been fetched.
+// Fails the test on error.
+func (c *CSAPI) AllPublicRooms(t *testing.T, req PublicRoomsReq) []gjson.Result {
+	t.Helper()
+	var rooms []gjson.Result
+	for {
+		res := c.PublicRooms(t, req)
+		rooms = append(rooms, res.Chunk...)
+		if res.NextBatch == "" || len(res.Chunk) == 0 {
+			return rooms
+		}
+		req.Since = res.NextBatch
+	}
+}
+
+// PublicRoomsHasRoom returns an error unless `chunk` contains `roomID` and its entry passes all of the checks,
+// e.g match.JSONKeyEqual("num_joined_members", 2).
+func PublicRoomsHasRoom(chunk []gjson.Result, roomID string, checks ...match.JSON) error {
+	return roomsHaveRoom("PublicRoomsHasRoom", chunk, roomID, checks)
+}
+
+// PublicRoomsMissingRoom returns an error if `chunk` contains `roomID`.
+func PublicRoomsMissingRoom(chunk []gjson.Result, roomID string) error {
+	for _, room := range chunk {
+		if room.Get("room_id").Str == roomID {
+			return fmt.Errorf("PublicRoomsMissingRoom(%s): room is in the directory: %s", roomID, room.Raw)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// GetRoomSummary returns the summary of a room (MSC3266), which users can see before joining, e.g to preview a
+// room before knocking. `via` lists servers to ask if the room is not known locally. Fails the test on error.
+func (c *CSAPI) GetRoomSummary(t *testing.T, roomIDOrAlias string, via []string) gjson.Result {
+	t.Helper()
+	res := c.DoGetRoomSummary(t, roomIDOrAlias, via)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("GetRoomSummary: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
+
+// DoGetRoomSummary is the same as GetRoomSummary but returns the response, for testing rooms which should not be
+// previewable. Uses the stable endpoint, falling back to the unstable MSC3266 endpoints if the server does not
+// support it.
+func (c *CSAPI) DoGetRoomSummary(t *testing.T, roomIDOrAlias string, via []string) *http.Response {
+	t.Helper()
+	query := WithQueries(map[string][]string{"via": via})
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "v1", "room_summary", roomIDOrAlias}, query)
+	if !isUnrecognisedEndpoint(res) {
+		return res
+	}
+	res.Body.Close()
+	res = c.DoFunc(t, "GET", []string{"_matrix", "client", "unstable", "im.nheko.summary", "summary", roomIDOrAlias}, query)
+	if !isUnrecognisedEndpoint(res) {
+		return res
+	}
+	res.Body.Close()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "unstable", "im.nheko.summary", "rooms", roomIDOrAlias, "summary"}, query)
+}
+
+// MustHaveRoomSummary fails the test unless the summary of the room passes all of the checks, e.g
+// RoomSummaryJoinRule("knock").
+func (c *CSAPI) MustHaveRoomSummary(t *testing.T, roomIDOrAlias string, via []string, checks ...match.JSON) {
+	t.Helper()
+	summary := c.GetRoomSummary(t, roomIDOrAlias, via)
+	for _, check := range checks {
+		if err := check([]byte(summary.Raw)); err != nil {
+			t.Fatalf("MustHaveRoomSummary(%s): %s - body: %s", roomIDOrAlias, err, summary.Raw)
+		}
+	}
+}
+
+// RoomSummaryMembership checks the requesting user's membership of the room, e.g "invite". An empty
+// `membership` checks that the user has no membership, as the field is then omitted.
+func RoomSummaryMembership(membership string) match.JSON {
+	if membership == "" {
+		return match.JSONKeyMissing("membership")
+	}
+	return match.JSONKeyEqual("membership", membership)
+}
+
+// RoomSummaryJoinRule checks the join rule of the room, e.g "public" or "knock".
+func RoomSummaryJoinRule(joinRule string) match.JSON {
+	return match.JSONKeyEqual("join_rule", joinRule)
+}
+
+// RoomSummaryJoinedMembers checks the number of users joined to the room.
+func RoomSummaryJoinedMembers(count int) match.JSON {
+	return match.JSONKeyEqual("num_joined_members", float64(count))
+}
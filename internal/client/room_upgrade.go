@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+// UpgradeRoom upgrades the room to `newVersion`, else fails the test. Returns the room ID of the replacement room.
+func (c *CSAPI) UpgradeRoom(t *testing.T, roomID, newVersion string) string {
+	t.Helper()
+	res := c.DoUpgradeRoom(t, roomID, newVersion)
+	mustSucceed(t, "UpgradeRoom", res)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "replacement_room")
+}
+
+// DoUpgradeRoom is the same as UpgradeRoom but returns the response, for testing upgrades which should fail.
+func (c *CSAPI) DoUpgradeRoom(t *testing.T, roomID, newVersion string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "upgrade"}, WithJSONBody(t, map[string]interface{}{
+		"new_version": newVersion,
+	}))
+}
+
+// MustHaveUpgradedRoom checks that `oldRoomID` has a tombstone pointing at `newRoomID`, and that `newRoomID` has
+// the given room version and an m.room.create event whose predecessor is `oldRoomID`. The client must be able to
+// read the state of both rooms.
+func (c *CSAPI) MustHaveUpgradedRoom(t *testing.T, oldRoomID, newRoomID, newVersion string) {
+	t.Helper()
+	tombstone := c.GetStateEvent(t, oldRoomID, "m.room.tombstone", "")
+	if got := tombstone.Get("replacement_room").Str; got != newRoomID {
+		t.Fatalf("MustHaveUpgradedRoom: tombstone in %s has replacement_room %q, want %q", oldRoomID, got, newRoomID)
+	}
+	create := c.GetStateEvent(t, newRoomID, "m.room.create", "")
+	if got := create.Get("room_version").Str; got != newVersion {
+		t.Fatalf("MustHaveUpgradedRoom: %s has room_version %q, want %q", newRoomID, got, newVersion)
+	}
+	if got := create.Get("predecessor.room_id").Str; got != oldRoomID {
+		t.Fatalf("MustHaveUpgradedRoom: %s has predecessor room_id %q, want %q", newRoomID, got, oldRoomID)
+	}
+}
+
+// MustHaveCarriedOverInvites checks that every user invited to `oldRoomID` is also invited to `newRoomID`.
+func (c *CSAPI) MustHaveCarriedOverInvites(t *testing.T, oldRoomID, newRoomID string) {
+	t.Helper()
+	invited := make(map[string]bool)
+	for _, ev := range c.GetRoomState(t, newRoomID) {
+		if ev.Get("type").Str == "m.room.member" && ev.Get("content.membership").Str == "invite" {
+			invited[ev.Get("state_key").Str] = true
+		}
+	}
+	for _, ev := range c.GetRoomState(t, oldRoomID) {
+		if ev.Get("type").Str != "m.room.member" || ev.Get("content.membership").Str != "invite" {
+			continue
+		}
+		if userID := ev.Get("state_key").Str; !invited[userID] {
+			t.Fatalf("MustHaveCarriedOverInvites: %s is invited to %s but not %s", userID, oldRoomID, newRoomID)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// The SAS parameters MustVerifySAS uses. Only the ones in the current spec are supported.
+const (
+	sasMethod            = "m.sas.v1"
+	sasKeyAgreement      = "curve25519-hkdf-sha256"
+	sasHash              = "sha256"
+	sasMAC               = "hkdf-hmac-sha256.v2"
+	sasVerificationTypes = "m.key.verification."
+)
+
+// SASParty is one side of an SAS verification run by MustVerifySAS.
+type SASParty struct {
+	Client *CSAPI
+	// The E2EE state of the client's device, whose keys must have been uploaded.
+	Crypto *Crypto
+	// If set, the party also sends a MAC of its master key, and signs the other party once verified: its master
+	// key with the user-signing key, or its device with the self-signing key if both parties are the same user.
+	// The keys must have been uploaded.
+	CrossSigning *CrossSigningKeys
+
+	since      string
+	privateKey []byte
+	publicKey  string
+	theirKey   string
+	shared     []byte
+}
+
+// sasTransport sends and receives the events of one verification, either to-device or in a room.
+type sasTransport struct {
+	roomID string
+	// the event ID of the in-room verification request, which later events reference
+	requestID string
+	// the transaction ID of a to-device verification
+	txnID string
+}
+
+// MustVerifySAS runs a full SAS verification (m.sas.v1) between two clients, as their devices would when users
+// compare emoji or numbers. The verification messages are sent as to-device events, or in `roomID` if it is not
+// empty. Both parties must compute the same short authentication string, and each checks the other's MACs
+// of its keys. If both parties have CrossSigning set, each then signs the other and the test asserts the
+// signatures are visible in /keys/query.
+func MustVerifySAS(t *testing.T, initiator, responder *SASParty, roomID string) {
+	t.Helper()
+	for _, p := range []*SASParty{initiator, responder} {
+		p.since = p.Client.MustSyncUntil(t, SyncReq{TimeoutMillis: "0"})
+		p.privateKey = make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(p.privateKey); err != nil {
+			t.Fatalf("MustVerifySAS: failed to generate key: %s", err)
+		}
+		pub, err := curve25519.X25519(p.privateKey, curve25519.Basepoint)
+		if err != nil {
+			t.Fatalf("MustVerifySAS: failed to derive public key: %s", err)
+		}
+		p.publicKey = base64.RawStdEncoding.EncodeToString(pub)
+	}
+	tr := &sasTransport{roomID: roomID}
+
+	// request and ready
+	request := map[string]interface{}{
+		"from_device": initiator.Client.DeviceID,
+		"methods":     []string{sasMethod},
+	}
+	if roomID == "" {
+		tr.txnID = randomString(t, 16)
+		request["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+		tr.send(t, initiator, responder, "request", request)
+	} else {
+		request["msgtype"] = sasVerificationTypes + "request"
+		request["body"] = "Verification request"
+		request["to"] = responder.Client.UserID
+		tr.requestID = initiator.Client.SendEventUnsynced(t, roomID, b.Event{
+			Type:    "m.room.message",
+			Content: request,
+		})
+	}
+	tr.mustReceive(t, responder, initiator, "request")
+	tr.send(t, responder, initiator, "ready", map[string]interface{}{
+		"from_device": responder.Client.DeviceID,
+		"methods":     []string{sasMethod},
+	})
+	tr.mustReceive(t, initiator, responder, "ready")
+
+	// start and accept, committing to the responder's key before it is revealed
+	start := map[string]interface{}{
+		"from_device":                  initiator.Client.DeviceID,
+		"method":                       sasMethod,
+		"key_agreement_protocols":      []string{sasKeyAgreement},
+		"hashes":                       []string{sasHash},
+		"message_authentication_codes": []string{sasMAC},
+		"short_authentication_string":  []string{"decimal", "emoji"},
+	}
+	tr.send(t, initiator, responder, "start", start)
+	startContent := tr.mustReceive(t, responder, initiator, "start")
+	canonicalStart, err := gomatrixserverlib.CanonicalJSON([]byte(startContent.Raw))
+	if err != nil {
+		t.Fatalf("MustVerifySAS: failed to canonicalise start event: %s", err)
+	}
+	commitment := sha256.Sum256([]byte(responder.publicKey + string(canonicalStart)))
+	tr.send(t, responder, initiator, "accept", map[string]interface{}{
+		"method":                      sasMethod,
+		"key_agreement_protocol":      sasKeyAgreement,
+		"hash":                        sasHash,
+		"message_authentication_code": sasMAC,
+		"short_authentication_string": []string{"decimal", "emoji"},
+		"commitment":                  base64.RawStdEncoding.EncodeToString(commitment[:]),
+	})
+	accept := tr.mustReceive(t, initiator, responder, "accept")
+
+	// exchange keys, checking the responder's key against its commitment
+	tr.send(t, initiator, responder, "key", map[string]interface{}{"key": initiator.publicKey})
+	responder.mustSetTheirKey(t, tr.mustReceive(t, responder, initiator, "key").Get("key").Str)
+	tr.send(t, responder, initiator, "key", map[string]interface{}{"key": responder.publicKey})
+	initiator.mustSetTheirKey(t, tr.mustReceive(t, initiator, responder, "key").Get("key").Str)
+	canonicalStart, err = gomatrixserverlib.CanonicalJSON(mustMarshalJSON(t, tr.content(start)))
+	if err != nil {
+		t.Fatalf("MustVerifySAS: failed to canonicalise start event: %s", err)
+	}
+	wantCommitment := sha256.Sum256([]byte(initiator.theirKey + string(canonicalStart)))
+	if accept.Get("commitment").Str != base64.RawStdEncoding.EncodeToString(wantCommitment[:]) {
+		t.Fatalf("MustVerifySAS: responder's key does not match its commitment")
+	}
+
+	// both sides must show the same emoji and numbers
+	flowID := tr.txnID + tr.requestID
+	sasInfo := "MATRIX_KEY_VERIFICATION_SAS|" +
+		initiator.Client.UserID + "|" + initiator.Client.DeviceID + "|" + initiator.publicKey + "|" +
+		responder.Client.UserID + "|" + responder.Client.DeviceID + "|" + responder.publicKey + "|" + flowID
+	initiatorSAS := mustHKDF(t, initiator.shared, sasInfo, 6)
+	responderSAS := mustHKDF(t, responder.shared, sasInfo, 6)
+	if sasDecimal(initiatorSAS) != sasDecimal(responderSAS) || sasEmoji(initiatorSAS) != sasEmoji(responderSAS) {
+		t.Fatalf("MustVerifySAS: short authentication strings differ: %v %v vs %v %v",
+			sasDecimal(initiatorSAS), sasEmoji(initiatorSAS), sasDecimal(responderSAS), sasEmoji(responderSAS))
+	}
+
+	// exchange MACs of each party's keys, then finish
+	tr.send(t, responder, initiator, "mac", responder.macContent(t, initiator, flowID))
+	initiator.mustCheckMAC(t, responder, flowID, tr.mustReceive(t, initiator, responder, "mac"))
+	tr.send(t, initiator, responder, "mac", initiator.macContent(t, responder, flowID))
+	responder.mustCheckMAC(t, initiator, flowID, tr.mustReceive(t, responder, initiator, "mac"))
+	tr.send(t, initiator, responder, "done", map[string]interface{}{})
+	tr.mustReceive(t, responder, initiator, "done")
+	tr.send(t, responder, initiator, "done", map[string]interface{}{})
+	tr.mustReceive(t, initiator, responder, "done")
+
+	if initiator.CrossSigning != nil && responder.CrossSigning != nil {
+		initiator.mustSignVerified(t, responder)
+		responder.mustSignVerified(t, initiator)
+	}
+}
+
+// content returns the content of a verification event as sent by this transport.
+func (tr *sasTransport) content(content map[string]interface{}) map[string]interface{} {
+	withIDs := make(map[string]interface{}, len(content)+1)
+	for k, v := range content {
+		withIDs[k] = v
+	}
+	if tr.roomID == "" {
+		withIDs["transaction_id"] = tr.txnID
+	} else {
+		withIDs["m.relates_to"] = map[string]interface{}{
+			"rel_type": "m.reference",
+			"event_id": tr.requestID,
+		}
+	}
+	return withIDs
+}
+
+// send sends the verification event `m.key.verification.<step>` from one party to the other.
+func (tr *sasTransport) send(t *testing.T, from, to *SASParty, step string, content map[string]interface{}) {
+	t.Helper()
+	evType := sasVerificationTypes + step
+	if tr.roomID != "" {
+		from.Client.SendEventUnsynced(t, tr.roomID, b.Event{
+			Type:    evType,
+			Content: tr.content(content),
+		})
+		return
+	}
+	from.Client.txnID++
+	from.Client.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "sendToDevice", evType, strconv.Itoa(from.Client.txnID)}, WithJSONBody(t, map[string]interface{}{
+		"messages": map[string]interface{}{
+			to.Client.UserID: map[string]interface{}{
+				to.Client.DeviceID: tr.content(content),
+			},
+		},
+	}))
+}
+
+// mustReceive syncs as `to` until the verification event `m.key.verification.<step>` from `from` arrives, and
+// returns its content.
+func (tr *sasTransport) mustReceive(t *testing.T, to, from *SASParty, step string) gjson.Result {
+	t.Helper()
+	evType := sasVerificationTypes + step
+	var content gjson.Result
+	var check SyncCheckOpt
+	if tr.roomID == "" {
+		check = func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+			return loopArray(topLevelSyncJSON, "to_device.events", func(ev gjson.Result) bool {
+				if ev.Get("type").Str != evType || ev.Get("sender").Str != from.Client.UserID || ev.Get("content.transaction_id").Str != tr.txnID {
+					return false
+				}
+				content = ev.Get("content")
+				return true
+			})
+		}
+	} else {
+		check = SyncTimelineHas(tr.roomID, func(ev gjson.Result) bool {
+			if ev.Get("sender").Str != from.Client.UserID {
+				return false
+			}
+			if step == "request" {
+				if ev.Get("event_id").Str != tr.requestID {
+					return false
+				}
+			} else if ev.Get("type").Str != evType || ev.Get(`content.m\.relates_to.event_id`).Str != tr.requestID {
+				return false
+			}
+			content = ev.Get("content")
+			return true
+		})
+	}
+	to.since = to.Client.MustSyncUntil(t, SyncReq{Since: to.since}, check)
+	if fromDevice := content.Get("from_device"); fromDevice.Exists() && fromDevice.Str != from.Client.DeviceID {
+		t.Fatalf("MustVerifySAS: %s from_device is %s, want %s", evType, fromDevice.Str, from.Client.DeviceID)
+	}
+	return content
+}
+
+func (p *SASParty) mustSetTheirKey(t *testing.T, theirKey string) {
+	t.Helper()
+	key, err := base64.RawStdEncoding.DecodeString(theirKey)
+	if err != nil {
+		t.Fatalf("MustVerifySAS: invalid key %q: %s", theirKey, err)
+	}
+	p.shared, err = curve25519.X25519(p.privateKey, key)
+	if err != nil {
+		t.Fatalf("MustVerifySAS: failed to compute shared secret: %s", err)
+	}
+	p.theirKey = theirKey
+}
+
+// sasKeys returns the keys this party MACs, keyed off key ID.
+func (p *SASParty) sasKeys() map[string]string {
+	ed25519Key, _ := p.Crypto.IdentityKeys()
+	keys := map[string]string{
+		"ed25519:" + p.Client.DeviceID: ed25519Key.String(),
+	}
+	if p.CrossSigning != nil {
+		master := p.CrossSigning.Master
+		keys[master.KeyID] = master.Key.Keys[master.KeyID]
+	}
+	return keys
+}
+
+// macContent returns the content of this party's m.key.verification.mac event to `to`.
+func (p *SASParty) macContent(t *testing.T, to *SASParty, flowID string) map[string]interface{} {
+	t.Helper()
+	baseInfo := "MATRIX_KEY_VERIFICATION_MAC" + p.Client.UserID + p.Client.DeviceID + to.Client.UserID + to.Client.DeviceID + flowID
+	macs := map[string]string{}
+	var keyIDs []string
+	for keyID, key := range p.sasKeys() {
+		macs[keyID] = sasCalculateMAC(t, p.shared, baseInfo+keyID, key)
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return map[string]interface{}{
+		"mac":  macs,
+		"keys": sasCalculateMAC(t, p.shared, baseInfo+"KEY_IDS", strings.Join(keyIDs, ",")),
+	}
+}
+
+// mustCheckMAC checks the MACs `from` sent against the keys the homeserver has for it.
+func (p *SASParty) mustCheckMAC(t *testing.T, from *SASParty, flowID string, content gjson.Result) {
+	t.Helper()
+	baseInfo := "MATRIX_KEY_VERIFICATION_MAC" + from.Client.UserID + from.Client.DeviceID + p.Client.UserID + p.Client.DeviceID + flowID
+	var keyIDs []string
+	for keyID := range content.Get("mac").Map() {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	if got, want := content.Get("keys").Str, sasCalculateMAC(t, p.shared, baseInfo+"KEY_IDS", strings.Join(keyIDs, ",")); got != want {
+		t.Fatalf("MustVerifySAS: MAC of key IDs from %s does not match", from.Client.UserID)
+	}
+	queried := p.Client.MustQueryKeys(t, from.Client.UserID)
+	for _, keyID := range keyIDs {
+		var key string
+		if keyID == "ed25519:"+from.Client.DeviceID {
+			key = queried.Get("device_keys." + GjsonEscape(from.Client.UserID) + "." + GjsonEscape(from.Client.DeviceID) + ".keys." + GjsonEscape(keyID)).Str
+		} else {
+			key = queried.Get("master_keys." + GjsonEscape(from.Client.UserID) + ".keys." + GjsonEscape(keyID)).Str
+		}
+		if key == "" {
+			t.Fatalf("MustVerifySAS: %s sent a MAC for unknown key %s", from.Client.UserID, keyID)
+		}
+		if content.Get("mac."+GjsonEscape(keyID)).Str != sasCalculateMAC(t, p.shared, baseInfo+keyID, key) {
+			t.Fatalf("MustVerifySAS: MAC of %s from %s does not match", keyID, from.Client.UserID)
+		}
+	}
+}
+
+// mustSignVerified cross-signs the verified party, then asserts the signature is visible.
+func (p *SASParty) mustSignVerified(t *testing.T, verified *SASParty) {
+	t.Helper()
+	if verified.Client.UserID == p.Client.UserID {
+		p.Client.MustSignDevice(t, p.CrossSigning, verified.Client.DeviceID)
+		p.Client.MustSeeDeviceSignature(t, p.Client.UserID, verified.Client.DeviceID, p.Client.UserID, p.CrossSigning.SelfSigning.KeyID)
+		return
+	}
+	p.Client.MustSignUser(t, p.CrossSigning, verified.Client.UserID)
+	p.Client.MustSeeMasterKeySignature(t, verified.Client.UserID, p.Client.UserID, p.CrossSigning.UserSigning.KeyID)
+}
+
+func sasCalculateMAC(t *testing.T, shared []byte, info, input string) string {
+	t.Helper()
+	mac := hmac.New(sha256.New, mustHKDF(t, shared, info, 32))
+	mac.Write([]byte(input))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func mustHKDF(t *testing.T, secret []byte, info string, n int) []byte {
+	t.Helper()
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), out); err != nil {
+		t.Fatalf("MustVerifySAS: failed to derive bytes: %s", err)
+	}
+	return out
+}
+
+// sasDecimal returns the three numbers shown for the decimal SAS method.
+func sasDecimal(b []byte) [3]int {
+	return [3]int{
+		(int(b[0])<<5 | int(b[1])>>3) + 1000,
+		((int(b[1])&0x7)<<10 | int(b[2])<<2 | int(b[3])>>6) + 1000,
+		((int(b[3])&0x3f)<<7 | int(b[4])>>1) + 1000,
+	}
+}
+
+// sasEmoji returns the indexes of the seven emoji shown for the emoji SAS method.
+func sasEmoji(b []byte) [7]int {
+	var bits uint64
+	for _, x := range b {
+		bits = bits<<8 | uint64(x)
+	}
+	var emoji [7]int
+	for i := range emoji {
+		emoji[i] = int(bits >> (42 - 6*uint(i)) & 0x3f)
+	}
+	return emoji
+}
+
+func mustMarshalJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal JSON: %s", err)
+	}
+	return b
+}
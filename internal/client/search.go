@@ -0,0 +1,194 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// Orderings for search results.
+const (
+	SearchOrderByRank   = "rank"
+	SearchOrderByRecent = "recent"
+)
+
+// SearchReq is a full-text search over room events. Only SearchTerm is required.
+type SearchReq struct {
+	SearchTerm string
+	// The keys to search, e.g "content.body". Empty searches the server default keys.
+	Keys []string
+	// A RoomEventFilter to apply to the search results, may be nil.
+	Filter map[string]interface{}
+	// One of the SearchOrderBy constants. Empty uses the server default.
+	OrderBy string
+	// Keys to group results by: "room_id" or "sender".
+	GroupBy []string
+	// If non-nil, request events around each result.
+	EventContext *SearchEventContext
+	// Request the current state of the rooms the results are in.
+	IncludeState bool
+	// The next_batch token from an earlier response.
+	NextBatch string
+}
+
+// SearchEventContext asks for events around each search result.
+type SearchEventContext struct {
+	BeforeLimit    int
+	AfterLimit     int
+	IncludeProfile bool
+}
+
+// SearchResp is the room_events section of a /search response.
+type SearchResp struct {
+	Count      int64
+	Results    []gjson.Result // each has `rank`, `result` (the event) and optionally `context`
+	Highlights []string
+	NextBatch  string
+	State      gjson.Result // room ID -> state events
+	Groups     gjson.Result // group key -> group value -> group
+}
+
+// SearchCheck is a check over a /search response.
+type SearchCheck func(res SearchResp) error
+
+// SearchMessages performs a full-text search over room events. Fails the test on error.
+func (c *CSAPI) SearchMessages(t *testing.T, req SearchReq) SearchResp {
+	t.Helper()
+	roomEvents := map[string]interface{}{
+		"search_term": req.SearchTerm,
+	}
+	if len(req.Keys) > 0 {
+		roomEvents["keys"] = req.Keys
+	}
+	if req.Filter != nil {
+		roomEvents["filter"] = req.Filter
+	}
+	if req.OrderBy != "" {
+		roomEvents["order_by"] = req.OrderBy
+	}
+	if len(req.GroupBy) > 0 {
+		groupBy := make([]map[string]interface{}, 0, len(req.GroupBy))
+		for _, key := range req.GroupBy {
+			groupBy = append(groupBy, map[string]interface{}{"key": key})
+		}
+		roomEvents["groupings"] = map[string]interface{}{
+			"group_by": groupBy,
+		}
+	}
+	if req.EventContext != nil {
+		roomEvents["event_context"] = map[string]interface{}{
+			"before_limit":    req.EventContext.BeforeLimit,
+			"after_limit":     req.EventContext.AfterLimit,
+			"include_profile": req.EventContext.IncludeProfile,
+		}
+	}
+	if req.IncludeState {
+		roomEvents["include_state"] = true
+	}
+	query := url.Values{}
+	if req.NextBatch != "" {
+		query.Set("next_batch", req.NextBatch)
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "search"}, WithQueries(query), WithJSONBody(t, map[string]interface{}{
+		"search_categories": map[string]interface{}{
+			"room_events": roomEvents,
+		},
+	}))
+	body := gjson.ParseBytes(ParseJSON(t, res)).Get("search_categories.room_events")
+	var highlights []string
+	for _, h := range body.Get("highlights").Array() {
+		highlights = append(highlights, h.Str)
+	}
+	return SearchResp{
+		Count:      body.Get("count").Int(),
+		Results:    body.Get("results").Array(),
+		Highlights: highlights,
+		NextBatch:  body.Get("next_batch").Str,
+		State:      body.Get("state"),
+		Groups:     body.Get("groups"),
+	}
+}
+
+// MustMatch fails the test unless the response passes all of the checks.
+func (res SearchResp) MustMatch(t *testing.T, checks ...SearchCheck) {
+	t.Helper()
+	for _, check := range checks {
+		if err := check(res); err != nil {
+			t.Fatalf("SearchResp.MustMatch: %s", err)
+		}
+	}
+}
+
+// EventIDs returns the event IDs of the results, in order.
+func (res SearchResp) EventIDs() []string {
+	eventIDs := make([]string, 0, len(res.Results))
+	for _, result := range res.Results {
+		eventIDs = append(eventIDs, result.Get("result.event_id").Str)
+	}
+	return eventIDs
+}
+
+// SearchResultsAre checks that the results are exactly these events, in order.
+func SearchResultsAre(eventIDs ...string) SearchCheck {
+	return func(res SearchResp) error {
+		got := res.EventIDs()
+		if len(got) != len(eventIDs) {
+			return fmt.Errorf("SearchResultsAre: got %v, want %v", got, eventIDs)
+		}
+		for i := range got {
+			if got[i] != eventIDs[i] {
+				return fmt.Errorf("SearchResultsAre: got %v, want %v", got, eventIDs)
+			}
+		}
+		return nil
+	}
+}
+
+// SearchResultsInclude checks that the results include these events, in any order.
+func SearchResultsInclude(eventIDs ...string) SearchCheck {
+	return func(res SearchResp) error {
+		got := make(map[string]bool)
+		for _, eventID := range res.EventIDs() {
+			got[eventID] = true
+		}
+		for _, eventID := range eventIDs {
+			if !got[eventID] {
+				return fmt.Errorf("SearchResultsInclude: %s not in %v", eventID, res.EventIDs())
+			}
+		}
+		return nil
+	}
+}
+
+// SearchCountIs checks the approximate result `count` returned by the server.
+func SearchCountIs(count int64) SearchCheck {
+	return func(res SearchResp) error {
+		if res.Count != count {
+			return fmt.Errorf("SearchCountIs: got %d, want %d", res.Count, count)
+		}
+		return nil
+	}
+}
+
+// SearchGroupHas checks that the results were grouped by `key` and the group for `value`, e.g a room ID, has
+// these events in its results.
+func SearchGroupHas(key, value string, eventIDs ...string) SearchCheck {
+	return func(res SearchResp) error {
+		group := res.Groups.Get(GjsonEscape(key) + "." + GjsonEscape(value))
+		if !group.Exists() {
+			return fmt.Errorf("SearchGroupHas: no group %s=%s in %s", key, value, res.Groups.Raw)
+		}
+		got := make(map[string]bool)
+		for _, eventID := range group.Get("results").Array() {
+			got[eventID.Str] = true
+		}
+		for _, eventID := range eventIDs {
+			if !got[eventID] {
+				return fmt.Errorf("SearchGroupHas: %s not in group %s=%s: %s", eventID, key, value, group.Raw)
+			}
+		}
+		return nil
+	}
+}
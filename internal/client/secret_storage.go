@@ -0,0 +1,192 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SecretStorageAlgorithm is the only secret storage algorithm in the spec.
+const SecretStorageAlgorithm = "m.secret_storage.v2.aes-hmac-sha2"
+
+// Well-known secrets which clients keep in secret storage.
+const (
+	SecretCrossSigningMaster      = "m.cross_signing.master"
+	SecretCrossSigningSelfSigning = "m.cross_signing.self_signing"
+	SecretCrossSigningUserSigning = "m.cross_signing.user_signing"
+	SecretMegolmBackup            = "m.megolm_backup.v1"
+)
+
+// Account data types for key descriptions and the default key.
+const (
+	secretStorageKeyPrefix         = "m.secret_storage.key."
+	secretStorageDefaultKeyAccount = "m.secret_storage.default_key"
+)
+
+// SecretStorageKey is a secret storage (SSSS) key, which encrypts secrets stored in account data.
+type SecretStorageKey struct {
+	ID  string
+	Key []byte
+}
+
+// secretStorageCiphertext is an encrypted secret, or the check value in a key description.
+type secretStorageCiphertext struct {
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+// CreateSecretStorageKey generates a new secret storage key and uploads its description to account data. If
+// `makeDefault` is true, it also becomes the default key. Fails the test on error.
+func (c *CSAPI) CreateSecretStorageKey(t *testing.T, name string, makeDefault bool) *SecretStorageKey {
+	t.Helper()
+	key := &SecretStorageKey{
+		ID:  randomString(t, 16),
+		Key: make([]byte, 32),
+	}
+	if _, err := rand.Read(key.Key); err != nil {
+		t.Fatalf("CreateSecretStorageKey: failed to generate key: %s", err)
+	}
+	// the description lets clients check a key is correct: it holds the encryption of 32 zero bytes
+	check := key.mustEncrypt(t, "", make([]byte, 32))
+	c.SetGlobalAccountData(t, secretStorageKeyPrefix+key.ID, map[string]interface{}{
+		"algorithm": SecretStorageAlgorithm,
+		"name":      name,
+		"iv":        check.IV,
+		"mac":       check.MAC,
+	})
+	if makeDefault {
+		c.SetGlobalAccountData(t, secretStorageDefaultKeyAccount, map[string]interface{}{
+			"key": key.ID,
+		})
+	}
+	return key
+}
+
+// GetDefaultSecretStorageKeyID returns the ID of the default secret storage key. Fails the test if there is none.
+func (c *CSAPI) GetDefaultSecretStorageKeyID(t *testing.T) string {
+	t.Helper()
+	res := c.GetGlobalAccountData(t, secretStorageDefaultKeyAccount)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "key")
+}
+
+// MustHaveValidSecretStorageKey asserts that the key description in account data uses the spec algorithm and
+// that `key` is the key it describes, by checking the MAC over the encryption of zeros.
+func (c *CSAPI) MustHaveValidSecretStorageKey(t *testing.T, key *SecretStorageKey) {
+	t.Helper()
+	res := c.GetGlobalAccountData(t, secretStorageKeyPrefix+key.ID)
+	desc := gjson.ParseBytes(ParseJSON(t, res))
+	if alg := desc.Get("algorithm").Str; alg != SecretStorageAlgorithm {
+		t.Fatalf("MustHaveValidSecretStorageKey(%s): algorithm is %q, want %q", key.ID, alg, SecretStorageAlgorithm)
+	}
+	check := key.mustEncryptWithIV(t, "", make([]byte, 32), mustDecodeBase64(t, desc.Get("iv").Str))
+	if !hmac.Equal(mustDecodeBase64(t, check.MAC), mustDecodeBase64(t, desc.Get("mac").Str)) {
+		t.Fatalf("MustHaveValidSecretStorageKey(%s): MAC does not match the key", key.ID)
+	}
+}
+
+// StoreSecret encrypts `secret` with `key` and stores it in account data under `secretName`, e.g
+// SecretMegolmBackup. Encryptions of the secret with other keys are kept. Fails the test on error.
+func (c *CSAPI) StoreSecret(t *testing.T, key *SecretStorageKey, secretName, secret string) {
+	t.Helper()
+	encrypted := map[string]interface{}{}
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "account_data", secretName})
+	if res.StatusCode == 200 {
+		for keyID, value := range gjson.GetBytes(ParseJSON(t, res), "encrypted").Map() {
+			encrypted[keyID] = value.Value()
+		}
+	} else {
+		res.Body.Close()
+	}
+	encrypted[key.ID] = key.mustEncrypt(t, secretName, []byte(secret))
+	c.SetGlobalAccountData(t, secretName, map[string]interface{}{
+		"encrypted": encrypted,
+	})
+}
+
+// GetSecret fetches the secret `secretName` from account data and decrypts it with `key`, checking its MAC. Fails
+// the test on error.
+func (c *CSAPI) GetSecret(t *testing.T, key *SecretStorageKey, secretName string) string {
+	t.Helper()
+	res := c.GetGlobalAccountData(t, secretName)
+	encrypted := gjson.GetBytes(ParseJSON(t, res), "encrypted."+GjsonEscape(key.ID))
+	if !encrypted.Exists() {
+		t.Fatalf("GetSecret(%s): secret is not encrypted with key %s", secretName, key.ID)
+	}
+	aesKey, macKey := key.mustDeriveKeys(t, secretName)
+	ciphertext := mustDecodeBase64(t, encrypted.Get("ciphertext").Str)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), mustDecodeBase64(t, encrypted.Get("mac").Str)) {
+		t.Fatalf("GetSecret(%s): MAC does not match", secretName)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	mustAESCTR(t, aesKey, mustDecodeBase64(t, encrypted.Get("iv").Str)).XORKeyStream(plaintext, ciphertext)
+	return string(plaintext)
+}
+
+func (k *SecretStorageKey) mustEncrypt(t *testing.T, secretName string, plaintext []byte) secretStorageCiphertext {
+	t.Helper()
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatalf("SecretStorageKey: failed to generate IV: %s", err)
+	}
+	// clear bit 63 so the counter cannot overflow, for compatibility with other implementations
+	iv[8] &= 0x7f
+	return k.mustEncryptWithIV(t, secretName, plaintext, iv)
+}
+
+func (k *SecretStorageKey) mustEncryptWithIV(t *testing.T, secretName string, plaintext, iv []byte) secretStorageCiphertext {
+	t.Helper()
+	aesKey, macKey := k.mustDeriveKeys(t, secretName)
+	ciphertext := make([]byte, len(plaintext))
+	mustAESCTR(t, aesKey, iv).XORKeyStream(ciphertext, plaintext)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	return secretStorageCiphertext{
+		IV:         base64.StdEncoding.EncodeToString(iv),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		MAC:        base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+// mustDeriveKeys derives the AES and HMAC keys for the secret `secretName` from the key.
+func (k *SecretStorageKey) mustDeriveKeys(t *testing.T, secretName string) (aesKey, macKey []byte) {
+	t.Helper()
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.Key, make([]byte, 32), []byte(secretName)), keys); err != nil {
+		t.Fatalf("SecretStorageKey: failed to derive keys: %s", err)
+	}
+	return keys[:32], keys[32:]
+}
+
+func mustAESCTR(t *testing.T, key, iv []byte) cipher.Stream {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("SecretStorageKey: failed to create cipher: %s", err)
+	}
+	if len(iv) != aes.BlockSize {
+		t.Fatalf("SecretStorageKey: IV is %d bytes, want %d", len(iv), aes.BlockSize)
+	}
+	return cipher.NewCTR(block, iv)
+}
+
+// mustDecodeBase64 decodes base64 with or without padding, as clients differ in which they send.
+func mustDecodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		t.Fatalf("failed to decode base64 %q: %s", s, err)
+	}
+	return b
+}
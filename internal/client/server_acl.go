@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// SetServerACL replaces the m.room.server_acl of the room and waits for it to come down /sync, so the homeserver
+// is enforcing it by the time this returns. Server names in `allow` and `deny` may be globs, e.g "*". Take care
+// to allow the client's own server. Fails the test on error. Returns the event ID.
+func (c *CSAPI) SetServerACL(t *testing.T, roomID string, allow, deny []string, allowIPLiterals bool) string {
+	t.Helper()
+	return c.SendEventSynced(t, roomID, b.ServerACLEvent(allow, deny, allowIPLiterals))
+}
+
+// MustHaveServerACLDenying fails the test unless the current server ACL of the room lists `serverName` in its
+// deny list.
+func (c *CSAPI) MustHaveServerACLDenying(t *testing.T, roomID, serverName string) {
+	t.Helper()
+	acl := c.GetStateEvent(t, roomID, "m.room.server_acl", "")
+	for _, denied := range acl.Get("deny").Array() {
+		if denied.Str == serverName {
+			return
+		}
+	}
+	t.Fatalf("MustHaveServerACLDenying(%s): %s is not denied by %s", roomID, serverName, acl.Raw)
+}
+
+// SyncServerACLDenies checks that an m.room.server_acl denying `serverName` comes down /sync in the room.
+func SyncServerACLDenies(roomID, serverName string) SyncCheckOpt {
+	return SyncStateHas(roomID, "m.room.server_acl", "", func(ev gjson.Result) bool {
+		for _, denied := range ev.Get("content.deny").Array() {
+			if denied.Str == serverName {
+				return true
+			}
+		}
+		return false
+	})
+}
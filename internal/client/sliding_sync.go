@@ -0,0 +1,341 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// SlidingSyncVersion is the flavour of sliding sync to use.
+type SlidingSyncVersion string
+
+const (
+	// SlidingSyncMSC4186 is simplified sliding sync, which has no list operations.
+	SlidingSyncMSC4186 SlidingSyncVersion = "org.matrix.simplified_msc3575"
+	// SlidingSyncMSC3575 is the original sliding sync proposal, which returns list operations.
+	SlidingSyncMSC3575 SlidingSyncVersion = "org.matrix.msc3575"
+)
+
+// SlidingSyncReq is a sliding sync request. The empty struct `SlidingSyncReq{}` is valid, and starts
+// a new connection with no lists.
+type SlidingSyncReq struct {
+	Lists             map[string]SlidingSyncList         `json:"lists,omitempty"`
+	RoomSubscriptions map[string]SlidingRoomSubscription `json:"room_subscriptions,omitempty"`
+	Extensions        *SlidingSyncExtensions             `json:"extensions,omitempty"`
+	ConnID            string                             `json:"conn_id,omitempty"`
+
+	// The position to continue the connection from, as returned in an earlier response.
+	Pos string `json:"-"`
+	// The maximum time to wait before returning this request. By default, this is 1000 for Complement testing.
+	TimeoutMillis string `json:"-"`
+	// Which sliding sync endpoint to use. Defaults to SlidingSyncMSC4186.
+	Version SlidingSyncVersion `json:"-"`
+}
+
+// SlidingRoomSubscription controls which data is returned for each room.
+type SlidingRoomSubscription struct {
+	// Pairs of [event type, state key] to return, which may use "*" wildcards.
+	RequiredState [][2]string `json:"required_state,omitempty"`
+	TimelineLimit int         `json:"timeline_limit,omitempty"`
+}
+
+// SlidingSyncList is a list of rooms in a sliding sync request.
+type SlidingSyncList struct {
+	SlidingRoomSubscription
+	Ranges  [][2]int64          `json:"ranges,omitempty"`
+	Sort    []string            `json:"sort,omitempty"` // MSC3575 only
+	Filters *SlidingSyncFilters `json:"filters,omitempty"`
+}
+
+// SlidingSyncFilters restricts the rooms in a SlidingSyncList.
+type SlidingSyncFilters struct {
+	IsDM         *bool    `json:"is_dm,omitempty"`
+	Spaces       []string `json:"spaces,omitempty"`
+	IsEncrypted  *bool    `json:"is_encrypted,omitempty"`
+	IsInvite     *bool    `json:"is_invite,omitempty"`
+	RoomTypes    []string `json:"room_types,omitempty"`
+	NotRoomTypes []string `json:"not_room_types,omitempty"`
+}
+
+// SlidingSyncExtensions enables sliding sync extensions. Leave an extension nil to leave it unchanged.
+type SlidingSyncExtensions struct {
+	ToDevice    *SlidingSyncToDeviceExtension    `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncExtension            `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncAccountDataExtension `json:"account_data,omitempty"`
+}
+
+// SlidingSyncExtension is an extension with no configuration beyond whether it is enabled.
+type SlidingSyncExtension struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// SlidingSyncToDeviceExtension configures the to_device extension.
+type SlidingSyncToDeviceExtension struct {
+	Enabled *bool  `json:"enabled,omitempty"`
+	Since   string `json:"since,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// SlidingSyncAccountDataExtension configures the account_data extension.
+type SlidingSyncAccountDataExtension struct {
+	Enabled *bool    `json:"enabled,omitempty"`
+	Lists   []string `json:"lists,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"`
+}
+
+// SlidingSyncResp is a sliding sync response.
+type SlidingSyncResp struct {
+	Pos        string                         `json:"pos"`
+	Lists      map[string]SlidingSyncListResp `json:"lists"`
+	Rooms      map[string]SlidingSyncRoomResp `json:"rooms"`
+	Extensions SlidingSyncExtensionsResp      `json:"extensions"`
+}
+
+// SlidingSyncListResp is a list in a sliding sync response.
+type SlidingSyncListResp struct {
+	Count int             `json:"count"`
+	Ops   []SlidingSyncOp `json:"ops,omitempty"` // MSC3575 only
+}
+
+// SlidingSyncOp is an operation on a list in an MSC3575 sliding sync response.
+type SlidingSyncOp struct {
+	Op      string   `json:"op"`
+	Range   []int64  `json:"range,omitempty"`
+	Index   *int64   `json:"index,omitempty"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+	RoomID  string   `json:"room_id,omitempty"`
+}
+
+// SlidingSyncRoomResp is a room in a sliding sync response.
+type SlidingSyncRoomResp struct {
+	Name              string            `json:"name,omitempty"`
+	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
+	Timeline          []json.RawMessage `json:"timeline,omitempty"`
+	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
+	NotificationCount int64             `json:"notification_count"`
+	HighlightCount    int64             `json:"highlight_count"`
+	Initial           bool              `json:"initial,omitempty"`
+	Limited           bool              `json:"limited,omitempty"`
+	PrevBatch         string            `json:"prev_batch,omitempty"`
+	JoinedCount       int64             `json:"joined_count,omitempty"`
+	InvitedCount      int64             `json:"invited_count,omitempty"`
+	NumLive           int64             `json:"num_live,omitempty"`
+}
+
+// SlidingSyncExtensionsResp contains the extension data in a sliding sync response.
+type SlidingSyncExtensionsResp struct {
+	ToDevice *struct {
+		NextBatch string            `json:"next_batch"`
+		Events    []json.RawMessage `json:"events"`
+	} `json:"to_device,omitempty"`
+	E2EE *struct {
+		DeviceLists *struct {
+			Changed []string `json:"changed"`
+			Left    []string `json:"left"`
+		} `json:"device_lists,omitempty"`
+		DeviceOneTimeKeysCount       map[string]int `json:"device_one_time_keys_count,omitempty"`
+		DeviceUnusedFallbackKeyTypes []string       `json:"device_unused_fallback_key_types,omitempty"`
+	} `json:"e2ee,omitempty"`
+	AccountData *struct {
+		Global []json.RawMessage            `json:"global,omitempty"`
+		Rooms  map[string][]json.RawMessage `json:"rooms,omitempty"`
+	} `json:"account_data,omitempty"`
+}
+
+// SlidingSyncCheckOpt is a functional option for use with SlidingSyncUntil which should return <nil> if
+// the response satisfies the check, else return a human friendly error.
+type SlidingSyncCheckOpt func(clientUserID string, res SlidingSyncResp) error
+
+// SlidingSync performs a single sliding sync request. To sync until something happens, see SlidingSyncUntil.
+//
+// Fails the test if the request does not return 200 OK.
+func (c *CSAPI) SlidingSync(t *testing.T, req SlidingSyncReq) SlidingSyncResp {
+	t.Helper()
+	version := req.Version
+	if version == "" {
+		version = SlidingSyncMSC4186
+	}
+	query := url.Values{
+		"timeout": []string{"1000"},
+	}
+	if req.TimeoutMillis != "" {
+		query["timeout"] = []string{req.TimeoutMillis}
+	}
+	if req.Pos != "" {
+		query["pos"] = []string{req.Pos}
+	}
+	res := c.MustDoFunc(
+		t, "POST", []string{"_matrix", "client", "unstable", string(version), "sync"},
+		WithJSONBody(t, req), WithQueries(query),
+	)
+	body := ParseJSON(t, res)
+	var resp SlidingSyncResp
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("SlidingSync: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return resp
+}
+
+// SlidingSyncUntil blocks and continually calls sliding sync (advancing the pos) until all the check
+// functions return no error. The request is sent in full each time. Returns the final response, whose
+// pos can be used to continue the connection. Check functions behave as in MustSyncUntil.
+//
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) SlidingSyncUntil(t *testing.T, req SlidingSyncReq, checks ...SlidingSyncCheckOpt) SlidingSyncResp {
+	t.Helper()
+	start := time.Now()
+	numResponsesReturned := 0
+	errs := make([][]string, len(checks))
+	remaining := make([]int, len(checks))
+	for i := range checks {
+		remaining[i] = i
+	}
+	for {
+		if time.Since(start) > c.SyncUntilTimeout {
+			msg := "Checkers:\n"
+			for _, i := range remaining {
+				msg += fmt.Sprintf("%v, \n", errs[i])
+			}
+			t.Fatalf("%s SlidingSyncUntil: timed out after %v. Seen %d responses. %s", c.UserID, time.Since(start), numResponsesReturned, msg)
+		}
+		res := c.SlidingSync(t, req)
+		req.Pos = res.Pos
+		numResponsesReturned++
+
+		var stillRemaining []int
+		for _, i := range remaining {
+			if err := checks[i](c.UserID, res); err != nil {
+				errs[i] = append(errs[i], fmt.Sprintf("[t=%v] Response #%d: %s", time.Since(start), numResponsesReturned, err))
+				stillRemaining = append(stillRemaining, i)
+			}
+		}
+		remaining = stillRemaining
+		if len(remaining) == 0 {
+			return res
+		}
+	}
+}
+
+// SlidingSyncListState tracks the ordered room IDs of an MSC3575 list by applying list operations.
+type SlidingSyncListState struct {
+	Count   int
+	roomIDs map[int64]string
+}
+
+// Apply updates the list with the count and operations from a response.
+func (l *SlidingSyncListState) Apply(t *testing.T, list SlidingSyncListResp) {
+	t.Helper()
+	if l.roomIDs == nil {
+		l.roomIDs = make(map[int64]string)
+	}
+	l.Count = list.Count
+	for _, op := range list.Ops {
+		switch op.Op {
+		case "SYNC":
+			if len(op.Range) != 2 {
+				t.Fatalf("SlidingSyncListState: SYNC op has invalid range %v", op.Range)
+			}
+			for i, roomID := range op.RoomIDs {
+				l.roomIDs[op.Range[0]+int64(i)] = roomID
+			}
+		case "INVALIDATE":
+			if len(op.Range) != 2 {
+				t.Fatalf("SlidingSyncListState: INVALIDATE op has invalid range %v", op.Range)
+			}
+			for i := op.Range[0]; i <= op.Range[1]; i++ {
+				delete(l.roomIDs, i)
+			}
+		case "DELETE":
+			if op.Index == nil {
+				t.Fatalf("SlidingSyncListState: DELETE op has no index")
+			}
+			delete(l.roomIDs, *op.Index)
+		case "INSERT":
+			if op.Index == nil {
+				t.Fatalf("SlidingSyncListState: INSERT op has no index")
+			}
+			l.insert(*op.Index, op.RoomID)
+		default:
+			t.Fatalf("SlidingSyncListState: unknown op %s", op.Op)
+		}
+	}
+}
+
+// insert puts the room at the index, shifting rooms down into the gap left by an earlier DELETE.
+func (l *SlidingSyncListState) insert(index int64, roomID string) {
+	gap := index
+	for ; gap < int64(l.Count); gap++ {
+		if _, ok := l.roomIDs[gap]; !ok {
+			break
+		}
+	}
+	for i := gap; i > index; i-- {
+		l.roomIDs[i] = l.roomIDs[i-1]
+	}
+	l.roomIDs[index] = roomID
+}
+
+// RoomIDs returns the known room IDs in list order. Indexes which are unknown, e.g outside of the requested
+// ranges, are returned as "".
+func (l *SlidingSyncListState) RoomIDs() []string {
+	var max int64 = -1
+	for i := range l.roomIDs {
+		if i > max {
+			max = i
+		}
+	}
+	roomIDs := make([]string, max+1)
+	for i, roomID := range l.roomIDs {
+		roomIDs[i] = roomID
+	}
+	return roomIDs
+}
+
+// Check that the list `listKey` has a count of `count`.
+func SlidingSyncListHasCount(listKey string, count int) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResp) error {
+		list, ok := res.Lists[listKey]
+		if !ok {
+			return fmt.Errorf("SlidingSyncListHasCount(%s): list missing from response", listKey)
+		}
+		if list.Count != count {
+			return fmt.Errorf("SlidingSyncListHasCount(%s): got count %d, want %d", listKey, list.Count, count)
+		}
+		return nil
+	}
+}
+
+// Check that the timeline for `roomID` has an event which passes the check function.
+func SlidingSyncTimelineHas(roomID string, check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResp) error {
+		room, ok := res.Rooms[roomID]
+		if !ok {
+			return fmt.Errorf("SlidingSyncTimelineHas(%s): room missing from response", roomID)
+		}
+		for _, ev := range room.Timeline {
+			if check(gjson.ParseBytes(ev)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("SlidingSyncTimelineHas(%s): check function did not pass while iterating over %d events", roomID, len(room.Timeline))
+	}
+}
+
+// Check that the to_device extension has an event which passes the check function.
+func SlidingSyncToDeviceHas(check func(gjson.Result) bool) SlidingSyncCheckOpt {
+	return func(clientUserID string, res SlidingSyncResp) error {
+		if res.Extensions.ToDevice == nil {
+			return fmt.Errorf("SlidingSyncToDeviceHas: to_device extension missing from response")
+		}
+		for _, ev := range res.Extensions.ToDevice.Events {
+			if check(gjson.ParseBytes(ev)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("SlidingSyncToDeviceHas: check function did not pass while iterating over %d events", len(res.Extensions.ToDevice.Events))
+	}
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
+)
+
+// CreateSpace creates a room with the m.space room type. `createRoomBody` is merged into the /createRoom request
+// body and may be nil. Fails the test on error. Returns the room ID.
+func (c *CSAPI) CreateSpace(t *testing.T, createRoomBody map[string]interface{}) string {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"preset": "public_chat",
+	}
+	for k, v := range createRoomBody {
+		reqBody[k] = v
+	}
+	creationContent, _ := reqBody["creation_content"].(map[string]interface{})
+	merged := map[string]interface{}{
+		"type": "m.space",
+	}
+	for k, v := range creationContent {
+		merged[k] = v
+	}
+	reqBody["creation_content"] = merged
+	return c.CreateRoom(t, reqBody)
+}
+
+// AddSpaceChild adds `childRoomID` to the space by sending an m.space.child state event. Fails the test on error.
+// Returns the event ID.
+func (c *CSAPI) AddSpaceChild(t *testing.T, spaceID, childRoomID string, via []string, suggested bool) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, spaceID, b.Event{
+		Type:     "m.space.child",
+		StateKey: b.Ptr(childRoomID),
+		Content: map[string]interface{}{
+			"via":       via,
+			"suggested": suggested,
+		},
+	})
+}
+
+// SpaceHierarchyReq contains the /hierarchy request options. The empty struct is valid.
+type SpaceHierarchyReq struct {
+	// The maximum number of rooms per page. 0 uses the server default.
+	Limit int
+	// The maximum depth to walk. nil uses the server default.
+	MaxDepth      *int
+	SuggestedOnly bool
+}
+
+// SpaceHierarchy iterates over the rooms returned by /hierarchy, fetching further pages as needed.
+type SpaceHierarchy struct {
+	client    *CSAPI
+	spaceID   string
+	query     url.Values
+	rooms     []gjson.Result
+	nextBatch string
+	fetched   bool
+}
+
+// GetSpaceHierarchy returns an iterator over the rooms in the space. No requests are made until Next is called.
+func (c *CSAPI) GetSpaceHierarchy(spaceID string, req SpaceHierarchyReq) *SpaceHierarchy {
+	query := url.Values{}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.MaxDepth != nil {
+		query.Set("max_depth", strconv.Itoa(*req.MaxDepth))
+	}
+	if req.SuggestedOnly {
+		query.Set("suggested_only", "true")
+	}
+	return &SpaceHierarchy{
+		client:  c,
+		spaceID: spaceID,
+		query:   query,
+	}
+}
+
+// Next returns the next room summary, fetching the next page if needed. Returns false when there are no more
+// rooms. Fails the test on error.
+func (h *SpaceHierarchy) Next(t *testing.T) (gjson.Result, bool) {
+	t.Helper()
+	for len(h.rooms) == 0 {
+		if h.fetched && h.nextBatch == "" {
+			return gjson.Result{}, false
+		}
+		if h.nextBatch != "" {
+			h.query.Set("from", h.nextBatch)
+		}
+		res := h.client.MustDoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", h.spaceID, "hierarchy"}, WithQueries(h.query))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		h.fetched = true
+		h.rooms = body.Get("rooms").Array()
+		h.nextBatch = body.Get("next_batch").Str
+	}
+	room := h.rooms[0]
+	h.rooms = h.rooms[1:]
+	return room, true
+}
+
+// All returns all remaining room summaries. Fails the test on error.
+func (h *SpaceHierarchy) All(t *testing.T) []gjson.Result {
+	t.Helper()
+	var rooms []gjson.Result
+	for {
+		room, ok := h.Next(t)
+		if !ok {
+			return rooms
+		}
+		rooms = append(rooms, room)
+	}
+}
+
+// SpaceHierarchyRoomIDs returns the room IDs of the given room summaries, in order.
+func SpaceHierarchyRoomIDs(rooms []gjson.Result) []string {
+	roomIDs := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.Get("room_id").Str)
+	}
+	return roomIDs
+}
+
+// SpaceHierarchyHasRoom returns an error unless `rooms` contains a summary for `roomID` which passes all of the
+// checks, e.g match.JSONKeyEqual("name", "My room") or match.JSONKeyArrayOfSize("children_state", 2).
+func SpaceHierarchyHasRoom(rooms []gjson.Result, roomID string, checks ...match.JSON) error {
+	return roomsHaveRoom("SpaceHierarchyHasRoom", rooms, roomID, checks)
+}
+
+// roomsHaveRoom returns an error unless `rooms` contains an object with `room_id` which passes all of the checks.
+func roomsHaveRoom(funcName string, rooms []gjson.Result, roomID string, checks []match.JSON) error {
+	for _, room := range rooms {
+		if room.Get("room_id").Str != roomID {
+			continue
+		}
+		for _, check := range checks {
+			if err := check([]byte(room.Raw)); err != nil {
+				return fmt.Errorf("%s(%s): %s", funcName, roomID, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s(%s): room not in %v", funcName, roomID, SpaceHierarchyRoomIDs(rooms))
+}
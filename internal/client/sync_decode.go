@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tidwall/gjson"
+)
+
+// decodeSyncStreaming decodes a /sync response from `r` incrementally, calling `onEvent` for each event in the
+// `events` arrays of rooms and of the top-level to_device, presence and account_data sections. Returns the
+// response with those arrays emptied, so only one event is held in memory at a time.
+func decodeSyncStreaming(r io.Reader, onEvent func(SyncStreamEvent)) ([]byte, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := decodeSyncValue(dec, nil, &out, onEvent); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decodeSyncValue decodes the next value from `dec`, which is at `path` in the response, into `out`.
+func decodeSyncValue(dec *json.Decoder, path []string, out *bytes.Buffer, onEvent func(SyncStreamEvent)) error {
+	if !syncPathMayHaveEvents(path) {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		out.Write(raw)
+		return nil
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		out.WriteByte('{')
+		for i := 0; dec.More(); i++ {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, ok := keyTok.(string)
+			if !ok {
+				return fmt.Errorf("decodeSyncValue: expected object key at %v, got %v", path, keyTok)
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			keyJSON, _ := json.Marshal(key)
+			out.Write(keyJSON)
+			out.WriteByte(':')
+			if err := decodeSyncValue(dec, append(path[:len(path):len(path)], key), out, onEvent); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case json.Delim('['):
+		roomID, section, isEvents := syncEventsPath(path)
+		out.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			if isEvents {
+				onEvent(SyncStreamEvent{RoomID: roomID, Section: section, Event: gjson.ParseBytes(raw)})
+				continue
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.Write(raw)
+		}
+		out.WriteByte(']')
+	default:
+		scalar, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		out.Write(scalar)
+		return nil
+	}
+	// consume the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// syncPathMayHaveEvents returns true if `path` is, or is a parent of, an events array which is streamed.
+func syncPathMayHaveEvents(path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	switch path[0] {
+	case "rooms":
+		return len(path) < 5 || (len(path) == 5 && path[4] == "events")
+	case SyncSectionToDevice, SyncSectionPresence, SyncSectionAccountData:
+		return len(path) < 2 || (len(path) == 2 && path[1] == "events")
+	}
+	return false
+}
+
+// syncEventsPath returns the room ID and section of the events array at `path`, if it is one.
+func syncEventsPath(path []string) (roomID, section string, ok bool) {
+	if len(path) == 5 && path[0] == "rooms" && path[4] == "events" {
+		return path[2], path[3], true
+	}
+	if len(path) == 2 && path[0] != "rooms" && path[1] == "events" {
+		return "", path[0], true
+	}
+	return "", "", false
+}
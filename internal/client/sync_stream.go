@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Sections of the /sync response which a SyncStream delivers events from.
+const (
+	SyncSectionTimeline    = "timeline"
+	SyncSectionState       = "state"
+	SyncSectionEphemeral   = "ephemeral"
+	SyncSectionAccountData = "account_data"
+	SyncSectionInviteState = "invite_state"
+	SyncSectionToDevice    = "to_device"
+	SyncSectionPresence    = "presence"
+)
+
+// SyncStreamEvent is an event delivered by a SyncStream.
+type SyncStreamEvent struct {
+	// The room the event is in, or empty for global account data, to-device and presence events.
+	RoomID string
+	// One of the SyncSection constants.
+	Section string
+	Event   gjson.Result
+}
+
+// SyncStreamFilter selects which events a SyncStream delivers to a subscriber. Empty fields match anything.
+type SyncStreamFilter struct {
+	RoomID    string
+	EventType string
+	Section   string
+}
+
+func (f SyncStreamFilter) matches(ev SyncStreamEvent) bool {
+	return (f.RoomID == "" || f.RoomID == ev.RoomID) &&
+		(f.EventType == "" || f.EventType == ev.Event.Get("type").Str) &&
+		(f.Section == "" || f.Section == ev.Section)
+}
+
+// SyncStream runs a /sync loop in the background, delivering events to subscribers as they arrive. Unlike
+// MustSyncUntil, each response is only parsed once and no events are missed between calls. Subscribe before
+// doing the action which causes the events, as events which arrived earlier are not replayed.
+//
+//	stream := alice.StartSyncStream(t, client.SyncReq{})
+//	defer stream.Stop(t)
+//	ch, unsubscribe := stream.Subscribe(client.SyncStreamFilter{RoomID: roomID, EventType: "m.room.message"})
+//	defer unsubscribe()
+//	bob.SendEventUnsynced(t, roomID, ...)
+//	ev := <-ch
+type SyncStream struct {
+	c      *CSAPI
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	callbacks map[int]syncStreamCallback
+	nextID    int
+	nextBatch string
+	err       error
+}
+
+type syncStreamCallback struct {
+	filter SyncStreamFilter
+	fn     func(ev SyncStreamEvent)
+}
+
+// StartSyncStream starts syncing in the background from `syncReq.Since`. The stream is stopped when the test
+// finishes, but tests should call Stop to check the loop did not fail.
+func (c *CSAPI) StartSyncStream(t *testing.T, syncReq SyncReq) *SyncStream {
+	t.Helper()
+	// build the query in the test goroutine, as the loop cannot fail the test
+	query := syncReq.queryParams(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SyncStream{
+		c:         c,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		callbacks: make(map[int]syncStreamCallback),
+		nextBatch: syncReq.Since,
+	}
+	go s.run(ctx, query)
+	t.Cleanup(func() {
+		cancel()
+		<-s.done
+	})
+	return s
+}
+
+// OnEvent calls `fn` for each event which matches the filter. `fn` is called from the sync loop, so it must not
+// block or call t.Fatal. Returns a function which removes the callback.
+func (s *SyncStream) OnEvent(filter SyncStreamFilter, fn func(ev SyncStreamEvent)) (remove func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.callbacks[id] = syncStreamCallback{filter: filter, fn: fn}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.callbacks, id)
+	}
+}
+
+// Subscribe returns a channel of the events which match the filter. Events are queued until read, so slow
+// readers do not hold up the sync loop. The channel is closed when the stream stops or unsubscribe is called.
+func (s *SyncStream) Subscribe(filter SyncStreamFilter) (ch <-chan SyncStreamEvent, unsubscribe func()) {
+	out := make(chan SyncStreamEvent)
+	notify := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	var mu sync.Mutex
+	var queue []SyncStreamEvent
+	remove := s.OnEvent(filter, func(ev SyncStreamEvent) {
+		mu.Lock()
+		queue = append(queue, ev)
+		mu.Unlock()
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	})
+	go func() {
+		defer close(out)
+		for {
+			mu.Lock()
+			if len(queue) > 0 {
+				ev := queue[0]
+				queue = queue[1:]
+				mu.Unlock()
+				select {
+				case out <- ev:
+				case <-closed:
+					return
+				case <-s.done:
+					return
+				}
+				continue
+			}
+			mu.Unlock()
+			select {
+			case <-notify:
+			case <-closed:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			remove()
+			close(closed)
+		})
+	}
+}
+
+// WaitForEvent blocks until an event which matches the filter and passes the check function arrives. Fails the
+// test if none arrives within SyncUntilTimeout, or if the stream stops.
+func (s *SyncStream) WaitForEvent(t *testing.T, filter SyncStreamFilter, check func(ev gjson.Result) bool) SyncStreamEvent {
+	t.Helper()
+	ch, unsubscribe := s.Subscribe(filter)
+	defer unsubscribe()
+	timer := time.NewTimer(s.c.SyncUntilTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				t.Fatalf("SyncStream.WaitForEvent: stream stopped: %v", s.Err())
+			}
+			if check == nil || check(ev.Event) {
+				return ev
+			}
+		case <-timer.C:
+			t.Fatalf("SyncStream.WaitForEvent: timed out after %v waiting for %+v", s.c.SyncUntilTimeout, filter)
+		}
+	}
+}
+
+// NextBatch returns the next_batch token of the latest response processed.
+func (s *SyncStream) NextBatch() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextBatch
+}
+
+// Err returns the error which stopped the sync loop, if any.
+func (s *SyncStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Stop stops the sync loop and waits for it to exit. Fails the test if the loop stopped because of an error.
+func (s *SyncStream) Stop(t *testing.T) {
+	t.Helper()
+	s.cancel()
+	<-s.done
+	if err := s.Err(); err != nil {
+		t.Fatalf("SyncStream.Stop: sync loop failed: %s", err)
+	}
+}
+
+func (s *SyncStream) run(ctx context.Context, query url.Values) {
+	defer close(s.done)
+	for {
+		query.Set("since", s.NextBatch())
+		if query.Get("since") == "" {
+			query.Del("since")
+		}
+		body, err := s.syncOnce(ctx, query.Encode())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		s.nextBatch = body.Get("next_batch").Str
+		s.mu.Unlock()
+		s.dispatch(body)
+	}
+}
+
+func (s *SyncStream) syncOnce(ctx context.Context, rawQuery string) (gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.c.BaseURL+"/_matrix/client/v3/sync?"+rawQuery, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.c.AccessToken)
+	res, err := s.c.Client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if res.StatusCode != 200 {
+		return gjson.Result{}, fmt.Errorf("/sync returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	if !gjson.ValidBytes(body) {
+		return gjson.Result{}, fmt.Errorf("/sync returned invalid JSON: %s", string(body))
+	}
+	return gjson.ParseBytes(body), nil
+}
+
+// dispatch delivers every event in the response to the matching callbacks, in response order.
+func (s *SyncStream) dispatch(body gjson.Result) {
+	var events []SyncStreamEvent
+	add := func(roomID, section string, array gjson.Result) {
+		for _, ev := range array.Array() {
+			events = append(events, SyncStreamEvent{RoomID: roomID, Section: section, Event: ev})
+		}
+	}
+	add("", SyncSectionAccountData, body.Get("account_data.events"))
+	add("", SyncSectionToDevice, body.Get("to_device.events"))
+	add("", SyncSectionPresence, body.Get("presence.events"))
+	body.Get("rooms.join").ForEach(func(roomID, room gjson.Result) bool {
+		add(roomID.Str, SyncSectionState, room.Get("state.events"))
+		add(roomID.Str, SyncSectionTimeline, room.Get("timeline.events"))
+		add(roomID.Str, SyncSectionEphemeral, room.Get("ephemeral.events"))
+		add(roomID.Str, SyncSectionAccountData, room.Get("account_data.events"))
+		return true
+	})
+	body.Get("rooms.invite").ForEach(func(roomID, room gjson.Result) bool {
+		add(roomID.Str, SyncSectionInviteState, room.Get("invite_state.events"))
+		return true
+	})
+	body.Get("rooms.leave").ForEach(func(roomID, room gjson.Result) bool {
+		add(roomID.Str, SyncSectionState, room.Get("state.events"))
+		add(roomID.Str, SyncSectionTimeline, room.Get("timeline.events"))
+		return true
+	})
+
+	s.mu.Lock()
+	callbacks := make([]syncStreamCallback, 0, len(s.callbacks))
+	for _, cb := range s.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	s.mu.Unlock()
+	for _, ev := range events {
+		for _, cb := range callbacks {
+			if cb.filter.matches(ev) {
+				cb.fn(ev)
+			}
+		}
+	}
+}
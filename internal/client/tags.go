@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// RoomTag is the content of a room tag. Order is nil if the tag has no order.
+type RoomTag struct {
+	Order *float64 `json:"order,omitempty"`
+}
+
+// SetRoomTag adds `tag` to the room, e.g "m.favourite". Fails the test on error.
+func (c *CSAPI) SetRoomTag(t *testing.T, roomID, tag string, order *float64) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "user", c.UserID, "rooms", roomID, "tags", tag}, WithJSONBody(t, RoomTag{
+		Order: order,
+	}))
+}
+
+// DeleteRoomTag removes `tag` from the room. Fails the test on error.
+func (c *CSAPI) DeleteRoomTag(t *testing.T, roomID, tag string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "v3", "user", c.UserID, "rooms", roomID, "tags", tag})
+}
+
+// GetRoomTags returns the tags on the room. Fails the test on error.
+func (c *CSAPI) GetRoomTags(t *testing.T, roomID string) map[string]RoomTag {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "rooms", roomID, "tags"})
+	body := ParseJSON(t, res)
+	var tags struct {
+		Tags map[string]RoomTag `json:"tags"`
+	}
+	if err := json.Unmarshal(body, &tags); err != nil {
+		t.Fatalf("GetRoomTags: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return tags.Tags
+}
+
+// Check that the m.tag account data for `roomID` has `tag`. If `order` is non-nil, the tag must have that order.
+func SyncRoomTagHas(roomID, tag string, order *float64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+			got := ev.Get("content.tags." + GjsonEscape(tag))
+			if ev.Get("type").Str != "m.tag" || !got.Exists() {
+				return false
+			}
+			return order == nil || (got.Get("order").Exists() && got.Get("order").Float() == *order)
+		})(clientUserID, topLevelSyncJSON)
+		if err != nil {
+			return fmt.Errorf("SyncRoomTagHas(%s, %s): %s", roomID, tag, err)
+		}
+		return nil
+	}
+}
+
+// Check that the m.tag account data for `roomID` does not have `tag`. The room must have m.tag account data in
+// the response, so this passes once the tag removal has been synced.
+func SyncRoomTagMissing(roomID, tag string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.tag" && !ev.Get("content.tags."+GjsonEscape(tag)).Exists()
+		})(clientUserID, topLevelSyncJSON)
+		if err != nil {
+			return fmt.Errorf("SyncRoomTagMissing(%s, %s): %s", roomID, tag, err)
+		}
+		return nil
+	}
+}
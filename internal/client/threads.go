@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// SendThreadReply sends a text message into the thread rooted at `threadRootID`, with the reply fallback clients
+// add for compatibility. Returns the event ID of the sent event.
+func (c *CSAPI) SendThreadReply(t *testing.T, roomID, threadRootID, text string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    text,
+			"m.relates_to": map[string]interface{}{
+				"rel_type":        "m.thread",
+				"event_id":        threadRootID,
+				"is_falling_back": true,
+				"m.in_reply_to": map[string]interface{}{
+					"event_id": threadRootID,
+				},
+			},
+		},
+	})
+}
+
+// GetThreadRelations returns the `chunk` of events in the thread rooted at `threadRootID`, following `next_batch`
+// until all events have been fetched. Events are returned newest first, as the server returns them. Fails the
+// test on error.
+func (c *CSAPI) GetThreadRelations(t *testing.T, roomID, threadRootID string) []gjson.Result {
+	t.Helper()
+	return c.mustPaginate(t, []string{"_matrix", "client", "v1", "rooms", roomID, "relations", threadRootID, "m.thread"}, url.Values{})
+}
+
+// GetThreads returns the thread roots in the room from the /threads endpoint, following `next_batch` until all
+// threads have been fetched. `include` is "all" or "participated". Fails the test on error.
+func (c *CSAPI) GetThreads(t *testing.T, roomID, include string) []gjson.Result {
+	t.Helper()
+	query := url.Values{}
+	if include != "" {
+		query.Set("include", include)
+	}
+	return c.mustPaginate(t, []string{"_matrix", "client", "v1", "rooms", roomID, "threads"}, query)
+}
+
+// mustPaginate calls an endpoint which returns `chunk` and `next_batch`, following `next_batch` via the `from`
+// query parameter until it is absent. Returns all events from every chunk.
+func (c *CSAPI) mustPaginate(t *testing.T, paths []string, query url.Values) []gjson.Result {
+	t.Helper()
+	var chunk []gjson.Result
+	for {
+		res := c.MustDoFunc(t, "GET", append([]string(nil), paths...), WithQueries(query))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		chunk = append(chunk, body.Get("chunk").Array()...)
+		nextBatch := body.Get("next_batch").Str
+		if nextBatch == "" {
+			return chunk
+		}
+		query.Set("from", nextBatch)
+	}
+}
+
+// Check that the timeline for `roomID` has the thread root `threadRootID`, with a thread summary which passes
+// the check function. The summary is the `m.thread` aggregation in the event's unsigned relations, containing
+// `latest_event`, `count` and `current_user_participated`.
+func SyncThreadSummaryHas(roomID, threadRootID string, check func(summary gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("event_id").Str != threadRootID {
+				return false
+			}
+			summary := ev.Get(`unsigned.m\.relations.m\.thread`)
+			return summary.Exists() && check(summary)
+		})(clientUserID, topLevelSyncJSON)
+		if err != nil {
+			return fmt.Errorf("SyncThreadSummaryHas(%s): %s", threadRootID, err)
+		}
+		return nil
+	}
+}
+
+// Check that the unread thread notification counts for the thread rooted at `threadRootID` are as given. The
+// /sync filter must set `unread_thread_notifications` in the room event filter for the counts to be returned.
+func SyncThreadUnreadCountsAre(roomID, threadRootID string, notificationCount, highlightCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		counts := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".unread_thread_notifications." + GjsonEscape(threadRootID))
+		if !counts.Exists() {
+			return fmt.Errorf("SyncThreadUnreadCountsAre(%s): no unread_thread_notifications for thread", threadRootID)
+		}
+		gotNotifs := counts.Get("notification_count").Int()
+		gotHighlights := counts.Get("highlight_count").Int()
+		if gotNotifs != notificationCount || gotHighlights != highlightCount {
+			return fmt.Errorf(
+				"SyncThreadUnreadCountsAre(%s): got notification_count=%d highlight_count=%d, want %d and %d",
+				threadRootID, gotNotifs, gotHighlights, notificationCount, highlightCount,
+			)
+		}
+		return nil
+	}
+}
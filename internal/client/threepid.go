@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Purposes for requesting a 3PID validation token, used to build the requestToken path.
+const (
+	ThreePIDPurposeRegister = "register"
+	ThreePIDPurposeAdd      = "account/3pid"
+	ThreePIDPurposePassword = "account/password"
+)
+
+// ThreePID is a third-party identifier as returned by /account/3pid.
+type ThreePID struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	ValidatedAt int64  `json:"validated_at"`
+	AddedAt     int64  `json:"added_at"`
+}
+
+// RequestEmailToken asks the homeserver to send a validation token to `email`. `purpose` is one of the
+// ThreePIDPurpose constants. Fails the test on error. Returns the session ID.
+func (c *CSAPI) RequestEmailToken(t *testing.T, purpose, email, clientSecret string, sendAttempt int) string {
+	t.Helper()
+	return c.requestThreePIDToken(t, purpose, "email", map[string]interface{}{
+		"client_secret": clientSecret,
+		"email":         email,
+		"send_attempt":  sendAttempt,
+	})
+}
+
+// RequestMSISDNToken asks the homeserver to send a validation token to the phone number. `purpose` is one of
+// the ThreePIDPurpose constants. Fails the test on error. Returns the session ID.
+func (c *CSAPI) RequestMSISDNToken(t *testing.T, purpose, country, phoneNumber, clientSecret string, sendAttempt int) string {
+	t.Helper()
+	return c.requestThreePIDToken(t, purpose, "msisdn", map[string]interface{}{
+		"client_secret": clientSecret,
+		"country":       country,
+		"phone_number":  phoneNumber,
+		"send_attempt":  sendAttempt,
+	})
+}
+
+func (c *CSAPI) requestThreePIDToken(t *testing.T, purpose, medium string, reqBody map[string]interface{}) string {
+	t.Helper()
+	paths := append([]string{"_matrix", "client", "v3"}, strings.Split(purpose, "/")...)
+	paths = append(paths, medium, "requestToken")
+	res := c.MustDoFunc(t, "POST", paths, WithJSONBody(t, reqBody))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "sid")
+}
+
+// AddThreePID adds the 3PID validated in the given session to this account, completing user-interactive auth
+// with `password`. Fails the test on error.
+func (c *CSAPI) AddThreePID(t *testing.T, clientSecret, sid, password string) {
+	t.Helper()
+	c.MustDoWithPasswordUIA(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "add"}, map[string]interface{}{
+		"client_secret": clientSecret,
+		"sid":           sid,
+	}, password)
+}
+
+// GetThreePIDs returns the 3PIDs associated with this account. Fails the test on error.
+func (c *CSAPI) GetThreePIDs(t *testing.T) []ThreePID {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "account", "3pid"})
+	body := ParseJSON(t, res)
+	var threepids struct {
+		ThreePIDs []ThreePID `json:"threepids"`
+	}
+	if err := json.Unmarshal(body, &threepids); err != nil {
+		t.Fatalf("GetThreePIDs: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return threepids.ThreePIDs
+}
+
+// DeleteThreePID removes a 3PID from this account, and unbinds it from any identity server. Fails the test on error.
+func (c *CSAPI) DeleteThreePID(t *testing.T, medium, address string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "delete"}, WithJSONBody(t, map[string]interface{}{
+		"medium":  medium,
+		"address": address,
+	}))
+}
+
+// BindThreePID binds the 3PID validated in the given identity server session to this account. Fails the test on error.
+func (c *CSAPI) BindThreePID(t *testing.T, idServer, idAccessToken, clientSecret, sid string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "bind"}, WithJSONBody(t, map[string]interface{}{
+		"id_server":       idServer,
+		"id_access_token": idAccessToken,
+		"client_secret":   clientSecret,
+		"sid":             sid,
+	}))
+}
+
+// UnbindThreePID unbinds a 3PID from the identity server without removing it from this account. Fails the test on error.
+func (c *CSAPI) UnbindThreePID(t *testing.T, idServer, medium, address string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "unbind"}, WithJSONBody(t, map[string]interface{}{
+		"id_server": idServer,
+		"medium":    medium,
+		"address":   address,
+	}))
+}
+
+// LoginWithThreePID logs in using a 3PID and password. The client's user ID, access token and device ID are
+// replaced with those from the response. Fails the test on error.
+func (c *CSAPI) LoginWithThreePID(t *testing.T, medium, address, password string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "login"}, WithJSONBody(t, map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type":    "m.id.thirdparty",
+			"medium":  medium,
+			"address": address,
+		},
+		"password": password,
+	}))
+	body := ParseJSON(t, res)
+	c.UserID = GetJSONFieldStr(t, body, "user_id")
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	c.DeviceID = GetJSONFieldStr(t, body, "device_id")
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Directions for TimestampToEvent.
+const (
+	TimestampDirForward  = "f"
+	TimestampDirBackward = "b"
+)
+
+// TimestampToEventResp is the response from /timestamp_to_event
+type TimestampToEventResp struct {
+	EventID        string
+	OriginServerTS int64
+}
+
+// DoTimestampToEvent looks up the closest event to `ts` in the room, in the direction `dir` ("f" or "b"), and
+// returns the response. Uses the stable endpoint, falling back to the unstable MSC3030 endpoint if the server
+// does not support it.
+func (c *CSAPI) DoTimestampToEvent(t *testing.T, roomID string, ts time.Time, dir string) *http.Response {
+	t.Helper()
+	query := WithQueries(map[string][]string{
+		"ts":  {strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10)},
+		"dir": {dir},
+	})
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "timestamp_to_event"}, query)
+	if !isUnrecognisedEndpoint(res) {
+		return res
+	}
+	res.Body.Close()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc3030", "rooms", roomID, "timestamp_to_event"}, query)
+}
+
+// TimestampToEvent looks up the closest event to `ts` in the room, in the direction `dir` ("f" or "b"). Returns
+// false if the server found no event in that direction. Fails the test on any other error.
+func (c *CSAPI) TimestampToEvent(t *testing.T, roomID string, ts time.Time, dir string) (TimestampToEventResp, bool) {
+	t.Helper()
+	res := c.DoTimestampToEvent(t, roomID, ts, dir)
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return TimestampToEventResp{}, false
+	}
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("TimestampToEvent: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return TimestampToEventResp{
+		EventID:        GetJSONFieldStr(t, body, "event_id"),
+		OriginServerTS: gjson.GetBytes(body, "origin_server_ts").Int(),
+	}, true
+}
+
+// MustTimestampToEventIs asserts that looking up `ts` in direction `dir` returns the event `wantEventID`. If
+// `wantEventID` is empty, asserts that no event is found.
+func (c *CSAPI) MustTimestampToEventIs(t *testing.T, roomID string, ts time.Time, dir, wantEventID string) {
+	t.Helper()
+	res := c.DoTimestampToEvent(t, roomID, ts, dir)
+	if wantEventID == "" {
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_NOT_FOUND"),
+			},
+		})
+		return
+	}
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 200,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("event_id", wantEventID),
+			match.JSONKeyPresent("origin_server_ts"),
+		},
+	})
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// wrappingRoundTripper is implemented by the round trippers this package wraps around the transport, so
+// UseTransport can replace the transport underneath them.
+type wrappingRoundTripper interface {
+	http.RoundTripper
+	wrapped() http.RoundTripper
+	setWrapped(rt http.RoundTripper)
+}
+
+func (t *loggedRoundTripper) wrapped() http.RoundTripper         { return t.wrap }
+func (t *loggedRoundTripper) setWrapped(rt http.RoundTripper)    { t.wrap = rt }
+func (rt *capturingRoundTripper) wrapped() http.RoundTripper     { return rt.wrap }
+func (rt *capturingRoundTripper) setWrapped(w http.RoundTripper) { rt.wrap = w }
+
+// UseTransport makes the client send requests via `rt`, e.g an *http.Transport with HTTP/2 or custom TLS
+// settings, LatencyTransport or a ConnCountingTransport. Logging and traffic capture are kept.
+func (c *CSAPI) UseTransport(rt http.RoundTripper) {
+	// copy the client so other CSAPIs sharing it are unaffected
+	cli := *c.Client
+	c.Client = &cli
+	wrapper, ok := cli.Transport.(wrappingRoundTripper)
+	if !ok {
+		cli.Transport = rt
+		return
+	}
+	// copy each wrapper down to the innermost, then replace its transport
+	var outer wrappingRoundTripper
+	for ok {
+		copied := copyWrapper(wrapper)
+		if outer == nil {
+			cli.Transport = copied
+		} else {
+			outer.setWrapped(copied)
+		}
+		outer = copied
+		wrapper, ok = copied.wrapped().(wrappingRoundTripper)
+	}
+	outer.setWrapped(rt)
+}
+
+func copyWrapper(w wrappingRoundTripper) wrappingRoundTripper {
+	switch rt := w.(type) {
+	case *loggedRoundTripper:
+		copied := *rt
+		return &copied
+	case *capturingRoundTripper:
+		copied := *rt
+		return &copied
+	}
+	return w
+}
+
+// LatencyTransport returns a transport which waits for `delay` before sending each request via `rt`, which
+// may be nil to use http.DefaultTransport.
+func LatencyTransport(rt http.RoundTripper, delay time.Duration) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return rt.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ConnCountingTransport sends requests via a transport and counts how many used a new connection, so tests can
+// assert that connections are reused.
+type ConnCountingTransport struct {
+	Transport http.RoundTripper // nil uses http.DefaultTransport
+
+	mu       sync.Mutex
+	newConns int
+	reused   int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (ct *ConnCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := ct.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			if info.Reused {
+				ct.reused++
+			} else {
+				ct.newConns++
+			}
+		},
+	}
+	return rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// Counts returns the number of requests which used a new connection and which reused an existing one.
+func (ct *ConnCountingTransport) Counts() (newConns, reused int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.newConns, ct.reused
+}
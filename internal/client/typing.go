@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// SendTyping sets whether this user is typing in the room. `timeout` is only sent when typing is true.
+// Fails the test on error.
+func (c *CSAPI) SendTyping(t *testing.T, roomID string, typing bool, timeout time.Duration) {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"typing": typing,
+	}
+	if typing {
+		reqBody["timeout"] = timeout.Milliseconds()
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "typing", c.UserID}, WithJSONBody(t, reqBody))
+}
+
+// Check that the ephemeral section for `roomID` has an m.typing event where exactly `userIDs` are typing, in any
+// order. Pass no user IDs to check that nobody is typing.
+func SyncUsersTyping(roomID string, userIDs ...string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var lastSeen []string
+		err := SyncEphemeralHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.typing" {
+				return false
+			}
+			lastSeen = nil
+			for _, userID := range ev.Get("content.user_ids").Array() {
+				lastSeen = append(lastSeen, userID.Str)
+			}
+			return sameStringSet(lastSeen, userIDs)
+		})(clientUserID, topLevelSyncJSON)
+		if err != nil {
+			return fmt.Errorf("SyncUsersTyping(%s): got typing users %v, want %v: %s", roomID, lastSeen, userIDs, err)
+		}
+		return nil
+	}
+}
+
+// sameStringSet returns true if a and b contain the same strings, ignoring order and duplicates.
+func sameStringSet(a, b []string) bool {
+	setA := make(map[string]bool, len(a))
+	for _, s := range a {
+		setA[s] = true
+	}
+	setB := make(map[string]bool, len(b))
+	for _, s := range b {
+		if !setA[s] {
+			return false
+		}
+		setB[s] = true
+	}
+	return len(setA) == len(setB)
+}
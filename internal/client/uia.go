@@ -0,0 +1,33 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// MustDoWithPasswordUIA performs a request with the given JSON body. If the server responds with a
+// user-interactive auth challenge, the request is retried with an m.login.password auth dict using `password`.
+// `reqBody` is modified to include the auth dict. Fails the test if the final response is not 2xx.
+func (c *CSAPI) MustDoWithPasswordUIA(t *testing.T, method string, paths []string, reqBody map[string]interface{}, password string) *http.Response {
+	t.Helper()
+	res := c.DoFunc(t, method, paths, WithJSONBody(t, reqBody))
+	if res.StatusCode != 401 {
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			t.Fatalf("MustDoWithPasswordUIA: %s %v returned HTTP %d: %s", method, paths, res.StatusCode, string(ParseJSON(t, res)))
+		}
+		return res
+	}
+	body := ParseJSON(t, res)
+	reqBody["auth"] = map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": c.UserID,
+		},
+		"password": password,
+		"session":  gjson.GetBytes(body, "session").Str,
+	}
+	return c.MustDoFunc(t, method, paths, WithJSONBody(t, reqBody))
+}
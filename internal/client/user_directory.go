@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// UserDirectoryCheck is a check over the `results` of a user directory search.
+type UserDirectoryCheck func(results []gjson.Result) error
+
+// SearchUserDirectory searches the user directory for `term`. Fails the test on error. Returns the `results`.
+func (c *CSAPI) SearchUserDirectory(t *testing.T, term string) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "user_directory", "search"}, WithJSONBody(t, map[string]interface{}{
+		"search_term": term,
+	}))
+	return gjson.GetBytes(ParseJSON(t, res), "results").Array()
+}
+
+// MustSearchUserDirectoryUntil searches the user directory for `term` until the results pass all of the checks.
+// User directory updates are processed asynchronously by most homeservers, so tests should use this rather than
+// searching once after a change. Fails the test if the checks do not pass within SyncUntilTimeout.
+func (c *CSAPI) MustSearchUserDirectoryUntil(t *testing.T, term string, checks ...UserDirectoryCheck) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "user_directory", "search"}, WithJSONBody(t, map[string]interface{}{
+		"search_term": term,
+	}), WithRetryUntil(c.SyncUntilTimeout, func(res *http.Response) bool {
+		if res.StatusCode != 200 {
+			return false
+		}
+		results := gjson.GetBytes(ParseJSON(t, res), "results").Array()
+		for _, check := range checks {
+			if err := check(results); err != nil {
+				t.Logf("MustSearchUserDirectoryUntil(%s): %s", term, err)
+				return false
+			}
+		}
+		return true
+	}))
+	return gjson.GetBytes(ParseJSON(t, res), "results").Array()
+}
+
+// UserDirectoryHasUser checks that the results contain `userID`, optionally with the given display name.
+// An empty `displayName` matches any display name.
+func UserDirectoryHasUser(userID, displayName string) UserDirectoryCheck {
+	return func(results []gjson.Result) error {
+		for _, result := range results {
+			if result.Get("user_id").Str != userID {
+				continue
+			}
+			if displayName != "" && result.Get("display_name").Str != displayName {
+				return fmt.Errorf("UserDirectoryHasUser(%s): got display_name %q, want %q", userID, result.Get("display_name").Str, displayName)
+			}
+			return nil
+		}
+		return fmt.Errorf("UserDirectoryHasUser(%s): user not in results %v", userID, userDirectoryUserIDs(results))
+	}
+}
+
+// UserDirectoryMissingUser checks that the results do not contain `userID`.
+func UserDirectoryMissingUser(userID string) UserDirectoryCheck {
+	return func(results []gjson.Result) error {
+		for _, result := range results {
+			if result.Get("user_id").Str == userID {
+				return fmt.Errorf("UserDirectoryMissingUser(%s): user is in results: %s", userID, result.Raw)
+			}
+		}
+		return nil
+	}
+}
+
+func userDirectoryUserIDs(results []gjson.Result) []string {
+	userIDs := make([]string, 0, len(results))
+	for _, result := range results {
+		userIDs = append(userIDs, result.Get("user_id").Str)
+	}
+	return userIDs
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// ServerSupports returns true if the server supports `feature`, which is either a spec version such as
+// "v1.7", supported if the server advertises that or any later version in /versions, or an unstable feature
+// such as "org.matrix.msc3882", supported if it is enabled in `unstable_features`.
+func (c *CSAPI) ServerSupports(t *testing.T, feature string) bool {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	want, isSpecVersion := parseSpecVersion(feature)
+	if !isSpecVersion {
+		return body.Get("unstable_features." + GjsonEscape(feature)).Bool()
+	}
+	for _, v := range body.Get("versions").Array() {
+		got, ok := parseSpecVersion(v.Str)
+		if ok && (got[0] > want[0] || (got[0] == want[0] && got[1] >= want[1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipUnlessServerSupports skips the test unless the server supports `feature`. See ServerSupports.
+func (c *CSAPI) SkipUnlessServerSupports(t *testing.T, feature string) {
+	t.Helper()
+	if !c.ServerSupports(t, feature) {
+		t.Skipf("%s does not support %s", c.BaseURL, feature)
+	}
+}
+
+// parseSpecVersion parses a "vX.Y" spec version. Legacy "r0.x" versions are treated as v0.x.
+func parseSpecVersion(version string) ([2]int, bool) {
+	if !strings.HasPrefix(version, "v") && !strings.HasPrefix(version, "r") {
+		return [2]int{}, false
+	}
+	parts := strings.Split(version[1:], ".")
+	if len(parts) < 2 {
+		return [2]int{}, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return [2]int{}, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return [2]int{}, false
+	}
+	return [2]int{major, minor}, true
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// WhoamiResp is the response from /account/whoami
+type WhoamiResp struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	IsGuest  bool   `json:"is_guest"`
+}
+
+// WhoamiCheck is a check on a /account/whoami response, returning an error if it fails.
+type WhoamiCheck func(WhoamiResp) error
+
+// Whoami returns who the homeserver thinks owns this client's access token. `opts` are passed to the request,
+// e.g an appservice can set the `user_id` query parameter to assert an identity. Fails the test on error.
+func (c *CSAPI) Whoami(t *testing.T, opts ...RequestOpt) WhoamiResp {
+	t.Helper()
+	res := c.DoWhoami(t, opts...)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("Whoami: returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	var whoami WhoamiResp
+	if err := json.Unmarshal(body, &whoami); err != nil {
+		t.Fatalf("Whoami: failed to unmarshal response: %s - %s", err, string(body))
+	}
+	return whoami
+}
+
+// DoWhoami is the same as Whoami but returns the response, for testing access tokens which should be rejected.
+func (c *CSAPI) DoWhoami(t *testing.T, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"}, opts...)
+}
+
+// MustWhoami calls Whoami and fails the test if any of the checks fail.
+func (c *CSAPI) MustWhoami(t *testing.T, checks ...WhoamiCheck) WhoamiResp {
+	t.Helper()
+	whoami := c.Whoami(t)
+	for _, check := range checks {
+		if err := check(whoami); err != nil {
+			t.Fatalf("MustWhoami: %s", err)
+		}
+	}
+	return whoami
+}
+
+// MustWhoamiBeSelf asserts that the access token belongs to this client's user ID and device ID.
+func (c *CSAPI) MustWhoamiBeSelf(t *testing.T) {
+	t.Helper()
+	c.MustWhoami(t, WhoamiUserIs(c.UserID), WhoamiDeviceIs(c.DeviceID))
+}
+
+// MustWhoamiFailUnknownToken asserts that the access token is rejected with M_UNKNOWN_TOKEN, with the given
+// `soft_logout` flag.
+func (c *CSAPI) MustWhoamiFailUnknownToken(t *testing.T, softLogout bool) {
+	t.Helper()
+	res := c.DoWhoami(t)
+	checks := []match.JSON{
+		match.JSONKeyEqual("errcode", "M_UNKNOWN_TOKEN"),
+	}
+	if softLogout {
+		checks = append(checks, match.JSONKeyEqual("soft_logout", true))
+	}
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 401,
+		JSON:       checks,
+	})
+}
+
+// WhoamiUserIs checks that the access token belongs to `userID`.
+func WhoamiUserIs(userID string) WhoamiCheck {
+	return func(whoami WhoamiResp) error {
+		if whoami.UserID != userID {
+			return fmt.Errorf("WhoamiUserIs: got user_id %s, want %s", whoami.UserID, userID)
+		}
+		return nil
+	}
+}
+
+// WhoamiDeviceIs checks that the access token belongs to `deviceID`.
+func WhoamiDeviceIs(deviceID string) WhoamiCheck {
+	return func(whoami WhoamiResp) error {
+		if whoami.DeviceID != deviceID {
+			return fmt.Errorf("WhoamiDeviceIs: got device_id %s, want %s", whoami.DeviceID, deviceID)
+		}
+		return nil
+	}
+}
+
+// WhoamiIsGuest checks whether the access token belongs to a guest account.
+func WhoamiIsGuest(isGuest bool) WhoamiCheck {
+	return func(whoami WhoamiResp) error {
+		if whoami.IsGuest != isGuest {
+			return fmt.Errorf("WhoamiIsGuest: got is_guest %v, want %v", whoami.IsGuest, isGuest)
+		}
+		return nil
+	}
+}
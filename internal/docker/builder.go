@@ -309,6 +309,11 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			labels["device_id"+userID] = deviceID
 		}
 
+		// collect and store the Olm accounts of E2EE users as labels 'olm_account_$userid: $pickle'
+		for userID, pickle := range runner.OlmAccounts(res.homeserver.Name) {
+			labels["olm_account_"+userID] = pickle
+		}
+
 		// Combine the labels for tokens and application services
 		asLabels := labelsForApplicationServices(res.homeserver)
 		for k, v := range asLabels {
@@ -384,11 +389,17 @@ func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, context
 	return deployImage(
 		d.Docker, d.Config.BaseImageURI, fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkID, d.Config,
+		networkID, nil, d.Config,
 	)
 }
 
 func generateASRegistrationYaml(as b.ApplicationService) string {
+	namespaces := as.Namespaces
+	if namespaces == nil {
+		namespaces = &b.ApplicationServiceNamespaces{
+			Users: []b.ApplicationServiceNamespace{{Regex: ".*"}},
+		}
+	}
 	return fmt.Sprintf("id: %s\n", as.ID) +
 		fmt.Sprintf("hs_token: %s\n", as.HSToken) +
 		fmt.Sprintf("as_token: %s\n", as.ASToken) +
@@ -396,11 +407,22 @@ func generateASRegistrationYaml(as b.ApplicationService) string {
 		fmt.Sprintf("sender_localpart: %s\n", as.SenderLocalpart) +
 		fmt.Sprintf("rate_limited: %v\n", as.RateLimited) +
 		"namespaces:\n" +
-		"  users:\n" +
-		"    - exclusive: false\n" +
-		"      regex: .*\n" +
-		"  rooms: []\n" +
-		"  aliases: []\n"
+		generateASNamespaceYaml("users", namespaces.Users) +
+		generateASNamespaceYaml("rooms", namespaces.Rooms) +
+		generateASNamespaceYaml("aliases", namespaces.Aliases)
+}
+
+func generateASNamespaceYaml(kind string, namespaces []b.ApplicationServiceNamespace) string {
+	if len(namespaces) == 0 {
+		return fmt.Sprintf("  %s: []\n", kind)
+	}
+	yaml := fmt.Sprintf("  %s:\n", kind)
+	for _, ns := range namespaces {
+		// single-quote the regex so YAML does not interpret it, escaping single quotes by doubling them
+		yaml += fmt.Sprintf("    - exclusive: %v\n", ns.Exclusive) +
+			fmt.Sprintf("      regex: '%s'\n", strings.ReplaceAll(ns.Regex, "'", "''"))
+	}
+	return yaml
 }
 
 // createNetworkIfNotExists creates a docker network and returns its id.
@@ -49,9 +49,18 @@ type Deployer struct {
 	DeployNamespace string
 	Docker          *client.Client
 	Counter         int
-	networkID       string
-	debugLogging    bool
-	config          *config.Complement
+	// Federation traffic which is sent to the host running Complement rather than the destination homeserver.
+	FederationRoutes []FederationRoute
+	networkID        string
+	debugLogging     bool
+	config           *config.Complement
+}
+
+// FederationRoute makes the homeserver `From` resolve the server name `To` to the host running Complement, so
+// that its federation traffic for `To` can pass through a federation.RecordingProxy.
+type FederationRoute struct {
+	From string
+	To   string
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
@@ -112,11 +121,17 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		contextStr := img.Labels["complement_context"]
 		hsName := img.Labels["complement_hs_name"]
 		asIDToRegistrationMap := asIDToRegistrationFromLabels(img.Labels)
+		var routedHosts []string
+		for _, route := range d.FederationRoutes {
+			if route.From == hsName {
+				routedHosts = append(routedHosts, route.To)
+			}
+		}
 
 		// TODO: Make CSAPI port configurable
 		deployment, err := deployImage(
 			d.Docker, img.ID, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter),
-			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkID, d.config,
+			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkID, routedHosts, d.config,
 		)
 		if err != nil {
 			if deployment != nil && deployment.ContainerID != "" {
@@ -216,7 +231,7 @@ func (d *Deployer) Restart(hsDep *HomeserverDeployment, cfg *config.Complement)
 // nolint
 func deployImage(
 	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
-	asIDToRegistrationMap map[string]string, contextStr, networkID string, cfg *config.Complement,
+	asIDToRegistrationMap map[string]string, contextStr, networkID string, routedHosts []string, cfg *config.Complement,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
 	var extraHosts []string
@@ -230,6 +245,11 @@ func deployImage(
 		// see https://github.com/moby/moby/pull/40007 
 		extraHosts = []string{"host.docker.internal:host-gateway"}
 	}
+	// Send traffic for these homeservers to the host instead, see FederationRoute. Entries in /etc/hosts take
+	// precedence over the network aliases of the other containers.
+	for _, host := range routedHosts {
+		extraHosts = append(extraHosts, host+":host-gateway")
+	}
 
 	for _, m := range cfg.HostMounts {
 		mounts = append(mounts, mount.Mount{
@@ -360,6 +380,7 @@ func deployImage(
 		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
 		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
 		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
+		OlmAccounts:         olmAccountsFromLabels(inspect.Config.Labels),
 	}
 
 	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
@@ -1,9 +1,12 @@
 package docker
 
 import (
+	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/config"
 )
@@ -28,6 +31,7 @@ type HomeserverDeployment struct {
 	AccessTokens        map[string]string // e.g { "@alice:hs1": "myAcc3ssT0ken" }
 	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
 	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }
+	OlmAccounts         map[string]string // e.g { "@alice:hs1": "pickled Olm account" }
 	CSAPIClients        []*client.CSAPI
 }
 
@@ -72,7 +76,7 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 		AccessToken:      token,
 		DeviceID:         deviceID,
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.newHTTPClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -80,6 +84,29 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 	return client
 }
 
+// E2EEClient returns a CSAPI client for a user whose device keys were uploaded by the blueprint, along with the
+// Crypto for its device so the test can send and receive encrypted events straight away. Fails the test if the
+// user does not have keys.
+func (d *Deployment) E2EEClient(t *testing.T, hsName, userID string) (*client.CSAPI, *client.Crypto) {
+	t.Helper()
+	c := d.Client(t, hsName, userID)
+	pickle := d.HS[hsName].OlmAccounts[userID]
+	if pickle == "" {
+		t.Fatalf("Deployment.E2EEClient - HS name '%s' - user ID '%s' has no keys: set DeviceKeys or OneTimeKeys in the blueprint", hsName, userID)
+	}
+	return c, client.MustRestoreCrypto(t, c, pickle, b.OlmPickleKey)
+}
+
+// newHTTPClient returns a logged HTTP client, which also captures traffic if COMPLEMENT_HTTP_CAPTURE_DIR is set.
+func (d *Deployment) newHTTPClient(t *testing.T, hsName string) *http.Client {
+	t.Helper()
+	cli := client.NewLoggedClient(t, hsName, nil)
+	if dir := d.Deployer.config.HTTPCaptureDir; dir != "" {
+		cli = client.WithTrafficCapture(t, cli, dir)
+	}
+	return cli
+}
+
 // RegisterUser within a homeserver and return an authenticatedClient, Fails the test if the hsName is not found.
 func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password string, isAdmin bool) *client.CSAPI {
 	t.Helper()
@@ -90,7 +117,7 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 	}
 	client := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.newHTTPClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
@@ -111,6 +138,50 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 	return client
 }
 
+// LoginUser logs in as an existing user on a homeserver and returns a client for the new device, e.g to give a
+// user several devices for to-device and E2EE tests. `deviceID` may be empty to let the homeserver generate one.
+// Fails the test if the hsName is not found.
+func (d *Deployment) LoginUser(t *testing.T, hsName, localpart, password, deviceID string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.LoginUser - HS name '%s' not found", hsName)
+		return nil
+	}
+	unauthed := &client.CSAPI{
+		UserID:           fmt.Sprintf("@%s:%s", localpart, hsName),
+		BaseURL:          dep.BaseURL,
+		Client:           d.newHTTPClient(t, hsName),
+		SyncUntilTimeout: 5 * time.Second,
+		Debug:            d.Deployer.debugLogging,
+	}
+	client := unauthed.LoginNewDevice(t, password, deviceID)
+	dep.CSAPIClients = append(dep.CSAPIClients, client)
+	return client
+}
+
+// GuestClient registers a new guest account on a homeserver and returns a client logged in as it. Fails the test
+// if the hsName is not found, and skips it if the homeserver does not allow guest registration.
+func (d *Deployment) GuestClient(t *testing.T, hsName string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.GuestClient - HS name '%s' not found", hsName)
+		return nil
+	}
+	client := &client.CSAPI{
+		BaseURL:          dep.BaseURL,
+		Client:           d.newHTTPClient(t, hsName),
+		SyncUntilTimeout: 5 * time.Second,
+		Debug:            d.Deployer.debugLogging,
+	}
+	dep.CSAPIClients = append(dep.CSAPIClients, client)
+	client.UserID, client.AccessToken, client.DeviceID = client.RegisterGuest(t)
+	dep.AccessTokens[client.UserID] = client.AccessToken
+	dep.DeviceIDs[client.UserID] = client.DeviceID
+	return client
+}
+
 // Restart a deployment.
 func (dep *Deployment) Restart(t *testing.T) error {
 	t.Helper()
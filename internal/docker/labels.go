@@ -60,3 +60,13 @@ func deviceIDsFromLabels(labels map[string]string) map[string]string {
 	}
 	return userIDToToken
 }
+
+func olmAccountsFromLabels(labels map[string]string) map[string]string {
+	userIDToPickle := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, "olm_account_") {
+			userIDToPickle[strings.TrimPrefix(k, "olm_account_")] = v
+		}
+	}
+	return userIDToPickle
+}
@@ -0,0 +1,74 @@
+package federation
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WithCompressedResponses is an option which compresses every response from the server using gzip or deflate,
+// whichever the homeserver lists first in its Accept-Encoding header. Responses to requests without a supported
+// Accept-Encoding are sent uncompressed, so tests can check both that the homeserver advertises support and that
+// it can decode large compressed payloads such as /state responses.
+func WithCompressedResponses() func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Use(compressionMiddleware)
+	}
+}
+
+// compressionMiddleware wraps the response writer in a gzip or deflate writer based on the Accept-Encoding header.
+func compressionMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var cw io.WriteCloser
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		switch encoding {
+		case "gzip":
+			cw = gzip.NewWriter(w)
+		case "deflate":
+			// flate.NewWriter only returns an error for an invalid compression level
+			cw, _ = flate.NewWriter(w, flate.DefaultCompression)
+		default:
+			h.ServeHTTP(w, req)
+			return
+		}
+		defer cw.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		h.ServeHTTP(&compressedResponseWriter{ResponseWriter: w, w: cw}, req)
+	})
+}
+
+// negotiateEncoding returns the first of gzip or deflate listed in the Accept-Encoding header, or "" if neither
+// is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "deflate" {
+			continue
+		}
+		if len(fields) > 1 && strings.ReplaceAll(strings.TrimSpace(fields[1]), " ", "") == "q=0" {
+			continue
+		}
+		return coding
+	}
+	return ""
+}
+
+// compressedResponseWriter writes the response body through a compressing writer.
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (c *compressedResponseWriter) WriteHeader(statusCode int) {
+	// the length of the compressed body is not known up front
+	c.ResponseWriter.Header().Del("Content-Length")
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *compressedResponseWriter) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
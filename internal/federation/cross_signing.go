@@ -0,0 +1,84 @@
+package federation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// CrossSigningKey is a cross-signing public key in the format used by m.signing_key_update and /keys/query.
+type CrossSigningKey struct {
+	UserID     string                       `json:"user_id"`
+	Usage      []string                     `json:"usage"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// CrossSigningKeyPair is a cross-signing key along with its private key, so it can sign other keys.
+type CrossSigningKeyPair struct {
+	Key   CrossSigningKey
+	KeyID string // e.g "ed25519:<public key>"
+	Priv  ed25519.PrivateKey
+}
+
+// MustGenerateCrossSigningKeys generates a master key and a self-signing key for `userID`. The self-signing key is
+// signed by the master key, as homeservers require.
+func MustGenerateCrossSigningKeys(t *testing.T, userID string) (master, selfSigning *CrossSigningKeyPair) {
+	t.Helper()
+	master = mustGenerateCrossSigningKey(t, userID, "master")
+	selfSigning = mustGenerateCrossSigningKey(t, userID, "self_signing")
+	master.MustSign(t, &selfSigning.Key)
+	return master, selfSigning
+}
+
+// MustSign adds a signature from this key to `key`.
+func (kp *CrossSigningKeyPair) MustSign(t *testing.T, key *CrossSigningKey) {
+	t.Helper()
+	unsigned := *key
+	unsigned.Signatures = nil
+	toSign, err := json.Marshal(unsigned)
+	if err != nil {
+		t.Fatalf("CrossSigningKeyPair.MustSign: failed to marshal key: %s", err)
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(kp.Key.UserID, gomatrixserverlib.KeyID(kp.KeyID), kp.Priv, toSign)
+	if err != nil {
+		t.Fatalf("CrossSigningKeyPair.MustSign: failed to sign key: %s", err)
+	}
+	var signed CrossSigningKey
+	if err = json.Unmarshal(signedJSON, &signed); err != nil {
+		t.Fatalf("CrossSigningKeyPair.MustSign: failed to unmarshal signed key: %s", err)
+	}
+	if key.Signatures == nil {
+		key.Signatures = make(map[string]map[string]string)
+	}
+	for signer, sigs := range signed.Signatures {
+		if key.Signatures[signer] == nil {
+			key.Signatures[signer] = make(map[string]string)
+		}
+		for keyID, sig := range sigs {
+			key.Signatures[signer][keyID] = sig
+		}
+	}
+}
+
+func mustGenerateCrossSigningKey(t *testing.T, userID, usage string) *CrossSigningKeyPair {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("MustGenerateCrossSigningKeys: failed to generate ed25519 key: %s", err)
+	}
+	pubB64 := base64.RawStdEncoding.EncodeToString(pub)
+	keyID := "ed25519:" + pubB64
+	return &CrossSigningKeyPair{
+		Key: CrossSigningKey{
+			UserID: userID,
+			Usage:  []string{usage},
+			Keys:   map[string]string{keyID: pubB64},
+		},
+		KeyID: keyID,
+		Priv:  priv,
+	}
+}
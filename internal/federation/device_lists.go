@@ -0,0 +1,217 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DeviceListUpdate is the content of an m.device_list_update EDU.
+type DeviceListUpdate struct {
+	UserID            string          `json:"user_id"`
+	DeviceID          string          `json:"device_id"`
+	DeviceDisplayName string          `json:"device_display_name,omitempty"`
+	StreamID          int64           `json:"stream_id"`
+	PrevID            []int64         `json:"prev_id,omitempty"`
+	Deleted           bool            `json:"deleted,omitempty"`
+	Keys              json.RawMessage `json:"keys,omitempty"`
+}
+
+// Device is a device belonging to a user on this server, as served by HandleUserDeviceQueries.
+type Device struct {
+	DeviceID          string          `json:"device_id"`
+	DeviceDisplayName string          `json:"device_display_name,omitempty"`
+	Keys              json.RawMessage `json:"keys,omitempty"`
+}
+
+// DeviceList is the device list of a single user on this server. Every change to the list allocates the next
+// stream ID and returns the m.device_list_update EDU describing it, with prev_id set to the stream ID of the
+// previous change. To simulate the homeserver missing an update, simply don't send the returned EDU: the next
+// EDU will then refer to a prev_id the homeserver has never seen, which should cause it to resync the device list
+// via /user/devices.
+type DeviceList struct {
+	srv    *Server
+	userID string
+
+	mu             sync.Mutex
+	streamID       int64
+	devices        map[string]Device
+	masterKey      *CrossSigningKey
+	selfSigningKey *CrossSigningKey
+}
+
+// DeviceList returns the device list for the given user on this server, creating an empty one if needed.
+func (s *Server) DeviceList(userID string) *DeviceList {
+	s.deviceListsMu.Lock()
+	defer s.deviceListsMu.Unlock()
+	dl, ok := s.deviceLists[userID]
+	if !ok {
+		dl = &DeviceList{
+			srv:     s,
+			userID:  userID,
+			devices: make(map[string]Device),
+		}
+		s.deviceLists[userID] = dl
+	}
+	return dl
+}
+
+// StreamID returns the stream ID of the latest change to the device list, or 0 if it has never changed.
+func (d *DeviceList) StreamID() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.streamID
+}
+
+// Devices returns the current devices in the device list, sorted by device ID.
+func (d *DeviceList) Devices() []Device {
+	_, devices := d.snapshot()
+	return devices
+}
+
+// CrossSigningKeys returns the current master and self-signing keys of the user, which are nil if they have
+// never been set.
+func (d *DeviceList) CrossSigningKeys() (masterKey, selfSigningKey *CrossSigningKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.masterKey, d.selfSigningKey
+}
+
+// MustUpdateCrossSigningKeys replaces the user's master and self-signing keys, returning the m.signing_key_update
+// EDU for the change. Either key may be nil to leave it out of the EDU and keep the current key.
+func (d *DeviceList) MustUpdateCrossSigningKeys(t *testing.T, masterKey, selfSigningKey *CrossSigningKey) gomatrixserverlib.EDU {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	content := map[string]interface{}{
+		"user_id": d.userID,
+	}
+	if masterKey != nil {
+		d.masterKey = masterKey
+		content["master_key"] = masterKey
+	}
+	if selfSigningKey != nil {
+		d.selfSigningKey = selfSigningKey
+		content["self_signing_key"] = selfSigningKey
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("DeviceList: failed to marshal m.signing_key_update: %s", err)
+	}
+	return gomatrixserverlib.EDU{
+		Type:    "m.signing_key_update",
+		Origin:  d.srv.serverName,
+		Content: b,
+	}
+}
+
+// snapshot returns the latest stream ID along with the devices at that stream ID.
+func (d *DeviceList) snapshot() (int64, []Device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	devices := make([]Device, 0, len(d.devices))
+	for _, device := range d.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return d.streamID, devices
+}
+
+// MustUpdateDevice adds or replaces the given device, returning the m.device_list_update EDU for the change.
+func (d *DeviceList) MustUpdateDevice(t *testing.T, device Device) gomatrixserverlib.EDU {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.devices[device.DeviceID] = device
+	return d.mustNextEDU(t, DeviceListUpdate{
+		DeviceID:          device.DeviceID,
+		DeviceDisplayName: device.DeviceDisplayName,
+		Keys:              device.Keys,
+	})
+}
+
+// MustDeleteDevice removes the given device, returning the m.device_list_update EDU for the change.
+func (d *DeviceList) MustDeleteDevice(t *testing.T, deviceID string) gomatrixserverlib.EDU {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.devices[deviceID]; !ok {
+		t.Fatalf("MustDeleteDevice: user %s has no device %s", d.userID, deviceID)
+	}
+	delete(d.devices, deviceID)
+	return d.mustNextEDU(t, DeviceListUpdate{
+		DeviceID: deviceID,
+		Deleted:  true,
+	})
+}
+
+// mustNextEDU allocates the next stream ID and wraps the update in an EDU. Must be called with d.mu held.
+func (d *DeviceList) mustNextEDU(t *testing.T, update DeviceListUpdate) gomatrixserverlib.EDU {
+	t.Helper()
+	update.UserID = d.userID
+	if d.streamID > 0 {
+		update.PrevID = []int64{d.streamID}
+	}
+	d.streamID++
+	update.StreamID = d.streamID
+	content, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("DeviceList: failed to marshal m.device_list_update: %s", err)
+	}
+	return gomatrixserverlib.EDU{
+		Type:    "m.device_list_update",
+		Origin:  d.srv.serverName,
+		Content: content,
+	}
+}
+
+// HandleUserDeviceQueries is an option which will process GET /_matrix/federation/v1/user/devices/{userID}
+// requests using the device lists and cross-signing keys from Server.DeviceList. Users without a device list get a 404.
+// queryCallback is a function that if non-nil will be called with the user ID of each request, which is
+// useful to check that the homeserver resyncs a device list after it notices a gap in the stream.
+func HandleUserDeviceQueries(queryCallback func(userID string)) func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/user/devices/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			userID := mux.Vars(req)["userID"]
+			if queryCallback != nil {
+				queryCallback(userID)
+			}
+			srv.deviceListsMu.Lock()
+			dl, ok := srv.deviceLists[userID]
+			srv.deviceListsMu.Unlock()
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"User has no device list"}`))
+				return
+			}
+			streamID, devices := dl.snapshot()
+			res := map[string]interface{}{
+				"user_id":   userID,
+				"stream_id": streamID,
+				"devices":   devices,
+			}
+			masterKey, selfSigningKey := dl.CrossSigningKeys()
+			if masterKey != nil {
+				res["master_key"] = masterKey
+			}
+			if selfSigningKey != nil {
+				res["self_signing_key"] = selfSigningKey
+			}
+			b, err := json.Marshal(res)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleUserDeviceQueries failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
@@ -0,0 +1,94 @@
+package federation
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// MustSendEDUs sends a transaction containing only the given EDUs to the target destination. Fails the test
+// if the /send fails. Each call uses a new transaction ID.
+func (s *Server) MustSendEDUs(t *testing.T, deployment *docker.Deployment, destination string, edus ...gomatrixserverlib.EDU) {
+	t.Helper()
+	if len(edus) == 0 {
+		t.Fatalf("MustSendEDUs: no EDUs to send")
+	}
+	// gomatrixserverlib.Transaction would send a nil PDU list as "pdus": null, which is not a valid transaction
+	s.MustSendTransaction(t, deployment, destination, []json.RawMessage{}, edus)
+}
+
+// MustCreateTypingEDU creates an m.typing EDU for a user on this server.
+func (s *Server) MustCreateTypingEDU(t *testing.T, roomID, userID string, typing bool) gomatrixserverlib.EDU {
+	t.Helper()
+	return s.mustCreateEDU(t, "m.typing", map[string]interface{}{
+		"room_id": roomID,
+		"user_id": userID,
+		"typing":  typing,
+	})
+}
+
+// MustCreateReceiptEDU creates an m.receipt EDU of `receiptType` (e.g "m.read") for a user on this server,
+// acknowledging `eventID` in `roomID`.
+func (s *Server) MustCreateReceiptEDU(t *testing.T, roomID, receiptType, userID, eventID string) gomatrixserverlib.EDU {
+	t.Helper()
+	return s.mustCreateEDU(t, "m.receipt", map[string]interface{}{
+		roomID: map[string]interface{}{
+			receiptType: map[string]interface{}{
+				userID: map[string]interface{}{
+					"event_ids": []string{eventID},
+					"data": map[string]interface{}{
+						"ts": s.now().UnixNano() / int64(time.Millisecond),
+					},
+				},
+			},
+		},
+	})
+}
+
+// MustCreatePresenceEDU creates an m.presence EDU for a user on this server. `presence` should be one of
+// "online", "offline" or "unavailable". `statusMsg` is omitted if empty.
+func (s *Server) MustCreatePresenceEDU(t *testing.T, userID, presence, statusMsg string) gomatrixserverlib.EDU {
+	t.Helper()
+	update := map[string]interface{}{
+		"user_id":          userID,
+		"presence":         presence,
+		"currently_active": presence == "online",
+		"last_active_ago":  0,
+	}
+	if statusMsg != "" {
+		update["status_msg"] = statusMsg
+	}
+	return s.mustCreateEDU(t, "m.presence", map[string]interface{}{
+		"push": []interface{}{update},
+	})
+}
+
+// MustCreateToDeviceEDU creates an m.direct_to_device EDU from `sender` on this server. `messages` maps user ID
+// to device ID (or "*") to the content of the to-device event.
+func (s *Server) MustCreateToDeviceEDU(t *testing.T, sender, eventType string, messages map[string]map[string]interface{}) gomatrixserverlib.EDU {
+	t.Helper()
+	return s.mustCreateEDU(t, "m.direct_to_device", map[string]interface{}{
+		"sender":     sender,
+		"type":       eventType,
+		"message_id": string(s.nextTransactionID()),
+		"messages":   messages,
+	})
+}
+
+// mustCreateEDU creates an EDU of the given type from this server.
+func (s *Server) mustCreateEDU(t *testing.T, eduType string, content interface{}) gomatrixserverlib.EDU {
+	t.Helper()
+	b, err := json.Marshal(content)
+	if err != nil {
+		t.Fatalf("mustCreateEDU: failed to marshal %s content: %s", eduType, err)
+	}
+	return gomatrixserverlib.EDU{
+		Type:    eduType,
+		Origin:  s.serverName,
+		Content: b,
+	}
+}
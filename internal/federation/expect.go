@@ -0,0 +1,100 @@
+package federation
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// Expectation is a federation request which the server expects to receive, created via Server.Expect.
+type Expectation struct {
+	srv    *Server
+	method string
+	path   string
+
+	mu      sync.Mutex
+	times   int
+	calls   int
+	handler http.Handler
+}
+
+// Expect registers an expectation that the server will receive exactly one `method` request to `pathPattern`.
+// Paths which do not begin with /_matrix are relative to /_matrix/federation/v1, and may contain mux variables.
+// Unless Reply is called, matching requests are responded to with 200 {}. For example:
+//
+//	srv.Expect("GET", "/state_ids/{roomID}").Times(2).Reply(handler)
+//	...
+//	srv.VerifyExpectations(t)
+//
+// Requests beyond the expected number fail the test. Call VerifyExpectations at the end of the test to fail it
+// if fewer requests were received than expected. Requests which match no route fail the test as usual when
+// UnexpectedRequestsAreErrors is set.
+func (s *Server) Expect(method, pathPattern string) *Expectation {
+	e := &Expectation{
+		srv:    s,
+		method: method,
+		path:   federationPath(pathPattern),
+		times:  1,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(200)
+			w.Write([]byte("{}"))
+		}),
+	}
+	s.expectationsMu.Lock()
+	s.expectations = append(s.expectations, e)
+	s.expectationsMu.Unlock()
+	s.mux.Handle(e.path, http.HandlerFunc(e.serveHTTP)).Methods(method)
+	return e
+}
+
+// Times sets the number of matching requests the server expects to receive. Defaults to 1.
+func (e *Expectation) Times(n int) *Expectation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.times = n
+	return e
+}
+
+// Reply sets the handler which responds to matching requests.
+func (e *Expectation) Reply(handler http.HandlerFunc) *Expectation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handler = handler
+	return e
+}
+
+// Calls returns the number of matching requests received so far.
+func (e *Expectation) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+func (e *Expectation) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	e.mu.Lock()
+	e.calls++
+	calls, times, handler := e.calls, e.times, e.handler
+	e.mu.Unlock()
+	if calls > times {
+		e.srv.t.Errorf("Expect: received %d %s %s requests, want %d", calls, e.method, e.path, times)
+		w.WriteHeader(500)
+		w.Write([]byte("complement: Expect: received more requests than expected"))
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// VerifyExpectations fails the test if any expectation registered via Expect has not received the expected
+// number of requests.
+func (s *Server) VerifyExpectations(t *testing.T) {
+	t.Helper()
+	s.expectationsMu.Lock()
+	defer s.expectationsMu.Unlock()
+	for _, e := range s.expectations {
+		e.mu.Lock()
+		if e.calls != e.times {
+			t.Errorf("VerifyExpectations: received %d %s %s requests, want %d", e.calls, e.method, e.path, e.times)
+		}
+		e.mu.Unlock()
+	}
+}
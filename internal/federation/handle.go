@@ -1,16 +1,21 @@
 package federation
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/sjson"
 )
 
 // MakeJoinRequestsHandler is the http.Handler implementation for the make_join part of
@@ -71,13 +76,61 @@ func MakeJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 	w.Write(b)
 }
 
+// sendJoinResponseShape describes deviations from a well-formed /send_join response. See SendJoinResponseOpt.
+type sendJoinResponseShape struct {
+	omitServersInRoom bool
+	extraServers      []string
+	membersOmitted    *bool
+	authEventFilter   func(*gomatrixserverlib.Event) bool
+}
+
+// SendJoinResponseOpt is a functional option which changes the shape of /send_join responses, to test how
+// homeservers handle unusual or malicious responses to partial-state joins.
+type SendJoinResponseOpt func(*sendJoinResponseShape)
+
+// OmitServersInRoom removes the servers_in_room field from /send_join responses.
+func OmitServersInRoom() SendJoinResponseOpt {
+	return func(shape *sendJoinResponseShape) {
+		shape.omitServersInRoom = true
+	}
+}
+
+// WithExtraServersInRoom adds the given spurious servers to servers_in_room in /send_join responses.
+func WithExtraServersInRoom(servers ...string) SendJoinResponseOpt {
+	return func(shape *sendJoinResponseShape) {
+		shape.extraServers = append(shape.extraServers, servers...)
+	}
+}
+
+// WithMembersOmitted sets the members_omitted (partial_state) flag in /send_join responses to `membersOmitted`,
+// regardless of whether any members were actually omitted from the state.
+func WithMembersOmitted(membersOmitted bool) SendJoinResponseOpt {
+	return func(shape *sendJoinResponseShape) {
+		shape.membersOmitted = &membersOmitted
+	}
+}
+
+// WithAuthEventsSubset only returns auth chain events in /send_join responses for which `include` returns true.
+func WithAuthEventsSubset(include func(*gomatrixserverlib.Event) bool) SendJoinResponseOpt {
+	return func(shape *sendJoinResponseShape) {
+		shape.authEventFilter = include
+	}
+}
+
 // SendJoinRequestsHandler is the http.Handler implementation for the send_join part of
 // HandleMakeSendJoinRequests.
 //
 // expectPartialState should be true if we should expect the incoming send_join
 // request to use the partial_state flag, per MSC3706. In that case, we reply
 // with only the critical subset of the room state.
-func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request, expectPartialState bool) {
+//
+// opts can be used to deliberately produce an unusual response. See SendJoinResponseOpt.
+func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request, expectPartialState bool, opts ...SendJoinResponseOpt) {
+	var shape sendJoinResponseShape
+	for _, opt := range opts {
+		opt(&shape)
+	}
+
 	fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
 		req, time.Now(), gomatrixserverlib.ServerName(s.serverName), s.keyRing,
 	)
@@ -128,9 +181,23 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 	}
 
 	authEvents := room.AuthChainForEvents(stateEvents)
+	if shape.authEventFilter != nil {
+		var filtered []*gomatrixserverlib.Event
+		for _, ev := range authEvents {
+			if shape.authEventFilter(ev) {
+				filtered = append(filtered, ev)
+			}
+		}
+		authEvents = filtered
+	}
 
 	// get servers in room *before* the join event
-	serversInRoom := room.ServersInRoom()
+	serversInRoom := append(room.ServersInRoom(), shape.extraServers...)
+
+	respPartialState := expectPartialState
+	if shape.membersOmitted != nil {
+		respPartialState = *shape.membersOmitted
+	}
 
 	// insert the join event into the room state
 	room.AddEvent(event)
@@ -140,7 +207,7 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 		Origin:        gomatrixserverlib.ServerName(s.serverName),
 		AuthEvents:    gomatrixserverlib.NewEventJSONsFromEvents(authEvents),
 		StateEvents:   gomatrixserverlib.NewEventJSONsFromEvents(stateEvents),
-		PartialState:  expectPartialState,
+		PartialState:  respPartialState,
 		ServersInRoom: serversInRoom,
 	})
 	if err != nil {
@@ -148,6 +215,17 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 		w.Write([]byte("complement: HandleMakeSendJoinRequests send_join cannot marshal RespSendJoin: " + err.Error()))
 		return
 	}
+	if shape.omitServersInRoom {
+		// remove both the stable and unstable forms of the key
+		for _, key := range []string{"servers_in_room", `org\.matrix\.msc3706\.servers_in_room`} {
+			b, err = sjson.DeleteBytes(b, key)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleMakeSendJoinRequests send_join cannot remove servers_in_room: " + err.Error()))
+				return
+			}
+		}
+	}
 	w.WriteHeader(200)
 	w.Write(b)
 }
@@ -155,31 +233,204 @@ func SendJoinRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request
 // HandleMakeSendJoinRequests is an option which will process make_join and send_join requests for rooms which are present
 // in this server. To add a room to this server, see Server.MustMakeRoom. No checks are done to see whether join requests
 // are allowed or not. If you wish to test that, write your own test.
+//
+// Only v2 of /send_join is accepted unless v1 is enabled via WithSendJoinLeaveVersions.
 func HandleMakeSendJoinRequests() func(*Server) {
 	return func(s *Server) {
 		s.mux.Handle("/_matrix/federation/v1/make_join/{roomID}/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			MakeJoinRequestsHandler(s, w, req)
 		})).Methods("GET")
 
-		s.mux.Handle("/_matrix/federation/v2/send_join/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			SendJoinRequestsHandler(s, w, req, false)
-		})).Methods("PUT")
+		for _, version := range []string{"v1", "v2"} {
+			s.mux.Handle("/_matrix/federation/"+version+"/send_join/{roomID}/{eventID}", s.versionedSendHandler(version, func(w http.ResponseWriter, req *http.Request) {
+				SendJoinRequestsHandler(s, w, req, false)
+			})).Methods("PUT")
+		}
 	}
 }
 
 // HandlePartialStateMakeSendJoinRequests is similar to HandleMakeSendJoinRequests, but expects a partial-state join.
-func HandlePartialStateMakeSendJoinRequests() func(*Server) {
+// opts can be used to change the shape of the /send_join response, e.g to omit servers_in_room.
+func HandlePartialStateMakeSendJoinRequests(opts ...SendJoinResponseOpt) func(*Server) {
 	return func(s *Server) {
 		s.mux.Handle("/_matrix/federation/v1/make_join/{roomID}/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			MakeJoinRequestsHandler(s, w, req)
 		})).Methods("GET")
 
-		s.mux.Handle("/_matrix/federation/v2/send_join/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			SendJoinRequestsHandler(s, w, req, true)
-		})).Methods("PUT")
+		for _, version := range []string{"v1", "v2"} {
+			s.mux.Handle("/_matrix/federation/"+version+"/send_join/{roomID}/{eventID}", s.versionedSendHandler(version, func(w http.ResponseWriter, req *http.Request) {
+				SendJoinRequestsHandler(s, w, req, true, opts...)
+			})).Methods("PUT")
+		}
+	}
+}
+
+// MakeLeaveRequestsHandler is the http.Handler implementation for the make_leave part of
+// HandleMakeSendLeaveRequests.
+func MakeLeaveRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request) {
+	fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+		req, time.Now(), gomatrixserverlib.ServerName(s.serverName), s.keyRing,
+	)
+	if fedReq == nil {
+		w.WriteHeader(errResp.Code)
+		b, _ := json.Marshal(errResp.JSON)
+		w.Write(b)
+		return
+	}
+
+	vars := mux.Vars(req)
+	userID := vars["userID"]
+	roomID := vars["roomID"]
+
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests make_leave unexpected room ID: " + roomID))
+		return
+	}
+
+	// Generate a leave event
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     userID,
+		RoomID:     roomID,
+		Type:       "m.room.member",
+		StateKey:   &userID,
+		PrevEvents: []string{room.Timeline[len(room.Timeline)-1].EventID()},
+		Depth:      room.Timeline[len(room.Timeline)-1].Depth() + 1,
+	}
+	err := builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Leave})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests make_leave cannot set membership content: " + err.Error()))
+		return
+	}
+	stateNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests make_leave cannot calculate auth_events: " + err.Error()))
+		return
+	}
+	builder.AuthEvents = room.AuthEvents(stateNeeded)
+
+	res := map[string]interface{}{
+		"event":        builder,
+		"room_version": room.Version,
+	}
+	w.WriteHeader(200)
+	b, _ := json.Marshal(res)
+	w.Write(b)
+}
+
+// SendLeaveRequestsHandler is the http.Handler implementation for the send_leave part of
+// HandleMakeSendLeaveRequests.
+func SendLeaveRequestsHandler(s *Server, w http.ResponseWriter, req *http.Request) {
+	fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+		req, time.Now(), gomatrixserverlib.ServerName(s.serverName), s.keyRing,
+	)
+	if fedReq == nil {
+		w.WriteHeader(errResp.Code)
+		b, _ := json.Marshal(errResp.JSON)
+		w.Write(b)
+		return
+	}
+
+	roomID := mux.Vars(req)["roomID"]
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests send_leave unexpected room ID: " + roomID))
+		return
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(fedReq.Content(), room.Version)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: HandleMakeSendLeaveRequests send_leave cannot parse event JSON: " + err.Error()))
+		return
+	}
+	room.AddEvent(event)
+	w.WriteHeader(200)
+	w.Write([]byte("{}"))
+}
+
+// HandleMakeSendLeaveRequests is an option which will process make_leave and send_leave requests for rooms which are
+// present in this server. Only v2 of /send_leave is accepted unless v1 is enabled via WithSendJoinLeaveVersions.
+func HandleMakeSendLeaveRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/make_leave/{roomID}/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			MakeLeaveRequestsHandler(s, w, req)
+		})).Methods("GET")
+
+		for _, version := range []string{"v1", "v2"} {
+			s.mux.Handle("/_matrix/federation/"+version+"/send_leave/{roomID}/{eventID}", s.versionedSendHandler(version, func(w http.ResponseWriter, req *http.Request) {
+				SendLeaveRequestsHandler(s, w, req)
+			})).Methods("PUT")
+		}
+	}
+}
+
+// WithSendJoinLeaveVersions is an option which sets the versions of /send_join and /send_leave which the server
+// accepts, e.g "v1". By default only v2 is accepted, and v1 requests are unexpected. Requests to versions which
+// are not listed are rejected with 404 M_UNRECOGNIZED, which lets tests check that the homeserver falls back to
+// another version.
+func WithSendJoinLeaveVersions(versions ...string) func(*Server) {
+	return func(s *Server) {
+		s.sendJoinLeaveVersions = versions
+	}
+}
+
+// versionedSendHandler wraps a /send_join or /send_leave handler for the given API version. It rejects the
+// request if the version is disabled, and wraps successful v1 responses in the legacy [200, response] format.
+func (s *Server) versionedSendHandler(version string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.sendJoinLeaveVersions == nil && version != "v2" {
+			// v1 is opt-in, so treat the request as if the route did not exist
+			s.mux.NotFoundHandler.ServeHTTP(w, req)
+			return
+		}
+		allowed := s.sendJoinLeaveVersions == nil
+		for _, v := range s.sendJoinLeaveVersions {
+			if v == version {
+				allowed = true
+			}
+		}
+		if !allowed {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"complement: this API version is disabled"}`))
+			return
+		}
+		if version != "v1" {
+			h(w, req)
+			return
+		}
+		v1w := &v1ResponseWriter{ResponseWriter: w, statusCode: 200}
+		h(v1w, req)
+		if v1w.statusCode != 200 {
+			w.WriteHeader(v1w.statusCode)
+			w.Write(v1w.body.Bytes())
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("[200,"))
+		w.Write(v1w.body.Bytes())
+		w.Write([]byte("]"))
 	}
 }
 
+// v1ResponseWriter buffers the response so it can be wrapped in the v1 [200, response] format.
+type v1ResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *v1ResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+func (w *v1ResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
 // HandleInviteRequests is an option which makes the server process invite requests.
 //
 // inviteCallback is a callback function that if non-nil will be called and passed the incoming invite event
@@ -230,6 +481,8 @@ func HandleInviteRequests(inviteCallback func(*gomatrixserverlib.Event)) func(*S
 }
 
 // HandleDirectoryLookups will automatically return room IDs for any aliases present on this server.
+// The servers list in each response is the one given to Server.MakeAliasMappingWithServers, or just
+// this server if the alias was made with Server.MakeAliasMapping.
 func HandleDirectoryLookups() func(*Server) {
 	return func(s *Server) {
 		if s.directoryHandlerSetup {
@@ -238,12 +491,14 @@ func HandleDirectoryLookups() func(*Server) {
 		s.directoryHandlerSetup = true
 		s.mux.Handle("/_matrix/federation/v1/query/directory", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			alias := req.URL.Query().Get("room_alias")
-			if roomID, ok := s.aliases[alias]; ok {
+			if mapping, ok := s.aliases[alias]; ok {
+				servers := make([]gomatrixserverlib.ServerName, len(mapping.servers))
+				for i, server := range mapping.servers {
+					servers[i] = gomatrixserverlib.ServerName(server)
+				}
 				b, err := json.Marshal(gomatrixserverlib.RespDirectory{
-					RoomID: roomID,
-					Servers: []gomatrixserverlib.ServerName{
-						gomatrixserverlib.ServerName(s.serverName),
-					},
+					RoomID:  mapping.roomID,
+					Servers: servers,
 				})
 				if err != nil {
 					w.WriteHeader(500)
@@ -263,6 +518,79 @@ func HandleDirectoryLookups() func(*Server) {
 	}
 }
 
+// HandleOpenIDUserInfoRequests is an option which will process GET /_matrix/federation/v1/openid/userinfo requests
+// for tokens minted via Server.MintOpenIDToken. Unknown tokens are rejected with 401 M_UNKNOWN_TOKEN.
+func HandleOpenIDUserInfoRequests() func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/openid/userinfo", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			token := req.URL.Query().Get("access_token")
+			srv.openIDTokensMu.Lock()
+			userID, ok := srv.openIDTokens[token]
+			srv.openIDTokensMu.Unlock()
+			if !ok {
+				w.WriteHeader(401)
+				w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Access Token unknown or expired"}`))
+				return
+			}
+			b, err := json.Marshal(map[string]string{
+				"sub": userID,
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleOpenIDUserInfoRequests failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
+// HandleProfileQueries is an option which will process GET /_matrix/federation/v1/query/profile requests for
+// users whose profiles have been set via Server.SetProfile. Unknown users are rejected with 404 M_NOT_FOUND.
+//
+// queryCallback is a callback function that if non-nil will be called with the user ID and field (which may be
+// empty) of each query, so tests can assert how often the homeserver asks for remote profiles.
+func HandleProfileQueries(queryCallback func(userID, field string)) func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/query/profile", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			userID := req.URL.Query().Get("user_id")
+			field := req.URL.Query().Get("field")
+			if queryCallback != nil {
+				queryCallback(userID, field)
+			}
+			localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+			var profile Profile
+			var ok bool
+			if err == nil && string(domain) == srv.serverName {
+				srv.profilesMu.Lock()
+				profile, ok = srv.profiles[localpart]
+				srv.profilesMu.Unlock()
+			}
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Profile was not found"}`))
+				return
+			}
+			res := map[string]interface{}{}
+			if field == "" || field == "displayname" {
+				res["displayname"] = profile.DisplayName
+			}
+			if field == "" || field == "avatar_url" {
+				res["avatar_url"] = profile.AvatarURL
+			}
+			b, err := json.Marshal(res)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleProfileQueries failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
 // HandleEventRequests is an option which will process GET /_matrix/federation/v1/event/{eventId} requests universally when requested.
 func HandleEventRequests() func(*Server) {
 	return func(srv *Server) {
@@ -300,9 +628,33 @@ func HandleEventRequests() func(*Server) {
 	}
 }
 
+// AuthChainTransform modifies the auth chain served by HandleEventAuthRequests for the event `eventID`. The
+// returned JSON is served verbatim as the auth_chain, so events can be omitted, reordered or corrupted.
+type AuthChainTransform func(eventID string, authChain []*gomatrixserverlib.Event) []json.RawMessage
+
+// eventAuthOpts configures HandleEventAuthRequests. See AuthOpt.
+type eventAuthOpts struct {
+	transform AuthChainTransform
+}
+
+// AuthOpt is a functional option which changes the /event_auth responses served by HandleEventAuthRequests.
+type AuthOpt func(*eventAuthOpts)
+
+// WithAuthChainTransform calls `transform` with the auth chain of each requested event, and serves its return
+// value instead of the real auth chain.
+func WithAuthChainTransform(transform AuthChainTransform) AuthOpt {
+	return func(o *eventAuthOpts) {
+		o.transform = transform
+	}
+}
+
 // HandleEventAuthRequests is an option which will process GET /_matrix/federation/v1/event_auth/{roomId}/{eventId}
-// requests universally when requested.
-func HandleEventAuthRequests() func(*Server) {
+// requests universally when requested. opts can be used to change the auth chain which is served.
+func HandleEventAuthRequests(opts ...AuthOpt) func(*Server) {
+	var o eventAuthOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return func(srv *Server) {
 		srv.mux.Handle("/_matrix/federation/v1/event_auth/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			vars := mux.Vars(req)
@@ -334,9 +686,14 @@ func HandleEventAuthRequests() func(*Server) {
 			}
 
 			authEvents := room.AuthChainForEvents([]*gomatrixserverlib.Event{event})
-			resp := gomatrixserverlib.RespEventAuth{
+			var resp interface{} = gomatrixserverlib.RespEventAuth{
 				gomatrixserverlib.NewEventJSONsFromEvents(authEvents),
 			}
+			if o.transform != nil {
+				resp = map[string]interface{}{
+					"auth_chain": o.transform(eventID, authEvents),
+				}
+			}
 			respJSON, err := json.Marshal(resp)
 			if err != nil {
 				w.WriteHeader(500)
@@ -423,10 +780,104 @@ func HandleMediaRequests(mediaIds map[string]func(w http.ResponseWriter)) func(*
 	}
 }
 
+// MediaFixture is an in-memory piece of media served by HandleAuthenticatedMediaRequests.
+type MediaFixture struct {
+	ContentType string
+	Data        []byte
+	// Optional: the filename to send in the Content-Disposition header.
+	Filename string
+	// Optional: the bytes to serve for thumbnail requests. If nil, Data is served instead.
+	Thumbnail []byte
+}
+
+// HandleAuthenticatedMediaRequests is an option which will process MSC3916 authenticated federation media requests
+// to /_matrix/federation/v1/media/download/{mediaID} and /_matrix/federation/v1/media/thumbnail/{mediaID} using
+// the provided media fixtures. The key of the map is the media ID to be handled.
+//
+// requestCallback is a callback function that if non-nil will be called with each validly signed media request,
+// so tests can assert that the homeserver used the authenticated endpoints.
+func HandleAuthenticatedMediaRequests(media map[string]MediaFixture, requestCallback func(*gomatrixserverlib.FederationRequest)) func(*Server) {
+	return func(srv *Server) {
+		mediaFn := func(thumbnail bool) http.HandlerFunc {
+			return func(w http.ResponseWriter, req *http.Request) {
+				fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+					req, time.Now(), gomatrixserverlib.ServerName(srv.serverName), srv.keyRing,
+				)
+				if fedReq == nil {
+					w.WriteHeader(errResp.Code)
+					b, _ := json.Marshal(errResp.JSON)
+					w.Write(b)
+					return
+				}
+				if requestCallback != nil {
+					requestCallback(fedReq)
+				}
+
+				mediaID := mux.Vars(req)["mediaID"]
+				fixture, ok := media[mediaID]
+				if !ok {
+					w.WriteHeader(404)
+					w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: Unknown predefined media ID"}`))
+					return
+				}
+				data := fixture.Data
+				if thumbnail && fixture.Thumbnail != nil {
+					data = fixture.Thumbnail
+				}
+
+				// The response is multipart/mixed: a JSON metadata object followed by the media itself.
+				mw := multipart.NewWriter(w)
+				w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+				w.WriteHeader(200)
+				metadata, _ := mw.CreatePart(textproto.MIMEHeader{
+					"Content-Type": []string{"application/json"},
+				})
+				metadata.Write([]byte("{}"))
+				mediaHeader := textproto.MIMEHeader{
+					"Content-Type": []string{fixture.ContentType},
+				}
+				if fixture.Filename != "" {
+					mediaHeader.Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", fixture.Filename))
+				}
+				mediaPart, _ := mw.CreatePart(mediaHeader)
+				mediaPart.Write(data)
+				mw.Close()
+			}
+		}
+
+		for _, prefix := range []string{"/_matrix/federation/v1/media", "/_matrix/federation/unstable/org.matrix.msc3916/media"} {
+			srv.mux.Handle(prefix+"/download/{mediaID}", mediaFn(false)).Methods("GET")
+			srv.mux.Handle(prefix+"/thumbnail/{mediaID}", mediaFn(true)).Methods("GET")
+		}
+	}
+}
+
+// HandleUnrecognisedAuthenticatedMediaRequests is an option which makes the server behave like a server which
+// does not support MSC3916, by responding to authenticated federation media requests with 404 M_UNRECOGNIZED.
+// Use this together with HandleMediaRequests to test that homeservers fall back to the legacy media endpoints.
+func HandleUnrecognisedAuthenticatedMediaRequests() func(*Server) {
+	return func(srv *Server) {
+		unrecognisedFn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`))
+		})
+		for _, prefix := range []string{"/_matrix/federation/v1/media", "/_matrix/federation/unstable/org.matrix.msc3916/media"} {
+			srv.mux.Handle(prefix+"/download/{mediaID}", unrecognisedFn).Methods("GET")
+			srv.mux.Handle(prefix+"/thumbnail/{mediaID}", unrecognisedFn).Methods("GET")
+		}
+	}
+}
+
 // HandleTransactionRequests is an option which will process GET /_matrix/federation/v1/send/{transactionID} requests universally when requested.
 // pduCallback and eduCallback are functions that if non-nil will be called and passed each PDU or EDU event received in the transaction.
 // Callbacks will be fired AFTER the event has been stored onto the respective ServerRoom.
-func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCallback func(gomatrixserverlib.EDU)) func(*Server) {
+// Every transaction received is recorded, see Server.ReceivedTransactions.
+// opts can be used to change how PDUs are handled, e.g to reject some of them. See TransactionOpt.
+func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCallback func(gomatrixserverlib.EDU), opts ...TransactionOpt) func(*Server) {
+	var cfg transactionConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	return func(srv *Server) {
 		srv.mux.Handle("/_matrix/federation/v1/send/{transactionID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			// Extract the transaction ID from the request vars
@@ -465,10 +916,11 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 				return
 			}
 			transaction.TransactionID = gomatrixserverlib.TransactionID(transactionID)
+			received := srv.recordTransaction(fedReq.Origin(), transaction)
 
 			// Transactions are limited in size; they can have at most 50 PDUs and 100 EDUs.
 			// https://matrix.org/docs/spec/server_server/latest#transactions
-			if len(transaction.PDUs) > 50 || len(transaction.EDUs) > 100 {
+			if len(transaction.PDUs) > maxTransactionPDUs || len(transaction.EDUs) > maxTransactionEDUs {
 				log.Printf(
 					"complement: Transaction '%s': Transaction too large. PDUs: %d/50, EDUs: %d/100",
 					transaction.TransactionID, len(transaction.PDUs), len(transaction.EDUs),
@@ -518,6 +970,16 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 					continue
 				}
 
+				srv.recordTransactionEvent(received, event.EventID())
+
+				// Fail this PDU if the test wants us to
+				if cfg.pduError != nil {
+					if errMsg := cfg.pduError(event); errMsg != "" {
+						response.PDUs[event.EventID()] = gomatrixserverlib.PDUResult{Error: errMsg}
+						continue
+					}
+				}
+
 				// Store this PDU in the room's timeline
 				room.AddEvent(event)
 
@@ -549,3 +1011,74 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 		})).Methods("PUT")
 	}
 }
+
+// HandleVersionRequests is an option which will process GET /_matrix/federation/v1/version requests, reporting
+// the given server implementation name and version.
+func HandleVersionRequests(name, version string) func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/version", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(map[string]interface{}{
+				"server": ServerVersion{Name: name, Version: version},
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleVersionRequests failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
+// HandleTimestampToEventRequests is an option which will process GET /_matrix/federation/v1/timestamp_to_event/{roomId}
+// requests (and the unstable MSC3030 equivalent) for rooms on this server. The closest event in the room timeline to
+// `ts` in the direction `dir` is returned, or 404 M_NOT_FOUND if there is none.
+func HandleTimestampToEventRequests() func(*Server) {
+	return func(srv *Server) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			roomID := mux.Vars(req)["roomID"]
+			room, ok := srv.rooms[roomID]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: HandleTimestampToEventRequests unknown room"}`))
+				return
+			}
+			ts, err := strconv.ParseUint(req.URL.Query().Get("ts"), 10, 64)
+			dir := req.URL.Query().Get("dir")
+			if err != nil || (dir != "f" && dir != "b") {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errcode":"M_INVALID_PARAM","error":"complement: HandleTimestampToEventRequests needs ts and dir=f|b"}`))
+				return
+			}
+			var closest *gomatrixserverlib.Event
+			for _, ev := range room.Timeline {
+				evTS := uint64(ev.OriginServerTS())
+				if dir == "f" && evTS >= ts && (closest == nil || evTS < uint64(closest.OriginServerTS())) {
+					closest = ev
+				}
+				if dir == "b" && evTS <= ts && (closest == nil || evTS >= uint64(closest.OriginServerTS())) {
+					closest = ev
+				}
+			}
+			if closest == nil {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: HandleTimestampToEventRequests found no event"}`))
+				return
+			}
+			resp, err := json.Marshal(map[string]interface{}{
+				"event_id":         closest.EventID(),
+				"origin_server_ts": closest.OriginServerTS(),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(fmt.Sprintf(`complement: failed to marshal JSON response: %s`, err)))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(resp)
+		})
+		srv.mux.Handle("/_matrix/federation/v1/timestamp_to_event/{roomID}", handler).Methods("GET")
+		srv.mux.Handle("/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/{roomID}", handler).Methods("GET")
+	}
+}
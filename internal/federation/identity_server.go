@@ -0,0 +1,366 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// ThreePIDSession is a validation session on an IdentityServer.
+type ThreePIDSession struct {
+	SID          string
+	ClientSecret string
+	Medium       string
+	Address      string
+	// The token which would have been sent to the address. Submit it via submitToken to validate the session.
+	Token       string
+	ValidatedAt int64 // 0 if not validated
+}
+
+// IdentityServer is a mock identity server, served by HandleIdentityServerRequests. Nothing is ever sent to
+// email addresses or phone numbers: tests read tokens via Session, or skip validation via CreateValidatedSession.
+type IdentityServer struct {
+	srv *Server
+	key *IdentityServerKey
+
+	mu           sync.Mutex
+	nextSID      int
+	sessions     map[string]*ThreePIDSession
+	bindings     map[string]string // "medium address" -> mxid
+	accessTokens map[string]bool
+}
+
+// NewIdentityServer creates a new mock identity server. Pass it to HandleIdentityServerRequests to serve it.
+func NewIdentityServer() *IdentityServer {
+	return &IdentityServer{
+		sessions:     make(map[string]*ThreePIDSession),
+		bindings:     make(map[string]string),
+		accessTokens: make(map[string]bool),
+	}
+}
+
+// ServerName returns the identity server name to pass to homeservers as `id_server`.
+func (is *IdentityServer) ServerName() string {
+	return is.srv.ServerName()
+}
+
+// NewAccessToken mints an identity server access token, as if a client had registered via /account/register.
+func (is *IdentityServer) NewAccessToken() string {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	token := util.RandomString(16)
+	is.accessTokens[token] = true
+	return token
+}
+
+// Session returns the validation session with the given ID.
+func (is *IdentityServer) Session(sid string) (ThreePIDSession, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	session, ok := is.sessions[sid]
+	if !ok {
+		return ThreePIDSession{}, false
+	}
+	return *session, true
+}
+
+// CreateValidatedSession creates a session which has already been validated, as if the user had followed the
+// link sent to them. Returns the session ID and client secret to pass to the homeserver.
+func (is *IdentityServer) CreateValidatedSession(medium, address string) (sid, clientSecret string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	session := is.newSession(util.RandomString(16), medium, address)
+	session.ValidatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	return session.SID, session.ClientSecret
+}
+
+// Bindings returns the current 3PID bindings, keyed off "medium address", e.g "email alice@example.com".
+func (is *IdentityServer) Bindings() map[string]string {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	bindings := make(map[string]string, len(is.bindings))
+	for k, v := range is.bindings {
+		bindings[k] = v
+	}
+	return bindings
+}
+
+// signingKey returns the key used to sign associations. It is created lazily as the server name is only
+// known once the server is listening.
+func (is *IdentityServer) signingKey(t *testing.T) *IdentityServerKey {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.key == nil {
+		is.key = NewIdentityServerKey(t, is.srv.ServerName())
+	}
+	return is.key
+}
+
+func (is *IdentityServer) newSession(clientSecret, medium, address string) *ThreePIDSession {
+	is.nextSID++
+	session := &ThreePIDSession{
+		SID:          fmt.Sprintf("%d", is.nextSID),
+		ClientSecret: clientSecret,
+		Medium:       medium,
+		Address:      address,
+		Token:        util.RandomString(8),
+	}
+	is.sessions[session.SID] = session
+	return session
+}
+
+func (is *IdentityServer) hasAccessToken(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.accessTokens[token]
+}
+
+// HandleIdentityServerRequests is an option which will serve `is` as an identity server on the
+// /_matrix/identity/v2 API. It supports terms, account registration, validation sessions, binding, unbinding,
+// lookups with the "none" algorithm and public key checks. OpenID tokens passed to /account/register are not
+// verified. Binding and lookups require an access token from /account/register or IdentityServer.NewAccessToken.
+func HandleIdentityServerRequests(is *IdentityServer) func(*Server) {
+	return func(srv *Server) {
+		is.srv = srv
+		r := srv.mux.PathPrefix("/_matrix/identity/v2").Subrouter()
+		respond := func(w http.ResponseWriter, code int, res interface{}) {
+			b, err := json.Marshal(res)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleIdentityServerRequests failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(code)
+			w.Write(b)
+		}
+		readBody := func(w http.ResponseWriter, req *http.Request, into interface{}) bool {
+			body, err := ioutil.ReadAll(req.Body)
+			if err == nil {
+				err = json.Unmarshal(body, into)
+			}
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errcode":"M_BAD_JSON","error":"complement: cannot parse request body"}`))
+				return false
+			}
+			return true
+		}
+		requireAuth := func(h http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, req *http.Request) {
+				if !is.hasAccessToken(req) {
+					w.WriteHeader(401)
+					w.Write([]byte(`{"errcode":"M_UNAUTHORIZED","error":"complement: unknown identity server access token"}`))
+					return
+				}
+				h(w, req)
+			}
+		}
+
+		r.HandleFunc("", func(w http.ResponseWriter, req *http.Request) {
+			respond(w, 200, struct{}{})
+		}).Methods("GET")
+		r.HandleFunc("/terms", func(w http.ResponseWriter, req *http.Request) {
+			respond(w, 200, map[string]interface{}{"policies": map[string]interface{}{}})
+		}).Methods("GET")
+		r.HandleFunc("/terms", func(w http.ResponseWriter, req *http.Request) {
+			respond(w, 200, struct{}{})
+		}).Methods("POST")
+		r.HandleFunc("/account/register", func(w http.ResponseWriter, req *http.Request) {
+			token := is.NewAccessToken()
+			respond(w, 200, map[string]string{"token": token, "access_token": token})
+		}).Methods("POST")
+
+		r.HandleFunc("/validate/{medium}/requestToken", func(w http.ResponseWriter, req *http.Request) {
+			medium := mux.Vars(req)["medium"]
+			var body struct {
+				ClientSecret string `json:"client_secret"`
+				Email        string `json:"email"`
+				Country      string `json:"country"`
+				PhoneNumber  string `json:"phone_number"`
+			}
+			if !readBody(w, req, &body) {
+				return
+			}
+			address := body.Email
+			if medium == "msisdn" {
+				address = body.Country + body.PhoneNumber
+			}
+			is.mu.Lock()
+			var session *ThreePIDSession
+			for _, s := range is.sessions {
+				if s.ClientSecret == body.ClientSecret && s.Medium == medium && s.Address == address {
+					session = s
+				}
+			}
+			if session == nil {
+				session = is.newSession(body.ClientSecret, medium, address)
+			}
+			is.mu.Unlock()
+			res := map[string]string{"sid": session.SID}
+			if medium == "msisdn" {
+				res["msisdn"] = address
+			}
+			respond(w, 200, res)
+		}).Methods("POST")
+
+		r.HandleFunc("/validate/{medium}/submitToken", func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				SID          string `json:"sid"`
+				ClientSecret string `json:"client_secret"`
+				Token        string `json:"token"`
+			}
+			if !readBody(w, req, &body) {
+				return
+			}
+			is.mu.Lock()
+			session, ok := is.sessions[body.SID]
+			success := ok && session.ClientSecret == body.ClientSecret && session.Token == body.Token
+			if success && session.ValidatedAt == 0 {
+				session.ValidatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+			is.mu.Unlock()
+			respond(w, 200, map[string]bool{"success": success})
+		}).Methods("POST")
+
+		r.HandleFunc("/3pid/getValidated3pid", func(w http.ResponseWriter, req *http.Request) {
+			session, ok := is.Session(req.URL.Query().Get("sid"))
+			if !ok || session.ClientSecret != req.URL.Query().Get("client_secret") {
+				respond(w, 404, map[string]string{"errcode": "M_NO_VALID_SESSION", "error": "complement: unknown session"})
+				return
+			}
+			if session.ValidatedAt == 0 {
+				respond(w, 400, map[string]string{"errcode": "M_SESSION_NOT_VALIDATED", "error": "complement: session not validated"})
+				return
+			}
+			respond(w, 200, map[string]interface{}{
+				"medium":       session.Medium,
+				"address":      session.Address,
+				"validated_at": session.ValidatedAt,
+			})
+		}).Methods("GET")
+
+		r.HandleFunc("/3pid/bind", requireAuth(func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				SID          string `json:"sid"`
+				ClientSecret string `json:"client_secret"`
+				MXID         string `json:"mxid"`
+			}
+			if !readBody(w, req, &body) {
+				return
+			}
+			session, ok := is.Session(body.SID)
+			if !ok || session.ClientSecret != body.ClientSecret {
+				respond(w, 404, map[string]string{"errcode": "M_NO_VALID_SESSION", "error": "complement: unknown session"})
+				return
+			}
+			if session.ValidatedAt == 0 {
+				respond(w, 400, map[string]string{"errcode": "M_SESSION_NOT_VALIDATED", "error": "complement: session not validated"})
+				return
+			}
+			is.mu.Lock()
+			is.bindings[session.Medium+" "+session.Address] = body.MXID
+			is.mu.Unlock()
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			association, err := json.Marshal(map[string]interface{}{
+				"address":    session.Address,
+				"medium":     session.Medium,
+				"mxid":       body.MXID,
+				"not_before": now,
+				"not_after":  now + int64(24*time.Hour/time.Millisecond),
+				"ts":         now,
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleIdentityServerRequests failed to marshal association: " + err.Error()))
+				return
+			}
+			key := is.signingKey(srv.t)
+			signed, err := gomatrixserverlib.SignJSON(key.ServerName, key.KeyID, key.Priv, association)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleIdentityServerRequests failed to sign association: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(signed)
+		})).Methods("POST")
+
+		r.HandleFunc("/3pid/unbind", func(w http.ResponseWriter, req *http.Request) {
+			// homeservers sign this request with X-Matrix auth rather than using an access token
+			var body struct {
+				MXID     string `json:"mxid"`
+				ThreePID struct {
+					Medium  string `json:"medium"`
+					Address string `json:"address"`
+				} `json:"threepid"`
+			}
+			if !readBody(w, req, &body) {
+				return
+			}
+			key := body.ThreePID.Medium + " " + body.ThreePID.Address
+			is.mu.Lock()
+			if is.bindings[key] == body.MXID {
+				delete(is.bindings, key)
+			}
+			is.mu.Unlock()
+			respond(w, 200, struct{}{})
+		}).Methods("POST")
+
+		r.HandleFunc("/hash_details", requireAuth(func(w http.ResponseWriter, req *http.Request) {
+			respond(w, 200, map[string]interface{}{
+				"algorithms":    []string{"none"},
+				"lookup_pepper": "complement",
+			})
+		})).Methods("GET")
+
+		r.HandleFunc("/lookup", requireAuth(func(w http.ResponseWriter, req *http.Request) {
+			var body struct {
+				Algorithm string   `json:"algorithm"`
+				Addresses []string `json:"addresses"`
+			}
+			if !readBody(w, req, &body) {
+				return
+			}
+			if body.Algorithm != "none" {
+				respond(w, 400, map[string]string{"errcode": "M_INVALID_PARAM", "error": "complement: only the none algorithm is supported"})
+				return
+			}
+			// with the "none" algorithm, addresses are "address medium"
+			mappings := make(map[string]string)
+			bindings := is.Bindings()
+			for _, addr := range body.Addresses {
+				i := strings.LastIndex(addr, " ")
+				if i < 0 {
+					continue
+				}
+				if mxid, ok := bindings[addr[i+1:]+" "+addr[:i]]; ok {
+					mappings[addr] = mxid
+				}
+			}
+			respond(w, 200, map[string]interface{}{"mappings": mappings})
+		})).Methods("POST")
+
+		r.HandleFunc("/pubkey/isvalid", func(w http.ResponseWriter, req *http.Request) {
+			key := is.signingKey(srv.t)
+			respond(w, 200, map[string]bool{"valid": req.URL.Query().Get("public_key") == key.PublicKeyBase64()})
+		}).Methods("GET")
+		r.HandleFunc("/pubkey/{keyID}", func(w http.ResponseWriter, req *http.Request) {
+			key := is.signingKey(srv.t)
+			if mux.Vars(req)["keyID"] != string(key.KeyID) {
+				respond(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "complement: unknown key"})
+				return
+			}
+			respond(w, 200, map[string]string{"public_key": key.PublicKeyBase64()})
+		}).Methods("GET")
+	}
+}
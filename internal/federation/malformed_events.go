@@ -0,0 +1,231 @@
+package federation
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// maxEventSize is the maximum size of an event in bytes, as defined by the spec.
+const maxEventSize = 65536
+
+// EventCorruption creates an event in `room` from `ev` which is deliberately invalid in some way, returning
+// the raw event JSON. The JSON is returned rather than a gomatrixserverlib.Event as it may no longer parse as one.
+type EventCorruption func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage
+
+// MalformedEvents returns the standard corpus of event corruptions, keyed by a human-readable name which is
+// suitable for use as a subtest name. Use this to check that a homeserver rejects each kind of bad event:
+//
+//	for name, corrupt := range federation.MalformedEvents() {
+//		t.Run(name, func(t *testing.T) {
+//			eventJSON := srv.MustCreateMalformedEvent(t, room, ev, corrupt)
+//			...
+//		})
+//	}
+func MalformedEvents() map[string]EventCorruption {
+	return map[string]EventCorruption{
+		"unsigned":           UnsignedEvent(),
+		"bad_signature":      BadSignatureEvent(),
+		"invalid_hash":       InvalidHashEvent(),
+		"missing_sender":     MissingEventField("sender"),
+		"missing_type":       MissingEventField("type"),
+		"missing_room_id":    MissingEventField("room_id"),
+		"missing_auth_event": MissingEventField("auth_events"),
+		"missing_prev_event": MissingEventField("prev_events"),
+		"wrong_room_version": WrongRoomVersionEvent(""),
+		"oversized":          OversizedEvent(),
+	}
+}
+
+// MustCreateMalformedEvent creates a new latest event for the given room like MustCreateEvent, then corrupts it
+// using `corrupt`. It does not insert the event into the room.
+func (s *Server) MustCreateMalformedEvent(t *testing.T, room *ServerRoom, ev b.Event, corrupt EventCorruption) json.RawMessage {
+	t.Helper()
+	return corrupt(t, s, room, ev)
+}
+
+// UnsignedEvent creates an event with an empty signatures block.
+func UnsignedEvent() EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		eventJSON, err := sjson.SetRawBytes(s.MustCreateEvent(t, room, ev).JSON(), "signatures", []byte(`{}`))
+		if err != nil {
+			t.Fatalf("UnsignedEvent: failed to strip signatures: %s", err)
+		}
+		return eventJSON
+	}
+}
+
+// BadSignatureEvent creates an event which claims to be signed with this server's key ID, but is
+// actually signed by a different key.
+func BadSignatureEvent() EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		_, otherPriv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("BadSignatureEvent: failed to generate ed25519 key: %s", err)
+		}
+		event := s.MustCreateEvent(t, room, ev)
+		badlySigned := event.Sign(s.serverName, s.KeyID, otherPriv)
+		return badlySigned.JSON()
+	}
+}
+
+// InvalidHashEvent creates an event whose content hash does not match its content, but which is otherwise
+// correctly signed. Homeservers should redact such events rather than rejecting them outright.
+func InvalidHashEvent() EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		wrongHash := sha256.Sum256([]byte("complement: this is not the content of the event"))
+		eventJSON, err := sjson.SetBytes(
+			s.MustCreateEvent(t, room, ev).JSON(), "hashes.sha256", base64.RawStdEncoding.EncodeToString(wrongHash[:]),
+		)
+		if err != nil {
+			t.Fatalf("InvalidHashEvent: failed to set hash: %s", err)
+		}
+		return s.mustResignEventJSON(t, room.Version, eventJSON)
+	}
+}
+
+// MissingEventField creates an event with the top-level key `field` removed. The event is re-hashed and
+// re-signed after the key is removed, so the only problem with it is the missing key.
+func MissingEventField(field string) EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		eventJSON, err := sjson.DeleteBytes(s.MustCreateEvent(t, room, ev).JSON(), field)
+		if err != nil {
+			t.Fatalf("MissingEventField: failed to delete '%s': %s", field, err)
+		}
+		return s.mustRehashAndSignEventJSON(t, room.Version, eventJSON)
+	}
+}
+
+// WrongRoomVersionEvent creates an event using the event format of `roomVer` rather than the room's own
+// version. If `roomVer` is empty, a room version with a different event format to the room is chosen.
+func WrongRoomVersionEvent(roomVer gomatrixserverlib.RoomVersion) EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		wrongVer := roomVer
+		if wrongVer == "" {
+			wrongVer = gomatrixserverlib.RoomVersionV1
+			if format, _ := room.Version.EventFormat(); format == gomatrixserverlib.EventFormatV1 {
+				wrongVer = gomatrixserverlib.RoomVersionV6
+			}
+		}
+		eb := s.mustCreateEventBuilder(t, room, ev)
+		// prev_events and auth_events are in the room's format, so convert them to the format of `wrongVer`
+		eb.PrevEvents = mustConvertEventRefs(t, room, eb.PrevEvents, wrongVer)
+		eb.AuthEvents = mustConvertEventRefs(t, room, eb.AuthEvents, wrongVer)
+		event, err := eb.Build(s.eventTimestamp(ev), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, wrongVer)
+		if err != nil {
+			t.Fatalf("WrongRoomVersionEvent: failed to sign event as room version %s: %s", wrongVer, err)
+		}
+		return event.JSON()
+	}
+}
+
+// mustConvertEventRefs converts `refs`, a list of event IDs or event references from an EventBuilder, into
+// the format used by `roomVer`: [event ID, hashes] pairs for the v1 event format, or event IDs otherwise.
+func mustConvertEventRefs(t *testing.T, room *ServerRoom, refs interface{}, roomVer gomatrixserverlib.RoomVersion) []interface{} {
+	t.Helper()
+	refsJSON, err := json.Marshal(refs)
+	if err != nil {
+		t.Fatalf("WrongRoomVersionEvent: failed to marshal event refs: %s", err)
+	}
+	var rawRefs []json.RawMessage
+	if err = json.Unmarshal(refsJSON, &rawRefs); err != nil {
+		t.Fatalf("WrongRoomVersionEvent: failed to unmarshal event refs: %s", err)
+	}
+	knownEvents := make(map[string]*gomatrixserverlib.Event)
+	for _, ev := range room.AuthChain() {
+		knownEvents[ev.EventID()] = ev
+	}
+	for _, ev := range room.AllCurrentState() {
+		knownEvents[ev.EventID()] = ev
+	}
+	for _, ev := range room.Timeline {
+		knownEvents[ev.EventID()] = ev
+	}
+	eventFormat, _ := roomVer.EventFormat()
+	converted := make([]interface{}, len(rawRefs))
+	for i, rawRef := range rawRefs {
+		var eventID string
+		if err = json.Unmarshal(rawRef, &eventID); err != nil {
+			var ref gomatrixserverlib.EventReference
+			if err = json.Unmarshal(rawRef, &ref); err != nil {
+				t.Fatalf("WrongRoomVersionEvent: event ref %s is neither an event ID nor an event reference", string(rawRef))
+			}
+			eventID = ref.EventID
+		}
+		if eventFormat != gomatrixserverlib.EventFormatV1 {
+			converted[i] = eventID
+			continue
+		}
+		ev := knownEvents[eventID]
+		if ev == nil {
+			t.Fatalf("WrongRoomVersionEvent: cannot make an event reference for unknown event %s", eventID)
+		}
+		converted[i] = ev.EventReference()
+	}
+	return converted
+}
+
+// OversizedEvent creates a correctly hashed and signed event which is larger than the 64KiB limit in the spec.
+func OversizedEvent() EventCorruption {
+	return func(t *testing.T, s *Server, room *ServerRoom, ev b.Event) json.RawMessage {
+		t.Helper()
+		eventJSON, err := sjson.SetBytes(
+			s.MustCreateEvent(t, room, ev).JSON(), "content.complement_padding", strings.Repeat("a", maxEventSize),
+		)
+		if err != nil {
+			t.Fatalf("OversizedEvent: failed to pad content: %s", err)
+		}
+		return s.mustRehashAndSignEventJSON(t, room.Version, eventJSON)
+	}
+}
+
+// mustRehashAndSignEventJSON recomputes the content hash of the event JSON then signs it with this server's key.
+func (s *Server) mustRehashAndSignEventJSON(t *testing.T, roomVer gomatrixserverlib.RoomVersion, eventJSON []byte) []byte {
+	t.Helper()
+	hashable := eventJSON
+	var err error
+	for _, key := range []string{"unsigned", "signatures", "hashes"} {
+		hashable, err = sjson.DeleteBytes(hashable, key)
+		if err != nil {
+			t.Fatalf("mustRehashAndSignEventJSON: failed to delete '%s': %s", key, err)
+		}
+	}
+	canonical, err := gomatrixserverlib.CanonicalJSON(hashable)
+	if err != nil {
+		t.Fatalf("mustRehashAndSignEventJSON: failed to canonicalise event: %s", err)
+	}
+	hash := sha256.Sum256(canonical)
+	eventJSON, err = sjson.SetBytes(eventJSON, "hashes.sha256", base64.RawStdEncoding.EncodeToString(hash[:]))
+	if err != nil {
+		t.Fatalf("mustRehashAndSignEventJSON: failed to set hash: %s", err)
+	}
+	return s.mustResignEventJSON(t, roomVer, eventJSON)
+}
+
+// mustResignEventJSON replaces all signatures on the event JSON with a fresh signature from this server's key.
+func (s *Server) mustResignEventJSON(t *testing.T, roomVer gomatrixserverlib.RoomVersion, eventJSON []byte) []byte {
+	t.Helper()
+	eventJSON, err := sjson.SetRawBytes(eventJSON, "signatures", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("mustResignEventJSON: failed to strip signatures: %s", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, roomVer)
+	if err != nil {
+		t.Fatalf("mustResignEventJSON: failed to load event JSON: %s", err)
+	}
+	signed := event.Sign(s.serverName, s.KeyID, s.Priv)
+	return signed.JSON()
+}
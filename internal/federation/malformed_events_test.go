@@ -0,0 +1,113 @@
+package federation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestMalformedEvents(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	roomVer := gomatrixserverlib.RoomVersionV6
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, roomVer, InitialRoomEvents(roomVer, alice))
+	ev := b.Event{
+		Type:   "m.room.message",
+		Sender: alice,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello world",
+		},
+	}
+
+	testCases := map[string]func(t *testing.T, eventJSON []byte){
+		"unsigned": func(t *testing.T, eventJSON []byte) {
+			if len(gjson.GetBytes(eventJSON, "signatures").Map()) != 0 {
+				t.Errorf("event has signatures: %s", eventJSON)
+			}
+		},
+		"bad_signature": func(t *testing.T, eventJSON []byte) {
+			// re-signing the same event with the server's real key should produce a different signature
+			goodJSON := srv.mustResignEventJSON(t, roomVer, eventJSON)
+			goodSig := gjson.GetBytes(goodJSON, "signatures.localhost*").Raw
+			badSig := gjson.GetBytes(eventJSON, "signatures.localhost*").Raw
+			if badSig == "" || badSig == goodSig {
+				t.Errorf("event does not have a bad signature: %s", eventJSON)
+			}
+		},
+		"invalid_hash": func(t *testing.T, eventJSON []byte) {
+			goodJSON := srv.mustRehashAndSignEventJSON(t, roomVer, eventJSON)
+			if gjson.GetBytes(eventJSON, "hashes.sha256").Str == gjson.GetBytes(goodJSON, "hashes.sha256").Str {
+				t.Errorf("event has the correct hash: %s", eventJSON)
+			}
+		},
+		"missing_sender": func(t *testing.T, eventJSON []byte) {
+			if gjson.GetBytes(eventJSON, "sender").Exists() {
+				t.Errorf("event has a sender: %s", eventJSON)
+			}
+		},
+		"missing_type": func(t *testing.T, eventJSON []byte) {
+			if gjson.GetBytes(eventJSON, "type").Exists() {
+				t.Errorf("event has a type: %s", eventJSON)
+			}
+		},
+		"missing_room_id": func(t *testing.T, eventJSON []byte) {
+			if gjson.GetBytes(eventJSON, "room_id").Exists() {
+				t.Errorf("event has a room_id: %s", eventJSON)
+			}
+		},
+		"missing_auth_event": func(t *testing.T, eventJSON []byte) {
+			if gjson.GetBytes(eventJSON, "auth_events").Exists() {
+				t.Errorf("event has auth_events: %s", eventJSON)
+			}
+		},
+		"missing_prev_event": func(t *testing.T, eventJSON []byte) {
+			if gjson.GetBytes(eventJSON, "prev_events").Exists() {
+				t.Errorf("event has prev_events: %s", eventJSON)
+			}
+		},
+		"wrong_room_version": func(t *testing.T, eventJSON []byte) {
+			// room v1 events have an event_id field, room v6 events do not
+			if !gjson.GetBytes(eventJSON, "event_id").Exists() {
+				t.Errorf("event is not in the room v1 format: %s", eventJSON)
+			}
+		},
+		"oversized": func(t *testing.T, eventJSON []byte) {
+			if len(eventJSON) <= maxEventSize {
+				t.Errorf("event is only %d bytes", len(eventJSON))
+			}
+		},
+	}
+
+	corpus := MalformedEvents()
+	if len(corpus) != len(testCases) {
+		t.Fatalf("MalformedEvents returned %d corruptions, want %d", len(corpus), len(testCases))
+	}
+	for name, corrupt := range corpus {
+		check, ok := testCases[name]
+		if !ok {
+			t.Errorf("no test case for corruption %s", name)
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			eventJSON := srv.MustCreateMalformedEvent(t, room, ev, corrupt)
+			if !gjson.ValidBytes(eventJSON) {
+				t.Fatalf("event is not valid JSON: %s", eventJSON)
+			}
+			check(t, eventJSON)
+		})
+	}
+}
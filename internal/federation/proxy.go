@@ -0,0 +1,211 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// ProxiedRequest is a request which passed through a RecordingProxy, along with the response to it.
+type ProxiedRequest struct {
+	Method       string
+	Path         string
+	RawQuery     string
+	RequestBody  []byte
+	StatusCode   int
+	ResponseBody []byte
+	// True if the response was injected by a ProxyFault rather than coming from the target homeserver.
+	Injected bool
+}
+
+// ProxyFault decides whether to inject a fault instead of forwarding a request. If ok is true, the status
+// code and body are returned to the sender and the request is not forwarded.
+type ProxyFault func(req *http.Request) (statusCode int, body []byte, ok bool)
+
+// FailRequests returns a ProxyFault which responds to the first `count` requests with the given method and path
+// prefix with `statusCode`, then lets later requests through. An empty method matches all methods.
+func FailRequests(method, pathPrefix string, statusCode, count int) ProxyFault {
+	var mu sync.Mutex
+	failed := 0
+	return func(req *http.Request) (int, []byte, bool) {
+		if method != "" && req.Method != method {
+			return 0, nil, false
+		}
+		if !strings.HasPrefix(req.URL.Path, pathPrefix) {
+			return 0, nil, false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failed >= count {
+			return 0, nil, false
+		}
+		failed++
+		return statusCode, []byte(`{"errcode":"M_UNKNOWN","error":"complement: injected fault"}`), true
+	}
+}
+
+// RecordingProxy sits between two real homeservers in the deployment and forwards every request it receives
+// to the target homeserver. Each request and response is recorded, and faults can optionally be injected.
+// This allows traffic between two real homeservers to be observed without mocking either side.
+//
+// To put the proxy between hs1 and hs2, mount it on a Server with WithRecordingProxy and deploy with a
+// docker.FederationRoute from hs1 to hs2, so that hs1 resolves hs2 to the host running Complement. Requests
+// addressed to the target are forwarded unmodified, still signed by the sender. Requests with any other X-Matrix
+// destination are re-addressed to the target and re-signed by the proxy's Server, so the target sees them as
+// coming from Complement.
+type RecordingProxy struct {
+	deployment *docker.Deployment
+	target     string
+	faults     []ProxyFault
+	srv        *Server
+
+	mu       sync.Mutex
+	requests []ProxiedRequest
+}
+
+// NewRecordingProxy creates a proxy to the homeserver `target` (e.g "hs2") in the deployment. Faults are checked
+// in order for each request and the first which matches is injected.
+func NewRecordingProxy(deployment *docker.Deployment, target string, faults ...ProxyFault) *RecordingProxy {
+	return &RecordingProxy{
+		deployment: deployment,
+		target:     target,
+		faults:     faults,
+	}
+}
+
+// WithRecordingProxy is an option which mounts the proxy on the server. Requests whose Host is the proxy's
+// target are passed to the proxy; all other requests are handled by the server as normal. The server listens
+// on port 8448, where homeservers send federation traffic for server names without a port, and its certificate
+// is valid for the target. As the port is fixed, only one such server can listen at a time.
+func WithRecordingProxy(p *RecordingProxy) func(*Server) {
+	return func(srv *Server) {
+		p.srv = srv
+		srv.proxy = p
+		srv.listenAddr = ":8448"
+		srv.extraHostnames = append(srv.extraHostnames, p.target)
+	}
+}
+
+// isProxiedRequest returns true if the request is for the target of the server's RecordingProxy. It is a
+// mux.MatcherFunc.
+func (s *Server) isProxiedRequest(req *http.Request, _ *mux.RouteMatch) bool {
+	if s.proxy == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	return host == s.proxy.target
+}
+
+// Requests returns every request the proxy has received so far, in the order they were received.
+func (p *RecordingProxy) Requests() []ProxiedRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	requests := make([]ProxiedRequest, len(p.requests))
+	copy(requests, p.requests)
+	return requests
+}
+
+func (p *RecordingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: RecordingProxy failed to read request body: " + err.Error()))
+		return
+	}
+	record := ProxiedRequest{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		RawQuery:    req.URL.RawQuery,
+		RequestBody: reqBody,
+	}
+	defer func() {
+		p.mu.Lock()
+		p.requests = append(p.requests, record)
+		p.mu.Unlock()
+	}()
+
+	for _, fault := range p.faults {
+		statusCode, body, ok := fault(req)
+		if !ok {
+			continue
+		}
+		record.StatusCode = statusCode
+		record.ResponseBody = body
+		record.Injected = true
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return
+	}
+
+	outReq, err := p.forwardedRequest(req, reqBody)
+	if err != nil {
+		record.StatusCode = 500
+		w.WriteHeader(500)
+		w.Write([]byte("complement: RecordingProxy failed to create request: " + err.Error()))
+		return
+	}
+	res, err := (&docker.RoundTripper{Deployment: p.deployment}).RoundTrip(outReq)
+	if err != nil {
+		record.StatusCode = 502
+		w.WriteHeader(502)
+		w.Write([]byte("complement: RecordingProxy failed to forward request: " + err.Error()))
+		return
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		record.StatusCode = 502
+		w.WriteHeader(502)
+		w.Write([]byte("complement: RecordingProxy failed to read response body: " + err.Error()))
+		return
+	}
+	record.StatusCode = res.StatusCode
+	record.ResponseBody = resBody
+	// the server's middleware sets a JSON Content-Type, which the target's response replaces
+	w.Header().Del("Content-Type")
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(resBody)
+}
+
+// forwardedRequest returns the request to send to the target. If the request is signed for a destination
+// other than the target, it is re-addressed to the target and re-signed with the proxy's Server key, as the
+// target would otherwise reject it.
+func (p *RecordingProxy) forwardedRequest(req *http.Request, body []byte) (*http.Request, error) {
+	_, origin, destination, _, _ := gomatrixserverlib.ParseAuthorization(req.Header.Get("Authorization"))
+	if origin == "" || destination == "" || string(destination) == p.target {
+		outReq, err := http.NewRequest(req.Method, "https://"+p.target+req.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		outReq.Header = req.Header.Clone()
+		return outReq, nil
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest(req.Method, gomatrixserverlib.ServerName(p.target), req.URL.RequestURI())
+	if len(body) > 0 {
+		if err := fedReq.SetContent(json.RawMessage(body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := fedReq.Sign(gomatrixserverlib.ServerName(p.srv.serverName), p.srv.KeyID, p.srv.Priv); err != nil {
+		return nil, err
+	}
+	return fedReq.HTTPRequest()
+}
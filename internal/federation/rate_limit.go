@@ -0,0 +1,65 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes federation requests which should be rejected with 429 M_LIMIT_EXCEEDED by WithRateLimits.
+type RateLimit struct {
+	// The method of requests to rate limit, e.g "PUT". If empty, all methods are rate limited.
+	Method string
+	// The path prefix of requests to rate limit, e.g "/_matrix/federation/v1/send/".
+	PathPrefix string
+	// The number of matching requests to reject before letting requests through to the handler.
+	Count int
+	// The retry_after_ms to return in the 429 response.
+	RetryAfter time.Duration
+}
+
+// WithRateLimits is an option which rejects the first Count requests matching each RateLimit with a
+// 429 M_LIMIT_EXCEEDED, then lets later requests through to the usual handler. This can be used to check
+// that the homeserver backs off and retries when a remote server rate limits it.
+func WithRateLimits(limits ...RateLimit) func(*Server) {
+	return func(srv *Server) {
+		var mu sync.Mutex
+		rejected := make([]int, len(limits))
+		srv.mux.Use(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				var limit *RateLimit
+				for i := range limits {
+					if limits[i].Method != "" && limits[i].Method != req.Method {
+						continue
+					}
+					if !strings.HasPrefix(req.URL.Path, limits[i].PathPrefix) || rejected[i] >= limits[i].Count {
+						continue
+					}
+					rejected[i]++
+					limit = &limits[i]
+					break
+				}
+				mu.Unlock()
+				if limit == nil {
+					h.ServeHTTP(w, req)
+					return
+				}
+				b, err := json.Marshal(map[string]interface{}{
+					"errcode":        "M_LIMIT_EXCEEDED",
+					"error":          "complement: rate limited",
+					"retry_after_ms": limit.RetryAfter.Milliseconds(),
+				})
+				if err != nil {
+					w.WriteHeader(500)
+					w.Write([]byte("complement: WithRateLimits failed to marshal JSON: " + err.Error()))
+					return
+				}
+				w.WriteHeader(429)
+				w.Write(b)
+			})
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waiterTimeout is how long AfterWaiter will block a response for before failing the test.
+const waiterTimeout = 60 * time.Second
+
+// Waiter is something which can be waited on until it is finished, such as the Waiter in the tests package.
+type Waiter interface {
+	Wait(t *testing.T, timeout time.Duration)
+	Finish()
+}
+
+// templatedResponse is the response built up from ResponseOpts passed to Server.Respond.
+type templatedResponse struct {
+	statusCode int
+	headers    map[string]string
+	body       []byte
+	notify     []Waiter
+	waitFor    []Waiter
+	callbacks  []func(req *http.Request)
+}
+
+// ResponseOpt is a functional option which configures a response registered via Server.Respond.
+type ResponseOpt func(t *testing.T, res *templatedResponse)
+
+// WithStatus sets the HTTP status code of the response. Defaults to 200.
+func WithStatus(statusCode int) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.statusCode = statusCode
+	}
+}
+
+// WithJSON sets the response body to the JSON serialised form of `body`. Defaults to {}.
+func WithJSON(body interface{}) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		t.Helper()
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("WithJSON: failed to marshal response body: %s", err)
+		}
+		res.body = b
+	}
+}
+
+// WithRawBody sets the response body to `body`, which need not be valid JSON.
+func WithRawBody(body []byte) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.body = body
+	}
+}
+
+// WithHeader sets the HTTP response header `key` to `value`.
+func WithHeader(key, value string) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.headers[key] = value
+	}
+}
+
+// NotifyWaiter calls Finish() on `w` as soon as a request arrives, before any AfterWaiter blocks the response.
+func NotifyWaiter(w Waiter) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.notify = append(res.notify, w)
+	}
+}
+
+// AfterWaiter blocks the response until `w` is finished. Fails the test if `w` is not finished within 60s.
+func AfterWaiter(w Waiter) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.waitFor = append(res.waitFor, w)
+	}
+}
+
+// OnRequest calls `fn` with every incoming request as soon as it arrives, e.g to log or assert on query parameters.
+func OnRequest(fn func(req *http.Request)) ResponseOpt {
+	return func(t *testing.T, res *templatedResponse) {
+		res.callbacks = append(res.callbacks, fn)
+	}
+}
+
+// Respond registers a canned response for `method` requests to `path`, replacing the need to write an
+// http.HandlerFunc for simple cases. Paths which do not begin with /_matrix are relative to
+// /_matrix/federation/v1, and may contain mux variables. For example:
+//
+//	srv.Respond("GET", "/state_ids/{roomID}",
+//		federation.NotifyWaiter(requestReceived),
+//		federation.AfterWaiter(sendResponse),
+//		federation.WithStatus(403),
+//		federation.WithJSON(map[string]interface{}{"errcode": "M_FORBIDDEN"}),
+//	)
+//
+// Requests are not checked for valid signatures. Use WithXMatrixAuthMode(XMatrixAuthStrict) for that.
+func (s *Server) Respond(method, path string, opts ...ResponseOpt) {
+	res := &templatedResponse{
+		statusCode: 200,
+		headers:    make(map[string]string),
+		body:       []byte("{}"),
+	}
+	for _, opt := range opts {
+		opt(s.t, res)
+	}
+	s.mux.Handle(federationPath(path), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, fn := range res.callbacks {
+			fn(req)
+		}
+		for _, waiter := range res.notify {
+			waiter.Finish()
+		}
+		for _, waiter := range res.waitFor {
+			waiter.Wait(s.t, waiterTimeout)
+		}
+		for k, v := range res.headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(res.statusCode)
+		w.Write(res.body)
+	})).Methods(method)
+}
+
+// federationPath returns `path` relative to /_matrix/federation/v1, unless it already begins with /_matrix.
+func federationPath(path string) string {
+	if strings.HasPrefix(path, "/_matrix") {
+		return path
+	}
+	return "/_matrix/federation/v1" + path
+}
@@ -0,0 +1,52 @@
+package federation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// InitialUpgradedRoomEvents is like InitialRoomEvents, but the m.room.create event refers to `predecessorRoomID`
+// and `predecessorEventID` (usually the tombstone) as the room it replaces.
+func InitialUpgradedRoomEvents(roomVer gomatrixserverlib.RoomVersion, creator, predecessorRoomID, predecessorEventID string) []b.Event {
+	events := InitialRoomEvents(roomVer, creator)
+	events[0].Content["predecessor"] = map[string]interface{}{
+		"room_id":  predecessorRoomID,
+		"event_id": predecessorEventID,
+	}
+	return events
+}
+
+// MustCreateTombstoneEvent creates and signs an m.room.tombstone event for the given room, pointing at
+// `replacementRoomID`. It does not insert this event into the room. See ServerRoom.AddEvent for that.
+func (s *Server) MustCreateTombstoneEvent(t *testing.T, room *ServerRoom, sender, replacementRoomID string) *gomatrixserverlib.Event {
+	t.Helper()
+	return s.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.tombstone",
+		StateKey: b.Ptr(""),
+		Sender:   sender,
+		Content: map[string]interface{}{
+			"body":             "This room has been replaced",
+			"replacement_room": replacementRoomID,
+		},
+	})
+}
+
+// MustUpgradeRoom upgrades `room` to `newVer` in the same way a homeserver would. The tombstone is added to
+// `room`, and a successor room is made whose m.room.create event links back to the tombstone. `sender` becomes
+// the creator of the successor room and must be able to send the tombstone in `room`.
+//
+// Both rooms are served over federation as usual. Send the tombstone to the homeserver via MustSendTransaction
+// to tell it about the upgrade.
+func (s *Server) MustUpgradeRoom(t *testing.T, room *ServerRoom, sender string, newVer gomatrixserverlib.RoomVersion) (successor *ServerRoom) {
+	t.Helper()
+	successorRoomID := s.nextRoomID()
+	tombstone := s.MustCreateTombstoneEvent(t, room, sender, successorRoomID)
+	room.AddEvent(tombstone)
+	successor = s.mustMakeRoomWithID(
+		t, newVer, successorRoomID, InitialUpgradedRoomEvents(newVer, sender, room.RoomID, tombstone.EventID()),
+	)
+	return successor
+}
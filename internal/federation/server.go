@@ -1,12 +1,14 @@
 package federation
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -14,9 +16,12 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,6 +34,23 @@ import (
 	"github.com/matrix-org/complement/internal/docker"
 )
 
+// XMatrixAuthMode controls how the server treats the X-Matrix Authorization header on inbound federation requests.
+type XMatrixAuthMode int
+
+const (
+	// XMatrixAuthDefault only verifies signatures in handlers which explicitly check them, such as
+	// HandleTransactionRequests and ValidFederationRequest.
+	XMatrixAuthDefault XMatrixAuthMode = iota
+	// XMatrixAuthStrict verifies the signature of every inbound /_matrix/federation request against the
+	// origin's keys before it reaches a handler. Requests which fail verification fail the test and are
+	// rejected with a 401. The failure describes the X-Matrix header alongside the JSON which should have
+	// been signed, to help track down signing bugs in the homeserver.
+	XMatrixAuthStrict
+	// XMatrixAuthPermissive parses the X-Matrix header but never checks the signature, so handlers accept
+	// requests from any origin regardless of how they were signed.
+	XMatrixAuthPermissive
+)
+
 // Server represents a federation server
 type Server struct {
 	t *testing.T
@@ -45,11 +67,56 @@ type Server struct {
 	keyPath  string
 	mux      *mux.Router
 	srv      *http.Server
+	// The address Listen() listens on. Default: ":0", a random port.
+	listenAddr string
+	// Extra hostnames which the TLS certificate is valid for, besides HostnameRunningComplement.
+	extraHostnames []string
+	proxy          *RecordingProxy
 
 	directoryHandlerSetup bool
-	aliases               map[string]string
+	aliases               map[string]aliasMapping
 	rooms                 map[string]*ServerRoom
-	keyRing               *gomatrixserverlib.KeyRing
+	keyRing               gomatrixserverlib.JSONVerifier
+
+	xMatrixAuthMode   XMatrixAuthMode
+	verifiedOriginsMu sync.Mutex
+	verifiedOrigins   []string
+
+	openIDTokensMu sync.Mutex
+	openIDTokens   map[string]string // access token -> user ID
+
+	profilesMu sync.Mutex
+	profiles   map[string]Profile // localpart -> profile
+
+	deviceListsMu sync.Mutex
+	deviceLists   map[string]*DeviceList // user ID -> device list
+
+	transactionsMu sync.Mutex
+	transactions   []*ReceivedTransaction
+
+	nextTxnID int64 // accessed atomically
+
+	expectationsMu sync.Mutex
+	expectations   []*Expectation
+
+	sendJoinLeaveVersions []string // nil means only v2
+
+	clockOffset time.Duration
+}
+
+// Profile is the profile of a user on this server, served by HandleProfileQueries.
+type Profile struct {
+	DisplayName string
+	AvatarURL   string
+}
+
+// OpenIDToken is an OpenID token minted by Server.MintOpenIDToken, in the same shape as the response to
+// /_matrix/client/v3/user/{userId}/openid/request_token.
+type OpenIDToken struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int    `json:"expires_in"`
 }
 
 // NewServer creates a new federation server with configured options.
@@ -68,8 +135,12 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 		// The server name will be updated when the caller calls Listen() to include the port number
 		// of the HTTP server e.g "host.docker.internal:56353"
 		serverName:                  docker.HostnameRunningComplement,
+		listenAddr:                  ":0",
 		rooms:                       make(map[string]*ServerRoom),
-		aliases:                     make(map[string]string),
+		aliases:                     make(map[string]aliasMapping),
+		openIDTokens:                make(map[string]string),
+		profiles:                    make(map[string]Profile),
+		deviceLists:                 make(map[string]*DeviceList),
 		UnexpectedRequestsAreErrors: true,
 	}
 	fetcher := &basicKeyFetcher{
@@ -93,6 +164,11 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 			h.ServeHTTP(w, r)
 		})
 	})
+	srv.mux.Use(srv.xMatrixAuthMiddleware)
+	// Requests for a RecordingProxy's target are matched before any other route, see WithRecordingProxy.
+	srv.mux.MatcherFunc(srv.isProxiedRequest).Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.proxy.ServeHTTP(w, req)
+	}))
 	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if srv.UnexpectedRequestsAreErrors {
 			body, _ := ioutil.ReadAll(req.Body)
@@ -104,19 +180,145 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 		w.Write([]byte("complement: federation server is not listening for this path"))
 	})
 
+	for _, opt := range opts {
+		opt(srv)
+	}
+
 	// generate certs and an http.Server
-	httpServer, certPath, keyPath, err := federationServer(deployment.Config, srv.mux)
+	httpServer, certPath, keyPath, err := federationServer(deployment.Config, srv.mux, srv.extraHostnames...)
 	if err != nil {
 		t.Fatalf("complement: unable to create federation server and certificates: %s", err.Error())
 	}
 	srv.certPath = certPath
 	srv.keyPath = keyPath
 	srv.srv = httpServer
+	return srv
+}
 
-	for _, opt := range opts {
-		opt(srv)
+// WithXMatrixAuthMode is an option which sets how inbound X-Matrix signatures are verified. See XMatrixAuthMode.
+func WithXMatrixAuthMode(mode XMatrixAuthMode) func(*Server) {
+	return func(s *Server) {
+		s.xMatrixAuthMode = mode
+		if mode == XMatrixAuthPermissive {
+			s.keyRing = &permissiveVerifier{}
+		}
+	}
+}
+
+// WithClockOffset is an option which shifts the server's clock by `offset`, so that the origin_server_ts of
+// every event and transaction it creates is skewed by that amount. Use a large positive or negative offset to
+// test how the homeserver handles events from the far future or past.
+func WithClockOffset(offset time.Duration) func(*Server) {
+	return func(s *Server) {
+		s.clockOffset = offset
+	}
+}
+
+// now returns the current time according to the server's clock. See WithClockOffset.
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.clockOffset)
+}
+
+// VerifiedOrigins returns the origin of every inbound request which passed X-Matrix verification in
+// XMatrixAuthStrict mode, in the order they were received.
+func (s *Server) VerifiedOrigins() []string {
+	s.verifiedOriginsMu.Lock()
+	defer s.verifiedOriginsMu.Unlock()
+	origins := make([]string, len(s.verifiedOrigins))
+	copy(origins, s.verifiedOrigins)
+	return origins
+}
+
+// MustHaveVerifiedOrigin fails the test unless at least one inbound request has passed X-Matrix
+// verification and every verified request was signed by `wantOrigin`. Requires XMatrixAuthStrict.
+func (s *Server) MustHaveVerifiedOrigin(t *testing.T, wantOrigin string) {
+	t.Helper()
+	if s.xMatrixAuthMode != XMatrixAuthStrict {
+		t.Fatalf("MustHaveVerifiedOrigin: server is not in XMatrixAuthStrict mode")
+	}
+	origins := s.VerifiedOrigins()
+	if len(origins) == 0 {
+		t.Fatalf("MustHaveVerifiedOrigin: no verified requests have been received")
+	}
+	for _, origin := range origins {
+		if origin != wantOrigin {
+			t.Fatalf("MustHaveVerifiedOrigin: got request signed by %s, want %s", origin, wantOrigin)
+		}
 	}
-	return srv
+}
+
+// xMatrixAuthMiddleware verifies inbound federation requests when the server is in XMatrixAuthStrict mode.
+// The request body is buffered so handlers can read it again after verification.
+func (s *Server) xMatrixAuthMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.xMatrixAuthMode != XMatrixAuthStrict || !strings.HasPrefix(req.URL.Path, "/_matrix/federation/") || s.isProxiedRequest(req, nil) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			s.t.Errorf("complement: xMatrixAuthMiddleware: failed to read request body: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+			req, time.Now(), gomatrixserverlib.ServerName(s.serverName), s.keyRing,
+		)
+		if fedReq == nil {
+			s.t.Errorf(
+				"complement: XMatrixAuthStrict: HTTP Code %d. Invalid signature on %s %s: %s\n%s",
+				errResp.Code, req.Method, req.URL.Path, errResp.JSON, s.describeXMatrixAuth(req, body),
+			)
+			w.WriteHeader(errResp.Code)
+			b, _ := json.Marshal(errResp.JSON)
+			w.Write(b)
+			return
+		}
+		s.verifiedOriginsMu.Lock()
+		s.verifiedOrigins = append(s.verifiedOrigins, string(fedReq.Origin()))
+		s.verifiedOriginsMu.Unlock()
+
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		h.ServeHTTP(w, req)
+	})
+}
+
+// describeXMatrixAuth explains what differs between the X-Matrix Authorization header on a rejected request
+// and what this server expected, alongside the JSON which the sender should have signed.
+func (s *Server) describeXMatrixAuth(req *http.Request, body []byte) string {
+	var sb strings.Builder
+	scheme, origin, destination, key, sig := gomatrixserverlib.ParseAuthorization(req.Header.Get("Authorization"))
+	if scheme != "X-Matrix" {
+		fmt.Fprintf(&sb, "Authorization header %q is not X-Matrix\n", req.Header.Get("Authorization"))
+	}
+	if origin == "" || key == "" || sig == "" {
+		fmt.Fprintf(&sb, "X-Matrix header is missing a field: origin=%q key=%q sig=%q\n", origin, key, sig)
+	}
+	if destination == "" {
+		destination = gomatrixserverlib.ServerName(s.serverName)
+	} else if string(destination) != s.serverName {
+		fmt.Fprintf(&sb, "X-Matrix destination %q does not match this server %q\n", destination, s.serverName)
+	}
+	signed := map[string]interface{}{
+		"method":      req.Method,
+		"uri":         req.URL.RequestURI(),
+		"origin":      origin,
+		"destination": destination,
+	}
+	if len(body) > 0 {
+		signed["content"] = json.RawMessage(body)
+	}
+	signedJSON, err := json.Marshal(signed)
+	if err == nil {
+		signedJSON, err = gomatrixserverlib.CanonicalJSON(signedJSON)
+	}
+	if err != nil {
+		fmt.Fprintf(&sb, "Expected signed JSON could not be built: %s", err)
+	} else {
+		fmt.Fprintf(&sb, "Expected signed JSON: %s", signedJSON)
+	}
+	return sb.String()
 }
 
 // Return the server name of this federation server. Only valid AFTER calling Listen() - doing so
@@ -140,6 +342,12 @@ func (s *Server) UserID(localpart string) string {
 	return fmt.Sprintf("@%s:%s", localpart, s.serverName)
 }
 
+// aliasMapping is the response to a directory lookup for a room alias on this server.
+type aliasMapping struct {
+	roomID  string
+	servers []string
+}
+
 // MakeAliasMapping will create a mapping of room alias to room ID on this server. Returns the alias.
 // If this is the first time calling this function, a directory lookup handler will be added to
 // handle alias requests over federation.
@@ -147,19 +355,72 @@ func (s *Server) MakeAliasMapping(aliasLocalpart, roomID string) string {
 	if !s.listening {
 		s.t.Fatalf("MakeAliasMapping() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room alias. Ensure you Listen() first!")
 	}
+	return s.MakeAliasMappingWithServers(aliasLocalpart, roomID, []string{s.serverName})
+}
+
+// MakeAliasMappingWithServers is like MakeAliasMapping but returns `servers` as the list of servers which
+// are in the room, instead of just this server. Use this to test joins via aliases which resolve to rooms
+// on other servers.
+func (s *Server) MakeAliasMappingWithServers(aliasLocalpart, roomID string, servers []string) string {
+	if !s.listening {
+		s.t.Fatalf("MakeAliasMappingWithServers() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room alias. Ensure you Listen() first!")
+	}
 	alias := fmt.Sprintf("#%s:%s", aliasLocalpart, s.serverName)
-	s.aliases[alias] = roomID
+	s.aliases[alias] = aliasMapping{
+		roomID:  roomID,
+		servers: servers,
+	}
 	HandleDirectoryLookups()(s)
 	return alias
 }
 
+// MintOpenIDToken creates an OpenID token for the given user on this server, which can be validated by other
+// servers via /_matrix/federation/v1/openid/userinfo. See HandleOpenIDUserInfoRequests.
+func (s *Server) MintOpenIDToken(t *testing.T, userID string) OpenIDToken {
+	t.Helper()
+	if !s.listening {
+		s.t.Fatalf("MintOpenIDToken() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name. Ensure you Listen() first!")
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		t.Fatalf("MintOpenIDToken: failed to generate token: %s", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	s.openIDTokensMu.Lock()
+	s.openIDTokens[token] = userID
+	s.openIDTokensMu.Unlock()
+	return OpenIDToken{
+		AccessToken:      token,
+		TokenType:        "Bearer",
+		MatrixServerName: s.serverName,
+		ExpiresIn:        3600,
+	}
+}
+
+// SetProfile sets the profile of the user with the given localpart on this server, replacing any existing
+// profile. The profile is returned to other servers via HandleProfileQueries.
+func (s *Server) SetProfile(localpart string, profile Profile) {
+	s.profilesMu.Lock()
+	defer s.profilesMu.Unlock()
+	s.profiles[localpart] = profile
+}
+
 // MustMakeRoom will add a room to this server so it is accessible to other servers when prompted via federation.
 // The `events` will be added to this room. Returns the created room.
 func (s *Server) MustMakeRoom(t *testing.T, roomVer gomatrixserverlib.RoomVersion, events []b.Event) *ServerRoom {
 	if !s.listening {
 		s.t.Fatalf("MustMakeRoom() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room ID. Ensure you Listen() first!")
 	}
-	roomID := fmt.Sprintf("!%d:%s", len(s.rooms), s.serverName)
+	return s.mustMakeRoomWithID(t, roomVer, s.nextRoomID(), events)
+}
+
+// nextRoomID returns the room ID which the next room made via MustMakeRoom will have.
+func (s *Server) nextRoomID() string {
+	return fmt.Sprintf("!%d:%s", len(s.rooms), s.serverName)
+}
+
+// mustMakeRoomWithID is like MustMakeRoom but uses the given room ID.
+func (s *Server) mustMakeRoomWithID(t *testing.T, roomVer gomatrixserverlib.RoomVersion, roomID string, events []b.Event) *ServerRoom {
 	t.Logf("Creating room %s with version %s", roomID, roomVer)
 	room := newRoom(roomVer, roomID)
 
@@ -194,11 +455,12 @@ func (s *Server) MustSendTransaction(t *testing.T, deployment *docker.Deployment
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 	resp, err := cli.SendTransaction(ctx, gomatrixserverlib.Transaction{
-		TransactionID: gomatrixserverlib.TransactionID(fmt.Sprintf("complement-%d", time.Now().Nanosecond())),
-		Origin:        gomatrixserverlib.ServerName(s.ServerName()),
-		Destination:   gomatrixserverlib.ServerName(destination),
-		PDUs:          pdus,
-		EDUs:          edus,
+		TransactionID:  s.nextTransactionID(),
+		Origin:         gomatrixserverlib.ServerName(s.ServerName()),
+		Destination:    gomatrixserverlib.ServerName(destination),
+		OriginServerTS: gomatrixserverlib.AsTimestamp(s.now()),
+		PDUs:           pdus,
+		EDUs:           edus,
 	})
 	if err != nil {
 		t.Fatalf("MustSendTransaction: %s", err)
@@ -210,6 +472,11 @@ func (s *Server) MustSendTransaction(t *testing.T, deployment *docker.Deployment
 	}
 }
 
+// nextTransactionID returns a transaction ID which is unique for the lifetime of this server.
+func (s *Server) nextTransactionID() gomatrixserverlib.TransactionID {
+	return gomatrixserverlib.TransactionID(fmt.Sprintf("complement-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&s.nextTxnID, 1)))
+}
+
 // SendFederationRequest signs and sends an arbitrary federation request from this server.
 //
 // The requests will be routed according to the deployment map in `deployment`.
@@ -227,19 +494,105 @@ func (s *Server) SendFederationRequest(deployment *docker.Deployment, req gomatr
 	return httpClient.DoRequestAndParseResponse(context.Background(), httpReq, resBody)
 }
 
+// ServerVersion is the server implementation reported by /_matrix/federation/v1/version.
+type ServerVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// MustGetServerVersion queries /_matrix/federation/v1/version on the destination homeserver. Fails the test if the
+// request fails or the response has no server name.
+func (s *Server) MustGetServerVersion(t *testing.T, deployment *docker.Deployment, destination string) ServerVersion {
+	t.Helper()
+	req := gomatrixserverlib.NewFederationRequest("GET", gomatrixserverlib.ServerName(destination), "/_matrix/federation/v1/version")
+	var res struct {
+		Server ServerVersion `json:"server"`
+	}
+	if err := s.SendFederationRequest(deployment, req, &res); err != nil {
+		t.Fatalf("MustGetServerVersion: %s", err)
+	}
+	if res.Server.Name == "" {
+		t.Fatalf("MustGetServerVersion: %s did not report a server name", destination)
+	}
+	return res.Server
+}
+
+// LookupOpenIDUserInfo validates an OpenID token minted by the destination homeserver via its
+// /_matrix/federation/v1/openid/userinfo endpoint, as an integration manager would. Returns the user ID the
+// token belongs to.
+func (s *Server) LookupOpenIDUserInfo(deployment *docker.Deployment, destination, accessToken string) (string, error) {
+	req := gomatrixserverlib.NewFederationRequest(
+		"GET", gomatrixserverlib.ServerName(destination),
+		"/_matrix/federation/v1/openid/userinfo?access_token="+url.QueryEscape(accessToken),
+	)
+	var res struct {
+		Sub string `json:"sub"`
+	}
+	if err := s.SendFederationRequest(deployment, req, &res); err != nil {
+		return "", err
+	}
+	return res.Sub, nil
+}
+
+// MustLookupOpenIDUserInfo is LookupOpenIDUserInfo but fails the test on error or if the token does not belong to
+// `wantUserID`.
+func (s *Server) MustLookupOpenIDUserInfo(t *testing.T, deployment *docker.Deployment, destination, accessToken, wantUserID string) {
+	t.Helper()
+	sub, err := s.LookupOpenIDUserInfo(deployment, destination, accessToken)
+	if err != nil {
+		t.Fatalf("MustLookupOpenIDUserInfo: %s", err)
+	}
+	if sub != wantUserID {
+		t.Fatalf("MustLookupOpenIDUserInfo: token belongs to %s, want %s", sub, wantUserID)
+	}
+}
+
 // MustCreateEvent will create and sign a new latest event for the given room.
 // It does not insert this event into the room however. See ServerRoom.AddEvent for that.
 func (s *Server) MustCreateEvent(t *testing.T, room *ServerRoom, ev b.Event) *gomatrixserverlib.Event {
 	t.Helper()
+	signedEvent, err := s.CreateEvent(room, ev)
+	if err != nil {
+		t.Fatalf("MustCreateEvent: %s", err)
+	}
+	return signedEvent
+}
+
+// CreateEvent is MustCreateEvent, but returns an error rather than failing the test. Use it in request handlers,
+// which run outside the test goroutine so cannot call t.Fatalf.
+func (s *Server) CreateEvent(room *ServerRoom, ev b.Event) (*gomatrixserverlib.Event, error) {
+	eb, err := s.createEventBuilder(room, ev)
+	if err != nil {
+		return nil, err
+	}
+	signedEvent, err := eb.Build(s.eventTimestamp(ev), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, room.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign event: %w", err)
+	}
+	return signedEvent, nil
+}
+
+// mustCreateEventBuilder returns an EventBuilder for a new latest event in the given room, populating
+// prev_events and auth_events from the room if they are not set on `ev`.
+func (s *Server) mustCreateEventBuilder(t *testing.T, room *ServerRoom, ev b.Event) gomatrixserverlib.EventBuilder {
+	t.Helper()
+	eb, err := s.createEventBuilder(room, ev)
+	if err != nil {
+		t.Fatalf("MustCreateEvent: %s", err)
+	}
+	return eb
+}
+
+func (s *Server) createEventBuilder(room *ServerRoom, ev b.Event) (gomatrixserverlib.EventBuilder, error) {
 	content, err := json.Marshal(ev.Content)
 	if err != nil {
-		t.Fatalf("MustCreateEvent: failed to marshal event content %s - %+v", err, ev.Content)
+		return gomatrixserverlib.EventBuilder{}, fmt.Errorf("failed to marshal event content %s - %+v", err, ev.Content)
 	}
 	var unsigned []byte
 	if ev.Unsigned != nil {
 		unsigned, err = json.Marshal(ev.Unsigned)
 		if err != nil {
-			t.Fatalf("MustCreateEvent: failed to marshal event unsigned: %s - %+v", err, ev.Unsigned)
+			return gomatrixserverlib.EventBuilder{}, fmt.Errorf("failed to marshal event unsigned: %s - %+v", err, ev.Unsigned)
 		}
 	}
 
@@ -253,9 +606,13 @@ func (s *Server) MustCreateEvent(t *testing.T, room *ServerRoom, ev b.Event) *go
 		// the usual behaviour.
 		prevEvents = room.ForwardExtremities
 	}
+	depth := ev.Depth
+	if depth == 0 {
+		depth = int64(room.Depth + 1) // depth starts at 1
+	}
 	eb := gomatrixserverlib.EventBuilder{
 		Sender:     ev.Sender,
-		Depth:      int64(room.Depth + 1), // depth starts at 1
+		Depth:      depth,
 		Type:       ev.Type,
 		StateKey:   ev.StateKey,
 		Content:    content,
@@ -269,13 +626,78 @@ func (s *Server) MustCreateEvent(t *testing.T, room *ServerRoom, ev b.Event) *go
 		var stateNeeded gomatrixserverlib.StateNeeded
 		stateNeeded, err = gomatrixserverlib.StateNeededForEventBuilder(&eb)
 		if err != nil {
-			t.Fatalf("MustCreateEvent: failed to work out auth_events : %s", err)
+			return gomatrixserverlib.EventBuilder{}, fmt.Errorf("failed to work out auth_events : %s", err)
 		}
 		eb.AuthEvents = room.AuthEvents(stateNeeded)
 	}
-	signedEvent, err := eb.Build(time.Now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, room.Version)
+	return eb, nil
+}
+
+// MustSelectAuthEvents returns the events which MustCreateEvent would select from the current room state as the
+// auth_events of `ev`. Tests can remove from or add to these then set b.Event.AuthEvents to
+// room.EventIDsOrReferences(...) in order to create events with unusual auth_events.
+func (s *Server) MustSelectAuthEvents(t *testing.T, room *ServerRoom, ev b.Event) []*gomatrixserverlib.Event {
+	t.Helper()
+	// use placeholder auth events so the builder doesn't select them itself
+	ev.AuthEvents = []string{}
+	eb := s.mustCreateEventBuilder(t, room, ev)
+	stateNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&eb)
+	if err != nil {
+		t.Fatalf("MustSelectAuthEvents: failed to work out auth_events : %s", err)
+	}
+	byID := make(map[string]*gomatrixserverlib.Event)
+	for _, stateEvent := range room.AllCurrentState() {
+		byID[stateEvent.EventID()] = stateEvent
+	}
+	var authEvents []*gomatrixserverlib.Event
+	for _, eventID := range room.AuthEvents(stateNeeded) {
+		authEvents = append(authEvents, byID[eventID])
+	}
+	return authEvents
+}
+
+// eventTimestamp returns the origin_server_ts to use for `ev`, which is the server's current time unless overridden.
+func (s *Server) eventTimestamp(ev b.Event) time.Time {
+	if ev.OriginServerTS.IsZero() {
+		return s.now()
+	}
+	return ev.OriginServerTS
+}
+
+// MustCreateSoftFailedEvent creates and signs an event which is authorised by the state of the room
+// immediately after `atEventID`, but which may fail auth against the current state of the room. For example,
+// pass the event ID of the event before a ban to create an event from the since-banned user.
+//
+// The event forks the DAG: its prev_events is `atEventID` and its auth_events are taken from the state at
+// that event, so the receiving homeserver should accept it as valid but soft-fail it. It does not insert this
+// event into the room. See ServerRoom.AddEvent for that.
+func (s *Server) MustCreateSoftFailedEvent(t *testing.T, room *ServerRoom, ev b.Event, atEventID string) *gomatrixserverlib.Event {
+	t.Helper()
+	var atEvent *gomatrixserverlib.Event
+	for _, tev := range room.Timeline {
+		if tev.EventID() == atEventID {
+			atEvent = tev
+			break
+		}
+	}
+	if atEvent == nil {
+		t.Fatalf("MustCreateSoftFailedEvent: event %s is not in the timeline of room %s", atEventID, room.RoomID)
+	}
+	ev.PrevEvents = room.EventIDsOrReferences([]*gomatrixserverlib.Event{atEvent})
+	// use placeholder auth events so the builder doesn't select them from the current state
+	ev.AuthEvents = []string{}
+	eb := s.mustCreateEventBuilder(t, room, ev)
+	stateNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&eb)
+	if err != nil {
+		t.Fatalf("MustCreateSoftFailedEvent: failed to work out auth_events : %s", err)
+	}
+	eb.AuthEvents = room.EventIDsOrReferences(room.AuthEventsAtEvent(atEventID, stateNeeded))
+	if ev.Depth == 0 {
+		eb.Depth = atEvent.Depth() + 1
+	}
+	signedEvent, err := eb.Build(s.eventTimestamp(ev), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, room.Version)
 	if err != nil {
-		t.Fatalf("MustCreateEvent: failed to sign event: %s", err)
+		t.Fatalf("MustCreateSoftFailedEvent: failed to sign event: %s", err)
 	}
 	return signedEvent
 }
@@ -290,7 +712,7 @@ func (s *Server) MustJoinRoom(t *testing.T, deployment *docker.Deployment, remot
 		t.Fatalf("MustJoinRoom: make_join failed: %v", err)
 	}
 	roomVer := makeJoinResp.RoomVersion
-	joinEvent, err := makeJoinResp.JoinEvent.Build(time.Now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, roomVer)
+	joinEvent, err := makeJoinResp.JoinEvent.Build(s.now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, roomVer)
 	if err != nil {
 		t.Fatalf("MustJoinRoom: failed to sign event: %v", err)
 	}
@@ -311,7 +733,54 @@ func (s *Server) MustJoinRoom(t *testing.T, deployment *docker.Deployment, remot
 	return room
 }
 
-// Leaves a room. If this is rejecting an invite then a make_leave request is made first, before send_leave.
+// inviteStrippedStateTypes are the state event types which are included in invite_room_state by MustSendInvite.
+var inviteStrippedStateTypes = []string{
+	"m.room.create", "m.room.join_rules", "m.room.name", "m.room.avatar", "m.room.canonical_alias", "m.room.encryption",
+}
+
+// MustSendInvite will make `sender` invite `target`, a user on `remoteServer`, to a room on this server using a
+// v2 /invite request. The invite contains the stripped state of the room in invite_room_state, so clients can
+// preview the room. The invite event, countersigned by the remote server, is added to the room and returned.
+// Handle make_join and send_join requests (see HandleMakeSendJoinRequests) to let the target accept the invite.
+func (s *Server) MustSendInvite(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, room *ServerRoom, sender, target string) *gomatrixserverlib.Event {
+	t.Helper()
+	inviteEvent := s.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.member",
+		StateKey: &target,
+		Sender:   sender,
+		Content: map[string]interface{}{
+			"membership": "invite",
+		},
+	})
+	var strippedState []gomatrixserverlib.InviteV2StrippedState
+	for _, evType := range inviteStrippedStateTypes {
+		if ev := room.CurrentState(evType, ""); ev != nil {
+			strippedState = append(strippedState, gomatrixserverlib.NewInviteV2StrippedState(ev))
+		}
+	}
+	if ev := room.CurrentState("m.room.member", sender); ev != nil {
+		strippedState = append(strippedState, gomatrixserverlib.NewInviteV2StrippedState(ev))
+	}
+	inviteReq, err := gomatrixserverlib.NewInviteV2Request(inviteEvent.Headered(room.Version), strippedState)
+	if err != nil {
+		t.Fatalf("MustSendInvite: failed to make invite request: %v", err)
+	}
+	resp, err := s.FederationClient(deployment).SendInviteV2(context.Background(), remoteServer, inviteReq)
+	if err != nil {
+		t.Fatalf("MustSendInvite: invite failed: %v", err)
+	}
+	signedInvite, err := gomatrixserverlib.NewEventFromUntrustedJSON(resp.Event, room.Version)
+	if err != nil {
+		t.Fatalf("MustSendInvite: failed to parse invite event returned by %s: %v", remoteServer, err)
+	}
+	room.AddEvent(signedInvite)
+
+	t.Logf("Server.MustSendInvite invited %s to room ID %s", target, room.RoomID)
+
+	return signedInvite
+}
+
+// Leaves a room. If this is rejecting an invite or rescinding a knock then a make_leave request is made first, before send_leave.
 func (s *Server) MustLeaveRoom(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, roomID string, userID string) {
 	t.Helper()
 	fedClient := s.FederationClient(deployment)
@@ -324,7 +793,7 @@ func (s *Server) MustLeaveRoom(t *testing.T, deployment *docker.Deployment, remo
 			t.Fatalf("MustLeaveRoom: (rejecting invite) make_leave failed: %v", err)
 		}
 		roomVer := makeLeaveResp.RoomVersion
-		leaveEvent, err = makeLeaveResp.LeaveEvent.Build(time.Now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, roomVer)
+		leaveEvent, err = makeLeaveResp.LeaveEvent.Build(s.now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, roomVer)
 		if err != nil {
 			t.Fatalf("MustLeaveRoom: (rejecting invite) failed to sign event: %v", err)
 		}
@@ -343,12 +812,55 @@ func (s *Server) MustLeaveRoom(t *testing.T, deployment *docker.Deployment, remo
 	if err != nil {
 		t.Fatalf("MustLeaveRoom: send_leave failed: %v", err)
 	}
-	room.AddEvent(leaveEvent)
-	s.rooms[roomID] = room
+	if room != nil {
+		room.AddEvent(leaveEvent)
+	}
 
 	t.Logf("Server.MustLeaveRoom left room ID %s", roomID)
 }
 
+// MustKnockRoom will make the server send a make_knock and a send_knock to knock on a room. It returns the stripped
+// state of the room from the send_knock response. To rescind the knock, see MustLeaveRoom.
+func (s *Server) MustKnockRoom(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, roomID string, userID string) (knockRoomState []json.RawMessage) {
+	t.Helper()
+	query := url.Values{}
+	for _, ver := range SupportedRoomVersions() {
+		query.Add("ver", string(ver))
+	}
+	makeKnockReq := gomatrixserverlib.NewFederationRequest(
+		"GET", remoteServer,
+		fmt.Sprintf("/_matrix/federation/v1/make_knock/%s/%s?%s", url.PathEscape(roomID), url.PathEscape(userID), query.Encode()),
+	)
+	var makeKnockResp struct {
+		Event       gomatrixserverlib.EventBuilder `json:"event"`
+		RoomVersion gomatrixserverlib.RoomVersion  `json:"room_version"`
+	}
+	if err := s.SendFederationRequest(deployment, makeKnockReq, &makeKnockResp); err != nil {
+		t.Fatalf("MustKnockRoom: make_knock failed: %v", err)
+	}
+	knockEvent, err := makeKnockResp.Event.Build(s.now(), gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv, makeKnockResp.RoomVersion)
+	if err != nil {
+		t.Fatalf("MustKnockRoom: failed to sign event: %v", err)
+	}
+	sendKnockReq := gomatrixserverlib.NewFederationRequest(
+		"PUT", remoteServer,
+		fmt.Sprintf("/_matrix/federation/v1/send_knock/%s/%s", url.PathEscape(roomID), url.PathEscape(knockEvent.EventID())),
+	)
+	if err = sendKnockReq.SetContent(knockEvent); err != nil {
+		t.Fatalf("MustKnockRoom: failed to set send_knock content: %v", err)
+	}
+	var sendKnockResp struct {
+		KnockRoomState []json.RawMessage `json:"knock_room_state"`
+	}
+	if err = s.SendFederationRequest(deployment, sendKnockReq, &sendKnockResp); err != nil {
+		t.Fatalf("MustKnockRoom: send_knock failed: %v", err)
+	}
+
+	t.Logf("Server.MustKnockRoom knocked on room ID %s", roomID)
+
+	return sendKnockResp.KnockRoomState
+}
+
 // ValidFederationRequest is a wrapper around http.HandlerFunc which automatically validates the incoming
 // federation request and supports sending back JSON. Fails the test if the request is not valid.
 func (s *Server) ValidFederationRequest(t *testing.T, handler func(fr *gomatrixserverlib.FederationRequest, pathParams map[string]string) util.JSONResponse) http.HandlerFunc {
@@ -396,7 +908,7 @@ func (s *Server) Listen() (cancel func()) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	ln, err := net.Listen("tcp", ":0") //nolint
+	ln, err := net.Listen("tcp", s.listenAddr) //nolint
 	if err != nil {
 		s.t.Fatalf("ListenFederationServer: net.Listen failed: %s", err)
 	}
@@ -424,8 +936,9 @@ func (s *Server) Listen() (cancel func()) {
 	}
 }
 
-// federationServer creates a federation server with the given handler
-func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, string, string, error) {
+// federationServer creates a federation server with the given handler. The certificate is valid for
+// HostnameRunningComplement and any `extraHostnames`.
+func federationServer(cfg *config.Complement, h http.Handler, extraHostnames ...string) (*http.Server, string, string, error) {
 	var derBytes []byte
 	srv := &http.Server{
 		Addr:    ":8448",
@@ -463,11 +976,12 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 			CommonName:    docker.HostnameRunningComplement,
 		},
 	}
-	host := docker.HostnameRunningComplement
-	if ip := net.ParseIP(host); ip != nil {
-		template.IPAddresses = append(template.IPAddresses, ip)
-	} else {
-		template.DNSNames = append(template.DNSNames, host)
+	for _, host := range append([]string{docker.HostnameRunningComplement}, extraHostnames...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
 
 	// derive a new certificate from the base complement one
@@ -519,6 +1033,15 @@ func (f *nopKeyDatabase) FetcherName() string {
 	return "nopKeyDatabase"
 }
 
+// permissiveVerifier is a JSONVerifier which accepts every signature. Used by XMatrixAuthPermissive.
+type permissiveVerifier struct{}
+
+func (v *permissiveVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	return make([]gomatrixserverlib.VerifyJSONResult, len(requests)), nil
+}
+
 type basicKeyFetcher struct {
 	gomatrixserverlib.KeyFetcher
 	srv *Server
@@ -0,0 +1,69 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// MustBeDeniedJoinByACL asserts that the remote server refuses to let `userID` join the room because this server
+// is denied by the room's m.room.server_acl: the make_join must fail with 403 M_FORBIDDEN.
+func (s *Server) MustBeDeniedJoinByACL(t *testing.T, deployment *docker.Deployment, remoteServer gomatrixserverlib.ServerName, roomID, userID string) {
+	t.Helper()
+	_, err := s.FederationClient(deployment).MakeJoin(context.Background(), remoteServer, roomID, userID, SupportedRoomVersions())
+	mustBeForbiddenByACL(t, "MustBeDeniedJoinByACL: make_join", err)
+}
+
+// MustSendTransactionDeniedByACL sends the events to the destination in a transaction, and asserts that every
+// one of them was rejected because this server is denied by the room's m.room.server_acl. Servers still accept
+// the transaction itself, but return an error for each PDU. Times out after 10 seconds.
+func (s *Server) MustSendTransactionDeniedByACL(t *testing.T, deployment *docker.Deployment, destination string, events []*gomatrixserverlib.Event) {
+	t.Helper()
+	pdus := make([]json.RawMessage, len(events))
+	for i, ev := range events {
+		pdus[i] = ev.JSON()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	resp, err := s.FederationClient(deployment).SendTransaction(ctx, gomatrixserverlib.Transaction{
+		TransactionID:  s.nextTransactionID(),
+		Origin:         gomatrixserverlib.ServerName(s.ServerName()),
+		Destination:    gomatrixserverlib.ServerName(destination),
+		OriginServerTS: gomatrixserverlib.AsTimestamp(s.now()),
+		PDUs:           pdus,
+	})
+	if err != nil {
+		t.Fatalf("MustSendTransactionDeniedByACL: %s", err)
+	}
+	for _, ev := range events {
+		result, ok := resp.PDUs[ev.EventID()]
+		if !ok || result.Error == "" {
+			t.Fatalf("MustSendTransactionDeniedByACL: %s accepted event %s from a denied server", destination, ev.EventID())
+		}
+	}
+}
+
+// mustBeForbiddenByACL asserts that `err` is an HTTP 403 M_FORBIDDEN from the remote server.
+func mustBeForbiddenByACL(t *testing.T, what string, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("%s succeeded, want 403 M_FORBIDDEN from the server ACL", what)
+	}
+	httpError, ok := err.(gomatrix.HTTPError)
+	if !ok {
+		t.Fatalf("%s: non-HTTPError: %v", what, err)
+	}
+	if httpError.Code != 403 {
+		t.Fatalf("%s: got HTTP %d, want 403: %s", what, httpError.Code, string(httpError.Contents))
+	}
+	if errcode := gjson.GetBytes(httpError.Contents, "errcode").Str; errcode != "M_FORBIDDEN" {
+		t.Fatalf("%s: got errcode %s, want M_FORBIDDEN", what, errcode)
+	}
+}
@@ -18,6 +18,15 @@ type ServerRoom struct {
 	Timeline           []*gomatrixserverlib.Event
 	ForwardExtremities []string
 	Depth              int64
+
+	// If non-zero, AddEvent prunes the timeline back to this many events whenever it grows to twice this
+	// length. See PruneTimeline.
+	MaxTimelineLength int
+
+	// The state of the room immediately after the most recently pruned timeline event.
+	prunedState map[string]*gomatrixserverlib.Event
+	// Pruned events which are still needed in auth chains, keyed by event ID.
+	prunedAuthEvents map[string]*gomatrixserverlib.Event
 }
 
 // newRoom creates an empty room structure with no events
@@ -42,6 +51,50 @@ func (r *ServerRoom) AddEvent(ev *gomatrixserverlib.Event) {
 		r.Depth = ev.Depth()
 	}
 	r.ForwardExtremities = []string{ev.EventID()}
+	if r.MaxTimelineLength > 0 && len(r.Timeline) >= 2*r.MaxTimelineLength {
+		r.PruneTimeline(r.MaxTimelineLength)
+	}
+}
+
+// PruneTimeline removes all but the most recent `keep` events from the timeline, so that long running tests
+// don't accumulate unbounded numbers of events. At least one event is always kept. Current state is unaffected,
+// StateAtEvent still works for the remaining timeline events, and pruned events which are in the auth chain of
+// the current state or of the remaining timeline are kept aside so AuthChainForEvents still works.
+// Returns the number of events which were pruned.
+func (r *ServerRoom) PruneTimeline(keep int) int {
+	if keep < 1 {
+		keep = 1
+	}
+	if len(r.Timeline) <= keep {
+		return 0
+	}
+	pruned := r.Timeline[:len(r.Timeline)-keep]
+	retained := make([]*gomatrixserverlib.Event, keep)
+	copy(retained, r.Timeline[len(r.Timeline)-keep:])
+
+	prunedState := r.stateAtEvent(pruned[len(pruned)-1].EventID())
+	needed := append([]*gomatrixserverlib.Event{}, retained...)
+	needed = append(needed, r.AllCurrentState()...)
+	for _, ev := range prunedState {
+		needed = append(needed, ev)
+	}
+	authChain := r.AuthChainForEvents(needed)
+
+	prunedByID := make(map[string]bool, len(pruned))
+	for _, ev := range pruned {
+		prunedByID[ev.EventID()] = true
+	}
+	prunedAuthEvents := make(map[string]*gomatrixserverlib.Event)
+	for _, ev := range authChain {
+		if prunedByID[ev.EventID()] || r.prunedAuthEvents[ev.EventID()] != nil {
+			prunedAuthEvents[ev.EventID()] = ev
+		}
+	}
+
+	r.prunedState = prunedState
+	r.prunedAuthEvents = prunedAuthEvents
+	r.Timeline = retained
+	return len(pruned)
 }
 
 // AuthEvents returns the state event IDs of the auth events which authenticate this event
@@ -68,6 +121,9 @@ func (r *ServerRoom) AuthEvents(sn gomatrixserverlib.StateNeeded) (eventIDs []st
 	for _, mem := range sn.Member {
 		appendIfExists("m.room.member", mem)
 	}
+	for _, token := range sn.ThirdPartyInvite {
+		appendIfExists("m.room.third_party_invite", token)
+	}
 	return
 }
 
@@ -84,6 +140,80 @@ func (r *ServerRoom) CurrentState(evType, stateKey string) *gomatrixserverlib.Ev
 	return r.State[tuple]
 }
 
+// StateAtEvent returns the state of the room immediately after the given timeline event, or nil if the event
+// is not in the timeline. State which was not received as part of the timeline (e.g state from a /send_join
+// response) is assumed to have existed before the first timeline event, unless the timeline has been pruned.
+func (r *ServerRoom) StateAtEvent(eventID string) (events []*gomatrixserverlib.Event) {
+	state := r.stateAtEvent(eventID)
+	if state == nil {
+		return nil
+	}
+	for _, ev := range state {
+		events = append(events, ev)
+	}
+	return
+}
+
+func (r *ServerRoom) stateAtEvent(eventID string) map[string]*gomatrixserverlib.Event {
+	inTimeline := make(map[string]bool, len(r.Timeline))
+	for _, ev := range r.Timeline {
+		inTimeline[ev.EventID()] = true
+	}
+	if !inTimeline[eventID] {
+		return nil
+	}
+	state := make(map[string]*gomatrixserverlib.Event)
+	if r.prunedState != nil {
+		for tuple, ev := range r.prunedState {
+			state[tuple] = ev
+		}
+	} else {
+		for tuple, ev := range r.State {
+			if !inTimeline[ev.EventID()] {
+				state[tuple] = ev
+			}
+		}
+	}
+	for _, ev := range r.Timeline {
+		if ev.StateKey() != nil {
+			state[fmt.Sprintf("%s\x1f%s", ev.Type(), *ev.StateKey())] = ev
+		}
+		if ev.EventID() == eventID {
+			break
+		}
+	}
+	return state
+}
+
+// AuthEventsAtEvent is like AuthEvents but selects auth events from the state immediately after the given
+// timeline event rather than the current state. Returns events rather than event IDs.
+func (r *ServerRoom) AuthEventsAtEvent(eventID string, sn gomatrixserverlib.StateNeeded) (events []*gomatrixserverlib.Event) {
+	state := r.stateAtEvent(eventID)
+	appendIfExists := func(evType, stateKey string) {
+		ev := state[fmt.Sprintf("%s\x1f%s", evType, stateKey)]
+		if ev == nil {
+			return
+		}
+		events = append(events, ev)
+	}
+	if sn.Create {
+		appendIfExists("m.room.create", "")
+	}
+	if sn.JoinRules {
+		appendIfExists("m.room.join_rules", "")
+	}
+	if sn.PowerLevels {
+		appendIfExists("m.room.power_levels", "")
+	}
+	for _, mem := range sn.Member {
+		appendIfExists("m.room.member", mem)
+	}
+	for _, token := range sn.ThirdPartyInvite {
+		appendIfExists("m.room.third_party_invite", token)
+	}
+	return
+}
+
 // AllCurrentState returns all the current state events
 func (r *ServerRoom) AllCurrentState() (events []*gomatrixserverlib.Event) {
 	for _, ev := range r.State {
@@ -110,6 +240,9 @@ func (r *ServerRoom) AuthChainForEvents(events []*gomatrixserverlib.Event) (chai
 	for _, ev := range r.State {
 		eventsByID[ev.EventID()] = ev
 	}
+	for _, ev := range r.prunedAuthEvents {
+		eventsByID[ev.EventID()] = ev
+	}
 
 	// a queue of events whose auth events are to be included in the auth chain
 	queue := []*gomatrixserverlib.Event{}
@@ -152,6 +285,26 @@ func (r *ServerRoom) MustHaveMembershipForUser(t *testing.T, userID, wantMembers
 	}
 }
 
+// Check that the user is joined with the given display name and avatar URL in the current state. Use this after
+// a remote user changes their profile to check the m.room.member update reached this server. Fails the test if not.
+func (r *ServerRoom) MustHaveMemberProfile(t *testing.T, userID, wantDisplayName, wantAvatarURL string) {
+	t.Helper()
+	r.MustHaveMembershipForUser(t, userID, "join")
+	var content struct {
+		DisplayName string `json:"displayname"`
+		AvatarURL   string `json:"avatar_url"`
+	}
+	if err := json.Unmarshal(r.CurrentState("m.room.member", userID).Content(), &content); err != nil {
+		t.Fatalf("m.room.member event exists for %s but cannot read content: %s", userID, err)
+	}
+	if content.DisplayName != wantDisplayName {
+		t.Fatalf("incorrect displayname for %s: got %q, want %q", userID, content.DisplayName, wantDisplayName)
+	}
+	if content.AvatarURL != wantAvatarURL {
+		t.Fatalf("incorrect avatar_url for %s: got %q, want %q", userID, content.AvatarURL, wantAvatarURL)
+	}
+}
+
 // ServersInRoom gets all servers currently joined to the room
 func (r *ServerRoom) ServersInRoom() (servers []string) {
 	serverSet := make(map[string]struct{})
@@ -0,0 +1,75 @@
+package federation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestPruneTimeline(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	roomVer := gomatrixserverlib.RoomVersionV6
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, roomVer, InitialRoomEvents(roomVer, alice))
+	for i := 0; i < 20; i++ {
+		room.AddEvent(srv.MustCreateEvent(t, room, b.Event{
+			Type:   "m.room.message",
+			Sender: alice,
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello world",
+			},
+		}))
+	}
+	lastEventID := room.Timeline[len(room.Timeline)-1].EventID()
+	wantState := len(room.State)
+
+	pruned := room.PruneTimeline(5)
+	if len(room.Timeline) != 5 {
+		t.Fatalf("PruneTimeline left %d events in the timeline, want 5", len(room.Timeline))
+	}
+	if pruned == 0 {
+		t.Fatalf("PruneTimeline did not prune any events")
+	}
+	if room.Timeline[len(room.Timeline)-1].EventID() != lastEventID {
+		t.Fatalf("PruneTimeline did not keep the latest event")
+	}
+	if len(room.State) != wantState {
+		t.Fatalf("PruneTimeline changed current state: got %d events, want %d", len(room.State), wantState)
+	}
+	if got := len(room.StateAtEvent(lastEventID)); got != wantState {
+		t.Fatalf("StateAtEvent after PruneTimeline returned %d events, want %d", got, wantState)
+	}
+	// this panics if any auth events were pruned
+	if len(room.AuthChainForEvents(room.Timeline)) == 0 {
+		t.Fatalf("AuthChainForEvents after PruneTimeline returned no events")
+	}
+
+	// MaxTimelineLength prunes automatically
+	room.MaxTimelineLength = 10
+	for i := 0; i < 30; i++ {
+		room.AddEvent(srv.MustCreateEvent(t, room, b.Event{
+			Type:   "m.room.message",
+			Sender: alice,
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello world",
+			},
+		}))
+		if len(room.Timeline) >= 2*room.MaxTimelineLength {
+			t.Fatalf("timeline has %d events, want fewer than %d", len(room.Timeline), 2*room.MaxTimelineLength)
+		}
+	}
+}
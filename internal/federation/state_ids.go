@@ -0,0 +1,73 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// HandleIncrementalStateIDsRequests registers a handler for /state_ids requests for `eventID` in the room, which
+// returns a different state on each request: the nth request gets roomStates[n-1], and once roomStates is
+// exhausted the last state is returned. This simulates the state of the room changing while the homeserver is
+// resyncing it, so tests can check that the homeserver's retries pick up the new state.
+//
+// If requestReceived is not nil, it is finished when each request arrives. If sendResponse is not nil, each
+// response is blocked until it is finished. Returns a function which reports how many requests have been served.
+func (s *Server) HandleIncrementalStateIDsRequests(
+	room *ServerRoom, eventID string, roomStates [][]*gomatrixserverlib.Event, requestReceived, sendResponse Waiter,
+) (requestCount func() int) {
+	var mu sync.Mutex
+	served := 0
+	s.mux.NewRoute().Methods("GET").Path(
+		fmt.Sprintf("/_matrix/federation/v1/state_ids/%s", room.RoomID),
+	).Queries("event_id", eventID).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.t.Logf("Incoming state_ids request for event %s in room %s", eventID, room.RoomID)
+			if requestReceived != nil {
+				requestReceived.Finish()
+			}
+			if sendResponse != nil {
+				sendResponse.Wait(s.t, waiterTimeout)
+			}
+
+			mu.Lock()
+			roomState := roomStates[len(roomStates)-1]
+			if served < len(roomStates) {
+				roomState = roomStates[served]
+			}
+			served++
+			n := served
+			mu.Unlock()
+			s.t.Logf("Replying to /state_ids request %d with %d state events", n, len(roomState))
+
+			res := gomatrixserverlib.RespStateIDs{
+				AuthEventIDs:  eventIDs(room.AuthChainForEvents(roomState)),
+				StateEventIDs: eventIDs(roomState),
+			}
+			jsonb, err := json.Marshal(res)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleIncrementalStateIDsRequests cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(jsonb)
+		}),
+	)
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return served
+	}
+}
+
+func eventIDs(events []*gomatrixserverlib.Event) []string {
+	ids := make([]string, len(events))
+	for i := range events {
+		ids[i] = events[i].EventID()
+	}
+	return ids
+}
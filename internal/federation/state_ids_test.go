@@ -0,0 +1,75 @@
+package federation
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func TestIncrementalStateIDsRequests(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	roomVer := gomatrixserverlib.RoomVersionV6
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, roomVer, InitialRoomEvents(roomVer, alice))
+	eventID := room.Timeline[len(room.Timeline)-1].EventID()
+	initialState := room.AllCurrentState()
+	room.AddEvent(srv.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.topic",
+		StateKey: b.Ptr(""),
+		Sender:   alice,
+		Content: map[string]interface{}{
+			"topic": "the state changed during the resync",
+		},
+	}))
+	grownState := room.AllCurrentState()
+
+	requestCount := srv.HandleIncrementalStateIDsRequests(room, eventID, [][]*gomatrixserverlib.Event{
+		initialState, grownState,
+	}, nil, nil)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	stateIDsURL := "https://" + srv.ServerName() + "/_matrix/federation/v1/state_ids/" + room.RoomID + "?event_id=" + url.QueryEscape(eventID)
+	// the first request gets the initial state, and retries see the grown state
+	for i, wantState := range [][]*gomatrixserverlib.Event{initialState, grownState, grownState} {
+		resp, err := client.Get(stateIDsURL)
+		if err != nil {
+			t.Fatalf("request %d: failed to GET /state_ids: %s", i+1, err)
+		}
+		var res gomatrixserverlib.RespStateIDs
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("request %d: failed to decode /state_ids response: %s", i+1, err)
+		}
+		if len(res.StateEventIDs) != len(wantState) {
+			t.Fatalf("request %d: got %d state events, want %d", i+1, len(res.StateEventIDs), len(wantState))
+		}
+		wantIDs := make(map[string]bool)
+		for _, ev := range wantState {
+			wantIDs[ev.EventID()] = true
+		}
+		for _, id := range res.StateEventIDs {
+			if !wantIDs[id] {
+				t.Fatalf("request %d: got unexpected state event %s", i+1, id)
+			}
+		}
+	}
+	if got := requestCount(); got != 3 {
+		t.Fatalf("served %d /state_ids requests, want 3", got)
+	}
+}
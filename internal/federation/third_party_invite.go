@@ -0,0 +1,223 @@
+package federation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// IdentityServerKey is a signing key which signs third-party invites as if from an identity server.
+type IdentityServerKey struct {
+	ServerName string
+	KeyID      gomatrixserverlib.KeyID
+	Pub        ed25519.PublicKey
+	Priv       ed25519.PrivateKey
+}
+
+// NewIdentityServerKey generates a new signing key for the identity server `serverName`.
+func NewIdentityServerKey(t *testing.T, serverName string) *IdentityServerKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("NewIdentityServerKey: failed to generate ed25519 key: %s", err)
+	}
+	return &IdentityServerKey{
+		ServerName: serverName,
+		KeyID:      "ed25519:0",
+		Pub:        pub,
+		Priv:       priv,
+	}
+}
+
+// PublicKeyBase64 returns the public key in the unpadded base64 form used in m.room.third_party_invite events.
+func (k *IdentityServerKey) PublicKeyBase64() string {
+	return base64.RawStdEncoding.EncodeToString(k.Pub)
+}
+
+// MustSign returns the `signed` block of a third-party invite, which proves that `mxid` has been bound to the
+// third-party identifier that `token` was issued for.
+func (k *IdentityServerKey) MustSign(t *testing.T, mxid, token string) map[string]interface{} {
+	t.Helper()
+	toSign, err := json.Marshal(map[string]interface{}{
+		"mxid":  mxid,
+		"token": token,
+	})
+	if err != nil {
+		t.Fatalf("IdentityServerKey.MustSign: failed to marshal JSON: %s", err)
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(k.ServerName, k.KeyID, k.Priv, toSign)
+	if err != nil {
+		t.Fatalf("IdentityServerKey.MustSign: failed to sign JSON: %s", err)
+	}
+	var signed map[string]interface{}
+	if err = json.Unmarshal(signedJSON, &signed); err != nil {
+		t.Fatalf("IdentityServerKey.MustSign: failed to unmarshal signed JSON: %s", err)
+	}
+	return signed
+}
+
+// MustCreateThirdPartyInviteEvent creates and signs an m.room.third_party_invite event from `sender` for the
+// given token, which can be redeemed using invites signed by `isKey`. It does not insert this event into the room.
+// See ServerRoom.AddEvent for that.
+func (s *Server) MustCreateThirdPartyInviteEvent(t *testing.T, room *ServerRoom, sender, token, displayName string, isKey *IdentityServerKey) *gomatrixserverlib.Event {
+	t.Helper()
+	keyValidityURL := "https://" + isKey.ServerName + "/_matrix/identity/v2/pubkey/isvalid"
+	return s.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.third_party_invite",
+		StateKey: b.Ptr(token),
+		Sender:   sender,
+		Content: map[string]interface{}{
+			"display_name":     displayName,
+			"key_validity_url": keyValidityURL,
+			"public_key":       isKey.PublicKeyBase64(),
+			"public_keys": []map[string]interface{}{
+				{
+					"public_key":       isKey.PublicKeyBase64(),
+					"key_validity_url": keyValidityURL,
+				},
+			},
+		},
+	})
+}
+
+// MustCreateThirdPartyInviteMemberEvent creates and signs the m.room.member invite event which redeems the
+// third-party invite with the given token for `mxid`. This is the event a homeserver sends to
+// /exchange_third_party_invite. It does not insert this event into the room. See ServerRoom.AddEvent for that.
+func (s *Server) MustCreateThirdPartyInviteMemberEvent(t *testing.T, room *ServerRoom, sender, mxid, token, displayName string, isKey *IdentityServerKey) *gomatrixserverlib.Event {
+	t.Helper()
+	return s.MustCreateEvent(t, room, b.Event{
+		Type:     "m.room.member",
+		StateKey: b.Ptr(mxid),
+		Sender:   sender,
+		Content: map[string]interface{}{
+			"membership": "invite",
+			"third_party_invite": map[string]interface{}{
+				"display_name": displayName,
+				"signed":       isKey.MustSign(t, mxid, token),
+			},
+		},
+	})
+}
+
+// HandleExchangeThirdPartyInviteRequests is an option which will process
+// PUT /_matrix/federation/v1/exchange_third_party_invite/{roomID} requests for rooms on this server. The
+// request must have a valid X-Matrix signature, and the invite is only accepted if the room has an
+// m.room.third_party_invite event for the token in the request whose public keys signed the `signed` block.
+// Accepted invites are signed and added to the room, then passed to inviteCallback if it is non-nil.
+func HandleExchangeThirdPartyInviteRequests(inviteCallback func(*gomatrixserverlib.Event)) func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/exchange_third_party_invite/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(srv.serverName), srv.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			roomID := mux.Vars(req)["roomID"]
+			room, ok := srv.rooms[roomID]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte("complement: HandleExchangeThirdPartyInviteRequests unknown room ID: " + roomID))
+				return
+			}
+			var ev struct {
+				Type     string                 `json:"type"`
+				Sender   string                 `json:"sender"`
+				StateKey *string                `json:"state_key"`
+				Content  map[string]interface{} `json:"content"`
+			}
+			if err := json.Unmarshal(fedReq.Content(), &ev); err != nil || ev.Type != "m.room.member" || ev.StateKey == nil {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errcode":"M_BAD_JSON","error":"complement: expected an m.room.member event"}`))
+				return
+			}
+			tpi, _ := ev.Content["third_party_invite"].(map[string]interface{})
+			signed, _ := tpi["signed"].(map[string]interface{})
+			token, _ := signed["token"].(string)
+			tpiEvent := room.CurrentState("m.room.third_party_invite", token)
+			if token == "" || tpiEvent == nil {
+				w.WriteHeader(403)
+				w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"complement: no third party invite for this token"}`))
+				return
+			}
+			if err := verifyThirdPartyInviteSigned(tpiEvent, *ev.StateKey, signed); err != nil {
+				w.WriteHeader(403)
+				b, _ := json.Marshal(map[string]string{
+					"errcode": "M_FORBIDDEN",
+					"error":   "complement: " + err.Error(),
+				})
+				w.Write(b)
+				return
+			}
+			inviteEvent, err := srv.CreateEvent(room, b.Event{
+				Type:     ev.Type,
+				StateKey: ev.StateKey,
+				Sender:   ev.Sender,
+				Content:  ev.Content,
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleExchangeThirdPartyInviteRequests failed to create invite: " + err.Error()))
+				return
+			}
+			room.AddEvent(inviteEvent)
+			if inviteCallback != nil {
+				inviteCallback(inviteEvent)
+			}
+			w.WriteHeader(200)
+			w.Write([]byte("{}"))
+		})).Methods("PUT")
+	}
+}
+
+// verifyThirdPartyInviteSigned checks that the `signed` block of a third-party invite is for `mxid` and was
+// signed by one of the public keys in the m.room.third_party_invite event.
+func verifyThirdPartyInviteSigned(tpiEvent *gomatrixserverlib.Event, mxid string, signed map[string]interface{}) error {
+	if signed["mxid"] != mxid {
+		return fmt.Errorf("signed block is for %v, not %s", signed["mxid"], mxid)
+	}
+	signedJSON, err := json.Marshal(signed)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signed block: %w", err)
+	}
+	content := gjson.ParseBytes(tpiEvent.Content())
+	publicKeys := []string{content.Get("public_key").Str}
+	for _, pk := range content.Get("public_keys.#.public_key").Array() {
+		publicKeys = append(publicKeys, pk.Str)
+	}
+	var verified bool
+	gjson.GetBytes(signedJSON, "signatures").ForEach(func(signingName, sigs gjson.Result) bool {
+		sigs.ForEach(func(keyID, _ gjson.Result) bool {
+			for _, pk := range publicKeys {
+				pub, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(pk, "="))
+				if err != nil || len(pub) != ed25519.PublicKeySize {
+					continue
+				}
+				if gomatrixserverlib.VerifyJSON(signingName.Str, gomatrixserverlib.KeyID(keyID.Str), pub, signedJSON) == nil {
+					verified = true
+					return false
+				}
+			}
+			return true
+		})
+		return !verified
+	})
+	if !verified {
+		return fmt.Errorf("signed block is not signed by any public key of the third party invite")
+	}
+	return nil
+}
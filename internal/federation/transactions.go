@@ -0,0 +1,137 @@
+package federation
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// maxTransactionPDUs is the maximum number of PDUs in a transaction, as defined by the spec.
+	maxTransactionPDUs = 50
+	// maxTransactionEDUs is the maximum number of EDUs in a transaction, as defined by the spec.
+	maxTransactionEDUs = 100
+)
+
+// ReceivedTransaction is a transaction received by HandleTransactionRequests.
+type ReceivedTransaction struct {
+	TransactionID string
+	Origin        string
+	PDUs          []json.RawMessage
+	EDUs          []gomatrixserverlib.EDU
+	// The IDs of the PDUs which could be parsed, in the order they appear in the transaction. This includes
+	// PDUs which were rejected via WithPDUErrors.
+	EventIDs []string
+}
+
+// transactionConfig is the configuration built up from TransactionOpts passed to HandleTransactionRequests.
+type transactionConfig struct {
+	pduError func(*gomatrixserverlib.Event) string
+}
+
+// TransactionOpt is a functional option which changes how HandleTransactionRequests processes transactions.
+type TransactionOpt func(*transactionConfig)
+
+// WithPDUErrors makes HandleTransactionRequests return a per-PDU error in the /send response for every PDU
+// for which `pduError` returns a non-empty error message. Such PDUs are not added to the room and are not
+// passed to the PDU callback. The transaction as a whole still succeeds.
+func WithPDUErrors(pduError func(*gomatrixserverlib.Event) string) TransactionOpt {
+	return func(cfg *transactionConfig) {
+		cfg.pduError = pduError
+	}
+}
+
+// recordTransaction stores a copy of the transaction before it is processed.
+func (s *Server) recordTransaction(origin gomatrixserverlib.ServerName, txn gomatrixserverlib.Transaction) *ReceivedTransaction {
+	received := &ReceivedTransaction{
+		TransactionID: string(txn.TransactionID),
+		Origin:        string(origin),
+		EDUs:          txn.EDUs,
+	}
+	for _, pdu := range txn.PDUs {
+		received.PDUs = append(received.PDUs, json.RawMessage(pdu))
+	}
+	s.transactionsMu.Lock()
+	s.transactions = append(s.transactions, received)
+	s.transactionsMu.Unlock()
+	return received
+}
+
+// recordTransactionEvent records that an event in the transaction was processed.
+func (s *Server) recordTransactionEvent(received *ReceivedTransaction, eventID string) {
+	s.transactionsMu.Lock()
+	received.EventIDs = append(received.EventIDs, eventID)
+	s.transactionsMu.Unlock()
+}
+
+// ReceivedTransactions returns every transaction received by HandleTransactionRequests, in the order they
+// were received. Retried transactions appear once per attempt.
+func (s *Server) ReceivedTransactions() []ReceivedTransaction {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	txns := make([]ReceivedTransaction, 0, len(s.transactions))
+	for _, txn := range s.transactions {
+		copied := *txn
+		copied.EventIDs = append([]string(nil), txn.EventIDs...)
+		txns = append(txns, copied)
+	}
+	return txns
+}
+
+// MustHaveTransactionsWithinLimits fails the test if any transaction received so far has more than 50 PDUs
+// or more than 100 EDUs.
+func (s *Server) MustHaveTransactionsWithinLimits(t *testing.T) {
+	t.Helper()
+	for _, txn := range s.ReceivedTransactions() {
+		if len(txn.PDUs) > maxTransactionPDUs {
+			t.Errorf("MustHaveTransactionsWithinLimits: transaction %s from %s has %d PDUs, want at most %d", txn.TransactionID, txn.Origin, len(txn.PDUs), maxTransactionPDUs)
+		}
+		if len(txn.EDUs) > maxTransactionEDUs {
+			t.Errorf("MustHaveTransactionsWithinLimits: transaction %s from %s has %d EDUs, want at most %d", txn.TransactionID, txn.Origin, len(txn.EDUs), maxTransactionEDUs)
+		}
+	}
+}
+
+// MustHaveReceivedEventsInOrder fails the test unless all of `eventIDs` have been received over /send, and the
+// first time each was received was in the given order. Other events may be interleaved between them.
+func (s *Server) MustHaveReceivedEventsInOrder(t *testing.T, eventIDs []string) {
+	t.Helper()
+	var received []string
+	seen := make(map[string]bool)
+	for _, txn := range s.ReceivedTransactions() {
+		for _, eventID := range txn.EventIDs {
+			if !seen[eventID] {
+				seen[eventID] = true
+				received = append(received, eventID)
+			}
+		}
+	}
+	i := 0
+	for _, eventID := range received {
+		if i < len(eventIDs) && eventID == eventIDs[i] {
+			i++
+		}
+	}
+	if i < len(eventIDs) {
+		if !seen[eventIDs[i]] {
+			t.Fatalf("MustHaveReceivedEventsInOrder: event %s was never received. Received: %v", eventIDs[i], received)
+		}
+		t.Fatalf("MustHaveReceivedEventsInOrder: event %s was received out of order. Received: %v, want order: %v", eventIDs[i], received, eventIDs)
+	}
+}
+
+// DeliveryAttempts returns the number of transactions received so far which contained the given event. This can
+// be used with WithPDUErrors to check whether the homeserver retries sending an event which failed.
+func (s *Server) DeliveryAttempts(eventID string) int {
+	attempts := 0
+	for _, txn := range s.ReceivedTransactions() {
+		for _, id := range txn.EventIDs {
+			if id == eventID {
+				attempts++
+				break
+			}
+		}
+	}
+	return attempts
+}
@@ -115,6 +115,22 @@ func (r *Runner) DeviceIDs(hsDomain string) map[string]string {
 	return res
 }
 
+// OlmAccounts returns the pickled Olm accounts of the E2EE users who were created on the given HS domain, pickled
+// with b.OlmPickleKey.
+// Returns a map of user_id => pickled account
+func (r *Runner) OlmAccounts(hsDomain string) map[string]string {
+	res := make(map[string]string)
+	r.lookup.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		val := v.(string)
+		if strings.HasPrefix(key, "olm_account_@") && strings.HasSuffix(key, ":"+hsDomain) {
+			res[strings.TrimPrefix(key, "olm_account_")] = val
+		}
+		return true
+	})
+	return res
+}
+
 // Load a previously stored value from RunInstructions
 func (r *Runner) GetStoredValue(opts RunOpts, key string) string {
 	fullKey := opts.StoreNamespace + key
@@ -244,6 +260,9 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 					r.lookup.Store(k, val.Str)
 				}
 			}
+			if instr.onSuccess != nil && res.StatusCode >= 200 && res.StatusCode < 300 {
+				instr.onSuccess()
+			}
 		}
 		req, instr, i = r.next(instrs, hsURL, i)
 	}
@@ -368,6 +387,8 @@ type instruction struct {
 	storeResponse map[string]string
 	// Optional: A function to create the request body from the lookup map provided. Only used if `body` is <nil>.
 	bodyFn func(lk *sync.Map) interface{}
+	// Optional: A function which is called once the request has returned a 2xx response.
+	onSuccess func()
 }
 
 // url returns the complete path resolved url for this instruction. Query parameters must be
@@ -413,8 +434,8 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		}
 		createdUsers[user.Localpart] = true
 
-		if user.OneTimeKeys > 0 {
-			instrs = append(instrs, instructionOneTimeKeyUpload(hs, user))
+		if user.HasE2EE() {
+			instrs = append(instrs, r.instructionKeyUpload(hs, user))
 		}
 		sets[i] = instrs
 	}
@@ -603,7 +624,9 @@ func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
-func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
+// instructionKeyUpload returns an instruction which uploads device keys and one-time keys for the user. The Olm
+// account is pickled and stored so that tests can use the device, see OlmAccounts.
+func (r *Runner) instructionKeyUpload(hs b.Homeserver, user b.User) instruction {
 	account := olm.NewAccount()
 	ed25519Key, curveKey := account.IdentityKeys()
 
@@ -651,6 +674,11 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 
 		oneTimeKeys[keyID] = keyMap
 	}
+	// the keys are only marked as published once the server has accepted them
+	storeAccount := func() {
+		r.lookup.Store("olm_account_"+userID, string(account.Pickle([]byte(b.OlmPickleKey))))
+	}
+	storeAccount()
 	return instruction{
 		method:      "POST",
 		path:        "/_matrix/client/v3/keys/upload",
@@ -659,6 +687,10 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 			"device_keys":   deviceKeys,
 			"one_time_keys": oneTimeKeys,
 		},
+		onSuccess: func() {
+			account.MarkKeysAsPublished()
+			storeAccount()
+		},
 	}
 }
 
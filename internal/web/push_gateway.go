@@ -0,0 +1,73 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// PushGateway is a mock push gateway, served on a Server by HandlePushGateway. It records every notification
+// it receives.
+type PushGateway struct {
+	srv *Server
+
+	mu               sync.Mutex
+	notifications    []gjson.Result
+	rejectedPushkeys map[string]bool
+}
+
+// HandlePushGateway serves a push gateway on /_matrix/push/v1/notify. Use PushGateway.URL as the pusher's
+// `data.url`.
+func HandlePushGateway(s *Server) *PushGateway {
+	gw := &PushGateway{
+		srv:              s,
+		rejectedPushkeys: make(map[string]bool),
+	}
+	s.mux.HandleFunc("/_matrix/push/v1/notify", func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || !gjson.ValidBytes(body) {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errcode":"M_BAD_JSON","error":"complement: cannot parse notification"}`))
+			return
+		}
+		notification := gjson.ParseBytes(body).Get("notification")
+		rejected := []string{}
+		gw.mu.Lock()
+		gw.notifications = append(gw.notifications, notification)
+		for _, device := range notification.Get("devices").Array() {
+			if pushkey := device.Get("pushkey").Str; gw.rejectedPushkeys[pushkey] {
+				rejected = append(rejected, pushkey)
+			}
+		}
+		gw.mu.Unlock()
+		res, _ := json.Marshal(map[string]interface{}{
+			"rejected": rejected,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(res)
+	}).Methods("POST")
+	return gw
+}
+
+// URL returns the URL of the notify endpoint. Must be called after Server.Listen.
+func (gw *PushGateway) URL() string {
+	return gw.srv.URL("/_matrix/push/v1/notify")
+}
+
+// Notifications returns the `notification` object of every request received so far, in order.
+func (gw *PushGateway) Notifications() []gjson.Result {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return append([]gjson.Result(nil), gw.notifications...)
+}
+
+// RejectPushkey makes the gateway report `pushkey` as rejected, which should make the homeserver remove the pusher.
+func (gw *PushGateway) RejectPushkey(pushkey string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	gw.rejectedPushkeys[pushkey] = true
+}
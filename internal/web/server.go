@@ -0,0 +1,140 @@
+// Package web contains a plain HTTP server which homeservers under test can reach, for serving fixture
+// web pages to features such as URL previews.
+package web
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Server is an HTTP server which serves fixture pages to homeservers under test.
+//
+// Homeservers usually refuse to preview URLs on private IP ranges, so the homeserver config must allow the
+// address of the host running Complement for previews of this server to work.
+type Server struct {
+	t   *testing.T
+	mux *mux.Router
+	srv *http.Server
+	// host:port which homeservers can reach this server on, set by Listen
+	addr string
+
+	requestsMu sync.Mutex
+	requests   map[string]int
+}
+
+// NewServer creates a new fixture server. Add pages to it, then call Listen.
+func NewServer(t *testing.T) *Server {
+	s := &Server{
+		t:        t,
+		mux:      mux.NewRouter(),
+		requests: make(map[string]int),
+	}
+	s.srv = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.requestsMu.Lock()
+			s.requests[req.URL.Path]++
+			s.requestsMu.Unlock()
+			s.mux.ServeHTTP(w, req)
+		}),
+	}
+	s.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.t.Logf("web.Server: no page at %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(404)
+	})
+	return s
+}
+
+// Listen starts the server on a random port. Returns a function to shut it down.
+func (s *Server) Listen() (cancel func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		s.t.Fatalf("web.Server.Listen: net.Listen failed: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	s.addr = fmt.Sprintf("%s:%d", docker.HostnameRunningComplement, port)
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("web.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Shutdown(context.Background())
+		if err != nil {
+			s.t.Fatalf("web.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// URL returns the URL homeservers can use to fetch `path` from this server. Must be called after Listen.
+func (s *Server) URL(path string) string {
+	if s.addr == "" {
+		s.t.Fatalf("web.Server.URL: called before Listen")
+	}
+	return "http://" + s.addr + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Requests returns how many times `path` has been requested.
+func (s *Server) Requests(path string) int {
+	s.requestsMu.Lock()
+	defer s.requestsMu.Unlock()
+	return s.requests["/"+strings.TrimPrefix(path, "/")]
+}
+
+// HandlePage serves `body` with the given Content-Type on GET requests to `path`.
+func (s *Server) HandlePage(path, contentType string, body []byte) {
+	s.mux.HandleFunc("/"+strings.TrimPrefix(path, "/"), func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(200)
+		w.Write(body)
+	}).Methods("GET")
+}
+
+// HandleOpenGraphPage serves an HTML page at `path` with a <meta property="..." content="..."> tag for each
+// OpenGraph property, e.g {"og:title": "Hello", "og:image": s.URL("image.png")}.
+func (s *Server) HandleOpenGraphPage(path string, properties map[string]string) {
+	var page strings.Builder
+	page.WriteString("<!DOCTYPE html><html><head>")
+	for property, content := range properties {
+		page.WriteString(fmt.Sprintf(`<meta property="%s" content="%s">`, html.EscapeString(property), html.EscapeString(content)))
+	}
+	if title, ok := properties["og:title"]; ok {
+		page.WriteString("<title>" + html.EscapeString(title) + "</title>")
+	}
+	page.WriteString("</head><body></body></html>")
+	s.HandlePage(path, "text/html; charset=utf-8", []byte(page.String()))
+}
+
+// HandleLargePage serves an HTML page at `path` which is `size` bytes long, to test size limits.
+func (s *Server) HandleLargePage(path string, size int) {
+	prefix := "<!DOCTYPE html><html><head><title>Large page</title></head><body>"
+	suffix := "</body></html>"
+	padding := size - len(prefix) - len(suffix)
+	if padding < 0 {
+		padding = 0
+	}
+	s.HandlePage(path, "text/html; charset=utf-8", []byte(prefix+strings.Repeat("a", padding)+suffix))
+}
+
+// Handle serves requests to `path` with an arbitrary handler, e.g to redirect or to respond slowly.
+func (s *Server) Handle(path string, handler http.HandlerFunc) {
+	s.mux.HandleFunc("/"+strings.TrimPrefix(path, "/"), handler)
+}
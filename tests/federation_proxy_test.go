@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
+)
+
+// Tests that a RecordingProxy between two real homeservers sees the traffic from hs1 to hs2, and that hs2 still
+// accepts it.
+func TestRecordingProxyRecordsFederationTraffic(t *testing.T) {
+	deployment := DeployWithFederationRoutes(t, b.BlueprintFederationOneToOneRoom, docker.FederationRoute{
+		From: "hs1",
+		To:   "hs2",
+	})
+	defer deployment.Destroy(t)
+
+	proxy := federation.NewRecordingProxy(deployment, "hs2")
+	srv := federation.NewServer(t, deployment,
+		federation.WithRecordingProxy(proxy),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	// bob joins from hs2, which talks to hs1 directly
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	// alice's message is sent from hs1 to hs2 via the proxy
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "through the proxy",
+		},
+	})
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+
+	for _, req := range proxy.Requests() {
+		if req.Method == "PUT" && strings.HasPrefix(req.Path, "/_matrix/federation/v1/send/") &&
+			strings.Contains(string(req.RequestBody), eventID) {
+			if req.StatusCode != 200 {
+				t.Fatalf("hs2 responded to the proxied transaction with HTTP %d: %s", req.StatusCode, string(req.ResponseBody))
+			}
+			return
+		}
+	}
+	t.Fatalf("proxy did not record a transaction from hs1 containing %s, got %d requests", eventID, len(proxy.Requests()))
+}
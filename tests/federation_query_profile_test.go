@@ -1,8 +1,6 @@
 package tests
 
 import (
-	"encoding/json"
-	"net/http"
 	"testing"
 
 	"github.com/matrix-org/complement/internal/b"
@@ -31,27 +29,14 @@ func TestOutboundFederationProfile(t *testing.T) {
 		remoteUserID := srv.UserID("user")
 		remoteDisplayName := "my remote display name"
 
-		srv.Mux().Handle("/_matrix/federation/v1/query/profile", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			userID := req.URL.Query().Get("user_id")
+		srv.SetProfile("user", federation.Profile{
+			DisplayName: remoteDisplayName,
+		})
+		federation.HandleProfileQueries(func(userID, field string) {
 			if userID != remoteUserID {
-				w.WriteHeader(500)
-				t.Fatalf("GET /_matrix/federation/v1/query/profile with wrong user ID, got '%s' want '%s'", userID, remoteUserID)
-				return
-			}
-			resBody, err := json.Marshal(struct {
-				Displayname string `json:"displayname"`
-				AvatarURL   string `json:"avatar_url"`
-			}{
-				remoteDisplayName, "",
-			})
-			if err != nil {
-				w.WriteHeader(500)
-				t.Fatalf("GET /_matrix/federation/v1/query/profile failed to marshal response: %s", err)
-				return
+				t.Errorf("GET /_matrix/federation/v1/query/profile with wrong user ID, got '%s' want '%s'", userID, remoteUserID)
 			}
-			w.WriteHeader(200)
-			w.Write(resBody)
-		})).Methods("GET")
+		})(srv)
 
 		// query the display name which should do an outbound federation hit
 		unauthedClient := deployment.Client(t, "hs1", "")
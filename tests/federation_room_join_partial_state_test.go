@@ -362,22 +362,13 @@ func TestPartialStateJoin(t *testing.T) {
 		// we will respond to the request with garbage
 		fedStateIdsRequestReceivedWaiter := NewWaiter()
 		fedStateIdsSendResponseWaiter := NewWaiter()
-		server.Mux().Handle(
-			fmt.Sprintf("/_matrix/federation/v1/state_ids/%s", roomID),
-			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				queryParams := req.URL.Query()
-				t.Logf("Incoming state_ids request for event %s in room %s", queryParams["event_id"], roomID)
-				fedStateIdsRequestReceivedWaiter.Finish()
-				fedStateIdsSendResponseWaiter.Wait(t, 60*time.Second)
-				t.Logf("Replying to /state_ids request with invalid response")
-
-				w.WriteHeader(200)
-
-				if _, err := w.Write([]byte("{}")); err != nil {
-					t.Errorf("Error writing to request: %v", err)
-				}
+		server.Respond("GET", "/state_ids/"+roomID,
+			federation.OnRequest(func(req *http.Request) {
+				t.Logf("Incoming state_ids request for event %s in room %s", req.URL.Query()["event_id"], roomID)
 			}),
-		).Methods("GET")
+			federation.NotifyWaiter(fedStateIdsRequestReceivedWaiter),
+			federation.AfterWaiter(fedStateIdsSendResponseWaiter),
+		)
 
 		// join charlie on hs2 to the room, via the complement homeserver
 		charlie.JoinRoom(t, roomID, []string{server.ServerName()})
@@ -652,32 +643,15 @@ func handleStateIdsRequests(
 	eventID string, roomState []*gomatrixserverlib.Event,
 	requestReceivedWaiter *Waiter, sendResponseWaiter *Waiter,
 ) {
-	srv.Mux().NewRoute().Methods("GET").Path(
-		fmt.Sprintf("/_matrix/federation/v1/state_ids/%s", serverRoom.RoomID),
-	).Queries("event_id", eventID).Handler(
-		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			queryParams := req.URL.Query()
-			t.Logf("Incoming state_ids request for event %s in room %s", queryParams["event_id"], serverRoom.RoomID)
-			if requestReceivedWaiter != nil {
-				requestReceivedWaiter.Finish()
-			}
-			if sendResponseWaiter != nil {
-				sendResponseWaiter.Waitf(t, 60*time.Second, "Waiting for /state_ids request")
-			}
-			t.Logf("Replying to /state_ids request")
-
-			res := gomatrixserverlib.RespStateIDs{
-				AuthEventIDs:  eventIDsFromEvents(serverRoom.AuthChainForEvents(roomState)),
-				StateEventIDs: eventIDsFromEvents(roomState),
-			}
-			w.WriteHeader(200)
-			jsonb, _ := json.Marshal(res)
-
-			if _, err := w.Write(jsonb); err != nil {
-				t.Errorf("Error writing to request: %v", err)
-			}
-		}),
-	)
+	// avoid passing typed nil pointers as non-nil Waiter interfaces
+	var received, sendResponse federation.Waiter
+	if requestReceivedWaiter != nil {
+		received = requestReceivedWaiter
+	}
+	if sendResponseWaiter != nil {
+		sendResponse = sendResponseWaiter
+	}
+	srv.HandleIncrementalStateIDsRequests(serverRoom, eventID, [][]*gomatrixserverlib.Event{roomState}, received, sendResponse)
 	t.Logf("Registered state_ids handler for event %s", eventID)
 }
 
@@ -717,11 +691,3 @@ func handleStateRequests(
 		}),
 	)
 }
-
-func eventIDsFromEvents(he []*gomatrixserverlib.Event) []string {
-	eventIDs := make([]string, len(he))
-	for i := range he {
-		eventIDs[i] = he[i].EventID()
-	}
-	return eventIDs
-}
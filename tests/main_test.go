@@ -51,6 +51,13 @@ func TestMain(m *testing.M) {
 // This function is the main setup function for all tests as it provides a deployment with
 // which tests can interact with.
 func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
+	t.Helper()
+	return DeployWithFederationRoutes(t, blueprint)
+}
+
+// DeployWithFederationRoutes is Deploy, but the homeservers send their federation traffic according to
+// `routes`, e.g to put a federation.RecordingProxy between them.
+func DeployWithFederationRoutes(t *testing.T, blueprint b.Blueprint, routes ...docker.FederationRoute) *docker.Deployment {
 	t.Helper()
 	timeStartBlueprint := time.Now()
 	if complementBuilder == nil {
@@ -64,6 +71,7 @@ func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
 	if err != nil {
 		t.Fatalf("Deploy: NewDeployer returned error %s", err)
 	}
+	d.FederationRoutes = routes
 	timeStartDeploy := time.Now()
 	dep, err := d.Deploy(context.Background(), blueprint.Name)
 	if err != nil {